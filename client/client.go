@@ -2,37 +2,111 @@ package client
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/anakinrm/crypto-exchange/orderbook"
 	"github.com/anakinrm/crypto-exchange/server"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
 	"github.com/anakinrm/crypto-exchange/server/token"
 )
 
-const Endpoint = "http://localhost:3000"
+// DefaultEndpoint is the exchange API of a local dev setup.
+const DefaultEndpoint = "http://localhost:3000"
+
+// DefaultMarket is used when the params of a request name no market.
+const DefaultMarket = token.MarketETHUSDT
 
 type PlaceOrderParams struct {
 	UserID int64
-	Bid    bool
+	// Market defaults to DefaultMarket
+	Market token.Market
+	// Type is only read by PlaceOrders and defaults to LIMIT there
+	Type server.OrderType
+	Bid  bool
 	// Price only needed for placing LIMIT orders
 	Price float64
 	Size  float64
+	// ExpiresAt optionally expires a LIMIT order at the unix nano time
+	ExpiresAt int64
+}
+
+func (p *PlaceOrderParams) market() token.Market {
+	if p.Market == "" {
+		return DefaultMarket
+	}
+	return p.Market
 }
 
 type Client struct {
 	*http.Client
+	// Endpoint is the URL of the exchange API
+	Endpoint string
+	// APIKey and APISecret sign every request, the user of the key is the
+	// one the exchange acts for
+	APIKey    string
+	APISecret string
 }
 
 func NewClient() *Client {
 	return &Client{
-		Client: http.DefaultClient,
+		Client:   http.DefaultClient,
+		Endpoint: DefaultEndpoint,
+	}
+}
+
+func NewClientWithAPIKey(key, secret string) *Client {
+	return &Client{
+		Client:    http.DefaultClient,
+		Endpoint:  DefaultEndpoint,
+		APIKey:    key,
+		APISecret: secret,
+	}
+}
+
+// Do signs the request with the API key of the client, if it has one, and
+// sends it.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if c.APIKey == "" {
+		return c.Client.Do(req)
 	}
+
+	var body []byte
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		body = b
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	var (
+		timestamp = time.Now().UnixMilli()
+		n         = hex.EncodeToString(nonce)
+	)
+	req.Header.Set(server.APIKeyHeader, c.APIKey)
+	req.Header.Set(server.APITimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(server.APINonceHeader, n)
+	req.Header.Set(server.APISignatureHeader, server.SignRequest(c.APISecret, timestamp, n, req.Method, req.URL.RequestURI(), body))
+
+	return c.Client.Do(req)
 }
 
 func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
-	e := fmt.Sprintf("%s/trades/%s", Endpoint, market)
+	e := fmt.Sprintf("%s/v1/markets/%s/trades", c.Endpoint, market)
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
 		return nil, err
@@ -44,7 +118,7 @@ func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
 	}
 	trades := []*orderbook.Trade{}
 
-	if err := json.NewDecoder(resp.Body).Decode(&trades); err != nil {
+	if err := decodeResponse(resp, &trades); err != nil {
 		return nil, err
 	}
 
@@ -53,7 +127,13 @@ func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
 }
 
 func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
-	e := fmt.Sprintf("%s/order/%d", Endpoint, userID)
+	return c.GetOrdersByStatus(userID, server.OrderFilterOpen)
+}
+
+// GetOrdersByStatus returns the orders of the user matching the filter,
+// "open", "closed", "all" or a single order status like "FILLED".
+func (c *Client) GetOrdersByStatus(userID int64, status string) (*server.GetOrdersResponse, error) {
+	e := fmt.Sprintf("%s/v1/users/%d/orders?status=%s", c.Endpoint, userID, status)
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
 		return nil, err
@@ -63,25 +143,83 @@ func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
 	if err != nil {
 		return nil, err
 	}
-	if resp.Status == "404 Not Found" {
-		return nil, fmt.Errorf("User Not Found")
-	}
-
 	orders := server.GetOrdersResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+	if err := decodeResponse(resp, &orders); err != nil {
 		return nil, err
 	}
 
 	return &orders, nil
 }
 
+// GetOrder looks up an open or closed order by ID.
+func (c *Client) GetOrder(orderID int64) (*server.Order, error) {
+	e := fmt.Sprintf("%s/v1/orders/%d", c.Endpoint, orderID)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	order := &server.Order{}
+	if err := decodeResponse(resp, order); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// GetLedger returns the journal entries touching the user, oldest first.
+func (c *Client) GetLedger(userID int64) ([]ledger.Entry, error) {
+	e := fmt.Sprintf("%s/v1/users/%d/ledger", c.Endpoint, userID)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []ledger.Entry{}
+	if err := decodeResponse(resp, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// GetBalances returns the available and held balances of the user per asset.
+func (c *Client) GetBalances(userID int64) (*server.GetBalancesResponse, error) {
+	e := fmt.Sprintf("%s/v1/users/%d/balances", c.Endpoint, userID)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	balances := &server.GetBalancesResponse{}
+	if err := decodeResponse(resp, balances); err != nil {
+		return nil, err
+	}
+
+	return balances, nil
+}
+
 func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
 	params := &server.PlaceOrderRequest{
 		UserID: p.UserID,
 		Type:   server.MarketOrder,
 		Bid:    p.Bid,
 		Size:   p.Size,
-		Market: token.MarketETH,
+		Market: p.market(),
 	}
 
 	body, err := json.Marshal(params)
@@ -89,7 +227,7 @@ func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderRespon
 		return nil, err
 	}
 
-	e := Endpoint + "/order"
+	e := c.Endpoint + "/v1/orders"
 	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
@@ -101,7 +239,7 @@ func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderRespon
 	}
 
 	placeOrderResponse := &server.PlaceOrderResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(placeOrderResponse); err != nil {
+	if err := decodeResponse(resp, placeOrderResponse); err != nil {
 		return nil, err
 	}
 
@@ -116,48 +254,69 @@ const (
 
 type bestPriceType string
 
-func (c *Client) getBestPrice(priceType bestPriceType) (*server.Order, error) {
+func (c *Client) getBestPrice(market token.Market, priceType bestPriceType) (*server.Order, error) {
 
-	e := fmt.Sprintf("%s/book/ETH/%s", Endpoint, priceType)
+	e := fmt.Sprintf("%s/v1/markets/%s/book/%s", c.Endpoint, market, priceType)
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	resp, err := c.Do(req)
-	if err != err {
+	if err != nil {
 		return nil, err
 	}
 
 	order := &server.Order{}
-	if err := json.NewDecoder(resp.Body).Decode(order); err != nil {
+	if err := decodeResponse(resp, order); err != nil {
 		return nil, err
 	}
 
 	return order, err
 }
 
-func (c *Client) GetBestBidPrice() (*server.Order, error) {
-	return c.getBestPrice(bestBidPrice)
+func (c *Client) GetBestBidPrice(market token.Market) (*server.Order, error) {
+	return c.getBestPrice(market, bestBidPrice)
+}
+
+func (c *Client) GetBestAskPrice(market token.Market) (*server.Order, error) {
+	return c.getBestPrice(market, bestAskPrice)
 }
 
-func (c *Client) GetBestAskPrice() (*server.Order, error) {
-	return c.getBestPrice(bestAskPrice)
+// GetMarkets returns the markets listed on the exchange.
+func (c *Client) GetMarkets() ([]server.MarketInfo, error) {
+	e := c.Endpoint + "/v1/markets"
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	markets := []server.MarketInfo{}
+	if err := decodeResponse(resp, &markets); err != nil {
+		return nil, err
+	}
+
+	return markets, nil
 }
 
 func (c *Client) CancelOrder(orderID int64) error {
-	e := fmt.Sprintf("%s/order/%d", Endpoint, orderID)
+	e := fmt.Sprintf("%s/v1/orders/%d", c.Endpoint, orderID)
 	req, err := http.NewRequest(http.MethodDelete, e, nil)
 	if err != nil {
 		return err
 	}
 
-	_, err = c.Do(req)
+	resp, err := c.Do(req)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return decodeResponse(resp, nil)
 }
 
 func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
@@ -167,7 +326,9 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 		Bid:    p.Bid,
 		Size:   p.Size,
 		Price:  p.Price,
-		Market: token.MarketETH,
+		Market: p.market(),
+
+		ExpiresAt: p.ExpiresAt,
 	}
 
 	body, err := json.Marshal(params)
@@ -175,7 +336,7 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 		return nil, err
 	}
 
-	e := Endpoint + "/order"
+	e := c.Endpoint + "/v1/orders"
 	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
@@ -187,9 +348,121 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 	}
 
 	placeOrderResponse := &server.PlaceOrderResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(placeOrderResponse); err != nil {
+	if err := decodeResponse(resp, placeOrderResponse); err != nil {
 		return nil, err
 	}
 
 	return placeOrderResponse, nil
 }
+
+// PlaceOrders places the orders in a single engine step of the market, no
+// other order gets in between them. An all-or-nothing batch places none of
+// the orders when one of them fails and only takes limit orders.
+// Each order has its own result, the error of a failed one can be checked
+// with ItemError.
+func (c *Client) PlaceOrders(market token.Market, orders []*PlaceOrderParams, allOrNothing bool) (*server.BatchOrdersResponse, error) {
+	params := &server.BatchPlaceOrdersRequest{
+		Market:       market,
+		Orders:       make([]server.PlaceOrderRequest, len(orders)),
+		AllOrNothing: allOrNothing,
+	}
+	for i, p := range orders {
+		orderType := p.Type
+		if orderType == "" {
+			orderType = server.LimitOrder
+		}
+		params.Orders[i] = server.PlaceOrderRequest{
+			UserID:    p.UserID,
+			Type:      orderType,
+			Bid:       p.Bid,
+			Size:      p.Size,
+			Price:     p.Price,
+			Market:    p.Market,
+			ExpiresAt: p.ExpiresAt,
+		}
+	}
+
+	return c.sendBatch(http.MethodPost, params)
+}
+
+// CancelOrders cancels the orders of the market in a single engine step.
+// An all-or-nothing batch cancels none of the orders when one of them can not
+// be cancelled.
+func (c *Client) CancelOrders(market token.Market, orderIDs []int64, allOrNothing bool) (*server.BatchOrdersResponse, error) {
+	params := &server.BatchCancelOrdersRequest{
+		Market:       market,
+		OrderIDs:     orderIDs,
+		AllOrNothing: allOrNothing,
+	}
+
+	return c.sendBatch(http.MethodDelete, params)
+}
+
+func (c *Client) sendBatch(method string, params any) (*server.BatchOrdersResponse, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, c.Endpoint+"/v1/orders/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	batchResponse := &server.BatchOrdersResponse{}
+	if err := decodeResponse(resp, batchResponse); err != nil {
+		return nil, err
+	}
+
+	return batchResponse, nil
+}
+
+// CancelAfter arms the dead man's switch of the user. All open orders of the
+// user get cancelled when no heartbeat arrives within timeout.
+// A zero timeout disarms the switch.
+func (c *Client) CancelAfter(userID int64, timeout time.Duration) (*server.CancelAfterResponse, error) {
+	params := &server.CancelAfterRequest{
+		UserID:  userID,
+		Timeout: timeout.Milliseconds(),
+	}
+
+	return c.postCancelAfter("/v1/orders/cancel-after", params)
+}
+
+// Heartbeat refreshes the armed dead man's switch of the user.
+func (c *Client) Heartbeat(userID int64) (*server.CancelAfterResponse, error) {
+	params := &server.HeartbeatRequest{
+		UserID: userID,
+	}
+
+	return c.postCancelAfter("/v1/orders/heartbeat", params)
+}
+
+func (c *Client) postCancelAfter(path string, params any) (*server.CancelAfterResponse, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	cancelAfterResponse := &server.CancelAfterResponse{}
+	if err := decodeResponse(resp, cancelAfterResponse); err != nil {
+		return nil, err
+	}
+
+	return cancelAfterResponse, nil
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/anakinrm/crypto-exchange/server"
+)
+
+// Error is a request the exchange failed. It unwraps to the error behind its
+// code, so callers check it with errors.Is against the errors of the server,
+// e.g. server.ErrOrderNotFound or ledger.ErrInsufficientBalance.
+type Error struct {
+	StatusCode int
+	// Code is empty when the response did not come from the exchange
+	Code      server.ErrorCode
+	Message   string
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return server.ErrorOf(e.Code)
+}
+
+// ItemError is the error of an item of a batch, nil when the item went
+// through. It unwraps like an Error, the status is the one of the batch.
+func ItemError(result server.BatchOrderResult) error {
+	if result.Error == nil {
+		return nil
+	}
+	return &Error{
+		StatusCode: http.StatusOK,
+		Code:       result.Error.Code,
+		Message:    result.Error.Error,
+	}
+}
+
+// decodeResponse decodes a successful response into v and a failed one into
+// an Error.
+func decodeResponse(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		apiErr := server.APIError{}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Code == "" {
+			return &Error{
+				StatusCode: resp.StatusCode,
+				Message:    http.StatusText(resp.StatusCode),
+				RequestID:  resp.Header.Get("X-Request-Id"),
+			}
+		}
+		return &Error{
+			StatusCode: resp.StatusCode,
+			Code:       apiErr.Code,
+			Message:    apiErr.Error,
+			RequestID:  apiErr.RequestID,
+		}
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
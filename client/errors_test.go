@@ -0,0 +1,67 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/server"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+)
+
+func errorResponse(status int, apiErr server.APIError) *http.Response {
+	rec := httptest.NewRecorder()
+	rec.WriteHeader(status)
+	json.NewEncoder(rec).Encode(apiErr)
+	return rec.Result()
+}
+
+func TestDecodeErrorResponse(t *testing.T) {
+	resp := errorResponse(http.StatusBadRequest, server.APIError{
+		Code:      server.CodeInsufficientBalance,
+		Error:     "insufficient balance: account 1:USDT has 10, needs 100",
+		RequestID: "abc",
+	})
+
+	err := decodeResponse(resp, &server.PlaceOrderResponse{})
+	if !errors.Is(err, ledger.ErrInsufficientBalance) {
+		t.Fatalf("expected insufficient balance, got %v", err)
+	}
+	if errors.Is(err, server.ErrOrderNotFound) {
+		t.Fatalf("%v is not an order not found error", err)
+	}
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an Error, got %T", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != server.CodeInsufficientBalance || apiErr.RequestID != "abc" {
+		t.Fatalf("unexpected error: %+v", apiErr)
+	}
+
+	err = decodeResponse(errorResponse(http.StatusNotFound, server.APIError{Code: server.CodeOrderNotFound}), nil)
+	if !errors.Is(err, server.ErrOrderNotFound) {
+		t.Fatalf("expected order not found, got %v", err)
+	}
+
+	// errors without a code, e.g. of a proxy, still fail the request
+	rec := httptest.NewRecorder()
+	rec.WriteHeader(http.StatusBadGateway)
+	err = decodeResponse(rec.Result(), nil)
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway || apiErr.Code != "" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestItemError(t *testing.T) {
+	if err := ItemError(server.BatchOrderResult{OrderID: 1}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	err := ItemError(server.BatchOrderResult{Error: &server.APIError{Code: server.CodeBatchAborted, Error: "batch aborted"}})
+	if !errors.Is(err, server.ErrBatchAborted) {
+		t.Fatalf("expected batch aborted, got %v", err)
+	}
+}
@@ -0,0 +1,427 @@
+// Package config loads the settings of the exchange, the chain it talks to
+// and the market maker from a YAML or TOML file. Every setting can be
+// overridden by an environment variable named after its path, e.g.
+// EXCHANGE_SERVER_ADDR for server.addr or EXCHANGE_CHAIN_CHAIN_ID for
+// chain.chain_id.
+package config
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the name of every environment variable overriding a
+// setting.
+const EnvPrefix = "EXCHANGE_"
+
+// devPrivateKey is the key of the first account of a local dev chain, it
+// must never hold real funds.
+const devPrivateKey = "6b93be18f885aa07271e5be6f9cf2db740a63a1b73a24778f7e597e4a1cbfbe9"
+
+type Config struct {
+	Server Server `yaml:"server" toml:"server"`
+	Mongo  Mongo  `yaml:"mongo" toml:"mongo"`
+	Audit  Audit  `yaml:"audit" toml:"audit"`
+	Chain  Chain  `yaml:"chain" toml:"chain"`
+	// Withdrawals sets the risk checks of the withdrawals
+	Withdrawals Withdrawals `yaml:"withdrawals" toml:"withdrawals"`
+	// Deposits sets how the deposits are picked up from the chain
+	Deposits Deposits `yaml:"deposits" toml:"deposits"`
+	// Sweeper consolidates the deposit addresses into the hot wallet
+	Sweeper Sweeper `yaml:"sweeper" toml:"sweeper"`
+	// Reserves sets how often the proof of reserves is published
+	Reserves Reserves `yaml:"reserves" toml:"reserves"`
+	// FIX serves the FIX 4.4 gateway next to the HTTP API
+	FIX FIX `yaml:"fix" toml:"fix"`
+	// Markets are listed on start, the exchange lists its default markets
+	// when there are none
+	Markets []Market `yaml:"markets" toml:"markets"`
+	// MarketsFile is a JSON list of markets to list instead of Markets
+	MarketsFile string      `yaml:"markets_file" toml:"markets_file"`
+	Client      Client      `yaml:"client" toml:"client"`
+	MarketMaker MarketMaker `yaml:"marketmaker" toml:"marketmaker"`
+}
+
+type Server struct {
+	Addr string `yaml:"addr" toml:"addr"`
+	// PrivateKey is the hex key of the exchange wallet
+	PrivateKey Secret `yaml:"private_key" toml:"private_key"`
+	// AdminToken guards the admin API, which is disabled without one
+	AdminToken Secret `yaml:"admin_token" toml:"admin_token"`
+	// TOTPKey is the hex AES-256 key the TOTP secrets, the wallet keys and
+	// the API key secrets are stored with in MongoDB
+	TOTPKey Secret `yaml:"totp_key" toml:"totp_key"`
+	// ShutdownTimeout bounds how long draining the requests and stopping
+	// the components may take on SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// CancelOrdersOnShutdown cancels the resting orders on shutdown instead
+	// of restoring them on the next start, which needs mongo.uri
+	CancelOrdersOnShutdown bool `yaml:"cancel_orders_on_shutdown" toml:"cancel_orders_on_shutdown"`
+}
+
+type Mongo struct {
+	// URI of MongoDB, without one the exchange keeps its state in memory only
+	URI      Secret `yaml:"uri" toml:"uri"`
+	Database string `yaml:"database" toml:"database"`
+}
+
+// The backends the audit log can be kept in.
+const (
+	AuditMemory = "memory"
+	AuditFile   = "file"
+	// AuditDB keeps the log in the MongoDB of mongo.uri
+	AuditDB = "db"
+)
+
+type Audit struct {
+	// Backend is memory, file or db
+	Backend string `yaml:"backend" toml:"backend"`
+	// Path of the log of the file backend
+	Path string `yaml:"path" toml:"path"`
+}
+
+type Chain struct {
+	RPCURL  string `yaml:"rpc_url" toml:"rpc_url"`
+	ChainID int64  `yaml:"chain_id" toml:"chain_id"`
+}
+
+type Withdrawals struct {
+	// AddressCooldown is how long an address has to be whitelisted before
+	// funds can be withdrawn to it
+	AddressCooldown time.Duration `yaml:"address_cooldown" toml:"address_cooldown"`
+	// Confirmations is the number of blocks a withdrawal needs to be
+	// confirmed, counting its own
+	Confirmations int64 `yaml:"confirmations" toml:"confirmations"`
+	// PollInterval is how often approved withdrawals are sent and sent
+	// ones are checked on chain
+	PollInterval time.Duration `yaml:"poll_interval" toml:"poll_interval"`
+	// Limits of every asset, assets without limits are not capped
+	Limits []WithdrawalLimit `yaml:"limits" toml:"limits"`
+}
+
+type WithdrawalLimit struct {
+	Asset string `yaml:"asset" toml:"asset"`
+	// Daily caps what a user withdraws in 24 hours, 0 does not cap it
+	Daily float64 `yaml:"daily" toml:"daily"`
+	// ApprovalThreshold is the amount above which an admin has to approve a
+	// withdrawal, 0 approves all of them automatically
+	ApprovalThreshold float64 `yaml:"approval_threshold" toml:"approval_threshold"`
+}
+
+type Deposits struct {
+	// Confirmations is the number of blocks a deposit needs to be credited,
+	// counting its own
+	Confirmations int64 `yaml:"confirmations" toml:"confirmations"`
+	// PollInterval is how often new blocks are scanned
+	PollInterval time.Duration `yaml:"poll_interval" toml:"poll_interval"`
+	// StartBlock is scanned first when no block was scanned before, 0 starts
+	// at the head of the chain
+	StartBlock int64 `yaml:"start_block" toml:"start_block"`
+}
+
+type Sweeper struct {
+	// Threshold is the ETH balance from which on a deposit address is swept
+	// into the hot wallet
+	Threshold float64 `yaml:"threshold" toml:"threshold"`
+	// HotCeiling caps the ETH of the hot wallet, the excess is forwarded to
+	// ColdAddress. 0 does not cap it
+	HotCeiling  float64 `yaml:"hot_ceiling" toml:"hot_ceiling"`
+	ColdAddress string  `yaml:"cold_address" toml:"cold_address"`
+	// PollInterval is how often the balances are checked
+	PollInterval time.Duration `yaml:"poll_interval" toml:"poll_interval"`
+}
+
+type Reserves struct {
+	// Interval between two proofs of reserves, 0 only publishes them when an
+	// admin asks for one
+	Interval time.Duration `yaml:"interval" toml:"interval"`
+}
+
+type FIX struct {
+	// Addr the gateway listens on, it is disabled without one
+	Addr string `yaml:"addr" toml:"addr"`
+	// CompID is the SenderCompID of the exchange, the TargetCompID of the
+	// logons it accepts
+	CompID string `yaml:"comp_id" toml:"comp_id"`
+	// MarketDataInterval is how often the subscribed books are checked for
+	// changes
+	MarketDataInterval time.Duration `yaml:"market_data_interval" toml:"market_data_interval"`
+}
+
+type Market struct {
+	Market string `yaml:"market" toml:"market"`
+	// State defaults to ACTIVE
+	State string `yaml:"state" toml:"state"`
+}
+
+type Client struct {
+	// Endpoint is the URL of the exchange API
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+}
+
+type MarketMaker struct {
+	Enabled bool  `yaml:"enabled" toml:"enabled"`
+	UserID  int64 `yaml:"user_id" toml:"user_id"`
+	// APIKey and APISecret sign the orders of the market maker
+	APIKey    string `yaml:"api_key" toml:"api_key"`
+	APISecret Secret `yaml:"api_secret" toml:"api_secret"`
+	// TakerAPIKey and TakerAPISecret sign the market orders placed against
+	// the quotes, none are placed without them
+	TakerAPIKey    string        `yaml:"taker_api_key" toml:"taker_api_key"`
+	TakerAPISecret Secret        `yaml:"taker_api_secret" toml:"taker_api_secret"`
+	Market         string        `yaml:"market" toml:"market"`
+	OrderSize      float64       `yaml:"order_size" toml:"order_size"`
+	MinSpread      float64       `yaml:"min_spread" toml:"min_spread"`
+	SeedOffset     float64       `yaml:"seed_offset" toml:"seed_offset"`
+	PriceOffset    float64       `yaml:"price_offset" toml:"price_offset"`
+	MakeInterval   time.Duration `yaml:"make_interval" toml:"make_interval"`
+}
+
+// Default is the config of a local dev setup.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Addr:            ":3000",
+			PrivateKey:      NewSecret(devPrivateKey),
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Mongo: Mongo{
+			Database: "crypto-exchange",
+		},
+		Audit: Audit{
+			Backend: AuditMemory,
+		},
+		Chain: Chain{
+			RPCURL:  "http://localhost:8545",
+			ChainID: 1337,
+		},
+		Withdrawals: Withdrawals{
+			AddressCooldown: 24 * time.Hour,
+			Confirmations:   12,
+			PollInterval:    15 * time.Second,
+			Limits: []WithdrawalLimit{
+				{Asset: "ETH", Daily: 100, ApprovalThreshold: 10},
+			},
+		},
+		Deposits: Deposits{
+			Confirmations: 12,
+			PollInterval:  15 * time.Second,
+		},
+		Sweeper: Sweeper{
+			Threshold:    0.1,
+			PollInterval: time.Minute,
+		},
+		Reserves: Reserves{
+			Interval: 24 * time.Hour,
+		},
+		FIX: FIX{
+			CompID:             "EXCHANGE",
+			MarketDataInterval: 100 * time.Millisecond,
+		},
+		Client: Client{
+			Endpoint: "http://localhost:3000",
+		},
+		MarketMaker: MarketMaker{
+			Enabled:      true,
+			UserID:       8,
+			OrderSize:    10,
+			MinSpread:    20,
+			SeedOffset:   40,
+			PriceOffset:  10,
+			MakeInterval: time.Second,
+		},
+	}
+}
+
+// Load reads the config file over the defaults, applies the environment
+// overrides, reads the secrets kept in files and validates the result. The
+// format of the file follows its extension, .yaml, .yml or .toml. Without a
+// path only the defaults and the environment count.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(cfg, os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	for _, s := range cfg.secrets() {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) readFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(b), c)
+		if err != nil {
+			return err
+		}
+		for _, key := range meta.Undecoded() {
+			// secrets decode their own tables
+			if len(key) > 1 && isSecretKey(key[:len(key)-1]) {
+				continue
+			}
+			return fmt.Errorf("unknown setting %s", key)
+		}
+	default:
+		return fmt.Errorf("unknown config format %q, use .yaml, .yml or .toml", ext)
+	}
+
+	return nil
+}
+
+func (c *Config) secrets() []*Secret {
+	return []*Secret{
+		&c.Server.PrivateKey,
+		&c.Server.AdminToken,
+		&c.Server.TOTPKey,
+		&c.Mongo.URI,
+		&c.MarketMaker.APISecret,
+		&c.MarketMaker.TakerAPISecret,
+	}
+}
+
+// Validate checks every setting and returns all the problems found.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(c.Server.Addr)
+	check(err == nil, "server.addr %q is not a host:port address", c.Server.Addr)
+	check(isHexKey(c.Server.PrivateKey.Value()), "server.private_key must be 32 bytes of hex")
+	check(c.Server.TOTPKey.Value() == "" || isHexKey(c.Server.TOTPKey.Value()), "server.totp_key must be 32 bytes of hex")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+
+	if uri := c.Mongo.URI.Value(); uri != "" {
+		check(strings.HasPrefix(uri, "mongodb://") || strings.HasPrefix(uri, "mongodb+srv://"), "mongo.uri must be a mongodb:// or mongodb+srv:// URI")
+		check(c.Mongo.Database != "", "mongo.database is required with mongo.uri")
+		check(c.Server.TOTPKey.Value() != "", "server.totp_key is required with mongo.uri")
+	}
+
+	switch c.Audit.Backend {
+	case AuditMemory:
+	case AuditFile:
+		check(c.Audit.Path != "", "audit.path is required with the file backend")
+	case AuditDB:
+		check(c.Mongo.URI.Value() != "", "mongo.uri is required with the db audit backend")
+	default:
+		check(false, "audit.backend %q must be memory, file or db", c.Audit.Backend)
+	}
+
+	check(isURL(c.Chain.RPCURL), "chain.rpc_url %q is not a URL", c.Chain.RPCURL)
+	check(c.Chain.ChainID > 0, "chain.chain_id must be positive")
+
+	check(c.Withdrawals.AddressCooldown >= 0, "withdrawals.address_cooldown can not be negative")
+	check(c.Withdrawals.Confirmations > 0, "withdrawals.confirmations must be positive")
+	check(c.Withdrawals.PollInterval > 0, "withdrawals.poll_interval must be positive")
+	limited := make(map[string]bool)
+	for _, l := range c.Withdrawals.Limits {
+		check(l.Asset != "", "withdrawal limit without asset")
+		check(!limited[l.Asset], "withdrawal limit of %s is set twice", l.Asset)
+		check(l.Daily >= 0 && l.ApprovalThreshold >= 0, "withdrawal limits of %s can not be negative", l.Asset)
+		limited[l.Asset] = true
+	}
+
+	check(c.Deposits.Confirmations > 0, "deposits.confirmations must be positive")
+	check(c.Deposits.PollInterval > 0, "deposits.poll_interval must be positive")
+	check(c.Deposits.StartBlock >= 0, "deposits.start_block can not be negative")
+
+	check(c.Sweeper.Threshold > 0, "sweeper.threshold must be positive")
+	check(c.Sweeper.HotCeiling >= 0, "sweeper.hot_ceiling can not be negative")
+	check(c.Sweeper.HotCeiling == 0 || isHexAddress(c.Sweeper.ColdAddress), "sweeper.cold_address %q is not an address, it is required with sweeper.hot_ceiling", c.Sweeper.ColdAddress)
+	check(c.Sweeper.PollInterval > 0, "sweeper.poll_interval must be positive")
+	check(c.Reserves.Interval >= 0, "reserves.interval can not be negative")
+
+	if c.FIX.Addr != "" {
+		_, _, err := net.SplitHostPort(c.FIX.Addr)
+		check(err == nil, "fix.addr %q is not a host:port address", c.FIX.Addr)
+		check(c.FIX.CompID != "", "fix.comp_id is required with fix.addr")
+	}
+	check(c.FIX.MarketDataInterval > 0, "fix.market_data_interval must be positive")
+
+	check(len(c.Markets) == 0 || c.MarketsFile == "", "markets and markets_file can not both be set")
+	seen := make(map[string]bool)
+	for _, m := range c.Markets {
+		base, quote, ok := strings.Cut(m.Market, "-")
+		check(ok && base != "" && quote != "", "market %q is not BASE-QUOTE", m.Market)
+		check(!seen[m.Market], "market %s is listed twice", m.Market)
+		seen[m.Market] = true
+	}
+
+	check(isURL(c.Client.Endpoint), "client.endpoint %q is not a URL", c.Client.Endpoint)
+
+	if c.MarketMaker.Enabled {
+		check(c.MarketMaker.OrderSize > 0, "marketmaker.order_size must be positive")
+		check(c.MarketMaker.MinSpread >= 0, "marketmaker.min_spread can not be negative")
+		check(c.MarketMaker.MakeInterval > 0, "marketmaker.make_interval must be positive")
+	}
+
+	return errors.Join(errs...)
+}
+
+func isHexKey(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 32
+}
+
+// isHexAddress checks for the 0x prefixed hex of a 20 byte address.
+func isHexAddress(s string) bool {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	return err == nil && len(b) == 20 && strings.HasPrefix(s, "0x")
+}
+
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// Print writes the effective config as YAML, with the secrets redacted.
+func (c *Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
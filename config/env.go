@@ -0,0 +1,182 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	secretType   = reflect.TypeOf(Secret{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	marketsType  = reflect.TypeOf([]Market{})
+	limitsType   = reflect.TypeOf([]WithdrawalLimit{})
+)
+
+// applyEnv overrides every setting that has an environment variable set. The
+// name of the variable is the path of the setting in the file, e.g.
+// EXCHANGE_MONGO_URI for mongo.uri. The markets are a comma separated list,
+// a market can name its state after a colon, e.g. ETH-USDT:CANCEL_ONLY. The
+// withdrawal limits are a comma separated list of asset:daily:threshold, e.g.
+// ETH:100:10.
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) error {
+	return applyEnvStruct(reflect.ValueOf(cfg).Elem(), strings.TrimSuffix(EnvPrefix, "_"), lookup)
+}
+
+func applyEnvStruct(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		var (
+			field = v.Type().Field(i)
+			tag   = strings.Split(field.Tag.Get("yaml"), ",")[0]
+			name  = prefix + "_" + strings.ToUpper(tag)
+			value = v.Field(i)
+		)
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		switch field.Type {
+		case secretType:
+			if file, ok := lookup(name + "_FILE"); ok {
+				value.Set(reflect.ValueOf(SecretFile(file)))
+			}
+			if s, ok := lookup(name); ok {
+				value.Set(reflect.ValueOf(NewSecret(s)))
+			}
+			continue
+		case marketsType:
+			if s, ok := lookup(name); ok {
+				value.Set(reflect.ValueOf(parseMarkets(s)))
+			}
+			continue
+		case limitsType:
+			if s, ok := lookup(name); ok {
+				limits, err := parseWithdrawalLimits(s)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				value.Set(reflect.ValueOf(limits))
+			}
+			continue
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnvStruct(value, name, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setValue(value, s); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// isSecretKey tells whether the TOML key names a Secret of the Config.
+func isSecretKey(key []string) bool {
+	t := reflect.TypeOf(Config{})
+	for _, name := range key {
+		if t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return false
+		}
+
+		found := false
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).Tag.Get("toml") == name {
+				t, found = t.Field(i).Type, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return t == secretType
+}
+
+func setValue(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+func parseMarkets(s string) []Market {
+	markets := []Market{}
+	for _, m := range strings.Split(s, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		market, state, _ := strings.Cut(m, ":")
+		markets = append(markets, Market{Market: market, State: state})
+	}
+	return markets
+}
+
+func parseWithdrawalLimits(s string) ([]WithdrawalLimit, error) {
+	limits := []WithdrawalLimit{}
+	for _, l := range strings.Split(s, ",") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		parts := strings.Split(l, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("withdrawal limit %q is not asset:daily:threshold", l)
+		}
+
+		limit := WithdrawalLimit{Asset: parts[0]}
+		var err error
+		if limit.Daily, err = strconv.ParseFloat(parts[1], 64); err != nil {
+			return nil, err
+		}
+		if limit.ApprovalThreshold, err = strconv.ParseFloat(parts[2], 64); err != nil {
+			return nil, err
+		}
+		limits = append(limits, limit)
+	}
+	return limits, nil
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[redacted]"
+
+// Secret is a setting that is never printed. It is set inline or read from
+// a file, like a mounted Docker or Kubernetes secret:
+//
+//	server:
+//	  private_key:
+//	    file: /run/secrets/exchange_key
+//
+// In the environment the file is given with a _FILE suffix, e.g.
+// EXCHANGE_SERVER_PRIVATE_KEY_FILE.
+type Secret struct {
+	value string
+	file  string
+}
+
+func NewSecret(value string) Secret {
+	return Secret{value: value}
+}
+
+// SecretFile is a secret read from the file when the config is loaded.
+func SecretFile(path string) Secret {
+	return Secret{file: path}
+}
+
+func (s Secret) Value() string {
+	return s.value
+}
+
+func (s Secret) String() string {
+	if s.value == "" && s.file == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) MarshalYAML() (any, error) {
+	return s.String(), nil
+}
+
+func (s *Secret) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*s = Secret{}
+		return node.Decode(&s.value)
+	}
+
+	var f struct {
+		File string `yaml:"file"`
+	}
+	if err := node.Decode(&f); err != nil {
+		return err
+	}
+	*s = SecretFile(f.File)
+	return nil
+}
+
+func (s *Secret) UnmarshalTOML(data any) error {
+	switch v := data.(type) {
+	case string:
+		*s = NewSecret(v)
+	case map[string]any:
+		file, ok := v["file"].(string)
+		if !ok || len(v) != 1 {
+			return fmt.Errorf("secret must be a string or a table with a file")
+		}
+		*s = SecretFile(file)
+	default:
+		return fmt.Errorf("secret must be a string or a table with a file")
+	}
+	return nil
+}
+
+// load reads the secret from its file, if it has one. The trailing newline
+// most editors add is not part of the secret.
+func (s *Secret) load() error {
+	if s.file == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.file)
+	if err != nil {
+		return fmt.Errorf("reading secret: %w", err)
+	}
+	s.value = strings.TrimRight(string(b), "\r\n")
+
+	return nil
+}
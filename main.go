@@ -1,43 +1,145 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/anakinrm/crypto-exchange/client"
+	"github.com/anakinrm/crypto-exchange/config"
 	"github.com/anakinrm/crypto-exchange/marketmaker"
 	"github.com/anakinrm/crypto-exchange/server"
+	"github.com/anakinrm/crypto-exchange/server/reserves"
+	"github.com/anakinrm/crypto-exchange/server/token"
 	"golang.org/x/exp/rand"
 )
 
 // resycle the time tick
 
 func main() {
-	go server.StartServer()
-	time.Sleep(1 * time.Second)
+	configPath := flag.String("config", os.Getenv("EXCHANGE_CONFIG"), "YAML or TOML config file")
+	printConfig := flag.Bool("print-config", false, "print the effective config and exit")
+	verifyAudit := flag.Bool("verify-audit", false, "verify the hash chain of the audit log and exit")
+	verifyProof := flag.String("verify-proof", "", "verify a proof of reserves downloaded from /v1/users/me/reserves-proof and exit")
+	proofRoot := flag.String("proof-root", "", "root hash the proof of -verify-proof has to lead to, the one published at /v1/reserves")
+	flag.Parse()
 
-	c := client.NewClient()
+	if *verifyProof != "" {
+		if err := verifyReservesProof(*verifyProof, *proofRoot); err != nil {
+			log.Fatalf("proof of reserves: %v", err)
+		}
+		return
+	}
 
-	cfg := marketmaker.Config{
-		UserID:         8,
-		OrderSize:      10,
-		MinSpread:      20,
-		MakeInterval:   1 * time.Second,
-		SeedOffset:     40,
-		ExchangeClient: c,
-		PriceOffset:    10,
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *verifyAudit {
+		n, err := server.VerifyAuditLog(cfg)
+		if err != nil {
+			log.Fatalf("audit log: %v", err)
+		}
+		log.Printf("audit log ok: %d entries", n)
+		return
 	}
-	maker := marketmaker.NewMakerMaker(cfg)
 
-	maker.Start()
+	// SIGTERM and Ctrl-C shut the exchange down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	time.Sleep(2 * time.Second)
-	go marketOrderPlacer(c)
+	lc := server.NewLifecycle()
+	if err := server.StartServer(cfg, lc); err != nil {
+		log.Fatal(err)
+	}
 
-	select {}
+	if cfg.MarketMaker.Enabled {
+		startMarketMaker(cfg, lc)
+	}
+
+	<-ctx.Done()
+	log.Println("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := lc.Shutdown(shutdownCtx); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func marketOrderPlacer(c *client.Client) {
+// verifyReservesProof checks the proof in the file and prints the balances
+// it proves, root pins the published root when it is set.
+func verifyReservesProof(path, root string) error {
+	proof, err := reserves.ReadProof(path)
+	if err != nil {
+		return err
+	}
+	if root != "" && proof.Root.Hash != root {
+		return fmt.Errorf("proof is for root %s, not %s", proof.Root.Hash, root)
+	}
+	if err := reserves.Verify(proof); err != nil {
+		return err
+	}
+
+	log.Printf("proof ok: root %s", proof.Root.Hash)
+	for _, asset := range proof.Balances.Assets() {
+		log.Printf("%s: %f of %f in liabilities", asset, reserves.FromUnits(proof.Balances[asset]), reserves.FromUnits(proof.Root.Sums[asset]))
+	}
+	return nil
+}
+
+func startMarketMaker(cfg *config.Config, lc *server.Lifecycle) {
+	makerClient := client.NewClientWithAPIKey(cfg.MarketMaker.APIKey, cfg.MarketMaker.APISecret.Value())
+	makerClient.Endpoint = cfg.Client.Endpoint
+
+	maker := marketmaker.NewMakerMaker(marketmaker.Config{
+		UserID:         cfg.MarketMaker.UserID,
+		Market:         token.Market(cfg.MarketMaker.Market),
+		OrderSize:      cfg.MarketMaker.OrderSize,
+		MinSpread:      cfg.MarketMaker.MinSpread,
+		MakeInterval:   cfg.MarketMaker.MakeInterval,
+		SeedOffset:     cfg.MarketMaker.SeedOffset,
+		ExchangeClient: makerClient,
+		PriceOffset:    cfg.MarketMaker.PriceOffset,
+	})
+
+	lc.Go("market maker", maker.Run)
+
+	if cfg.MarketMaker.TakerAPIKey == "" {
+		log.Println("market order placer disabled: marketmaker.taker_api_key is not set")
+		return
+	}
+	takerClient := client.NewClientWithAPIKey(cfg.MarketMaker.TakerAPIKey, cfg.MarketMaker.TakerAPISecret.Value())
+	takerClient.Endpoint = cfg.Client.Endpoint
+	market := token.Market(cfg.MarketMaker.Market)
+
+	lc.Go("market order placer", func(ctx context.Context) {
+		// give the maker time to seed the books
+		select {
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+		marketOrderPlacer(ctx, takerClient, market)
+	})
+}
+
+// marketOrderPlacer trades against the quotes of the market maker until ctx is
+// done, orders that fail are logged and the next one is placed on time.
+func marketOrderPlacer(ctx context.Context, c *client.Client, market token.Market) {
 	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
 
 	for {
 		randint := rand.Intn(10)
@@ -47,16 +149,19 @@ func marketOrderPlacer(c *client.Client) {
 		}
 
 		order := client.PlaceOrderParams{
-			UserID: 7,
+			Market: market,
 			Bid:    bid,
 			Size:   1,
 		}
 
-		_, err := c.PlaceMarketOrder(&order)
-		if err != nil {
-			panic(err)
+		if _, err := c.PlaceMarketOrder(&order); err != nil {
+			log.Printf("market order placer: %v", err)
 		}
 
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
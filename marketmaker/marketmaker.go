@@ -1,14 +1,17 @@
 package marketmaker
 
 import (
+	"context"
 	"time"
 
 	"github.com/anakinrm/crypto-exchange/client"
+	"github.com/anakinrm/crypto-exchange/server/token"
 	"github.com/sirupsen/logrus"
 )
 
 type Config struct {
 	UserID         int64
+	Market         token.Market
 	OrderSize      float64
 	MinSpread      float64
 	SeedOffset     float64
@@ -19,6 +22,7 @@ type Config struct {
 
 type MarketMaker struct {
 	userID         int64
+	market         token.Market
 	orderSize      float64
 	minSpread      float64
 	seedOffset     float64
@@ -28,8 +32,14 @@ type MarketMaker struct {
 }
 
 func NewMakerMaker(cfg Config) *MarketMaker {
+	market := cfg.Market
+	if market == "" {
+		market = client.DefaultMarket
+	}
+
 	return &MarketMaker{
 		userID:         cfg.UserID,
+		market:         market,
 		orderSize:      cfg.OrderSize,
 		minSpread:      cfg.MinSpread,
 		seedOffset:     cfg.SeedOffset,
@@ -39,29 +49,37 @@ func NewMakerMaker(cfg Config) *MarketMaker {
 	}
 }
 
-func (mm *MarketMaker) Start() {
+// Start runs the market maker in the background until ctx is done.
+func (mm *MarketMaker) Start(ctx context.Context) {
+	go mm.Run(ctx)
+}
+
+// Run makes the market until ctx is done or the exchange fails a request.
+func (mm *MarketMaker) Run(ctx context.Context) {
 	logrus.WithFields(logrus.Fields{
 		"id":           mm.userID,
+		"market":       mm.market,
 		"orderSize":    mm.orderSize,
 		"makeInterval": mm.makeInterval,
 		"minSpread":    mm.minSpread,
 		"priceOffset":  mm.priceOffset,
 	}).Info("starting market maker")
 
-	go mm.makerLoop()
+	mm.makerLoop(ctx)
 }
 
-func (mm *MarketMaker) makerLoop() {
+func (mm *MarketMaker) makerLoop(ctx context.Context) {
 	ticker := time.NewTicker(mm.makeInterval)
+	defer ticker.Stop()
 
-	for {
-		bestBid, err := mm.exchangeClient.GetBestBidPrice()
+	for ctx.Err() == nil {
+		bestBid, err := mm.exchangeClient.GetBestBidPrice(mm.market)
 		if err != nil {
 			logrus.Error(err)
 			break
 		}
 
-		bestAsk, err := mm.exchangeClient.GetBestAskPrice()
+		bestAsk, err := mm.exchangeClient.GetBestAskPrice(mm.market)
 		if err != nil {
 			logrus.Error(err)
 			break
@@ -89,28 +107,36 @@ func (mm *MarketMaker) makerLoop() {
 			continue
 		}
 
-		if err := mm.placeOrder(true, bestBid.Price+mm.priceOffset); err != nil {
-			logrus.Error(err)
-			break
-		}
-		if err := mm.placeOrder(false, bestAsk.Price-mm.priceOffset); err != nil {
+		if err := mm.quote(bestBid.Price+mm.priceOffset, bestAsk.Price-mm.priceOffset); err != nil {
 			logrus.Error(err)
 			break
 		}
 
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
 	}
 }
 
-func (mm *MarketMaker) placeOrder(bid bool, price float64) error {
-	bidOrder := &client.PlaceOrderParams{
-		UserID: mm.userID,
-		Size:   mm.orderSize,
-		Bid:    bid,
-		Price:  price,
+// quote places a bid and an ask in a single all-or-nothing batch, so the
+// book never sees one side of the quote without the other.
+func (mm *MarketMaker) quote(bidPrice, askPrice float64) error {
+	orders := []*client.PlaceOrderParams{
+		{UserID: mm.userID, Size: mm.orderSize, Bid: true, Price: bidPrice},
+		{UserID: mm.userID, Size: mm.orderSize, Bid: false, Price: askPrice},
+	}
+	resp, err := mm.exchangeClient.PlaceOrders(mm.market, orders, true)
+	if err != nil {
+		return err
 	}
-	_, err := mm.exchangeClient.PlaceLimitOrder(bidOrder)
-	return err
+
+	for _, result := range resp.Results {
+		if err := client.ItemError(result); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (mm *MarketMaker) seedMarket() error {
@@ -121,26 +147,7 @@ func (mm *MarketMaker) seedMarket() error {
 		"seedOffset":      mm.seedOffset,
 	}).Info("orderbooks empty => seeding market!")
 
-	bidOrder := &client.PlaceOrderParams{
-		UserID: mm.userID,
-		Size:   mm.orderSize,
-		Bid:    true,
-		Price:  currentPrice - mm.seedOffset,
-	}
-	_, err := mm.exchangeClient.PlaceLimitOrder(bidOrder)
-	if err != nil {
-		return err
-	}
-
-	askOrder := &client.PlaceOrderParams{
-		UserID: mm.userID,
-		Size:   mm.orderSize,
-		Bid:    false,
-		Price:  currentPrice + mm.seedOffset,
-	}
-	_, err = mm.exchangeClient.PlaceLimitOrder(askOrder)
-
-	return err
+	return mm.quote(currentPrice-mm.seedOffset, currentPrice+mm.seedOffset)
 }
 
 // this will simulate a call to an other exchange fetching
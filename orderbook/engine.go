@@ -0,0 +1,169 @@
+package orderbook
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// expiryInterval is how often the engine removes expired orders from the book.
+const expiryInterval = time.Second
+
+// Engine is the single writer of an Orderbook. Every mutation is sent as a
+// command over a channel and applied in order by the engine goroutine, so the
+// Orderbook itself never needs a lock. After each command an immutable
+// Snapshot is published that readers can use without touching the book.
+// A snapshot only copies the price levels the command changed.
+type Engine struct {
+	ob       *Orderbook
+	commands chan command
+	snapshot atomic.Pointer[Snapshot]
+	quit     chan struct{}
+	done     chan struct{}
+	sequence uint64
+	limits   limitCache
+}
+
+type command struct {
+	fn   func(ob *Orderbook)
+	done chan struct{}
+}
+
+func NewEngine(ob *Orderbook) *Engine {
+	e := &Engine{
+		ob:       ob,
+		commands: make(chan command),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		limits:   make(limitCache),
+	}
+	e.publish()
+
+	return e
+}
+
+// Start runs the engine goroutine.
+func (e *Engine) Start() {
+	go e.loop()
+}
+
+// Stop waits for the running command to finish and stops the engine.
+// Commands sent after Stop panic.
+func (e *Engine) Stop() {
+	close(e.quit)
+	<-e.done
+}
+
+func (e *Engine) loop() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case cmd := <-e.commands:
+			cmd.fn(e.ob)
+			e.publish()
+			close(cmd.done)
+		case now := <-ticker.C:
+			if len(e.ob.ExpireOrders(now.UnixNano())) > 0 {
+				e.publish()
+			}
+		case <-e.quit:
+			return
+		}
+	}
+}
+
+// Do runs fn on the engine goroutine and blocks until it is done. fn has
+// exclusive access to the Orderbook, but must not keep references to it or
+// its orders once it returns.
+func (e *Engine) Do(fn func(ob *Orderbook)) {
+	cmd := command{
+		fn:   fn,
+		done: make(chan struct{}),
+	}
+
+	select {
+	case e.commands <- cmd:
+	case <-e.quit:
+		panic("orderbook engine stopped")
+	}
+	<-cmd.done
+}
+
+func (e *Engine) PlaceLimitOrder(price float64, o *Order) {
+	e.Do(func(ob *Orderbook) {
+		ob.PlaceLimitOrder(price, o)
+	})
+}
+
+// PlaceMarketOrder fills the order against the book. Instead of panicking
+// like Orderbook.PlaceMarketOrder it returns an error when the book does not
+// hold enough volume.
+func (e *Engine) PlaceMarketOrder(o *Order) ([]Match, error) {
+	var (
+		matches []Match
+		err     error
+	)
+
+	e.Do(func(ob *Orderbook) {
+		matches, err = PlaceMarketOrderChecked(ob, o)
+	})
+
+	return matches, err
+}
+
+// CancelOrder cancels the resting order with the given ID.
+func (e *Engine) CancelOrder(id int64) (*Order, error) {
+	var (
+		order *Order
+		err   error
+	)
+
+	e.Do(func(ob *Orderbook) {
+		order, err = CancelOrderByID(ob, id)
+	})
+
+	return order, err
+}
+
+// Snapshot returns the state of the book after the last applied command.
+func (e *Engine) Snapshot() *Snapshot {
+	return e.snapshot.Load()
+}
+
+// PlaceMarketOrderChecked is Orderbook.PlaceMarketOrder returning an error
+// when there is not enough volume, for use inside Engine.Do.
+// The order is rejected when there is not enough volume.
+func PlaceMarketOrderChecked(ob *Orderbook, o *Order) ([]Match, error) {
+	volume := ob.BidTotalVolume()
+	if o.Bid {
+		volume = ob.AskTotalVolume()
+	}
+
+	if o.Size > volume {
+		ob.RejectOrder(o, 0)
+		return nil, fmt.Errorf("%w [size: %.2f, available: %.2f]", ErrNotEnoughVolume, o.Size, volume)
+	}
+
+	return ob.PlaceMarketOrder(o), nil
+}
+
+// CancelOrderByID cancels the resting order with the given ID, for use inside
+// Engine.Do.
+func CancelOrderByID(ob *Orderbook, id int64) (*Order, error) {
+	order, ok := ob.Orders[id]
+	if !ok || order.Limit == nil {
+		return nil, fmt.Errorf("can't find order ID: %d", id)
+	}
+	ob.CancelOrder(order)
+
+	return order, nil
+}
+
+func (e *Engine) publish() {
+	e.sequence++
+	e.snapshot.Store(newSnapshot(e.ob, e.sequence, e.limits))
+}
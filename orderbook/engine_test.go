@@ -0,0 +1,144 @@
+package orderbook
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestEngineSnapshot(t *testing.T) {
+	e := NewEngine(NewOrderbook())
+	e.Start()
+	defer e.Stop()
+
+	sellOrderA := NewOrder(false, 10, 1)
+	sellOrderB := NewOrder(false, 5, 2)
+	buyOrder := NewOrder(true, 4, 3)
+	e.PlaceLimitOrder(10_100, sellOrderA)
+	e.PlaceLimitOrder(10_000, sellOrderB)
+	e.PlaceLimitOrder(9_000, buyOrder)
+
+	snapshot := e.Snapshot()
+	assert(t, snapshot.AskTotalVolume, 15.0)
+	assert(t, snapshot.BidTotalVolume, 4.0)
+	assert(t, len(snapshot.Asks), 2)
+	assert(t, snapshot.Asks[0].Price, 10_000.0)
+	assert(t, snapshot.UserOrders(2)[0].ID, sellOrderB.ID)
+
+	matches, err := e.PlaceMarketOrder(NewOrder(true, 7, 4))
+	assert(t, err, nil)
+	assert(t, len(matches), 2)
+
+	// the old snapshot must not change
+	assert(t, snapshot.AskTotalVolume, 15.0)
+	assert(t, e.Snapshot().AskTotalVolume, 8.0)
+	assert(t, len(e.Snapshot().Trades), 2)
+
+	_, err = e.PlaceMarketOrder(NewOrder(true, 100, 4))
+	assert(t, err != nil, true)
+
+	_, err = e.CancelOrder(buyOrder.ID)
+	assert(t, err, nil)
+	_, err = e.CancelOrder(buyOrder.ID)
+	assert(t, err != nil, true)
+	assert(t, e.Snapshot().BidTotalVolume, 0.0)
+}
+
+func TestEngineSnapshotSharesUnchangedLimits(t *testing.T) {
+	e := NewEngine(NewOrderbook())
+	e.Start()
+	defer e.Stop()
+
+	e.PlaceLimitOrder(10_000, NewOrder(false, 5, 1))
+	e.PlaceLimitOrder(10_100, NewOrder(false, 10, 2))
+	e.PlaceLimitOrder(9_000, NewOrder(true, 4, 3))
+	before := e.Snapshot()
+
+	_, err := e.PlaceMarketOrder(NewOrder(true, 2, 4))
+	assert(t, err, nil)
+	after := e.Snapshot()
+
+	// only the filled limit is copied again
+	assert(t, &after.Asks[1].Orders[0] == &before.Asks[1].Orders[0], true)
+	assert(t, &after.Bids[0].Orders[0] == &before.Bids[0].Orders[0], true)
+	assert(t, before.Asks[0].Orders[0].Size, 5.0)
+	assert(t, after.Asks[0].Orders[0].Size, 3.0)
+
+	// a limit that left the book and came back is copied again
+	e.PlaceMarketOrder(NewOrder(true, 3, 4))
+	e.PlaceLimitOrder(10_000, NewOrder(false, 1, 5))
+	assert(t, len(e.Snapshot().Asks), 2)
+	assert(t, e.Snapshot().Asks[0].Orders[0].UserID, int64(5))
+	assert(t, e.Snapshot().Asks[1].TotalVolume, 10.0)
+}
+
+func TestOrderbookLimitsStaySorted(t *testing.T) {
+	ob := NewOrderbook()
+	for _, price := range []float64{10, 30, 20, 5, 25} {
+		ob.PlaceLimitOrder(price, NewOrder(false, 1, 0))
+		ob.PlaceLimitOrder(price-1, NewOrder(true, 1, 0))
+	}
+
+	for i := 1; i < len(ob.Asks()); i++ {
+		assert(t, ob.Asks()[i-1].Price < ob.Asks()[i].Price, true)
+		assert(t, ob.Bids()[i-1].Price > ob.Bids()[i].Price, true)
+	}
+
+	ob.CancelOrder(ob.AskLimits[20].Orders[0])
+	assert(t, len(ob.Asks()), 4)
+	assert(t, ob.Asks()[2].Price, 25.0)
+}
+
+// TestEngineConcurrent hammers an engine with places, cancels and reads from
+// many goroutines, run it with -race.
+func TestEngineConcurrent(t *testing.T) {
+	e := NewEngine(NewOrderbook())
+	e.Start()
+	defer e.Stop()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+
+			var placed []int64
+			for i := 0; i < 300; i++ {
+				switch r.Intn(4) {
+				case 0:
+					o := NewOrder(r.Intn(2) == 0, float64(1+r.Intn(5)), int64(w))
+					price := 1_000.0 + float64(r.Intn(20))
+					if o.Bid {
+						price -= 50
+					}
+					e.PlaceLimitOrder(price, o)
+					placed = append(placed, o.ID)
+				case 1:
+					if len(placed) > 0 {
+						e.CancelOrder(placed[r.Intn(len(placed))])
+					}
+				case 2:
+					e.PlaceMarketOrder(NewOrder(r.Intn(2) == 0, 1, int64(w)))
+				case 3:
+					snapshot := e.Snapshot()
+					total := 0.0
+					for _, limit := range snapshot.Asks {
+						for _, order := range limit.Orders {
+							total += order.Size
+						}
+					}
+					_ = total + float64(len(snapshot.Trades))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	snapshot := e.Snapshot()
+	total := 0.0
+	for _, limit := range snapshot.Asks {
+		total += limit.TotalVolume
+	}
+	assert(t, total, snapshot.AskTotalVolume)
+}
@@ -0,0 +1,69 @@
+package orderbook
+
+const (
+	EventPlaced    EventType = "PLACED"
+	EventFilled    EventType = "FILLED"
+	EventCancelled EventType = "CANCELLED"
+	EventExpired   EventType = "EXPIRED"
+	EventRejected  EventType = "REJECTED"
+)
+
+type (
+	EventType string
+
+	// EventHandler must be cheap, it runs on the engine goroutine while the
+	// book is being changed.
+	EventHandler func(Event)
+)
+
+// Event describes a change in the lifecycle of an order.
+type Event struct {
+	Type    EventType
+	OrderID int64
+	UserID  int64
+	Bid     bool
+	// Price is the limit price for placed, cancelled and expired orders and
+	// the match price for fills
+	Price float64
+	// SizeFilled is only set for fills
+	SizeFilled float64
+	// Size is what is left of the order after the event
+	Size float64
+
+	Status       OrderStatus
+	FilledSize   float64
+	AvgFillPrice float64
+	// CreatedAt is the timestamp of the order, Timestamp the time of the event
+	CreatedAt int64
+	Timestamp int64
+	// ExpiresAt is the unix nano time the order expires at, 0 if it does not
+	ExpiresAt int64
+}
+
+// Done reports whether the order left the book with this event.
+func (e Event) Done() bool {
+	return e.Status.Closed()
+}
+
+func (ob *Orderbook) emit(eventType EventType, o *Order, price, sizeFilled float64) {
+	if ob.OnEvent == nil {
+		return
+	}
+
+	ob.OnEvent(Event{
+		Type:       eventType,
+		OrderID:    o.ID,
+		UserID:     o.UserID,
+		Bid:        o.Bid,
+		Price:      price,
+		SizeFilled: sizeFilled,
+		Size:       o.Size,
+
+		Status:       o.Status,
+		FilledSize:   o.FilledSize,
+		AvgFillPrice: o.AvgFillPrice,
+		CreatedAt:    o.Timestamp,
+		Timestamp:    o.UpdatedAt,
+		ExpiresAt:    o.ExpiresAt,
+	})
+}
@@ -0,0 +1,69 @@
+package orderbook
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics of all orderbooks, labelled with the Market of the book. They
+// are updated on the engine goroutine and only cost an atomic add, the state
+// of the books is read from their snapshots when the metrics are scraped.
+var (
+	matchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "exchange",
+		Subsystem: "orderbook",
+		Name:      "match_duration_seconds",
+		Help:      "Time it takes to match a market order against the book.",
+		Buckets:   prometheus.ExponentialBuckets(0.000005, 4, 10),
+	}, []string{"market"})
+	tradesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "exchange",
+		Subsystem: "orderbook",
+		Name:      "trades_total",
+		Help:      "Number of trades.",
+	}, []string{"market"})
+	baseVolume = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "exchange",
+		Subsystem: "orderbook",
+		Name:      "base_volume_total",
+		Help:      "Traded volume in the base asset.",
+	}, []string{"market"})
+	quoteVolume = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "exchange",
+		Subsystem: "orderbook",
+		Name:      "quote_volume_total",
+		Help:      "Traded volume in the quote asset.",
+	}, []string{"market"})
+)
+
+// bookMetrics are the metrics of a single book, resolved once so updating
+// them skips the label lookup.
+type bookMetrics struct {
+	matchDuration prometheus.Observer
+	trades        prometheus.Counter
+	baseVolume    prometheus.Counter
+	quoteVolume   prometheus.Counter
+}
+
+func (ob *Orderbook) metrics() *bookMetrics {
+	if ob.bookMetrics == nil {
+		ob.bookMetrics = &bookMetrics{
+			matchDuration: matchDuration.WithLabelValues(ob.Market),
+			trades:        tradesTotal.WithLabelValues(ob.Market),
+			baseVolume:    baseVolume.WithLabelValues(ob.Market),
+			quoteVolume:   quoteVolume.WithLabelValues(ob.Market),
+		}
+	}
+	return ob.bookMetrics
+}
+
+func (m *bookMetrics) observeMatch(start time.Time, matches []Match) {
+	m.matchDuration.Observe(time.Since(start).Seconds())
+	for _, match := range matches {
+		m.trades.Inc()
+		m.baseVolume.Add(match.SizeFilled)
+		m.quoteVolume.Add(match.SizeFilled * match.Price)
+	}
+}
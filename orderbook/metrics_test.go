@@ -0,0 +1,21 @@
+package orderbook
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMatchMetrics(t *testing.T) {
+	ob := NewOrderbook()
+	ob.Market = "TEST-METRICS"
+
+	ob.PlaceLimitOrder(10_000, NewOrder(false, 5, 1))
+	ob.PlaceLimitOrder(10_100, NewOrder(false, 5, 2))
+	ob.PlaceMarketOrder(NewOrder(true, 7, 3))
+
+	assert(t, testutil.ToFloat64(tradesTotal.WithLabelValues("TEST-METRICS")), 2.0)
+	assert(t, testutil.ToFloat64(baseVolume.WithLabelValues("TEST-METRICS")), 7.0)
+	assert(t, testutil.ToFloat64(quoteVolume.WithLabelValues("TEST-METRICS")), 70_200.0)
+	assert(t, testutil.CollectAndCount(matchDuration, "exchange_orderbook_match_duration_seconds") > 0, true)
+}
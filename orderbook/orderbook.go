@@ -1,15 +1,19 @@
 package orderbook
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
+	"math"
 	"sort"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// ErrNotEnoughVolume is returned for market orders larger than the book.
+var ErrNotEnoughVolume = errors.New("not enough volume for market order")
+
 type Trade struct {
 	Price     float64
 	Size      float64
@@ -25,14 +29,40 @@ type Match struct {
 	Price      float64
 }
 
+const (
+	StatusNew             OrderStatus = "NEW"
+	StatusPartiallyFilled OrderStatus = "PARTIALLY_FILLED"
+	StatusFilled          OrderStatus = "FILLED"
+	StatusCancelled       OrderStatus = "CANCELLED"
+	StatusRejected        OrderStatus = "REJECTED"
+	StatusExpired         OrderStatus = "EXPIRED"
+)
+
+type OrderStatus string
+
+// Closed reports whether an order in this status can no longer change.
+func (s OrderStatus) Closed() bool {
+	switch s {
+	case StatusFilled, StatusCancelled, StatusRejected, StatusExpired:
+		return true
+	}
+	return false
+}
+
 // Order from the users
 type Order struct {
 	ID        int64
 	UserID    int64
-	Size      float64 //How many BTC
+	Size      float64 //How many BTC, what is left to fill
 	Bid       bool    //buy or sell, true is buy, false is sell
 	Limit     *Limit  // track which limit the order in
 	Timestamp int64
+	ExpiresAt int64 // unix nano, 0 means good till cancelled
+
+	Status       OrderStatus
+	FilledSize   float64
+	AvgFillPrice float64
+	UpdatedAt    int64
 }
 
 type Orders []*Order
@@ -41,16 +71,54 @@ func (o Orders) Len() int           { return len(o) }
 func (o Orders) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
 func (o Orders) Less(i, j int) bool { return o[i].Timestamp < o[j].Timestamp }
 
+// lastOrderID is the ID NewOrder handed out last.
+var lastOrderID atomic.Int64
+
+// SeedOrderIDs makes NewOrder hand out IDs above id, so orders created after
+// a restart do not reuse the IDs of the stored ones. Lower IDs than the ones
+// already handed out are ignored.
+func SeedOrderIDs(id int64) {
+	for {
+		last := lastOrderID.Load()
+		if last >= id || lastOrderID.CompareAndSwap(last, id) {
+			return
+		}
+	}
+}
+
+// NewOrder creates an order with the next ID of the sequence, IDs are never
+// reused within the process.
 func NewOrder(bid bool, size float64, userID int64) *Order {
+	now := time.Now().UnixNano()
 	return &Order{
-		ID:        int64(rand.Intn(10000000)),
+		ID:        lastOrderID.Add(1),
 		UserID:    userID,
 		Size:      size,
 		Bid:       bid,
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: now,
+		Status:    StatusNew,
+		UpdatedAt: now,
+	}
+}
+
+// fill records a fill of size at price on the order.
+func (o *Order) fill(size, price float64) {
+	o.AvgFillPrice = (o.AvgFillPrice*o.FilledSize + price*size) / (o.FilledSize + size)
+	o.FilledSize += size
+	o.UpdatedAt = time.Now().UnixNano()
+
+	if o.IsFilled() {
+		o.Status = StatusFilled
+	} else {
+		o.Status = StatusPartiallyFilled
 	}
 }
 
+func (o *Order) setStatus(status OrderStatus) {
+	o.Status = status
+	o.UpdatedAt = time.Now().UnixNano()
+}
+
 func (o *Order) String() string {
 	return fmt.Sprintf("[ID] %+v [UserID]  %+v [size] %.2f [Bid]  %+v[Timestamp] %+v", o.ID, o.UserID, o.Size, o.Bid, o.Timestamp)
 }
@@ -72,6 +140,9 @@ type Limit struct {
 	Price       float64
 	Orders      Orders
 	TotalVolume float64
+	// version changes with every change of the orders, the engine only
+	// copies the limits whose version changed into a new snapshot
+	version uint64
 }
 
 type Limits []*Limit
@@ -102,12 +173,14 @@ func (l *Limit) String() string {
 }
 
 func (l *Limit) AddOrder(o *Order) {
+	l.version++
 	o.Limit = l
 	l.Orders = append(l.Orders, o)
 	l.TotalVolume += o.Size
 }
 
 func (l *Limit) DeleteOrder(o *Order) {
+	l.version++
 	for i := 0; i < len(l.Orders); i++ {
 		if l.Orders[i] == o {
 			l.Orders[i] = l.Orders[len(l.Orders)-1]
@@ -127,6 +200,7 @@ func (l *Limit) Fill(o *Order) []Match {
 		ordersToDelete []*Order
 	)
 
+	l.version++
 	for _, order := range l.Orders {
 
 		if o.IsFilled() {
@@ -179,6 +253,9 @@ func (l *Limit) fillOrder(a, b *Order) Match {
 		a.Size = 0.0
 	}
 
+	a.fill(sizeFilled, l.Price)
+	b.fill(sizeFilled, l.Price)
+
 	return Match{
 		Bid:        bid,
 		Ask:        ask,
@@ -187,18 +264,27 @@ func (l *Limit) fillOrder(a, b *Order) Match {
 	}
 }
 
-// Orderbook
+// Orderbook is not safe for concurrent use, an Engine owns it and applies
+// every command on a single goroutine.
 type Orderbook struct {
+	// Market names the book in its metrics
+	Market string
+
 	//Map can not be sorted so using both slice and map
 	asks []*Limit
 	bids []*Limit
 
 	Trades []*Trade
 
-	mu        sync.RWMutex
 	AskLimits map[float64]*Limit
 	BidLimits map[float64]*Limit
 	Orders    map[int64]*Order
+
+	// OnEvent is called for every order lifecycle event, on the goroutine
+	// that changed the book.
+	OnEvent EventHandler
+
+	bookMetrics *bookMetrics
 }
 
 func NewOrderbook() *Orderbook {
@@ -214,9 +300,7 @@ func NewOrderbook() *Orderbook {
 
 // Buy BTC in the Market price
 func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
-	ob.mu.Lock()
-	defer ob.mu.Unlock()
-
+	start := time.Now()
 	matches := []Match{}
 
 	if o.Bid {
@@ -224,28 +308,13 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.AskTotalVolume(), o.Size))
 		}
 
-		for _, limit := range ob.Asks() {
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
-
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(false, limit)
-			}
-		}
+		matches = ob.fillMarketOrder(o, ob.Asks(), false)
 	} else {
 		if o.Size > ob.BidTotalVolume() {
 			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.BidTotalVolume(), o.Size))
 		}
 
-		for _, limit := range ob.Bids() {
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
-
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(true, limit)
-			}
-		}
-
+		matches = ob.fillMarketOrder(o, ob.Bids(), true)
 	}
 
 	for _, match := range matches {
@@ -257,6 +326,8 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 		}
 		ob.Trades = append(ob.Trades, trade)
 	}
+	ob.metrics().observeMatch(start, matches)
+
 	logrus.WithFields(logrus.Fields{
 		"currentPrice": ob.Trades[len(ob.Trades)-1].Price,
 	}).Info()
@@ -264,6 +335,49 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 	return matches
 }
 
+// fillMarketOrder walks the limits from the best price on, the emptied limits
+// are only cleared once the walk is done so the slice is not modified while
+// iterating it.
+func (ob *Orderbook) fillMarketOrder(o *Order, limits []*Limit, bid bool) []Match {
+	var (
+		matches        []Match
+		limitsToDelete []*Limit
+	)
+
+	for _, limit := range limits {
+		if o.IsFilled() {
+			break
+		}
+
+		limitMatches := limit.Fill(o)
+		matches = append(matches, limitMatches...)
+
+		if len(limit.Orders) == 0 {
+			limitsToDelete = append(limitsToDelete, limit)
+		}
+	}
+
+	for _, limit := range limitsToDelete {
+		ob.clearLimit(bid, limit)
+	}
+
+	// filled resting orders are gone from the book
+	for _, match := range matches {
+		resting := match.Ask
+		if bid {
+			resting = match.Bid
+		}
+		if resting.IsFilled() {
+			delete(ob.Orders, resting.ID)
+		}
+
+		ob.emit(EventFilled, resting, match.Price, match.SizeFilled)
+		ob.emit(EventFilled, o, match.Price, match.SizeFilled)
+	}
+
+	return matches
+}
+
 // Buy BTC in limit price
 //
 //	#TODO the limit order didn't filled when the price across
@@ -271,9 +385,6 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 	// 1. check volume is 15k
 	var limit *Limit
 
-	ob.mu.Lock()
-	defer ob.mu.Unlock()
-
 	if o.Bid {
 		limit = ob.BidLimits[price]
 	} else {
@@ -283,11 +394,12 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 	if limit == nil {
 		limit = NewLimit(price)
 
+		// keep the limits sorted on insert so reading them never has to sort
 		if o.Bid {
-			ob.bids = append(ob.bids, limit)
+			ob.bids = insertLimit(ob.bids, limit, func(l *Limit) bool { return l.Price < price })
 			ob.BidLimits[price] = limit
 		} else {
-			ob.asks = append(ob.asks, limit)
+			ob.asks = insertLimit(ob.asks, limit, func(l *Limit) bool { return l.Price > price })
 			ob.AskLimits[price] = limit
 		}
 	}
@@ -301,38 +413,135 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 
 	ob.Orders[o.ID] = o
 	limit.AddOrder(o)
+
+	ob.emit(EventPlaced, o, limit.Price, 0)
+}
+
+// insertLimit inserts l before the first limit for which after returns true.
+func insertLimit(limits []*Limit, l *Limit, after func(*Limit) bool) []*Limit {
+	i := sort.Search(len(limits), func(i int) bool { return after(limits[i]) })
+	limits = append(limits, nil)
+	copy(limits[i+1:], limits[i:])
+	limits[i] = l
+	return limits
+}
+
+// removeLimit removes l while keeping the order of the other limits.
+func removeLimit(limits []*Limit, l *Limit) []*Limit {
+	for i := 0; i < len(limits); i++ {
+		if limits[i] == l {
+			return append(limits[:i], limits[i+1:]...)
+		}
+	}
+	return limits
 }
 
 func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
 	if bid {
 		delete(ob.BidLimits, l.Price)
-		for i := 0; i < len(ob.bids); i++ {
-			if ob.bids[i] == l {
-				ob.bids[i] = ob.bids[len(ob.bids)-1]
-				ob.bids = ob.bids[:len(ob.bids)-1]
-			}
-		}
+		ob.bids = removeLimit(ob.bids, l)
 	} else {
 		delete(ob.AskLimits, l.Price)
-		for i := 0; i < len(ob.asks); i++ {
-			if ob.asks[i] == l {
-				ob.asks[i] = ob.asks[len(ob.asks)-1]
-				ob.asks = ob.asks[:len(ob.asks)-1]
+		ob.asks = removeLimit(ob.asks, l)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"price": l.Price,
+	}).Debug("clearing limit price level")
+}
+
+func (ob *Orderbook) CancelOrder(o *Order) {
+	ob.removeOrder(o, StatusCancelled, EventCancelled)
+}
+
+// RejectOrder marks an order that never made it into the book as rejected,
+// price is the limit price, 0 for market orders.
+func (ob *Orderbook) RejectOrder(o *Order, price float64) {
+	o.setStatus(StatusRejected)
+	ob.emit(EventRejected, o, price, 0)
+}
+
+// MarketCost returns how much of the quote asset a market order of size
+// would exchange when filled against the book right now.
+func (ob *Orderbook) MarketCost(bid bool, size float64) (float64, error) {
+	limits := ob.Bids()
+	if bid {
+		limits = ob.Asks()
+	}
+
+	cost := 0.0
+	for _, limit := range limits {
+		if size <= 0 {
+			break
+		}
+		fill := math.Min(size, limit.TotalVolume)
+		cost += fill * limit.Price
+		size -= fill
+	}
+
+	if size > 0 {
+		return 0, fmt.Errorf("%w, missing [size: %.2f]", ErrNotEnoughVolume, size)
+	}
+
+	return cost, nil
+}
+
+// PreviewMarketOrder returns the matches PlaceMarketOrder would make for the
+// order, without changing the book or the order.
+func (ob *Orderbook) PreviewMarketOrder(o *Order) []Match {
+	limits := ob.Bids()
+	if o.Bid {
+		limits = ob.Asks()
+	}
+
+	var matches []Match
+	size := o.Size
+	for _, limit := range limits {
+		for _, resting := range limit.Orders {
+			if size == 0.0 {
+				return matches
 			}
+			filled := math.Min(size, resting.Size)
+			match := Match{Ask: resting, Bid: o, SizeFilled: filled, Price: limit.Price}
+			if resting.Bid {
+				match.Ask, match.Bid = o, resting
+			}
+			matches = append(matches, match)
+			size -= filled
 		}
 	}
 
-	fmt.Printf("clearing limit price level [%.2f]\n", l.Price)
+	return matches
 }
 
-func (ob *Orderbook) CancelOrder(o *Order) {
+// ExpireOrders removes all the orders that expired at now (unix nano).
+func (ob *Orderbook) ExpireOrders(now int64) []*Order {
+	var expired []*Order
+
+	for _, o := range ob.Orders {
+		if o.ExpiresAt != 0 && o.ExpiresAt <= now && o.Limit != nil {
+			expired = append(expired, o)
+		}
+	}
+
+	for _, o := range expired {
+		ob.removeOrder(o, StatusExpired, EventExpired)
+	}
+
+	return expired
+}
+
+func (ob *Orderbook) removeOrder(o *Order, status OrderStatus, eventType EventType) {
 	limit := o.Limit
 	limit.DeleteOrder(o)
 	delete(ob.Orders, o.ID)
+	o.setStatus(status)
 
 	if len(limit.Orders) == 0 {
 		ob.clearLimit(o.Bid, limit)
 	}
+
+	ob.emit(eventType, o, limit.Price, 0)
 }
 
 func (ob *Orderbook) BidTotalVolume() float64 {
@@ -353,12 +562,12 @@ func (ob *Orderbook) AskTotalVolume() float64 {
 	return totalVolume
 }
 
+// Asks returns the ask limits, best (lowest) price first.
 func (ob *Orderbook) Asks() []*Limit {
-	sort.Sort(ByBestAsk{ob.asks})
 	return ob.asks
 }
 
+// Bids returns the bid limits, best (highest) price first.
 func (ob *Orderbook) Bids() []*Limit {
-	sort.Sort(ByBestBid{ob.bids})
 	return ob.bids
 }
@@ -140,3 +140,16 @@ func TestCancelOrderAsk(t *testing.T) {
 	_, ok = ob.AskLimits[price]
 	assert(t, ok, false)
 }
+
+func TestOrderIDsFollowTheSeed(t *testing.T) {
+	a := NewOrder(true, 1, 0)
+	b := NewOrder(true, 1, 0)
+	assert(t, b.ID > a.ID, true)
+
+	SeedOrderIDs(b.ID + 1000)
+	assert(t, NewOrder(true, 1, 0).ID, b.ID+1001)
+
+	// a lower seed never hands out an ID twice
+	SeedOrderIDs(a.ID)
+	assert(t, NewOrder(true, 1, 0).ID, b.ID+1002)
+}
@@ -0,0 +1,132 @@
+package orderbook
+
+// Snapshot is an immutable copy of an Orderbook. It is safe to read from any
+// goroutine, nothing in it is modified after the Engine published it.
+type Snapshot struct {
+	Sequence       uint64
+	Asks           []LimitSnapshot // best (lowest) price first
+	Bids           []LimitSnapshot // best (highest) price first
+	AskTotalVolume float64
+	BidTotalVolume float64
+	Trades         []*Trade
+}
+
+type LimitSnapshot struct {
+	Price       float64
+	TotalVolume float64
+	Orders      []OrderSnapshot
+}
+
+type OrderSnapshot struct {
+	ID        int64
+	UserID    int64
+	Size      float64
+	Bid       bool
+	Price     float64
+	Timestamp int64
+}
+
+// limitCache keeps the snapshot of every limit in the book with the version
+// of the limit it was taken at. Publishing a snapshot only copies the limits
+// a command changed, the others share their snapshot with the last one.
+type limitCache map[*Limit]cachedLimit
+
+type cachedLimit struct {
+	version  uint64
+	snapshot LimitSnapshot
+	// sequence is the last snapshot the limit was in
+	sequence uint64
+}
+
+func newSnapshot(ob *Orderbook, sequence uint64, cache limitCache) *Snapshot {
+	snapshot := &Snapshot{
+		Sequence:       sequence,
+		Asks:           cache.snapshotLimits(ob.Asks(), sequence),
+		Bids:           cache.snapshotLimits(ob.Bids(), sequence),
+		AskTotalVolume: ob.AskTotalVolume(),
+		BidTotalVolume: ob.BidTotalVolume(),
+		// trades are only ever appended and never modified, capping the
+		// slice is enough to share the backing array with the writer
+		Trades: ob.Trades[:len(ob.Trades):len(ob.Trades)],
+	}
+
+	// the limits that left the book are not needed anymore
+	if len(cache) > len(snapshot.Asks)+len(snapshot.Bids) {
+		for limit, cached := range cache {
+			if cached.sequence != sequence {
+				delete(cache, limit)
+			}
+		}
+	}
+
+	return snapshot
+}
+
+func (cache limitCache) snapshotLimits(limits []*Limit, sequence uint64) []LimitSnapshot {
+	snapshots := make([]LimitSnapshot, len(limits))
+
+	for i, limit := range limits {
+		cached, ok := cache[limit]
+		if !ok || cached.version != limit.version {
+			cached = cachedLimit{version: limit.version, snapshot: snapshotLimit(limit)}
+		}
+		cached.sequence = sequence
+		cache[limit] = cached
+		snapshots[i] = cached.snapshot
+	}
+
+	return snapshots
+}
+
+func snapshotLimit(limit *Limit) LimitSnapshot {
+	orders := make([]OrderSnapshot, len(limit.Orders))
+	for i, order := range limit.Orders {
+		orders[i] = OrderSnapshot{
+			ID:        order.ID,
+			UserID:    order.UserID,
+			Size:      order.Size,
+			Bid:       order.Bid,
+			Price:     limit.Price,
+			Timestamp: order.Timestamp,
+		}
+	}
+
+	return LimitSnapshot{
+		Price:       limit.Price,
+		TotalVolume: limit.TotalVolume,
+		Orders:      orders,
+	}
+}
+
+// BestAsk returns the lowest ask limit, false when there are no asks.
+func (s *Snapshot) BestAsk() (LimitSnapshot, bool) {
+	if len(s.Asks) == 0 {
+		return LimitSnapshot{}, false
+	}
+	return s.Asks[0], true
+}
+
+// BestBid returns the highest bid limit, false when there are no bids.
+func (s *Snapshot) BestBid() (LimitSnapshot, bool) {
+	if len(s.Bids) == 0 {
+		return LimitSnapshot{}, false
+	}
+	return s.Bids[0], true
+}
+
+// UserOrders returns the resting orders of the user.
+func (s *Snapshot) UserOrders(userID int64) []OrderSnapshot {
+	orders := []OrderSnapshot{}
+
+	for _, limits := range [][]LimitSnapshot{s.Asks, s.Bids} {
+		for _, limit := range limits {
+			for _, order := range limit.Orders {
+				if order.UserID == userID {
+					orders = append(orders, order)
+				}
+			}
+		}
+	}
+
+	return orders
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// AdminTokenHeader carries the token of the admin API.
+const AdminTokenHeader = "X-Admin-Token"
+
+// SetAdminToken sets the token the admin API is guarded with. The admin API
+// is disabled as long as no token is set.
+func (ex *Exchange) SetAdminToken(token string) {
+	ex.adminToken = token
+}
+
+func (ex *Exchange) adminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if ex.adminToken == "" {
+			return newErrorf(http.StatusForbidden, "admin API disabled")
+		}
+
+		token := c.Request().Header.Get(AdminTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(ex.adminToken)) != 1 {
+			return newErrorf(http.StatusUnauthorized, "invalid admin token")
+		}
+		c.Set(adminKey, true)
+
+		return next(c)
+	}
+}
+
+var ErrAccountFrozen = errors.New("account is frozen")
+
+// AdminUserResponse is what admins see of a user in the user list.
+type AdminUserResponse struct {
+	UserResponse
+	Frozen bool
+}
+
+// AdminUserDetails adds the wallets, balances and open orders of the user.
+type AdminUserDetails struct {
+	AdminUserResponse
+	// Wallets holds the deposit address of every asset
+	Wallets    map[token.Asset]string
+	Balances   map[token.Asset]Balance
+	OpenOrders []Order
+}
+
+type FreezeUserRequest struct {
+	Reason string
+}
+
+// AdjustBalanceRequest credits Amount of the asset to the user, a negative
+// amount debits it. The reason ends up in the audit trail.
+type AdjustBalanceRequest struct {
+	Asset  token.Asset
+	Amount float64
+	Reason string
+}
+
+type AdjustBalanceResponse struct {
+	Entry   ledger.Entry
+	Balance Balance
+}
+
+type CancelUserOrdersResponse struct {
+	UserID    int64
+	Cancelled int
+}
+
+// MarketStats describe the book of a market as of its last snapshot.
+type MarketStats struct {
+	MarketInfo
+	Sequence   uint64
+	BidLevels  int
+	AskLevels  int
+	BidVolume  float64
+	AskVolume  float64
+	OpenOrders int
+	Trades     int
+	// LastPrice is the price of the last trade, 0 before the first one
+	LastPrice float64
+}
+
+type EngineStats struct {
+	Users      int
+	OpenOrders int
+	Markets    []MarketStats
+}
+
+func newAdminUserResponse(user *User) AdminUserResponse {
+	return AdminUserResponse{
+		UserResponse: newUserResponse(user),
+		Frozen:       user.Frozen,
+	}
+}
+
+// adminUser is the user of the :userID of the request.
+func (ex *Exchange) adminUser(c echo.Context) (*User, error) {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, err)
+	}
+
+	ex.mu.RLock()
+	user, ok := ex.Users[userID]
+	ex.mu.RUnlock()
+	if !ok {
+		return nil, newErrorf(http.StatusNotFound, "%w: %d", ErrUserNotFound, userID)
+	}
+
+	return user, nil
+}
+
+// userFrozen reports whether the account of the user is frozen. Frozen
+// accounts can still read and cancel, but can not place orders.
+func (ex *Exchange) userFrozen(userID int64) bool {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	user, ok := ex.Users[userID]
+	return ok && user.Frozen
+}
+
+func (ex *Exchange) handleAdminGetUsers(c echo.Context) error {
+	ex.mu.RLock()
+	users := make([]AdminUserResponse, 0, len(ex.Users))
+	for _, user := range ex.Users {
+		users = append(users, newAdminUserResponse(user))
+	}
+	ex.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	return c.JSON(http.StatusOK, users)
+}
+
+func (ex *Exchange) handleAdminGetUser(c echo.Context) error {
+	user, err := ex.adminUser(c)
+	if err != nil {
+		return err
+	}
+
+	ex.mu.RLock()
+	details := AdminUserDetails{
+		AdminUserResponse: newAdminUserResponse(user),
+		Wallets:           make(map[token.Asset]string),
+	}
+	for asset, wallet := range user.Wallet {
+		address, err := wallet.GetPublicKey()
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"userID": user.ID,
+				"asset":  asset,
+			}).Error("failed to read wallet address")
+			continue
+		}
+		details.Wallets[asset] = address
+	}
+	ex.mu.RUnlock()
+
+	details.Balances = ex.balances(user.ID)
+	details.OpenOrders = ex.Orders.UserOrders(user.ID)
+
+	return c.JSON(http.StatusOK, details)
+}
+
+func (ex *Exchange) handleFreezeUser(c echo.Context) error {
+	return ex.setFrozen(c, true)
+}
+
+func (ex *Exchange) handleUnfreezeUser(c echo.Context) error {
+	return ex.setFrozen(c, false)
+}
+
+func (ex *Exchange) setFrozen(c echo.Context, frozen bool) error {
+	user, err := ex.adminUser(c)
+	if err != nil {
+		return err
+	}
+
+	var req FreezeUserRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	if err := ex.userStore.SetFrozen(user.ID, frozen); err != nil {
+		return err
+	}
+	ex.mu.Lock()
+	user.Frozen = frozen
+	resp := newAdminUserResponse(user)
+	ex.mu.Unlock()
+
+	action := audit.UserFrozen
+	if !frozen {
+		action = audit.UserUnfrozen
+	}
+	ex.recordAudit(c, action, user.ID, map[string]any{"reason": req.Reason})
+
+	logrus.WithFields(logrus.Fields{
+		"userID": user.ID,
+		"frozen": frozen,
+	}).Info("user account frozen state changed")
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleAdjustBalance posts a manual adjustment of the balance of the user
+// to the ledger, referencing the request it was made by.
+func (ex *Exchange) handleAdjustBalance(c echo.Context) error {
+	user, err := ex.adminUser(c)
+	if err != nil {
+		return err
+	}
+
+	var req AdjustBalanceRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		return newErrorf(http.StatusBadRequest, "an adjustment needs a reason")
+	}
+	if !token.IsKnownAsset(req.Asset) {
+		return newErrorf(http.StatusBadRequest, "unknown asset: %s", req.Asset)
+	}
+
+	ref := "adjustment:" + c.Response().Header().Get(echo.HeaderXRequestID)
+	entry, err := ex.Ledger.Adjust(user.ID, req.Asset, req.Amount, ref)
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	ex.recordAudit(c, audit.BalanceAdjusted, user.ID, map[string]any{
+		"asset":  req.Asset,
+		"amount": req.Amount,
+		"reason": req.Reason,
+		"entry":  entry.ID,
+	})
+
+	logrus.WithFields(logrus.Fields{
+		"userID": user.ID,
+		"asset":  req.Asset,
+		"amount": req.Amount,
+		"entry":  entry.ID,
+	}).Info("balance adjusted")
+
+	return c.JSON(http.StatusOK, AdjustBalanceResponse{
+		Entry:   entry,
+		Balance: ex.balances(user.ID)[req.Asset],
+	})
+}
+
+func (ex *Exchange) handleAdminCancelOrders(c echo.Context) error {
+	user, err := ex.adminUser(c)
+	if err != nil {
+		return err
+	}
+
+	cancelled := ex.cancelAllOrders(user.ID)
+	ex.recordAudit(c, audit.OrdersCancelled, user.ID, map[string]any{"cancelled": cancelled})
+
+	return c.JSON(http.StatusOK, CancelUserOrdersResponse{
+		UserID:    user.ID,
+		Cancelled: cancelled,
+	})
+}
+
+func (ex *Exchange) handleGetEngineStats(c echo.Context) error {
+	ex.mu.RLock()
+	stats := EngineStats{
+		Users:   len(ex.Users),
+		Markets: []MarketStats{},
+	}
+	ex.mu.RUnlock()
+
+	for _, info := range ex.markets.Markets() {
+		engine, ok := ex.markets.Engine(info.Market)
+		if !ok {
+			continue
+		}
+		snapshot := engine.Snapshot()
+
+		market := MarketStats{
+			MarketInfo: info,
+			Sequence:   snapshot.Sequence,
+			BidLevels:  len(snapshot.Bids),
+			AskLevels:  len(snapshot.Asks),
+			BidVolume:  snapshot.BidTotalVolume,
+			AskVolume:  snapshot.AskTotalVolume,
+			Trades:     len(snapshot.Trades),
+		}
+		for _, limits := range [][]orderbook.LimitSnapshot{snapshot.Bids, snapshot.Asks} {
+			for _, limit := range limits {
+				market.OpenOrders += len(limit.Orders)
+			}
+		}
+		if n := len(snapshot.Trades); n > 0 {
+			market.LastPrice = snapshot.Trades[n-1].Price
+		}
+
+		stats.OpenOrders += market.OpenOrders
+		stats.Markets = append(stats.Markets, market)
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+func decodeTestResponse[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	var v T
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestAdminGetUsers(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 2, 1)
+	ex.SetAdminToken(testAdminToken)
+	ex.Users[1].Wallet, _ = token.GenerateWallet()
+	e := newRouter(ex)
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 1, Price: 1_000, Market: token.MarketETHUSDT})
+
+	rec := doRequest(e, http.MethodGet, "/v1/admin/users", nil)
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	rec = doAdminRequest(e, http.MethodGet, "/v1/admin/users", nil)
+	assert(t, rec.Code, http.StatusOK)
+	users := decodeTestResponse[[]AdminUserResponse](t, rec)
+	assert(t, len(users), 2)
+	assert(t, users[0].ID, int64(1))
+	assert(t, users[1].Frozen, false)
+
+	rec = doAdminRequest(e, http.MethodGet, "/v1/admin/users/1", nil)
+	assert(t, rec.Code, http.StatusOK)
+	details := decodeTestResponse[AdminUserDetails](t, rec)
+	address, _ := ex.Users[1].Wallet[token.AssetETH].GetPublicKey()
+	assert(t, details.Wallets[token.AssetETH], address)
+	assert(t, details.Balances[token.AssetUSDT], Balance{Available: 9_000, Held: 1_000, Total: 10_000})
+	assert(t, len(details.OpenOrders), 1)
+
+	rec = doAdminRequest(e, http.MethodGet, "/v1/admin/users/3", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	assert(t, decodeAPIError(t, rec).Code, CodeUserNotFound)
+}
+
+func TestFreezeUser(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1)
+	ex.SetAdminToken(testAdminToken)
+	e := newRouter(ex)
+	order := PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 1, Price: 1_000, Market: token.MarketETHUSDT}
+	id := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1, Price: 2_000, Market: token.MarketETHUSDT})
+
+	rec := doAdminRequest(e, http.MethodPost, "/v1/admin/users/1/freeze", FreezeUserRequest{Reason: "chargeback"})
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, decodeTestResponse[AdminUserResponse](t, rec).Frozen, true)
+
+	rec = doUserRequest(e, 1, http.MethodPost, "/v1/orders", order)
+	assert(t, rec.Code, http.StatusForbidden)
+	assert(t, decodeAPIError(t, rec).Code, CodeAccountFrozen)
+
+	// frozen accounts can still read and cancel
+	rec = doUserRequest(e, 1, http.MethodGet, "/v1/users/1/balances", nil)
+	assert(t, rec.Code, http.StatusOK)
+	rec = doUserRequest(e, 1, http.MethodDelete, "/v1/orders/"+strconv.FormatInt(id, 10), nil)
+	assert(t, rec.Code, http.StatusOK)
+
+	rec = doAdminRequest(e, http.MethodPost, "/v1/admin/users/1/unfreeze", nil)
+	assert(t, rec.Code, http.StatusOK)
+	rec = doUserRequest(e, 1, http.MethodPost, "/v1/orders", order)
+	assert(t, rec.Code, http.StatusOK)
+
+	entries := ex.Audit.Search(audit.Filter{Actor: audit.ActorAdmin})
+	assert(t, len(entries), 2)
+	assert(t, entries[0].Action, audit.UserFrozen)
+	assert(t, entries[0].Actor, audit.ActorAdmin)
+	assert(t, entries[0].UserID, int64(1))
+	assert(t, entries[0].Details["reason"], "chargeback")
+	assert(t, entries[0].RequestID != "", true)
+	assert(t, entries[1].Action, audit.UserUnfrozen)
+}
+
+func TestAdjustBalance(t *testing.T) {
+	ex := newFundedExchange(t, 10, 0, 1)
+	ex.SetAdminToken(testAdminToken)
+	e := newRouter(ex)
+
+	rec := doAdminRequest(e, http.MethodPost, "/v1/admin/users/1/adjustments", AdjustBalanceRequest{Asset: token.AssetETH, Amount: 2})
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	rec = doAdminRequest(e, http.MethodPost, "/v1/admin/users/1/adjustments", AdjustBalanceRequest{Asset: token.AssetETH, Amount: 2, Reason: "missed deposit"})
+	assert(t, rec.Code, http.StatusOK)
+	resp := decodeTestResponse[AdjustBalanceResponse](t, rec)
+	assert(t, resp.Entry.Type, ledger.EntryAdjustment)
+	assert(t, resp.Balance.Available, 12.0)
+
+	rec = doAdminRequest(e, http.MethodPost, "/v1/admin/users/1/adjustments", AdjustBalanceRequest{Asset: token.AssetETH, Amount: -20, Reason: "double credit"})
+	assert(t, rec.Code, http.StatusBadRequest)
+	assert(t, decodeAPIError(t, rec).Code, CodeInsufficientBalance)
+
+	rec = doAdminRequest(e, http.MethodPost, "/v1/admin/users/1/adjustments", AdjustBalanceRequest{Asset: token.AssetETH, Amount: -5, Reason: "double credit"})
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, ex.Ledger.Balance(ledger.UserAccount(1, token.AssetETH)), 7.0)
+	assert(t, ex.Ledger.Balance(ledger.ExchangeAccount(ledger.Adjustment, token.AssetETH)), 3.0)
+	assert(t, ex.Ledger.Check(), nil)
+
+	entries := ex.Audit.Entries()
+	assert(t, len(entries), 2)
+	assert(t, entries[0].Action, audit.BalanceAdjusted)
+	assert(t, entries[0].Details["reason"], "missed deposit")
+	assert(t, entries[0].Details["entry"], strconv.FormatInt(resp.Entry.ID, 10))
+	assert(t, resp.Entry.Ref, "adjustment:"+entries[0].RequestID)
+}
+
+func TestAdminCancelOrders(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1)
+	ex.SetAdminToken(testAdminToken)
+	e := newRouter(ex)
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 1, Price: 1_000, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1, Price: 2_000, Market: token.MarketETHUSDT})
+
+	rec := doAdminRequest(e, http.MethodDelete, "/v1/admin/users/1/orders", nil)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, decodeTestResponse[CancelUserOrdersResponse](t, rec), CancelUserOrdersResponse{UserID: 1, Cancelled: 2})
+	assert(t, len(ex.Orders.UserOrders(1)), 0)
+	assert(t, getTestBalances(t, ex, 1)[token.AssetUSDT].Held, 0.0)
+	assert(t, ex.Audit.Search(audit.Filter{Action: audit.OrdersCancelled})[0].Details["cancelled"], "2")
+}
+
+func TestEngineStats(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1, 2)
+	ex.SetAdminToken(testAdminToken)
+	e := newRouter(ex)
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 2, Price: 1_000, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 1, Price: 900, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Size: 1, Market: token.MarketETHUSDT})
+
+	rec := doAdminRequest(e, http.MethodGet, "/v1/admin/stats", nil)
+	assert(t, rec.Code, http.StatusOK)
+	stats := decodeTestResponse[EngineStats](t, rec)
+	assert(t, stats.Users, 2)
+	assert(t, stats.OpenOrders, 2)
+
+	var eth MarketStats
+	for _, m := range stats.Markets {
+		if m.Market == token.MarketETHUSDT {
+			eth = m
+		}
+	}
+	assert(t, eth.BidLevels, 2)
+	assert(t, eth.BidVolume, 2.0)
+	assert(t, eth.Trades, 1)
+	assert(t, eth.LastPrice, 1_000.0)
+	assert(t, eth.State, MarketActive)
+}
+
+func TestAdminActionsAreAudited(t *testing.T) {
+	ex := newFundedExchange(t, 0, 0, 1)
+	ex.SetAdminToken(testAdminToken)
+	e := newRouter(ex)
+
+	doAdminRequest(e, http.MethodPut, "/v1/admin/markets/ETH-USDT", SetMarketStateRequest{State: MarketCancelOnly})
+	doAdminRequest(e, http.MethodPut, "/v1/admin/fees/users/1", FeeRates{MakerRate: 0.001, TakerRate: 0.002})
+	doAdminRequest(e, http.MethodPost, "/v1/admin/users/1/apikeys", CreateAPIKeyRequest{Scopes: []Scope{ScopeRead}})
+
+	rec := doAdminRequest(e, http.MethodGet, "/v1/admin/audit", nil)
+	assert(t, rec.Code, http.StatusOK)
+	entries := decodeTestResponse[[]audit.Entry](t, rec)
+	assert(t, len(entries), 3)
+	assert(t, entries[0].Action, audit.MarketStateChanged)
+	assert(t, entries[0].Details["state"], string(MarketCancelOnly))
+	assert(t, entries[1].Action, audit.FeeOverrideSet)
+	assert(t, entries[2].Action, audit.APIKeyCreated)
+	assert(t, entries[2].UserID, int64(1))
+	assert(t, entries[2].ID, int64(3))
+}
@@ -0,0 +1,517 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ScopeRead     Scope = "read"
+	ScopeTrade    Scope = "trade"
+	ScopeWithdraw Scope = "withdraw"
+
+	APIKeyHeader       = "X-API-Key"
+	APITimestampHeader = "X-API-Timestamp"
+	APINonceHeader     = "X-API-Nonce"
+	APISignatureHeader = "X-API-Signature"
+
+	// signatureWindow is how far the timestamp of a signed request can be off
+	// from the server clock. Nonces are remembered for twice as long, which
+	// covers every timestamp still accepted.
+	signatureWindow = 30 * time.Second
+
+	// authUserKey holds the user of the API key in the echo context.
+	authUserKey = "authUserID"
+)
+
+var (
+	ErrAPIKeyNotFound   = errors.New("api key not found")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrReplayedRequest  = errors.New("replayed request")
+	ErrMissingScope     = errors.New("api key lacks scope")
+)
+
+type Scope string
+
+func (s Scope) Valid() bool {
+	return s == ScopeRead || s == ScopeTrade || s == ScopeWithdraw
+}
+
+// APIKey lets a user sign requests. The secret is only handed out once, when
+// the key is created.
+type APIKey struct {
+	Key       string
+	Secret    string `json:",omitempty"`
+	UserID    int64
+	Scopes    []Scope
+	CreatedAt int64
+}
+
+func (k *APIKey) HasScope(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// SignRequest returns the hex HMAC-SHA256 of a request, signed with the
+// secret of an API key. The client and the server both sign
+// timestamp + nonce + method + request URI + body.
+func SignRequest(secret string, timestamp int64, nonce, method, requestURI string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte(method))
+	mac.Write([]byte(requestURI))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// APIKeyBackend keeps the API keys across restarts.
+type APIKeyBackend interface {
+	SaveAPIKey(APIKey) error
+	DeleteAPIKey(key string) error
+	GetAPIKeys() ([]APIKey, error)
+}
+
+// APIKeyStore holds the API keys and the nonces seen within the signature
+// window, so a signed request can not be sent twice.
+type APIKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]*APIKey
+	// nonces maps a key to its recent nonces and when they were seen
+	nonces map[string]map[string]time.Time
+	// backend gets every created and revoked key when set, the nonces stay
+	// in memory
+	backend APIKeyBackend
+}
+
+func NewAPIKeyStore() *APIKeyStore {
+	return &APIKeyStore{
+		keys:   make(map[string]*APIKey),
+		nonces: make(map[string]map[string]time.Time),
+	}
+}
+
+// Load puts the keys of the backend into the store and writes every later
+// change through to it. It has to be called before any key is created.
+func (s *APIKeyStore) Load(backend APIKeyBackend) (int, error) {
+	keys, err := backend.GetAPIKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, apiKey := range keys {
+		s.keys[apiKey.Key] = &apiKey
+	}
+	s.backend = backend
+
+	return len(keys), nil
+}
+
+func validateScopes(scopes []Scope) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("api key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !scope.Valid() {
+			return fmt.Errorf("invalid scope: %s", scope)
+		}
+	}
+	return nil
+}
+
+// Create generates a new key with a random secret for the user.
+func (s *APIKeyStore) Create(userID int64, scopes []Scope) (APIKey, error) {
+	if err := validateScopes(scopes); err != nil {
+		return APIKey{}, err
+	}
+
+	key, err := randomHex(16)
+	if err != nil {
+		return APIKey{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	apiKey := APIKey{
+		Key:       key,
+		Secret:    secret,
+		UserID:    userID,
+		Scopes:    append([]Scope{}, scopes...),
+		CreatedAt: time.Now().UnixNano(),
+	}
+	if s.backend != nil {
+		if err := s.backend.SaveAPIKey(apiKey); err != nil {
+			return APIKey{}, err
+		}
+	}
+	s.add(apiKey)
+
+	return apiKey, nil
+}
+
+func (s *APIKeyStore) add(apiKey APIKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[apiKey.Key] = &apiKey
+}
+
+// Revoke deletes the key and returns the user it belonged to.
+func (s *APIKeyStore) Revoke(key string) (int64, error) {
+	s.mu.Lock()
+	apiKey, ok := s.keys[key]
+	s.mu.Unlock()
+	if !ok {
+		return 0, ErrAPIKeyNotFound
+	}
+
+	// the key keeps working until it is gone from the backend, so a failed
+	// revoke can not come back after a restart
+	if s.backend != nil {
+		if err := s.backend.DeleteAPIKey(key); err != nil {
+			return 0, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, key)
+	delete(s.nonces, key)
+
+	return apiKey.UserID, nil
+}
+
+// UserKeys returns the keys of the user without their secrets.
+func (s *APIKeyStore) UserKeys(userID int64) []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []APIKey{}
+	for _, k := range s.keys {
+		if k.UserID == userID {
+			key := *k
+			key.Secret = ""
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt < keys[j].CreatedAt })
+
+	return keys
+}
+
+// SignedRequest is what a request carries to be verified against an API key.
+type SignedRequest struct {
+	Key        string
+	Signature  string
+	Timestamp  int64 // unix milliseconds
+	Nonce      string
+	Method     string
+	RequestURI string
+	Body       []byte
+}
+
+// Verify checks the signature of a request and that its nonce was not used
+// before, it returns the key the request was signed with.
+func (s *APIKeyStore) Verify(req SignedRequest, now time.Time) (APIKey, error) {
+	sent := time.UnixMilli(req.Timestamp)
+	if sent.Before(now.Add(-signatureWindow)) || sent.After(now.Add(signatureWindow)) {
+		return APIKey{}, fmt.Errorf("%w: timestamp outside the signature window", ErrInvalidSignature)
+	}
+	if req.Nonce == "" {
+		return APIKey{}, fmt.Errorf("%w: missing nonce", ErrInvalidSignature)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	apiKey, ok := s.keys[req.Key]
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+
+	expected := SignRequest(apiKey.Secret, req.Timestamp, req.Nonce, req.Method, req.RequestURI, req.Body)
+	if !hmac.Equal([]byte(expected), []byte(req.Signature)) {
+		return APIKey{}, ErrInvalidSignature
+	}
+
+	// only requests with a valid signature burn their nonce, so nobody can
+	// block the nonces of a key without knowing its secret
+	nonces, ok := s.nonces[req.Key]
+	if !ok {
+		nonces = make(map[string]time.Time)
+		s.nonces[req.Key] = nonces
+	}
+	for n, seen := range nonces {
+		if now.Sub(seen) > 2*signatureWindow {
+			delete(nonces, n)
+		}
+	}
+	if _, ok := nonces[req.Nonce]; ok {
+		return APIKey{}, ErrReplayedRequest
+	}
+	nonces[req.Nonce] = now
+
+	return *apiKey, nil
+}
+
+// apiKeyAuth verifies the signature of the request and puts the user of the
+// key in the context. Routes with a :userID param only serve that user.
+func (ex *Exchange) apiKeyAuth(scope Scope) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+
+			timestamp, err := strconv.ParseInt(r.Header.Get(APITimestampHeader), 10, 64)
+			if err != nil {
+				return newErrorf(http.StatusUnauthorized, "missing or invalid timestamp")
+			}
+
+			var body []byte
+			if r.Body != nil {
+				body, err = io.ReadAll(r.Body)
+				if err != nil {
+					return err
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+
+			apiKey, err := ex.APIKeys.Verify(SignedRequest{
+				Key:        r.Header.Get(APIKeyHeader),
+				Signature:  r.Header.Get(APISignatureHeader),
+				Timestamp:  timestamp,
+				Nonce:      r.Header.Get(APINonceHeader),
+				Method:     r.Method,
+				RequestURI: r.URL.RequestURI(),
+				Body:       body,
+			}, time.Now())
+			if err != nil {
+				return newError(http.StatusUnauthorized, err)
+			}
+
+			if !apiKey.HasScope(scope) {
+				return newErrorf(http.StatusForbidden, "%w: %s", ErrMissingScope, scope)
+			}
+
+			if err := checkUserParam(c, apiKey.UserID); err != nil {
+				return newError(http.StatusForbidden, err)
+			}
+
+			c.Set(authUserKey, apiKey.UserID)
+
+			return next(c)
+		}
+	}
+}
+
+// authUserID returns the user the request was authenticated for.
+func authUserID(c echo.Context) int64 {
+	userID, _ := c.Get(authUserKey).(int64)
+	return userID
+}
+
+type CreateAPIKeyRequest struct {
+	Scopes []Scope
+	// TOTPCode is required when a user with two-factor authentication creates
+	// a key, admins create keys without it
+	TOTPCode string
+}
+
+// handleCreateAPIKey creates a key for the logged in user.
+func (ex *Exchange) handleCreateAPIKey(c echo.Context) error {
+	return ex.createAPIKey(c, authUserID(c), true)
+}
+
+func (ex *Exchange) handleGetAPIKeys(c echo.Context) error {
+	return c.JSON(http.StatusOK, ex.APIKeys.UserKeys(authUserID(c)))
+}
+
+// handleRevokeAPIKey revokes a key of the logged in user.
+func (ex *Exchange) handleRevokeAPIKey(c echo.Context) error {
+	key := c.Param("key")
+
+	owned := false
+	for _, k := range ex.APIKeys.UserKeys(authUserID(c)) {
+		owned = owned || k.Key == key
+	}
+	if !owned {
+		return newError(http.StatusNotFound, ErrAPIKeyNotFound)
+	}
+
+	return ex.revokeAPIKey(c, key)
+}
+
+func (ex *Exchange) handleAdminCreateAPIKey(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	return ex.createAPIKey(c, int64(userID), false)
+}
+
+func (ex *Exchange) handleAdminGetAPIKeys(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	return c.JSON(http.StatusOK, ex.APIKeys.UserKeys(int64(userID)))
+}
+
+func (ex *Exchange) handleAdminRevokeAPIKey(c echo.Context) error {
+	return ex.revokeAPIKey(c, c.Param("key"))
+}
+
+func (ex *Exchange) createAPIKey(c echo.Context, userID int64, secondFactor bool) error {
+	ex.mu.RLock()
+	_, ok := ex.Users[userID]
+	ex.mu.RUnlock()
+	if !ok {
+		return newErrorf(http.StatusNotFound, "%w: %d", ErrUserNotFound, userID)
+	}
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	if secondFactor {
+		if err := ex.verifySecondFactor(userID, req.TOTPCode); err != nil {
+			return newError(http.StatusUnauthorized, err)
+		}
+	}
+
+	if err := validateScopes(req.Scopes); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	apiKey, err := ex.APIKeys.Create(userID, req.Scopes)
+	if err != nil {
+		return err
+	}
+
+	ex.recordAudit(c, audit.APIKeyCreated, userID, map[string]any{
+		"key":    apiKey.Key,
+		"scopes": apiKey.Scopes,
+	})
+
+	logrus.WithFields(logrus.Fields{
+		"userID": userID,
+		"key":    apiKey.Key,
+		"scopes": apiKey.Scopes,
+	}).Info("api key created")
+
+	return c.JSON(http.StatusOK, apiKey)
+}
+
+func (ex *Exchange) revokeAPIKey(c echo.Context, key string) error {
+	userID, err := ex.APIKeys.Revoke(key)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return newError(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return err
+	}
+	ex.recordAudit(c, audit.APIKeyRevoked, userID, map[string]any{"key": key})
+
+	logrus.WithField("key", key).Info("api key revoked")
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "api key revoked"})
+}
+
+// MongoAPIKeyBackend keeps the API keys in the apikeys collection with their
+// secrets encrypted under the key, the db has to be initialized with
+// db.InitializeMongo first.
+type MongoAPIKeyBackend struct {
+	key []byte
+}
+
+func NewMongoAPIKeyBackend(key []byte) (*MongoAPIKeyBackend, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("api key encryption key must be 32 bytes, got %d", len(key))
+	}
+	return &MongoAPIKeyBackend{key: key}, nil
+}
+
+func (b *MongoAPIKeyBackend) SaveAPIKey(apiKey APIKey) error {
+	secret, err := db.EncryptSecret(b.key, apiKey.Secret)
+	if err != nil {
+		return err
+	}
+
+	record := db.APIKey{
+		Key:       apiKey.Key,
+		Secret:    secret,
+		UserID:    apiKey.UserID,
+		CreatedAt: apiKey.CreatedAt,
+	}
+	for _, scope := range apiKey.Scopes {
+		record.Scopes = append(record.Scopes, string(scope))
+	}
+	return record.InsertAPIKey()
+}
+
+func (b *MongoAPIKeyBackend) DeleteAPIKey(key string) error {
+	return db.DeleteAPIKey(key)
+}
+
+func (b *MongoAPIKeyBackend) GetAPIKeys() ([]APIKey, error) {
+	records, err := db.GetAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]APIKey, len(records))
+	for i, record := range records {
+		secret, err := db.DecryptSecret(b.key, record.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("api key %s: %w", record.Key, err)
+		}
+
+		keys[i] = APIKey{
+			Key:       record.Key,
+			Secret:    secret,
+			UserID:    record.UserID,
+			CreatedAt: record.CreatedAt,
+		}
+		for _, scope := range record.Scopes {
+			keys[i].Scopes = append(keys[i].Scopes, Scope(scope))
+		}
+	}
+	return keys, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
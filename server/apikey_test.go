@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+func signedTestRequest(key APIKey, method, path string, timestamp int64, nonce string) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set(APIKeyHeader, key.Key)
+	req.Header.Set(APITimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(APINonceHeader, nonce)
+	req.Header.Set(APISignatureHeader, SignRequest(key.Secret, timestamp, nonce, method, path, nil))
+	return req
+}
+
+func TestSignedRequests(t *testing.T) {
+	_, e := newTestExchange(t, 1)
+	key := testAPIKey(1)
+	now := time.Now().UnixMilli()
+
+	send := func(req *http.Request) int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert(t, send(signedTestRequest(key, http.MethodGet, "/balances/1", now, "a")), http.StatusOK)
+	// the same nonce can not be used twice
+	assert(t, send(signedTestRequest(key, http.MethodGet, "/balances/1", now, "a")), http.StatusUnauthorized)
+	// neither can an old request
+	assert(t, send(signedTestRequest(key, http.MethodGet, "/balances/1", now-time.Minute.Milliseconds(), "b")), http.StatusUnauthorized)
+
+	req := signedTestRequest(key, http.MethodGet, "/balances/1", now, "c")
+	req.Header.Set(APISignatureHeader, SignRequest("wrong", now, "c", http.MethodGet, "/balances/1", nil))
+	assert(t, send(req), http.StatusUnauthorized)
+
+	// the signature covers the path
+	req = signedTestRequest(key, http.MethodGet, "/balances/1", now, "d")
+	req.URL.Path = "/ledger/1"
+	req.RequestURI = "/ledger/1"
+	assert(t, send(req), http.StatusUnauthorized)
+
+	assert(t, send(httptest.NewRequest(http.MethodGet, "/balances/1", nil)), http.StatusUnauthorized)
+
+	// a key only reads the data of its own user
+	assert(t, send(signedTestRequest(key, http.MethodGet, "/balances/2", now, "e")), http.StatusForbidden)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	ex, e := newTestExchange(t, 1)
+	ex.SetAdminToken(testAdminToken)
+
+	rec := doAdminRequest(e, http.MethodPost, "/admin/users/1/apikeys", CreateAPIKeyRequest{Scopes: []Scope{ScopeRead}})
+	assert(t, rec.Code, http.StatusOK)
+	key := APIKey{}
+	assert(t, json.NewDecoder(rec.Body).Decode(&key), nil)
+	assert(t, key.UserID, int64(1))
+	assert(t, len(key.Secret), 64)
+
+	now := time.Now().UnixMilli()
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, signedTestRequest(key, http.MethodGet, "/order/1", now, "a"))
+	assert(t, rec.Code, http.StatusOK)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, signedTestRequest(key, http.MethodDelete, "/order/1", now, "b"))
+	assert(t, rec.Code, http.StatusForbidden)
+
+	// the secret is not handed out again
+	rec = doAdminRequest(e, http.MethodGet, "/admin/users/1/apikeys", nil)
+	keys := []APIKey{}
+	assert(t, json.NewDecoder(rec.Body).Decode(&keys), nil)
+	assert(t, len(keys), 2)
+	assert(t, keys[1].Secret, "")
+
+	rec = doAdminRequest(e, http.MethodDelete, "/admin/apikeys/"+key.Key, nil)
+	assert(t, rec.Code, http.StatusOK)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, signedTestRequest(key, http.MethodGet, "/order/1", now, "c"))
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	rec = doAdminRequest(e, http.MethodPost, "/admin/users/1/apikeys", CreateAPIKeyRequest{Scopes: []Scope{"admin"}})
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doAdminRequest(e, http.MethodPost, "/admin/users/9/apikeys", CreateAPIKeyRequest{Scopes: []Scope{ScopeRead}})
+	assert(t, rec.Code, http.StatusNotFound)
+}
+
+func TestUserFromAPIKey(t *testing.T) {
+	ex, e := newTestExchange(t, 1, 2)
+
+	orderID := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1, Price: 1_000, Market: token.MarketETHUSDT})
+
+	// the body claims user 1, the key belongs to user 2
+	rec := doUserRequest(e, 2, http.MethodPost, "/order", PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1, Price: 1_000, Market: token.MarketETHUSDT})
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, len(ex.Orders.UserOrders(1)), 1)
+	assert(t, len(ex.Orders.UserOrders(2)), 1)
+
+	// nobody cancels or reads the orders of another user
+	rec = doUserRequest(e, 2, http.MethodDelete, fmt.Sprintf("/order/%d", orderID), nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	rec = doUserRequest(e, 2, http.MethodGet, fmt.Sprintf("/order/id/%d", orderID), nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	assert(t, len(ex.Orders.UserOrders(1)), 1)
+}
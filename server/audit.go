@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/anakinrm/crypto-exchange/config"
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// adminKey marks requests authenticated with the admin token in the echo
+// context.
+const adminKey = "admin"
+
+// auditActor names who made the request.
+func auditActor(c echo.Context) string {
+	if admin, _ := c.Get(adminKey).(bool); admin {
+		return audit.ActorAdmin
+	}
+	return userActor(authUserID(c))
+}
+
+func userActor(userID int64) string {
+	if userID == 0 {
+		return audit.ActorAnonymous
+	}
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// recordAudit records the action the request took on the user. The details
+// are formatted with %v.
+func (ex *Exchange) recordAudit(c echo.Context, action audit.Action, userID int64, details map[string]any) {
+	ex.writeAudit(audit.Entry{
+		Actor:     auditActor(c),
+		Action:    action,
+		UserID:    userID,
+		RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+	}, details)
+}
+
+// writeAudit records the entry with the details. The action it records
+// already happened, so a failing audit log is logged rather than failing it.
+func (ex *Exchange) writeAudit(entry audit.Entry, details map[string]any) {
+	entry.Details = make(map[string]string, len(details))
+	for k, v := range details {
+		entry.Details[k] = fmt.Sprintf("%v", v)
+	}
+
+	if _, err := ex.Audit.Record(entry); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"action": entry.Action,
+			"userID": entry.UserID,
+		}).Error("failed to write audit log")
+	}
+}
+
+// openAuditStore opens the store of the configured audit backend, nil for
+// the memory backend. The db backend needs the MongoDB to be initialized.
+func openAuditStore(cfg config.Audit) (audit.Store, error) {
+	switch cfg.Backend {
+	case config.AuditFile:
+		return audit.NewFileStore(cfg.Path)
+	case config.AuditDB:
+		return audit.NewMongoStore(), nil
+	}
+	return nil, nil
+}
+
+// VerifyAuditLog checks the chain of the configured audit log and returns
+// the number of its entries.
+func VerifyAuditLog(cfg *config.Config) (int, error) {
+	var (
+		entries []audit.Entry
+		err     error
+	)
+	switch cfg.Audit.Backend {
+	case config.AuditFile:
+		entries, err = audit.ReadFile(cfg.Audit.Path)
+	case config.AuditDB:
+		db.Database = cfg.Mongo.Database
+		db.InitializeMongo(cfg.Mongo.URI.Value())
+		entries, err = audit.NewMongoStore().Load()
+	default:
+		return 0, fmt.Errorf("the %s audit backend keeps no log to verify", cfg.Audit.Backend)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(entries), audit.Verify(entries)
+}
+
+func (ex *Exchange) handleGetAudit(c echo.Context) error {
+	var (
+		filter = audit.Filter{
+			Action: audit.Action(c.QueryParam("action")),
+			Actor:  c.QueryParam("actor"),
+		}
+		err error
+	)
+	if s := c.QueryParam("userID"); s != "" {
+		if filter.UserID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return newError(http.StatusBadRequest, err)
+		}
+	}
+	if s := c.QueryParam("after"); s != "" {
+		if filter.AfterID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return newError(http.StatusBadRequest, err)
+		}
+	}
+	if s := c.QueryParam("limit"); s != "" {
+		if filter.Limit, err = strconv.Atoi(s); err != nil || filter.Limit < 0 {
+			return newErrorf(http.StatusBadRequest, "invalid limit: %s", s)
+		}
+	}
+
+	return c.JSON(http.StatusOK, ex.Audit.Search(filter))
+}
+
+type VerifyAuditResponse struct {
+	Entries int
+	Valid   bool
+	// Error tells where the chain breaks
+	Error string `json:",omitempty"`
+}
+
+func (ex *Exchange) handleVerifyAudit(c echo.Context) error {
+	n, err := ex.Audit.Verify()
+	if err != nil && !errors.Is(err, audit.ErrBrokenChain) {
+		return err
+	}
+
+	resp := VerifyAuditResponse{Entries: n, Valid: err == nil}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,249 @@
+// Package audit keeps the append-only audit log of the exchange. Every entry
+// carries the hash of the entry before it, so changing, dropping or
+// reordering an entry breaks the chain from there on.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Action is the kind of action an entry records.
+type Action string
+
+const (
+	Login              Action = "LOGIN"
+	LoginFailed        Action = "LOGIN_FAILED"
+	APIKeyCreated      Action = "API_KEY_CREATED"
+	APIKeyRevoked      Action = "API_KEY_REVOKED"
+	OrderPlaced        Action = "ORDER_PLACED"
+	OrderCancelled     Action = "ORDER_CANCELLED"
+	OrdersCancelled    Action = "ORDERS_CANCELLED"
+	UserFrozen         Action = "USER_FROZEN"
+	UserUnfrozen       Action = "USER_UNFROZEN"
+	BalanceAdjusted    Action = "BALANCE_ADJUSTED"
+	MarketListed       Action = "MARKET_LISTED"
+	MarketStateChanged Action = "MARKET_STATE_CHANGED"
+	MarketDelisted     Action = "MARKET_DELISTED"
+	FeeScheduleChanged Action = "FEE_SCHEDULE_CHANGED"
+	FeeOverrideSet     Action = "FEE_OVERRIDE_SET"
+	FeeOverrideRemoved Action = "FEE_OVERRIDE_REMOVED"
+
+	WithdrawalRequested      Action = "WITHDRAWAL_REQUESTED"
+	WithdrawalApproved       Action = "WITHDRAWAL_APPROVED"
+	WithdrawalRejected       Action = "WITHDRAWAL_REJECTED"
+	WithdrawalCancelled      Action = "WITHDRAWAL_CANCELLED"
+	WithdrawalBroadcast      Action = "WITHDRAWAL_BROADCAST"
+	WithdrawalConfirmed      Action = "WITHDRAWAL_CONFIRMED"
+	WithdrawalFailed         Action = "WITHDRAWAL_FAILED"
+	WithdrawalAddressAdded   Action = "WITHDRAWAL_ADDRESS_ADDED"
+	WithdrawalAddressRemoved Action = "WITHDRAWAL_ADDRESS_REMOVED"
+	DepositCredited          Action = "DEPOSIT_CREDITED"
+	ReservesPublished        Action = "RESERVES_PUBLISHED"
+)
+
+const (
+	// ActorAdmin is the actor of the requests made with the admin token.
+	ActorAdmin = "admin"
+	// ActorSystem is the actor of what the exchange does on its own, like
+	// the dead man's switch cancelling orders.
+	ActorSystem = "system"
+	// ActorAnonymous is the actor of the requests of no known user, like a
+	// login with an unknown user name.
+	ActorAnonymous = "anonymous"
+)
+
+var ErrBrokenChain = errors.New("audit chain is broken")
+
+// Entry records who did what on the exchange.
+type Entry struct {
+	ID        int64
+	Timestamp int64
+	// Actor is ActorAdmin, ActorSystem, ActorAnonymous or user:<ID>
+	Actor  string
+	Action Action
+	// UserID is the user the action was taken on, 0 when there is none
+	UserID    int64
+	Details   map[string]string
+	RequestID string
+	// PrevHash is the Hash of the entry before, empty for the first one
+	PrevHash string
+	// Hash covers every other field of the entry
+	Hash string
+}
+
+// ComputeHash returns the hex SHA-256 of the entry without its Hash. The
+// fields are hashed as JSON, which writes the details sorted by key.
+func (e *Entry) ComputeHash() string {
+	b, _ := json.Marshal(struct {
+		ID        int64
+		Timestamp int64
+		Actor     string
+		Action    Action
+		UserID    int64
+		Details   map[string]string
+		RequestID string
+		PrevHash  string
+	}{e.ID, e.Timestamp, e.Actor, e.Action, e.UserID, e.Details, e.RequestID, e.PrevHash})
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify checks that the entries are numbered from 1 without gaps, that
+// every entry links to the one before and that no entry changed since it was
+// hashed. It reports the first entry breaking the chain.
+func Verify(entries []Entry) error {
+	prevHash := ""
+	for i, e := range entries {
+		if e.ID != int64(i)+1 {
+			return fmt.Errorf("%w: entry %d found at position %d", ErrBrokenChain, e.ID, i+1)
+		}
+		if e.PrevHash != prevHash {
+			return fmt.Errorf("%w: entry %d does not link to entry %d", ErrBrokenChain, e.ID, e.ID-1)
+		}
+		if e.Hash != e.ComputeHash() {
+			return fmt.Errorf("%w: entry %d was modified", ErrBrokenChain, e.ID)
+		}
+		prevHash = e.Hash
+	}
+	return nil
+}
+
+// Store persists the log. Entries are appended in the order they were
+// recorded and loaded back in the same order.
+type Store interface {
+	Append(Entry) error
+	Load() ([]Entry, error)
+}
+
+// Filter selects entries of the log, its zero value selects all of them.
+type Filter struct {
+	UserID int64
+	Action Action
+	Actor  string
+	// AfterID skips the entries up to and including this ID
+	AfterID int64
+	// Limit caps the number of entries returned
+	Limit int
+}
+
+func (f Filter) match(e Entry) bool {
+	return e.ID > f.AfterID &&
+		(f.UserID == 0 || e.UserID == f.UserID) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Actor == "" || e.Actor == f.Actor)
+}
+
+// Log is the audit log. It keeps every entry in memory to search them and
+// writes them through to its store.
+type Log struct {
+	mu      sync.RWMutex
+	store   Store
+	entries []Entry
+}
+
+// NewLog creates a log that only lives in memory.
+func NewLog() *Log {
+	return &Log{}
+}
+
+// Open loads the log kept in the store. It fails when the chain of the
+// stored entries is broken, new entries would only extend a chain nobody
+// can trust.
+func Open(store Store) (*Log, error) {
+	entries, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if err := Verify(entries); err != nil {
+		return nil, err
+	}
+
+	return &Log{store: store, entries: entries}, nil
+}
+
+// Record chains the entry to the log and appends it. The entry is assigned
+// the next ID and, unless it has one, the current time. Nothing is recorded
+// when the store fails.
+func (l *Log) Record(entry Entry) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.ID = int64(len(l.entries)) + 1
+	if entry.Timestamp == 0 {
+		entry.Timestamp = time.Now().UnixNano()
+	}
+	if len(entry.Details) == 0 {
+		entry.Details = nil
+	}
+	entry.PrevHash = ""
+	if len(l.entries) > 0 {
+		entry.PrevHash = l.entries[len(l.entries)-1].Hash
+	}
+	entry.Hash = entry.ComputeHash()
+
+	if l.store != nil {
+		if err := l.store.Append(entry); err != nil {
+			return Entry{}, err
+		}
+	}
+	l.entries = append(l.entries, entry)
+
+	return entry, nil
+}
+
+// Entries returns every entry, oldest first.
+func (l *Log) Entries() []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return append([]Entry{}, l.entries...)
+}
+
+// Search returns the entries matching the filter, oldest first.
+func (l *Log) Search(f Filter) []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	entries := []Entry{}
+	for _, e := range l.entries {
+		if f.Limit > 0 && len(entries) == f.Limit {
+			break
+		}
+		if f.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Verify checks the chain of the log as it is stored, which is where it
+// could have been tampered with, and returns the number of entries checked.
+// The chain can not tell that its last entries were dropped, so the stored
+// log also has to reach the last entry recorded. A log without a store
+// checks the entries in memory.
+func (l *Log) Verify() (int, error) {
+	recorded := l.Entries()
+	if l.store == nil {
+		return len(recorded), Verify(recorded)
+	}
+
+	stored, err := l.store.Load()
+	if err != nil {
+		return 0, err
+	}
+	if err := Verify(stored); err != nil {
+		return len(stored), err
+	}
+	if n := len(recorded); n > 0 && (len(stored) < n || stored[n-1].Hash != recorded[n-1].Hash) {
+		return len(stored), fmt.Errorf("%w: entry %d is missing from the store", ErrBrokenChain, n)
+	}
+
+	return len(stored), nil
+}
@@ -0,0 +1,155 @@
+package audit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+type memoryStore struct {
+	entries []Entry
+	fail    bool
+}
+
+func (s *memoryStore) Append(entry Entry) error {
+	if s.fail {
+		return errors.New("store down")
+	}
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *memoryStore) Load() ([]Entry, error) {
+	return append([]Entry{}, s.entries...), nil
+}
+
+func recordTestEntries(t *testing.T, l *Log) {
+	for _, e := range []Entry{
+		{Actor: "user:1", Action: Login, UserID: 1},
+		{Actor: "user:1", Action: OrderPlaced, UserID: 1, Details: map[string]string{"order": "7", "market": "ETH-USDT"}},
+		{Actor: ActorAdmin, Action: BalanceAdjusted, UserID: 2, Details: map[string]string{"amount": "5", "reason": "missed deposit"}},
+		{Actor: "user:1", Action: OrderCancelled, UserID: 1, Details: map[string]string{"order": "7"}},
+	} {
+		if _, err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHashChain(t *testing.T) {
+	l := NewLog()
+	recordTestEntries(t, l)
+
+	entries := l.Entries()
+	assert(t, len(entries), 4)
+	assert(t, entries[0].ID, int64(1))
+	assert(t, entries[0].PrevHash, "")
+	assert(t, entries[1].PrevHash, entries[0].Hash)
+	assert(t, entries[3].PrevHash, entries[2].Hash)
+	assert(t, Verify(entries), nil)
+
+	tampered := l.Entries()
+	tampered[2].Details = map[string]string{"amount": "500", "reason": "missed deposit"}
+	err := Verify(tampered)
+	assert(t, errors.Is(err, ErrBrokenChain), true)
+	assert(t, strings.Contains(err.Error(), "entry 3 was modified"), true)
+
+	// rehashing the changed entry breaks the link of the next one
+	tampered[2].Hash = tampered[2].ComputeHash()
+	err = Verify(tampered)
+	assert(t, strings.Contains(err.Error(), "entry 4 does not link"), true)
+
+	dropped := append(l.Entries()[:1], l.Entries()[2:]...)
+	assert(t, errors.Is(Verify(dropped), ErrBrokenChain), true)
+}
+
+func TestSearch(t *testing.T) {
+	l := NewLog()
+	recordTestEntries(t, l)
+
+	assert(t, len(l.Search(Filter{})), 4)
+	assert(t, len(l.Search(Filter{UserID: 1})), 3)
+	assert(t, l.Search(Filter{Action: OrderPlaced})[0].ID, int64(2))
+	assert(t, l.Search(Filter{Actor: ActorAdmin})[0].UserID, int64(2))
+	assert(t, len(l.Search(Filter{UserID: 1, Action: Login})), 1)
+
+	page := l.Search(Filter{UserID: 1, Limit: 2})
+	assert(t, len(page), 2)
+	page = l.Search(Filter{UserID: 1, AfterID: page[1].ID, Limit: 2})
+	assert(t, len(page), 1)
+	assert(t, page[0].Action, OrderCancelled)
+}
+
+func TestRecordStoreFailure(t *testing.T) {
+	store := &memoryStore{}
+	l, err := Open(store)
+	assert(t, err, nil)
+	recordTestEntries(t, l)
+
+	store.fail = true
+	_, err = l.Record(Entry{Actor: "user:1", Action: Login, UserID: 1})
+	assert(t, err != nil, true)
+	assert(t, len(l.Entries()), 4)
+
+	store.fail = false
+	entry, err := l.Record(Entry{Actor: "user:1", Action: Login, UserID: 1})
+	assert(t, err, nil)
+	assert(t, entry.ID, int64(5))
+
+	n, err := l.Verify()
+	assert(t, n, 5)
+	assert(t, err, nil)
+
+	// the chain of what is left is fine, but it misses the last entry
+	store.entries = store.entries[:4]
+	_, err = l.Verify()
+	assert(t, errors.Is(err, ErrBrokenChain), true)
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	store, err := NewFileStore(path)
+	assert(t, err, nil)
+	l, err := Open(store)
+	assert(t, err, nil)
+	recordTestEntries(t, l)
+	assert(t, store.Close(), nil)
+
+	// the log continues the chain when it is opened again
+	store, err = NewFileStore(path)
+	assert(t, err, nil)
+	l, err = Open(store)
+	assert(t, err, nil)
+	assert(t, len(l.Entries()), 4)
+	entry, err := l.Record(Entry{Actor: ActorSystem, Action: OrdersCancelled, UserID: 1})
+	assert(t, err, nil)
+	assert(t, entry.PrevHash, l.Entries()[3].Hash)
+	assert(t, store.Close(), nil)
+
+	entries, err := ReadFile(path)
+	assert(t, err, nil)
+	assert(t, entries, l.Entries())
+	assert(t, Verify(entries), nil)
+
+	// a log edited on disk refuses to open
+	b, err := os.ReadFile(path)
+	assert(t, err, nil)
+	b = []byte(strings.Replace(string(b), `"amount":"5"`, `"amount":"50"`, 1))
+	assert(t, os.WriteFile(path, b, 0o600), nil)
+
+	store, err = NewFileStore(path)
+	assert(t, err, nil)
+	defer store.Close()
+	_, err = Open(store)
+	assert(t, errors.Is(err, ErrBrokenChain), true)
+}
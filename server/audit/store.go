@@ -0,0 +1,129 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/anakinrm/crypto-exchange/server/db"
+)
+
+// FileStore keeps the log in a file, one JSON entry per line. The file is
+// only ever appended to and synced after every entry.
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{path: path, file: file}, nil
+}
+
+func (s *FileStore) Append(entry Entry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileStore) Load() ([]Entry, error) {
+	return ReadFile(s.path)
+}
+
+func (s *FileStore) Close() error {
+	return s.file.Close()
+}
+
+// ReadFile reads the entries of a log file written by a FileStore, a missing
+// file is an empty log.
+func ReadFile(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		entries []Entry
+		scanner = bufio.NewScanner(file)
+	)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// MongoStore keeps the log in the audit collection, the db has to be
+// initialized with db.InitializeMongo first.
+type MongoStore struct{}
+
+func NewMongoStore() *MongoStore {
+	return &MongoStore{}
+}
+
+func (s *MongoStore) Append(entry Entry) error {
+	entryDB := db.AuditEntry{
+		ID:        entry.ID,
+		Timestamp: entry.Timestamp,
+		Actor:     entry.Actor,
+		Action:    string(entry.Action),
+		UserID:    entry.UserID,
+		Details:   entry.Details,
+		RequestID: entry.RequestID,
+		PrevHash:  entry.PrevHash,
+		Hash:      entry.Hash,
+	}
+
+	return entryDB.InsertAuditEntry()
+}
+
+func (s *MongoStore) Load() ([]Entry, error) {
+	entriesDB, err := db.GetAuditEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, len(entriesDB))
+	for i, e := range entriesDB {
+		entries[i] = Entry{
+			ID:        e.ID,
+			Timestamp: e.Timestamp,
+			Actor:     e.Actor,
+			Action:    Action(e.Action),
+			UserID:    e.UserID,
+			Details:   e.Details,
+			RequestID: e.RequestID,
+			PrevHash:  e.PrevHash,
+			Hash:      e.Hash,
+		}
+	}
+
+	return entries, nil
+}
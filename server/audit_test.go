@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/config"
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+func TestAuditLog(t *testing.T) {
+	ex, e := newTestExchange(t)
+	ex.SetAdminToken(testAdminToken)
+
+	user := registerTestUser(t, e, "anakin")
+	ex.Ledger.Deposit(user.ID, token.AssetUSDT, 10_000, "test")
+	rec := doRequest(e, http.MethodPost, "/v1/sessions", LoginRequest{UserName: "anakin", Password: "wrong password"})
+	assert(t, rec.Code, http.StatusUnauthorized)
+	sess := loginTestUser(t, e, "anakin")
+	ex.APIKeys.add(testAPIKey(user.ID))
+
+	rec = doSessionRequest(e, sess.Token, http.MethodPost, "/v1/apikeys", CreateAPIKeyRequest{Scopes: []Scope{ScopeRead}})
+	assert(t, rec.Code, http.StatusOK)
+	id := placeTestOrder(t, ex, PlaceOrderRequest{UserID: user.ID, Type: LimitOrder, Bid: true, Size: 1, Price: 1_000, Market: token.MarketETHUSDT})
+	rec = doUserRequest(e, user.ID, http.MethodDelete, "/v1/orders/"+strconv.FormatInt(id, 10), nil)
+	assert(t, rec.Code, http.StatusOK)
+
+	rec = doAdminRequest(e, http.MethodGet, "/v1/admin/audit?userID="+strconv.FormatInt(user.ID, 10), nil)
+	assert(t, rec.Code, http.StatusOK)
+	entries := decodeTestResponse[[]audit.Entry](t, rec)
+	actions := []audit.Action{}
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+		assert(t, entry.Actor, userActor(user.ID))
+	}
+	assert(t, actions, []audit.Action{audit.LoginFailed, audit.Login, audit.APIKeyCreated, audit.OrderPlaced, audit.OrderCancelled})
+	assert(t, entries[3].Details["order"], strconv.FormatInt(id, 10))
+	assert(t, entries[3].Details["price"], "1000")
+
+	rec = doAdminRequest(e, http.MethodGet, "/v1/admin/audit?action=LOGIN&limit=1", nil)
+	entries = decodeTestResponse[[]audit.Entry](t, rec)
+	assert(t, len(entries), 1)
+	assert(t, entries[0].Details["userName"], "anakin")
+
+	doRequest(e, http.MethodPost, "/v1/sessions", LoginRequest{UserName: "vader", Password: "correct horse"})
+	rec = doAdminRequest(e, http.MethodGet, "/v1/admin/audit?actor=anonymous", nil)
+	entries = decodeTestResponse[[]audit.Entry](t, rec)
+	assert(t, len(entries), 1)
+	assert(t, entries[0].Details["userName"], "vader")
+
+	rec = doAdminRequest(e, http.MethodGet, "/v1/admin/audit?limit=many", nil)
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	rec = doAdminRequest(e, http.MethodGet, "/v1/admin/audit/verify", nil)
+	assert(t, decodeTestResponse[VerifyAuditResponse](t, rec), VerifyAuditResponse{Entries: 6, Valid: true})
+}
+
+func TestDeadMansSwitchIsAudited(t *testing.T) {
+	ex := newFundedExchange(t, 0, 10_000, 1)
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 1, Price: 1_000, Market: token.MarketETHUSDT})
+
+	ex.deadman.onExpire(1)
+
+	entries := ex.Audit.Search(audit.Filter{Actor: audit.ActorSystem})
+	assert(t, len(entries), 1)
+	assert(t, entries[0].Action, audit.OrdersCancelled)
+	assert(t, entries[0].Details["cancelled"], "1")
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	ex, e := newTestExchange(t)
+	ex.SetAdminToken(testAdminToken)
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	store, err := openAuditStore(config.Audit{Backend: config.AuditFile, Path: path})
+	assert(t, err, nil)
+	if ex.Audit, err = audit.Open(store); err != nil {
+		t.Fatal(err)
+	}
+	doAdminRequest(e, http.MethodPut, "/v1/admin/markets/ETH-USDT", SetMarketStateRequest{State: MarketCancelOnly})
+	doAdminRequest(e, http.MethodPut, "/v1/admin/markets/ETH-USDT", SetMarketStateRequest{State: MarketActive})
+
+	cfg := config.Default()
+	cfg.Audit = config.Audit{Backend: config.AuditFile, Path: path}
+	n, err := VerifyAuditLog(cfg)
+	assert(t, n, 2)
+	assert(t, err, nil)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// Balance of a single asset, Held is reserved for the open orders.
+type Balance struct {
+	Available float64
+	Held      float64
+	Total     float64
+}
+
+type GetBalancesResponse struct {
+	UserID   int64
+	Balances map[token.Asset]Balance
+}
+
+func (ex *Exchange) balances(userID int64) map[token.Asset]Balance {
+	balances := make(map[token.Asset]Balance)
+
+	for _, asset := range token.Assets() {
+		available := ex.Ledger.Balance(ledger.UserAccount(userID, asset))
+		held := ex.Ledger.Balance(ledger.HeldAccount(userID, asset))
+
+		balances[asset] = Balance{
+			Available: available,
+			Held:      held,
+			Total:     available + held,
+		}
+	}
+
+	return balances
+}
+
+func (ex *Exchange) handleGetBalances(c echo.Context) error {
+	userIDstr := c.Param("userID")
+	userID, err := strconv.Atoi(userIDstr)
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	return c.JSON(http.StatusOK, GetBalancesResponse{
+		UserID:   int64(userID),
+		Balances: ex.balances(int64(userID)),
+	})
+}
+
+// holdRef references the order a hold was made for.
+func holdRef(market token.Market, orderID int64) string {
+	return fmt.Sprintf("%s:%d", market, orderID)
+}
+
+// releaseHold gives held funds back. Amounts within float dust of zero are
+// skipped, there is nothing meaningful left to release.
+func (ex *Exchange) releaseHold(userID int64, asset token.Asset, amount float64, ref string) {
+	if amount <= 1e-9 {
+		return
+	}
+
+	// the float error of the fills can leave a hair less held than computed
+	if held := ex.Ledger.Balance(ledger.HeldAccount(userID, asset)); amount > held {
+		amount = held
+	}
+	if amount <= 0 {
+		return
+	}
+
+	if _, err := ex.Ledger.Release(userID, asset, amount, ref); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"userID": userID,
+			"asset":  asset,
+			"amount": amount,
+		}).Error("failed to release hold")
+	}
+}
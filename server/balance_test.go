@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+func newFundedExchange(t *testing.T, eth, usdt float64, userIDs ...int64) *Exchange {
+	ex, _ := newTestExchange(t)
+	for _, id := range userIDs {
+		ex.Users[id] = &User{ID: id}
+		ex.APIKeys.add(testAPIKey(id))
+		if eth > 0 {
+			ex.Ledger.Deposit(id, token.AssetETH, eth, "test")
+		}
+		if usdt > 0 {
+			ex.Ledger.Deposit(id, token.AssetUSDT, usdt, "test")
+		}
+	}
+	return ex
+}
+
+func getTestBalances(t *testing.T, ex *Exchange, userID int64) map[token.Asset]Balance {
+	rec := doUserRequest(newRouter(ex), userID, http.MethodGet, fmt.Sprintf("/balances/%d", userID), nil)
+	resp := GetBalancesResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Balances
+}
+
+func TestLimitOrderHolds(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1)
+
+	bidID := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 5, Price: 1_000, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 4, Price: 1_100, Market: token.MarketETHUSDT})
+
+	balances := getTestBalances(t, ex, 1)
+	assert(t, balances[token.AssetUSDT], Balance{Available: 5_000, Held: 5_000, Total: 10_000})
+	assert(t, balances[token.AssetETH], Balance{Available: 6, Held: 4, Total: 10})
+
+	doUserRequest(newRouter(ex), 1, http.MethodDelete, fmt.Sprintf("/order/%d", bidID), nil)
+	balances = getTestBalances(t, ex, 1)
+	assert(t, balances[token.AssetUSDT], Balance{Available: 10_000, Held: 0, Total: 10_000})
+	assert(t, ex.Ledger.Check(), nil)
+}
+
+func TestInsufficientBalanceRejected(t *testing.T) {
+	ex := newFundedExchange(t, 0, 1_000, 1)
+
+	rec := doUserRequest(newRouter(ex), 1, http.MethodPost, "/order", PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1_000, Price: 1_000, Market: token.MarketETHUSDT})
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	rec = doUserRequest(newRouter(ex), 1, http.MethodPost, "/order", PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 2, Price: 1_000, Market: token.MarketETHUSDT})
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	snapshot := bookSnapshot(ex, token.MarketETHUSDT)
+	assert(t, snapshot.AskTotalVolume, 0.0)
+	assert(t, snapshot.BidTotalVolume, 0.0)
+
+	orders, _ := ex.orderStore.GetUserOrders(1)
+	assert(t, len(orders), 2)
+	assert(t, orders[0].Status, orderbook.StatusRejected)
+	assert(t, orders[1].Price, 1_000.0)
+}
+
+func TestFillsConsumeHolds(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1, 2)
+
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 4, Price: 1_000, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 1_500, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Bid: true, Size: 3, Price: 900, Market: token.MarketETHUSDT})
+
+	// walks both ask limits, 4 * 1000 + 1 * 1500
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 5, Market: token.MarketETHUSDT})
+
+	balances := getTestBalances(t, ex, 2)
+	assert(t, balances[token.AssetUSDT], Balance{Available: 10_000 - 5_500 - 2_700, Held: 2_700, Total: 10_000 - 5_500})
+	assert(t, balances[token.AssetETH], Balance{Available: 15, Held: 0, Total: 15})
+
+	// fills the resting bid of user 2 with the held quote
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: MarketOrder, Size: 3, Market: token.MarketETHUSDT})
+
+	balances = getTestBalances(t, ex, 2)
+	assert(t, balances[token.AssetUSDT], Balance{Available: 1_800, Held: 0, Total: 1_800})
+	assert(t, balances[token.AssetETH].Total, 18.0)
+
+	balances = getTestBalances(t, ex, 1)
+	assert(t, balances[token.AssetETH], Balance{Available: 1, Held: 1, Total: 2})
+	assert(t, balances[token.AssetUSDT].Total, 10_000+5_500+2_700.0)
+	assert(t, ex.Ledger.Check(), nil)
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxBatchSize is the most orders a batch places or cancels.
+const MaxBatchSize = 20
+
+var (
+	ErrInvalidBatch = errors.New("invalid batch")
+	// ErrBatchAborted fails the items of an all-or-nothing batch another
+	// item of which failed.
+	ErrBatchAborted = errors.New("batch aborted")
+)
+
+// BatchPlaceOrdersRequest places the orders in a single engine step of the
+// market, no other order gets in between them.
+type BatchPlaceOrdersRequest struct {
+	Market token.Market
+	// Orders of the batch, their market is empty or the one of the batch
+	Orders []PlaceOrderRequest
+	// AllOrNothing places none of the orders when one of them fails,
+	// otherwise each order is placed or fails on its own. The fills of a
+	// market order can not be undone, all-or-nothing batches only take
+	// limit orders.
+	AllOrNothing bool
+}
+
+// BatchCancelOrdersRequest cancels the orders in a single engine step of the
+// market.
+type BatchCancelOrdersRequest struct {
+	Market       token.Market
+	OrderIDs     []int64
+	AllOrNothing bool
+}
+
+// BatchOrderResult is the outcome of an item of a batch, in the order of the
+// request.
+type BatchOrderResult struct {
+	// OrderID is 0 for orders refused before they were created
+	OrderID int64
+	// Fills of a market order, with the fee paid on each
+	Fills []Fill `json:",omitempty"`
+	// Error is why the item failed, nil when it went through
+	Error *APIError `json:",omitempty"`
+}
+
+type BatchOrdersResponse struct {
+	Results []BatchOrderResult
+}
+
+// batchOrder is an order of a batch on its way through the engine step.
+type batchOrder struct {
+	req   PlaceOrderRequest
+	order *orderbook.Order
+	fills []Fill
+	err   error
+}
+
+// batchItemError is the error reported for a failed item, with the code its
+// own request would have failed with.
+func batchItemError(status int, err error) *APIError {
+	apiErr := toError(newError(status, err))
+	return &APIError{Code: apiErr.Code, Error: apiErr.Error()}
+}
+
+// checkBatchSize fails batches that are empty or larger than MaxBatchSize.
+func checkBatchSize(market token.Market, n int) error {
+	if market == "" {
+		return fmt.Errorf("%w: market is missing", ErrInvalidBatch)
+	}
+	if n == 0 || n > MaxBatchSize {
+		return fmt.Errorf("%w: %d items, between 1 and %d are allowed", ErrInvalidBatch, n, MaxBatchSize)
+	}
+	return nil
+}
+
+// abortBatch fails every item of an all-or-nothing batch that has not failed
+// on its own.
+func abortBatch(errs []error) {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = ErrBatchAborted
+		}
+	}
+}
+
+func (ex *Exchange) handlePlaceOrders(c echo.Context) error {
+	var req BatchPlaceOrdersRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	userID := authUserID(c)
+
+	if err := checkBatchSize(req.Market, len(req.Orders)); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	if ex.userFrozen(userID) {
+		return newErrorf(http.StatusForbidden, "%w: %d", ErrAccountFrozen, userID)
+	}
+
+	orders := make([]*batchOrder, len(req.Orders))
+	errs := make([]error, len(req.Orders))
+	for i, r := range req.Orders {
+		// orders are placed for the owner of the API key, whatever the body says
+		r.UserID = userID
+		if r.Market == "" {
+			r.Market = req.Market
+		}
+		if req.AllOrNothing && r.Type == MarketOrder {
+			return newErrorf(http.StatusBadRequest, "%w: all-or-nothing batches take no market orders", ErrInvalidBatch)
+		}
+
+		orders[i] = &batchOrder{req: r}
+		if r.Market != req.Market {
+			errs[i] = fmt.Errorf("%w: market %s in a batch of %s", ErrInvalidOrder, r.Market, req.Market)
+		} else {
+			errs[i] = ex.validateOrderRequest(&r)
+		}
+	}
+	if req.AllOrNothing && errors.Join(errs...) != nil {
+		abortBatch(errs)
+	}
+
+	for i, o := range orders {
+		if errs[i] != nil {
+			continue
+		}
+		o.order = orderbook.NewOrder(o.req.Bid, o.req.Size, userID)
+		o.order.ExpiresAt = o.req.ExpiresAt
+	}
+
+	tradeErr := ex.markets.Trade(req.Market, func(book *orderbook.Orderbook, pair token.Pair) {
+		if req.AllOrNothing {
+			ex.placeAllOrNothing(book, pair, req.Market, orders)
+			return
+		}
+		for _, o := range orders {
+			if o.order == nil {
+				continue
+			}
+			if o.req.Type == LimitOrder {
+				o.err = ex.placeLimitOrder(book, pair, req.Market, o.req.Price, o.order)
+			} else {
+				matches, fills, err := ex.placeMarketOrder(book, pair, req.Market, o.order)
+				o.err = err
+				if err != nil {
+					continue
+				}
+				// handleMatches settled every match as a taker and a maker fill
+				for i := range matches {
+					o.fills = append(o.fills, fills[2*i])
+				}
+			}
+		}
+	})
+	if tradeErr != nil {
+		return placeOrderError(tradeErr)
+	}
+
+	resp := BatchOrdersResponse{Results: make([]BatchOrderResult, len(orders))}
+	for i, o := range orders {
+		result := &resp.Results[i]
+		if o.order != nil {
+			result.OrderID = o.order.ID
+			errs[i] = o.err
+		}
+		if errs[i] != nil {
+			result.Error = batchItemError(http.StatusBadRequest, errs[i])
+			continue
+		}
+		result.Fills = o.fills
+
+		if o.req.Type == MarketOrder {
+			countOrderEvent(req.Market, MarketOrder, orderbook.EventPlaced)
+		}
+		ex.recordAudit(c, audit.OrderPlaced, userID, map[string]any{
+			"order":  o.order.ID,
+			"market": req.Market,
+			"type":   o.req.Type,
+			"bid":    o.req.Bid,
+			"size":   o.req.Size,
+			"price":  o.req.Price,
+		})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID":       userID,
+		"market":       req.Market,
+		"orders":       len(orders),
+		"allOrNothing": req.AllOrNothing,
+	}).Info("placed order batch")
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// placeAllOrNothing takes the holds of every limit order of the batch before
+// any of them enters the book. When one hold fails the holds taken are given
+// back and every order is rejected. Resting limit orders never match, so the
+// book only changes once all the orders are sure to go in.
+func (ex *Exchange) placeAllOrNothing(book *orderbook.Orderbook, pair token.Pair, market token.Market, orders []*batchOrder) {
+	if orders[0].order == nil {
+		// the batch was aborted before it reached the book
+		return
+	}
+
+	held := 0
+	for _, o := range orders {
+		asset, amount := limitOrderHold(pair, o.req.Price, o.order)
+		if _, o.err = ex.Ledger.Hold(o.order.UserID, asset, amount, holdRef(market, o.order.ID)); o.err != nil {
+			break
+		}
+		held++
+	}
+
+	if held < len(orders) {
+		for i, o := range orders {
+			if i < held {
+				asset, amount := limitOrderHold(pair, o.req.Price, o.order)
+				ex.releaseHold(o.order.UserID, asset, amount, holdRef(market, o.order.ID))
+			}
+			if o.err == nil {
+				o.err = ErrBatchAborted
+			}
+			book.RejectOrder(o.order, o.req.Price)
+		}
+		return
+	}
+
+	for _, o := range orders {
+		book.PlaceLimitOrder(o.req.Price, o.order)
+	}
+}
+
+func (ex *Exchange) handleCancelOrders(c echo.Context) error {
+	var req BatchCancelOrdersRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	userID := authUserID(c)
+
+	if err := checkBatchSize(req.Market, len(req.OrderIDs)); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	errs := make([]error, len(req.OrderIDs))
+	seen := make(map[int64]bool, len(req.OrderIDs))
+	for i, id := range req.OrderIDs {
+		if seen[id] {
+			return newErrorf(http.StatusBadRequest, "%w: order %d is in the batch twice", ErrInvalidBatch, id)
+		}
+		seen[id] = true
+
+		// orders of other users or markets look the same as missing ones
+		order, ok := ex.Orders.Get(id)
+		if !ok || order.UserID != userID || order.Market != req.Market {
+			errs[i] = fmt.Errorf("%w: %d", ErrOrderNotFound, id)
+		}
+	}
+	if req.AllOrNothing && errors.Join(errs...) != nil {
+		abortBatch(errs)
+	}
+
+	doErr := ex.markets.Do(req.Market, func(book *orderbook.Orderbook, _ token.Pair) {
+		if req.AllOrNothing {
+			// the index lags the book, an order could have been filled since
+			for i, id := range req.OrderIDs {
+				if order, ok := book.Orders[id]; errs[i] == nil && (!ok || order.Limit == nil) {
+					errs[i] = fmt.Errorf("%w: %d", ErrOrderNotFound, id)
+					abortBatch(errs)
+				}
+			}
+		}
+		for i, id := range req.OrderIDs {
+			if errs[i] != nil {
+				continue
+			}
+			if _, err := orderbook.CancelOrderByID(book, id); err != nil {
+				errs[i] = fmt.Errorf("%w: %d", ErrOrderNotFound, id)
+			}
+		}
+	})
+	if doErr != nil {
+		if errors.Is(doErr, ErrShuttingDown) {
+			return doErr
+		}
+		return newError(http.StatusNotFound, doErr)
+	}
+
+	resp := BatchOrdersResponse{Results: make([]BatchOrderResult, len(req.OrderIDs))}
+	for i, id := range req.OrderIDs {
+		resp.Results[i].OrderID = id
+		if errs[i] != nil {
+			resp.Results[i].Error = batchItemError(http.StatusNotFound, errs[i])
+			continue
+		}
+		ex.recordAudit(c, audit.OrderCancelled, userID, map[string]any{
+			"order":  id,
+			"market": req.Market,
+		})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID":       userID,
+		"market":       req.Market,
+		"orders":       len(req.OrderIDs),
+		"allOrNothing": req.AllOrNothing,
+	}).Info("cancelled order batch")
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+func TestPlaceOrdersBatch(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1, 2)
+	e := newRouter(ex)
+
+	// best effort: the bid the user can not pay for fails on its own
+	rec := doUserRequest(e, 1, http.MethodPost, "/v1/orders/batch", BatchPlaceOrdersRequest{
+		Market: token.MarketETHUSDT,
+		Orders: []PlaceOrderRequest{
+			{Type: LimitOrder, Bid: true, Size: 5, Price: 1_000},
+			{Type: LimitOrder, Bid: true, Size: 10, Price: 900},
+			{Type: LimitOrder, Size: 4, Price: 1_100},
+			{Type: LimitOrder, Size: 1, Price: 1_100, Market: token.MarketBTCUSDT},
+		},
+	})
+	assert(t, rec.Code, http.StatusOK)
+	resp := decodeTestResponse[BatchOrdersResponse](t, rec)
+	assert(t, len(resp.Results), 4)
+	assert(t, resp.Results[0].Error == nil, true)
+	assert(t, resp.Results[1].Error.Code, CodeInsufficientBalance)
+	assert(t, resp.Results[2].Error == nil, true)
+	assert(t, resp.Results[3].Error.Code, CodeInvalidOrder)
+	assert(t, resp.Results[3].OrderID, int64(0))
+
+	book := bookSnapshot(ex, token.MarketETHUSDT)
+	assert(t, len(book.Bids), 1)
+	assert(t, len(book.Asks), 1)
+	assert(t, getTestOrder(t, ex, resp.Results[1].OrderID).Status, orderbook.StatusRejected)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetUSDT)), 5_000.0)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetETH)), 4.0)
+
+	// market orders fill in the order of the batch
+	rec = doUserRequest(e, 2, http.MethodPost, "/v1/orders/batch", BatchPlaceOrdersRequest{
+		Market: token.MarketETHUSDT,
+		Orders: []PlaceOrderRequest{
+			{Type: MarketOrder, Bid: true, Size: 3},
+			{Type: MarketOrder, Bid: true, Size: 3},
+		},
+	})
+	resp = decodeTestResponse[BatchOrdersResponse](t, rec)
+	assert(t, len(resp.Results[0].Fills), 1)
+	assert(t, resp.Results[0].Fills[0].Size, 3.0)
+	assert(t, resp.Results[1].Error.Code, CodeInsufficientLiquidity)
+	assert(t, ex.Ledger.Check(), nil)
+}
+
+func TestBatchMarketOrderNotSettled(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1, 2)
+	e := newRouter(ex)
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 1_000, Market: token.MarketETHUSDT})
+	// the maker's held funds are gone, the fill can not be settled
+	ex.Ledger.Release(1, token.AssetETH, 2, "test")
+
+	rec := doUserRequest(e, 2, http.MethodPost, "/v1/orders/batch", BatchPlaceOrdersRequest{
+		Market: token.MarketETHUSDT,
+		Orders: []PlaceOrderRequest{
+			{Type: MarketOrder, Bid: true, Size: 1},
+			{Type: LimitOrder, Bid: true, Size: 1, Price: 900},
+		},
+	})
+	assert(t, rec.Code, http.StatusOK)
+	resp := decodeTestResponse[BatchOrdersResponse](t, rec)
+	assert(t, resp.Results[0].Error != nil, true)
+	assert(t, len(resp.Results[0].Fills), 0)
+	assert(t, resp.Results[1].Error == nil, true)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(2, token.AssetUSDT)), 900.0)
+	assert(t, ex.Ledger.Check(), nil)
+}
+
+func TestPlaceOrdersAllOrNothing(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1)
+	e := newRouter(ex)
+
+	batch := BatchPlaceOrdersRequest{
+		Market: token.MarketETHUSDT,
+		Orders: []PlaceOrderRequest{
+			{Type: LimitOrder, Bid: true, Size: 5, Price: 1_000},
+			{Type: LimitOrder, Size: 4, Price: 1_100},
+			{Type: LimitOrder, Bid: true, Size: 10, Price: 900},
+		},
+		AllOrNothing: true,
+	}
+	rec := doUserRequest(e, 1, http.MethodPost, "/v1/orders/batch", batch)
+	assert(t, rec.Code, http.StatusOK)
+	resp := decodeTestResponse[BatchOrdersResponse](t, rec)
+	assert(t, resp.Results[0].Error.Code, CodeBatchAborted)
+	assert(t, resp.Results[1].Error.Code, CodeBatchAborted)
+	assert(t, resp.Results[2].Error.Code, CodeInsufficientBalance)
+
+	// none of the orders made it in and nothing stays held
+	book := bookSnapshot(ex, token.MarketETHUSDT)
+	assert(t, len(book.Bids)+len(book.Asks), 0)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetUSDT)), 0.0)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetETH)), 0.0)
+	assert(t, getTestOrder(t, ex, resp.Results[0].OrderID).Status, orderbook.StatusRejected)
+
+	batch.Orders[2].Size = 1
+	resp = decodeTestResponse[BatchOrdersResponse](t, doUserRequest(e, 1, http.MethodPost, "/v1/orders/batch", batch))
+	for _, result := range resp.Results {
+		assert(t, result.Error == nil, true)
+	}
+	book = bookSnapshot(ex, token.MarketETHUSDT)
+	assert(t, len(book.Bids), 2)
+	assert(t, len(book.Asks), 1)
+
+	// an invalid order aborts the batch before it reaches the book
+	batch.Orders[2].Size = 0
+	resp = decodeTestResponse[BatchOrdersResponse](t, doUserRequest(e, 1, http.MethodPost, "/v1/orders/batch", batch))
+	assert(t, resp.Results[0].Error.Code, CodeBatchAborted)
+	assert(t, resp.Results[0].OrderID, int64(0))
+	assert(t, resp.Results[2].Error.Code, CodeInvalidOrder)
+
+	batch.Orders[2].Type = MarketOrder
+	rec = doUserRequest(e, 1, http.MethodPost, "/v1/orders/batch", batch)
+	assert(t, rec.Code, http.StatusBadRequest)
+	assert(t, decodeAPIError(t, rec).Code, CodeInvalidBatch)
+
+	rec = doUserRequest(e, 1, http.MethodPost, "/v1/orders/batch", BatchPlaceOrdersRequest{
+		Market: token.MarketETHUSDT,
+		Orders: make([]PlaceOrderRequest, MaxBatchSize+1),
+	})
+	assert(t, rec.Code, http.StatusBadRequest)
+	assert(t, decodeAPIError(t, rec).Code, CodeInvalidBatch)
+}
+
+func TestCancelOrdersBatch(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1, 2)
+	e := newRouter(ex)
+
+	resp := decodeTestResponse[BatchOrdersResponse](t, doUserRequest(e, 1, http.MethodPost, "/v1/orders/batch", BatchPlaceOrdersRequest{
+		Market: token.MarketETHUSDT,
+		Orders: []PlaceOrderRequest{
+			{Type: LimitOrder, Bid: true, Size: 1, Price: 900},
+			{Type: LimitOrder, Bid: true, Size: 1, Price: 950},
+			{Type: LimitOrder, Size: 1, Price: 1_100},
+		},
+	}))
+	ids := []int64{resp.Results[0].OrderID, resp.Results[1].OrderID, resp.Results[2].OrderID}
+	other := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Size: 1, Price: 1_200, Market: token.MarketETHUSDT})
+
+	// the order of another user fails the whole batch
+	rec := doUserRequest(e, 1, http.MethodDelete, "/v1/orders/batch", BatchCancelOrdersRequest{
+		Market:       token.MarketETHUSDT,
+		OrderIDs:     []int64{ids[0], other},
+		AllOrNothing: true,
+	})
+	assert(t, rec.Code, http.StatusOK)
+	resp = decodeTestResponse[BatchOrdersResponse](t, rec)
+	assert(t, resp.Results[0].Error.Code, CodeBatchAborted)
+	assert(t, resp.Results[1].Error.Code, CodeOrderNotFound)
+	assert(t, len(bookSnapshot(ex, token.MarketETHUSDT).Bids), 2)
+
+	resp = decodeTestResponse[BatchOrdersResponse](t, doUserRequest(e, 1, http.MethodDelete, "/v1/orders/batch", BatchCancelOrdersRequest{
+		Market:   token.MarketETHUSDT,
+		OrderIDs: []int64{ids[0], other, ids[2]},
+	}))
+	assert(t, resp.Results[0].Error == nil, true)
+	assert(t, resp.Results[1].Error.Code, CodeOrderNotFound)
+	assert(t, resp.Results[2].Error == nil, true)
+	assert(t, getTestOrder(t, ex, ids[0]).Status, orderbook.StatusCancelled)
+	assert(t, getTestOrder(t, ex, other).Status, orderbook.StatusNew)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetUSDT)), 950.0)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetETH)), 0.0)
+
+	rec = doUserRequest(e, 1, http.MethodDelete, "/v1/orders/batch", BatchCancelOrdersRequest{
+		Market:   token.MarketETHUSDT,
+		OrderIDs: []int64{ids[1], ids[1]},
+	})
+	assert(t, rec.Code, http.StatusBadRequest)
+	assert(t, decodeAPIError(t, rec).Code, CodeInvalidBatch)
+}
@@ -4,8 +4,19 @@ type Client struct {
 	Eth *ethClient
 }
 
-func newClient() *Client {
-	return &Client{
-		Eth: StartNewEthClient(),
+// Config names the nodes the client talks to.
+type Config struct {
+	EthRPCURL  string
+	EthChainID int64
+}
+
+func NewClient(cfg Config) (*Client, error) {
+	eth, err := NewEthClient(cfg.EthRPCURL, cfg.EthChainID)
+	if err != nil {
+		return nil, err
 	}
+
+	return &Client{
+		Eth: eth,
+	}, nil
 }
@@ -3,11 +3,14 @@ package cryptoClient
 import (
 	"context"
 	"crypto/ecdsa"
+	"errors"
 	"fmt"
-	"log"
 	"math"
 	"math/big"
+	"strings"
+	"time"
 
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -15,61 +18,273 @@ import (
 )
 
 const (
-	clientAddr = "http://localhost:8545"
-	decimals   = 18
+	decimals = 18
 )
 
+// EthBackend is what the client needs of a node, an *ethclient.Client or the
+// client of a simulated backend.
+type EthBackend interface {
+	ethereum.BlockNumberReader
+	ethereum.ChainReader
+	ethereum.ChainStateReader
+	ethereum.GasPricer
+	ethereum.PendingStateReader
+	ethereum.TransactionReader
+	ethereum.TransactionSender
+}
+
 type ethClient struct {
-	client *ethclient.Client
+	client  EthBackend
+	chainID *big.Int
 }
 
-func StartNewEthClient() *ethClient {
-	c, err := ethclient.Dial(clientAddr)
+// NewEthClient connects to the node at the RPC URL, transactions are signed
+// for the chain ID.
+func NewEthClient(rpcURL string, chainID int64) (*ethClient, error) {
+	c, err := ethclient.Dial(rpcURL)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	client := ethClient{
-		client: c,
+	return NewEthClientWithBackend(c, chainID), nil
+}
+
+// NewEthClientWithBackend talks to the chain through the backend, like the
+// simulated one of the tests.
+func NewEthClientWithBackend(backend EthBackend, chainID int64) *ethClient {
+	return &ethClient{
+		client:  backend,
+		chainID: big.NewInt(chainID),
 	}
-	return &client
 }
 
 func (c ethClient) TransferETH(fromPrivKey *ecdsa.PrivateKey, to common.Address, amount *big.Int) error {
+	_, err := c.Transfer(fromPrivKey, to, amount)
+	return err
+}
 
-	ctx := context.Background()
-	publicKey := fromPrivKey.Public()
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("cannot assert type: publicKey is not of type *ecdsa.PublicKey")
+// Transfer sends the amount of wei and returns the hash of the transaction.
+func (c ethClient) Transfer(fromPrivKey *ecdsa.PrivateKey, to common.Address, amount *big.Int) (common.Hash, error) {
+	tx, err := c.SignTransfer(fromPrivKey, to, amount)
+	if err != nil {
+		return common.Hash{}, err
 	}
+	return tx.Hash(), c.SendTransaction(tx)
+}
+
+// SignTransfer signs a transaction sending the amount of wei with the next
+// nonce of the sender, without sending it. Its hash is known before it is
+// sent, so it can be tracked even when sending it fails halfway.
+func (c ethClient) SignTransfer(fromPrivKey *ecdsa.PrivateKey, to common.Address, amount *big.Int) (tx *types.Transaction, err error) {
+	start := time.Now()
+	defer func() { observeRPC("eth", "sign", start, err) }()
 
-	fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
-	nonce, err := c.client.PendingNonceAt(ctx, fromAddress)
+	gasPrice, err := c.client.SuggestGasPrice(context.Background())
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return c.signTransfer(fromPrivKey, to, amount, gasPrice)
+}
+
+// ErrBalanceBelowFee is returned for a sweep of an address that can not pay
+// for its own transfer.
+var ErrBalanceBelowFee = errors.New("balance does not cover the transfer fee")
 
-	gasLimit := uint64(21000)
+// SignSweep signs a transaction sending the whole balance of the sender less
+// the fee of the transaction, which leaves the sender empty once it is
+// mined.
+func (c ethClient) SignSweep(fromPrivKey *ecdsa.PrivateKey, to common.Address) (tx *types.Transaction, err error) {
+	start := time.Now()
+	defer func() { observeRPC("eth", "sign", start, err) }()
+
+	ctx := context.Background()
+	balance, err := c.client.BalanceAt(ctx, crypto.PubkeyToAddress(fromPrivKey.PublicKey), nil)
+	if err != nil {
+		return nil, err
+	}
 	gasPrice, err := c.client.SuggestGasPrice(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	fee := new(big.Int).Mul(gasPrice, big.NewInt(transferGas))
+	amount := new(big.Int).Sub(balance, fee)
+	if amount.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: %s wei for a fee of %s wei", ErrBalanceBelowFee, balance, fee)
+	}
+	return c.signTransfer(fromPrivKey, to, amount, gasPrice)
+}
+
+// transferGas is the gas of a plain ether transfer.
+const transferGas = 21000
+
+func (c ethClient) signTransfer(fromPrivKey *ecdsa.PrivateKey, to common.Address, amount, gasPrice *big.Int) (*types.Transaction, error) {
+	fromAddress := crypto.PubkeyToAddress(fromPrivKey.PublicKey)
+	nonce, err := c.client.PendingNonceAt(context.Background(), fromAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := types.NewTransaction(nonce, to, amount, transferGas, gasPrice, nil)
+
+	return types.SignTx(tx, types.NewEIP155Signer(c.chainID), fromPrivKey)
+}
+
+// SendTransaction hands a signed transaction to the node.
+func (c ethClient) SendTransaction(tx *types.Transaction) (err error) {
+	start := time.Now()
+	defer func() { observeRPC("eth", "transfer", start, err) }()
+
+	return c.client.SendTransaction(context.Background(), tx)
+}
+
+// rejections are what nodes answer for a transaction that can never be
+// mined as it was signed. Any other error of sending one leaves open whether
+// it reached the network.
+var rejections = []string{"nonce too low", "insufficient funds"}
+
+// IsRejected reports whether sending a transaction failed for good, so it
+// will never be mined.
+func IsRejected(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, rejection := range rejections {
+		if strings.Contains(err.Error(), rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+// TxStatus is where a transaction is at on chain.
+type TxStatus struct {
+	// Mined is false as long as the transaction is not in a block
+	Mined bool
+	// Failed tells that the transaction was mined but reverted
+	Failed bool
+	// Confirmations counts the block of the transaction and the blocks on
+	// top of it
+	Confirmations uint64
+}
+
+// errIndexing is what geth answers for the receipts it has not indexed yet,
+// right after it started.
+const errIndexing = "transaction indexing is in progress"
+
+// TxStatus looks up the receipt of the transaction, a transaction the node
+// does not know of is reported as not mined.
+func (c ethClient) TxStatus(hash common.Hash) (status TxStatus, err error) {
+	start := time.Now()
+	defer func() { observeRPC("eth", "receipt", start, err) }()
+
+	ctx := context.Background()
+	receipt, err := c.client.TransactionReceipt(ctx, hash)
+	if errors.Is(err, ethereum.NotFound) || (err != nil && err.Error() == errIndexing) {
+		return TxStatus{}, nil
+	}
+	if err != nil {
+		return TxStatus{}, err
 	}
 
-	tx := types.NewTransaction(nonce, to, amount, gasLimit, gasPrice, nil)
+	head, err := c.client.BlockNumber(ctx)
+	if err != nil {
+		return TxStatus{}, err
+	}
+
+	status = TxStatus{
+		Mined:  true,
+		Failed: receipt.Status != types.ReceiptStatusSuccessful,
+	}
+	if mined := receipt.BlockNumber.Uint64(); head >= mined {
+		status.Confirmations = head - mined + 1
+	}
+	return status, nil
+}
 
-	chainID := big.NewInt(1337)
+// BalanceAt returns the balance of the address in wei at the most recent
+// block.
+func (c ethClient) BalanceAt(address common.Address) (balance *big.Int, err error) {
+	start := time.Now()
+	defer func() { observeRPC("eth", "balance", start, err) }()
+
+	return c.client.BalanceAt(context.Background(), address, nil)
+}
 
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), fromPrivKey)
+// BalanceAtBlock returns the balance of the address in wei at the block.
+func (c ethClient) BalanceAtBlock(address common.Address, block uint64) (balance *big.Int, err error) {
+	start := time.Now()
+	defer func() { observeRPC("eth", "balance", start, err) }()
+
+	return c.client.BalanceAt(context.Background(), address, new(big.Int).SetUint64(block))
+}
+
+// NonceAt returns the number of transactions of the address mined so far.
+func (c ethClient) NonceAt(address common.Address) (nonce uint64, err error) {
+	start := time.Now()
+	defer func() { observeRPC("eth", "nonce", start, err) }()
+
+	return c.client.NonceAt(context.Background(), address, nil)
+}
+
+// TransferFee returns the fee of a transaction in wei, what its sender pays
+// on top of the amount.
+func TransferFee(tx *types.Transaction) *big.Int {
+	return new(big.Int).Mul(tx.GasPrice(), new(big.Int).SetUint64(tx.Gas()))
+}
+
+// BlockNumber returns the number of the most recent block.
+func (c ethClient) BlockNumber() (n uint64, err error) {
+	start := time.Now()
+	defer func() { observeRPC("eth", "block_number", start, err) }()
+
+	return c.client.BlockNumber(context.Background())
+}
+
+// Transfer is ether a transaction sends to an address.
+type Transfer struct {
+	TxHash common.Hash
+	From   common.Address
+	To     common.Address
+	Amount *big.Int
+	Block  uint64
+}
+
+// TransfersTo returns the transfers of the block to any of the addresses.
+// Only the ether sent by the transactions themselves is seen, not what
+// contracts forward, which is all plain addresses receive.
+func (c ethClient) TransfersTo(number uint64, to map[common.Address]bool) (transfers []Transfer, err error) {
+	start := time.Now()
+	defer func() { observeRPC("eth", "block", start, err) }()
+
+	block, err := c.client.BlockByNumber(context.Background(), new(big.Int).SetUint64(number))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return c.client.SendTransaction(ctx, signedTx)
+	signer := types.LatestSignerForChainID(c.chainID)
+	for _, tx := range block.Transactions() {
+		if tx.To() == nil || !to[*tx.To()] || tx.Value().Sign() <= 0 {
+			continue
+		}
+		// the sender is only informative, a transaction of another chain
+		// still moved the ether
+		from, _ := types.Sender(signer, tx)
+		transfers = append(transfers, Transfer{
+			TxHash: tx.Hash(),
+			From:   from,
+			To:     *tx.To(),
+			Amount: tx.Value(),
+			Block:  number,
+		})
+	}
+	return transfers, nil
 }
 
 func (c ethClient) GetBalance(addr string) (float64, error) {
 	account := common.HexToAddress(addr)
+	start := time.Now()
 	balance, err := c.client.BalanceAt(context.Background(), account, nil)
+	observeRPC("eth", "balance", start, err)
 	if err != nil {
 		return 0.0, nil
 	}
@@ -77,12 +292,12 @@ func (c ethClient) GetBalance(addr string) (float64, error) {
 	return c.BigIntToFloat(balance), nil
 }
 
+// FloatToBigInt converts ether to wei. The scaling is done on a big.Float,
+// above 9.2 ether the wei do not fit an int64.
 func (c ethClient) FloatToBigInt(value float64) *big.Int {
-	scaledValue := value * math.Pow10(decimals)
-
-	integerValue := big.NewInt(0)
-	integerValue.SetInt64(int64(scaledValue))
+	scaledValue := new(big.Float).Mul(big.NewFloat(value), big.NewFloat(math.Pow10(decimals)))
 
+	integerValue, _ := scaledValue.Int(nil)
 	return integerValue
 }
 
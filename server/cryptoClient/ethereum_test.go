@@ -1,8 +1,17 @@
 package cryptoClient
 
 import (
+	"context"
+	"errors"
+	"math/big"
 	"reflect"
 	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/params"
 )
 
 func assert(t *testing.T, a, b any) {
@@ -24,3 +33,116 @@ func assert(t *testing.T, a, b any) {
 
 // 	assert(t, floatValue, 1.2345)
 // }
+
+func newSimulatedClient(t *testing.T, funded common.Address) (*ethClient, *simulated.Backend) {
+	sim := simulated.NewBackend(types.GenesisAlloc{
+		funded: {Balance: new(big.Int).Mul(big.NewInt(100), big.NewInt(params.Ether))},
+	})
+	t.Cleanup(func() { sim.Close() })
+
+	return NewEthClientWithBackend(sim.Client(), 1337), sim
+}
+
+func TestTransfer(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, sim := newSimulatedClient(t, crypto.PubkeyToAddress(key.PublicKey))
+	to := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+
+	hash, err := c.Transfer(key, to, c.FloatToBigInt(1.5))
+	assert(t, err, nil)
+
+	status, err := c.TxStatus(hash)
+	assert(t, err, nil)
+	assert(t, status, TxStatus{})
+
+	sim.Commit()
+	status, _ = c.TxStatus(hash)
+	assert(t, status, TxStatus{Mined: true, Confirmations: 1})
+	sim.Commit()
+	status, _ = c.TxStatus(hash)
+	assert(t, status.Confirmations, uint64(2))
+
+	balance, err := c.GetBalance(to.Hex())
+	assert(t, err, nil)
+	assert(t, balance, 1.5)
+}
+
+func TestIsRejected(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := newSimulatedClient(t, crypto.PubkeyToAddress(key.PublicKey))
+	to := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+
+	tx, err := c.SignTransfer(key, to, c.FloatToBigInt(1_000))
+	assert(t, err, nil)
+	assert(t, IsRejected(c.SendTransaction(tx)), true)
+	assert(t, IsRejected(errors.New("nonce too low: next nonce 1, tx nonce 0")), true)
+
+	// the node may have taken them anyway
+	assert(t, IsRejected(nil), false)
+	assert(t, IsRejected(context.DeadlineExceeded), false)
+	assert(t, IsRejected(errors.New("already known")), false)
+}
+
+func TestTransfersTo(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	c, sim := newSimulatedClient(t, from)
+	watched := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	other := common.HexToAddress("0x00000000000000000000000000000000000000bb")
+
+	hash, err := c.Transfer(key, watched, c.FloatToBigInt(2))
+	assert(t, err, nil)
+	_, err = c.Transfer(key, other, c.FloatToBigInt(1))
+	assert(t, err, nil)
+	sim.Commit()
+
+	head, err := c.BlockNumber()
+	assert(t, err, nil)
+	transfers, err := c.TransfersTo(head, map[common.Address]bool{watched: true})
+	assert(t, err, nil)
+	assert(t, transfers, []Transfer{{TxHash: hash, From: from, To: watched, Amount: c.FloatToBigInt(2), Block: head}})
+
+	transfers, _ = c.TransfersTo(head-1, map[common.Address]bool{watched: true})
+	assert(t, len(transfers), 0)
+}
+
+func TestSignSweep(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	c, sim := newSimulatedClient(t, from)
+	to := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+
+	tx, err := c.SignSweep(key, to)
+	assert(t, err, nil)
+	assert(t, new(big.Int).Add(tx.Value(), TransferFee(tx)), new(big.Int).Mul(big.NewInt(100), big.NewInt(params.Ether)))
+	assert(t, c.SendTransaction(tx), nil)
+	sim.Commit()
+
+	left, err := c.BalanceAt(from)
+	assert(t, err, nil)
+	assert(t, left.Sign(), 0)
+	received, _ := c.BalanceAt(to)
+	assert(t, received, tx.Value())
+
+	_, err = c.SignSweep(key, to)
+	assert(t, errors.Is(err, ErrBalanceBelowFee), true)
+}
+
+func TestFloatToBigIntLargeAmounts(t *testing.T) {
+	c := NewEthClientWithBackend(nil, 1337)
+
+	assert(t, c.FloatToBigInt(1.5), big.NewInt(1_500_000_000_000_000_000))
+	assert(t, c.FloatToBigInt(100), new(big.Int).Mul(big.NewInt(100), big.NewInt(params.Ether)))
+}
@@ -0,0 +1,72 @@
+package cryptoClient
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	rpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "exchange",
+		Subsystem: "chain",
+		Name:      "rpc_duration_seconds",
+		Help:      "Duration of the calls to the chain nodes.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"chain", "method"})
+	rpcErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "exchange",
+		Subsystem: "chain",
+		Name:      "rpc_errors_total",
+		Help:      "Failed calls to the chain nodes.",
+	}, []string{"chain", "method"})
+	deposits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "exchange",
+		Subsystem: "chain",
+		Name:      "deposits_total",
+		Help:      "Deposits seen on chain, result is ok or failed.",
+	}, []string{"asset", "result"})
+	withdrawals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "exchange",
+		Subsystem: "chain",
+		Name:      "withdrawals_total",
+		Help:      "Withdrawals sent on chain, result is ok or failed.",
+	}, []string{"asset", "result"})
+	sweeps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "exchange",
+		Subsystem: "chain",
+		Name:      "sweeps_total",
+		Help:      "Sweeps between the wallets of the exchange, result is ok or failed.",
+	}, []string{"asset", "result"})
+)
+
+func observeRPC(chain, method string, start time.Time, err error) {
+	rpcDuration.WithLabelValues(chain, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcErrors.WithLabelValues(chain, method).Inc()
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "ok"
+}
+
+// RecordDeposit counts a deposit of the asset, err is why checking for it
+// failed.
+func RecordDeposit(asset string, err error) {
+	deposits.WithLabelValues(asset, result(err)).Inc()
+}
+
+// RecordWithdrawal counts a withdrawal of the asset, err is why it failed.
+func RecordWithdrawal(asset string, err error) {
+	withdrawals.WithLabelValues(asset, result(err)).Inc()
+}
+
+// RecordSweep counts a sweep of the asset, err is why it failed.
+func RecordSweep(asset string, err error) {
+	sweeps.WithLabelValues(asset, result(err)).Inc()
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// APIKey is an API key of a user. Secret is encrypted with EncryptSecret
+// before it is stored, requests are signed with it so it can not be hashed.
+type APIKey struct {
+	Key       string   `bson:"Key"`
+	Secret    string   `bson:"Secret"`
+	UserID    int64    `bson:"UserID"`
+	Scopes    []string `bson:"Scopes"`
+	CreatedAt int64    `bson:"CreatedAt"`
+}
+
+// InsertAPIKey inserts a new API key into the database
+func (k *APIKey) InsertAPIKey() error {
+	collection := GetCollection(Database, "apikeys")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.InsertOne(ctx, k)
+	return err
+}
+
+// DeleteAPIKey removes an API key
+func DeleteAPIKey(key string) error {
+	collection := GetCollection(Database, "apikeys")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.DeleteOne(ctx, bson.M{"Key": key})
+	return err
+}
+
+// GetAPIKeys retrieves the API keys of all users
+func GetAPIKeys() ([]APIKey, error) {
+	collection := GetCollection(Database, "apikeys")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var keys []APIKey
+	for cursor.Next(ctx) {
+		var key APIKey
+		if err := cursor.Decode(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type AuditEntry struct {
+	ID        int64             `bson:"ID"`
+	Timestamp int64             `bson:"Timestamp"`
+	Actor     string            `bson:"Actor"`
+	Action    string            `bson:"Action"`
+	UserID    int64             `bson:"UserID"`
+	Details   map[string]string `bson:"Details"`
+	RequestID string            `bson:"RequestID"`
+	PrevHash  string            `bson:"PrevHash"`
+	Hash      string            `bson:"Hash"`
+}
+
+// InsertAuditEntry appends an entry to the audit log, entries are never
+// updated or deleted
+func (e *AuditEntry) InsertAuditEntry() error {
+	collection := GetCollection(Database, "audit")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.InsertOne(ctx, e)
+	return err
+}
+
+// GetAuditEntries retrieves the whole audit log ordered by entry ID
+func GetAuditEntries() ([]AuditEntry, error) {
+	collection := GetCollection(Database, "audit")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"ID": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var entries []AuditEntry
+	for cursor.Next(ctx) {
+		var entry AuditEntry
+		if err := cursor.Decode(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
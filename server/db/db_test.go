@@ -29,3 +29,20 @@ func TestDataBase(t *testing.T) {
 	// fmt.Println(getUser)
 
 }
+
+func TestEncryptSecret(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	encrypted, err := EncryptSecret(key, "JBSWY3DPEHPK3PXP")
+	assert(t, err, nil)
+	assert(t, encrypted != "JBSWY3DPEHPK3PXP", true)
+
+	secret, err := DecryptSecret(key, encrypted)
+	assert(t, err, nil)
+	assert(t, secret, "JBSWY3DPEHPK3PXP")
+
+	_, err = DecryptSecret([]byte("fedcba9876543210fedcba9876543210"), encrypted)
+	assert(t, err != nil, true)
+	_, err = EncryptSecret([]byte("short"), "JBSWY3DPEHPK3PXP")
+	assert(t, err != nil, true)
+}
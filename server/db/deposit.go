@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Deposit struct {
+	TxHash        string  `bson:"TxHash"`
+	UserID        int64   `bson:"UserID"`
+	Asset         string  `bson:"Asset"`
+	Amount        float64 `bson:"Amount"`
+	Address       string  `bson:"Address"`
+	Block         int64   `bson:"Block"`
+	State         string  `bson:"State"`
+	Confirmations int64   `bson:"Confirmations"`
+	CreatedAt     int64   `bson:"CreatedAt"`
+	UpdatedAt     int64   `bson:"UpdatedAt"`
+}
+
+// ScanCursor is the last block scanned for deposits on a chain
+type ScanCursor struct {
+	Chain string `bson:"Chain"`
+	Block int64  `bson:"Block"`
+}
+
+// UpsertDeposit inserts the deposit or replaces the stored one of the same
+// transaction
+func (d *Deposit) UpsertDeposit() error {
+	collection := GetCollection(Database, "deposits")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"TxHash": d.TxHash}, d, options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetDepositByTxHash retrieves a deposit by its transaction, ErrNotFound when
+// there is none
+func (d *Deposit) GetDepositByTxHash() error {
+	collection := GetCollection(Database, "deposits")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return collection.FindOne(ctx, bson.M{"TxHash": d.TxHash}).Decode(d)
+}
+
+// GetDepositsByUserID retrieves all deposits of a user
+func GetDepositsByUserID(userID int64) ([]Deposit, error) {
+	return findDeposits(bson.M{"UserID": userID})
+}
+
+// GetDepositsByState retrieves the deposits in the state
+func GetDepositsByState(state string) ([]Deposit, error) {
+	return findDeposits(bson.M{"State": state})
+}
+
+func findDeposits(filter bson.M) ([]Deposit, error) {
+	collection := GetCollection(Database, "deposits")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "Block", Value: 1}, {Key: "CreatedAt", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var deposits []Deposit
+	for cursor.Next(ctx) {
+		var d Deposit
+		if err := cursor.Decode(&d); err != nil {
+			return nil, err
+		}
+		deposits = append(deposits, d)
+	}
+	return deposits, nil
+}
+
+// GetScanCursor retrieves the last block scanned on the chain, false when no
+// block was scanned yet
+func GetScanCursor(chain string) (int64, bool, error) {
+	collection := GetCollection(Database, "scan_cursors")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var c ScanCursor
+	err := collection.FindOne(ctx, bson.M{"Chain": chain}).Decode(&c)
+	if errors.Is(err, ErrNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return c.Block, true, nil
+}
+
+// UpsertScanCursor stores the last block scanned on the chain
+func (c *ScanCursor) UpsertScanCursor() error {
+	collection := GetCollection(Database, "scan_cursors")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"Chain": c.Chain}, c, options.Replace().SetUpsert(true))
+	return err
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FeeOverride holds the rates a user pays whatever their volume is.
+type FeeOverride struct {
+	UserID    int64   `bson:"UserID"`
+	MakerRate float64 `bson:"MakerRate"`
+	TakerRate float64 `bson:"TakerRate"`
+}
+
+// UpsertFeeOverride inserts the override or replaces the stored one of the
+// user
+func (f *FeeOverride) UpsertFeeOverride() error {
+	collection := GetCollection(Database, "feeoverrides")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"UserID": f.UserID}, f, options.Replace().SetUpsert(true))
+	return err
+}
+
+// DeleteFeeOverride removes the override of a user
+func DeleteFeeOverride(userID int64) error {
+	collection := GetCollection(Database, "feeoverrides")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.DeleteOne(ctx, bson.M{"UserID": userID})
+	return err
+}
+
+// GetFeeOverrides retrieves the overrides of all users
+func GetFeeOverrides() ([]FeeOverride, error) {
+	collection := GetCollection(Database, "feeoverrides")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var overrides []FeeOverride
+	for cursor.Next(ctx) {
+		var override FeeOverride
+		if err := cursor.Decode(&override); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, override)
+	}
+	return overrides, nil
+}
+
+type FeeTier struct {
+	MinVolume float64 `bson:"MinVolume"`
+	MakerRate float64 `bson:"MakerRate"`
+	TakerRate float64 `bson:"TakerRate"`
+}
+
+// FeeSchedule holds the fee tiers set by an admin, there is at most one
+// schedule stored.
+type FeeSchedule struct {
+	Tiers      []FeeTier            `bson:"Tiers"`
+	QuoteTiers map[string][]FeeTier `bson:"QuoteTiers"`
+}
+
+// UpsertFeeSchedule inserts the schedule or replaces the stored one
+func (f *FeeSchedule) UpsertFeeSchedule() error {
+	collection := GetCollection(Database, "feeschedule")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{}, f, options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetFeeSchedule retrieves the stored schedule, ErrNotFound when an admin
+// never set one
+func GetFeeSchedule() (FeeSchedule, error) {
+	collection := GetCollection(Database, "feeschedule")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var schedule FeeSchedule
+	err := collection.FindOne(ctx, bson.M{}).Decode(&schedule)
+	return schedule, err
+}
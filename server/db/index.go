@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// caseInsensitive compares strings regardless of their case, the lookups
+// using it have to pass the same collation to use the index
+var caseInsensitive = &options.Collation{Locale: "en", Strength: 2}
+
+func uniqueIndex(keys ...string) mongo.IndexModel {
+	return mongo.IndexModel{Keys: indexKeys(keys), Options: options.Index().SetUnique(true)}
+}
+
+func lookupIndex(keys ...string) mongo.IndexModel {
+	return mongo.IndexModel{Keys: indexKeys(keys)}
+}
+
+func indexKeys(keys []string) bson.D {
+	d := make(bson.D, len(keys))
+	for i, key := range keys {
+		d[i] = bson.E{Key: key, Value: 1}
+	}
+	return d
+}
+
+// indexes are the indexes of every collection, the unique ones keep the
+// stores from writing a document twice.
+var indexes = map[string][]mongo.IndexModel{
+	"users": {
+		uniqueIndex("ID"),
+		{
+			Keys:    bson.D{{Key: "UserName", Value: 1}},
+			Options: options.Index().SetUnique(true).SetCollation(caseInsensitive),
+		},
+		{
+			// users may register without an email
+			Keys: bson.D{{Key: "Email", Value: 1}},
+			Options: options.Index().SetUnique(true).SetCollation(caseInsensitive).
+				SetPartialFilterExpression(bson.M{"Email": bson.M{"$gt": ""}}),
+		},
+	},
+	"wallets":              {uniqueIndex("UserID", "TokenType")},
+	"apikeys":              {uniqueIndex("Key")},
+	"sessions":             {uniqueIndex("TokenHash")},
+	"feeoverrides":         {uniqueIndex("UserID")},
+	"totp":                 {uniqueIndex("UserID")},
+	"orders":               {uniqueIndex("ID"), lookupIndex("UserID"), lookupIndex("Type", "Status")},
+	"journal":              {uniqueIndex("ID")},
+	"audit":                {uniqueIndex("ID")},
+	"withdrawals":          {uniqueIndex("ID"), lookupIndex("UserID"), lookupIndex("State")},
+	"withdrawal_addresses": {lookupIndex("UserID")},
+	"deposits":             {uniqueIndex("TxHash"), lookupIndex("UserID"), lookupIndex("State")},
+	"scan_cursors":         {uniqueIndex("Chain")},
+	"sweeps":               {uniqueIndex("ID"), lookupIndex("State")},
+}
+
+// CreateIndexes creates the indexes of all the collections, the ones that
+// already exist are left alone. It fails when stored documents break a unique
+// index.
+func CreateIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for collection, models := range indexes {
+		if _, err := GetCollection(Database, collection).Indexes().CreateMany(ctx, models); err != nil {
+			return fmt.Errorf("indexes of %s: %w", collection, err)
+		}
+	}
+	return nil
+}
+
+// IsDuplicate reports whether the write failed because a unique index
+// already holds the value
+func IsDuplicate(err error) bool {
+	return mongo.IsDuplicateKeyError(err)
+}
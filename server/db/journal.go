@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type JournalPosting struct {
+	UserID      int64   `bson:"UserID"`
+	Asset       string  `bson:"Asset"`
+	AccountType string  `bson:"AccountType"`
+	Amount      float64 `bson:"Amount"`
+}
+
+type JournalEntry struct {
+	ID        int64            `bson:"ID"`
+	Type      string           `bson:"Type"`
+	Ref       string           `bson:"Ref"`
+	Postings  []JournalPosting `bson:"Postings"`
+	Timestamp int64            `bson:"Timestamp"`
+}
+
+// InsertJournalEntry inserts a ledger journal entry, all its postings are
+// written in a single document so the entry is stored atomically. Inserting
+// an entry again replaces it, so a retried write never duplicates it
+func (e *JournalEntry) InsertJournalEntry() error {
+	collection := GetCollection(Database, "journal")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"ID": e.ID}, e, options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetJournalEntries retrieves the whole journal ordered by entry ID
+func GetJournalEntries() ([]JournalEntry, error) {
+	collection := GetCollection(Database, "journal")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"ID": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var entries []JournalEntry
+	for cursor.Next(ctx) {
+		var entry JournalEntry
+		if err := cursor.Decode(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
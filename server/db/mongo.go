@@ -11,6 +11,12 @@ import (
 
 var MongoClient *mongo.Client
 
+// Database holds the collections of the exchange
+var Database = "crypto-exchange"
+
+// ErrNotFound is returned when no document matches a lookup
+var ErrNotFound = mongo.ErrNoDocuments
+
 // InitializeMongo connects to MongoDB and initializes the global client
 func InitializeMongo(uri string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -38,3 +44,12 @@ func GetCollection(database, collection string) *mongo.Collection {
 	}
 	return MongoClient.Database(database).Collection(collection)
 }
+
+// DisconnectMongo closes the connections of the global client, pending
+// writes are finished first
+func DisconnectMongo(ctx context.Context) error {
+	if MongoClient == nil {
+		return nil
+	}
+	return MongoClient.Disconnect(ctx)
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Order struct {
+	ID           int64   `bson:"ID"`
+	UserID       int64   `bson:"UserID"`
+	Market       string  `bson:"Market"`
+	Type         string  `bson:"Type"`
+	Bid          bool    `bson:"Bid"`
+	Price        float64 `bson:"Price"`
+	Size         float64 `bson:"Size"`
+	Status       string  `bson:"Status"`
+	FilledSize   float64 `bson:"FilledSize"`
+	AvgFillPrice float64 `bson:"AvgFillPrice"`
+	Timestamp    int64   `bson:"Timestamp"`
+	UpdatedAt    int64   `bson:"UpdatedAt"`
+	ExpiresAt    int64   `bson:"ExpiresAt"`
+}
+
+// UpsertOrder inserts the order or replaces the stored one with the same ID
+func (o *Order) UpsertOrder() error {
+	collection := GetCollection(Database, "orders")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"ID": o.ID}, o, options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetOrderByID retrieves an order by ID, ErrNotFound when there is none
+func (o *Order) GetOrderByID() error {
+	collection := GetCollection(Database, "orders")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return collection.FindOne(ctx, bson.M{"ID": o.ID}).Decode(o)
+}
+
+// GetOrdersByUserID retrieves all orders of a user
+func GetOrdersByUserID(userID int64) ([]Order, error) {
+	collection := GetCollection(Database, "orders")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"UserID": userID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var orders []Order
+	for cursor.Next(ctx) {
+		var order Order
+		if err := cursor.Decode(&order); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+// GetOrdersByStatus retrieves the orders of a type in any of the statuses
+func GetOrdersByStatus(orderType string, statuses ...string) ([]Order, error) {
+	collection := GetCollection(Database, "orders")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"Type": orderType, "Status": bson.M{"$in": statuses}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var orders []Order
+	for cursor.Next(ctx) {
+		var order Order
+		if err := cursor.Decode(&order); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+// GetLastOrderID retrieves the highest order ID, 0 when there are no orders
+func GetLastOrderID() (int64, error) {
+	collection := GetCollection(Database, "orders")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var order Order
+	err := collection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"ID": -1})).Decode(&order)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return order.ID, nil
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Session is a login session of a user, only the hashes of its tokens are
+// stored.
+type Session struct {
+	UserID           int64  `bson:"UserID"`
+	TokenHash        string `bson:"TokenHash"`
+	RefreshHash      string `bson:"RefreshHash"`
+	ExpiresAt        int64  `bson:"ExpiresAt"`
+	RefreshExpiresAt int64  `bson:"RefreshExpiresAt"`
+}
+
+// InsertSession inserts a new session into the database
+func (s *Session) InsertSession() error {
+	collection := GetCollection(Database, "sessions")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.InsertOne(ctx, s)
+	return err
+}
+
+// DeleteSessions removes the sessions with the token hashes
+func DeleteSessions(tokenHashes []string) error {
+	collection := GetCollection(Database, "sessions")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.DeleteMany(ctx, bson.M{"TokenHash": bson.M{"$in": tokenHashes}})
+	return err
+}
+
+// GetSessions retrieves the sessions of all users
+func GetSessions() ([]Session, error) {
+	collection := GetCollection(Database, "sessions")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var sessions []Session
+	for cursor.Next(ctx) {
+		var session Session
+		if err := cursor.Decode(&session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
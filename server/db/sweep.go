@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Sweep is a transfer between the wallets of the exchange
+type Sweep struct {
+	ID        int64   `bson:"ID"`
+	Kind      string  `bson:"Kind"`
+	UserID    int64   `bson:"UserID"`
+	Asset     string  `bson:"Asset"`
+	From      string  `bson:"From"`
+	To        string  `bson:"To"`
+	Amount    float64 `bson:"Amount"`
+	Fee       float64 `bson:"Fee"`
+	TxHash    string  `bson:"TxHash"`
+	Nonce     int64   `bson:"Nonce"`
+	State     string  `bson:"State"`
+	Reason    string  `bson:"Reason"`
+	CreatedAt int64   `bson:"CreatedAt"`
+	UpdatedAt int64   `bson:"UpdatedAt"`
+}
+
+// UpsertSweep inserts the sweep or replaces the stored one with the same ID
+func (s *Sweep) UpsertSweep() error {
+	collection := GetCollection(Database, "sweeps")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"ID": s.ID}, s, options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetSweepsByState retrieves the sweeps in any of the states, all of them
+// without states
+func GetSweepsByState(states ...string) ([]Sweep, error) {
+	collection := GetCollection(Database, "sweeps")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if len(states) > 0 {
+		filter["State"] = bson.M{"$in": states}
+	}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"ID": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var sweeps []Sweep
+	for cursor.Next(ctx) {
+		var s Sweep
+		if err := cursor.Decode(&s); err != nil {
+			return nil, err
+		}
+		sweeps = append(sweeps, s)
+	}
+	return sweeps, nil
+}
+
+// GetLastSweepID retrieves the highest sweep ID, 0 when there are no sweeps
+func GetLastSweepID() (int64, error) {
+	collection := GetCollection(Database, "sweeps")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var s Sweep
+	err := collection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"ID": -1})).Decode(&s)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	return s.ID, err
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TOTP is the two-factor enrollment of a user. Secret is encrypted with
+// EncryptSecret before it is stored, RecoveryCodes only holds their hashes.
+type TOTP struct {
+	UserID        int64    `bson:"UserID"`
+	Secret        string   `bson:"Secret"`
+	Enabled       bool     `bson:"Enabled"`
+	RecoveryCodes []string `bson:"RecoveryCodes"`
+	LastStep      int64    `bson:"LastStep"`
+}
+
+// EncryptSecret seals the secret with AES-256-GCM under the 32 byte key and
+// returns it base64 encoded, with the nonce prepended.
+func EncryptSecret(key []byte, secret string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret opens a secret sealed by EncryptSecret.
+func DecryptSecret(key []byte, encrypted string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode base64: %v", err)
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted data is too short")
+	}
+
+	plainText, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %v", err)
+	}
+	return string(plainText), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// UpsertTOTP inserts the enrollment or replaces the stored one of the user
+func (t *TOTP) UpsertTOTP() error {
+	collection := GetCollection(Database, "totp")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"UserID": t.UserID}, t, options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetTOTPByUserID retrieves the enrollment of a user, ErrNotFound when there
+// is none
+func (t *TOTP) GetTOTPByUserID() error {
+	collection := GetCollection(Database, "totp")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return collection.FindOne(ctx, bson.M{"UserID": t.UserID}).Decode(t)
+}
+
+// DeleteTOTP removes the enrollment of a user
+func (t *TOTP) DeleteTOTP() error {
+	collection := GetCollection(Database, "totp")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.DeleteOne(ctx, bson.M{"UserID": t.UserID})
+	return err
+}
@@ -2,10 +2,12 @@ package db
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type User struct {
@@ -14,11 +16,12 @@ type User struct {
 	PassWD   string `bson:"Passwd"`
 	Email    string `bson:"Email"`
 	Phone    int64  `bson:"Phone"`
+	Frozen   bool   `bson:"Frozen"`
 }
 
 // InsertUser inserts a new user into the database
 func (user *User) InsertUser() error {
-	collection := GetCollection("crypto-exchange", "users")
+	collection := GetCollection(Database, "users")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -28,7 +31,7 @@ func (user *User) InsertUser() error {
 
 // GetUserByID retrieves a user by ID
 func (user *User) GetUserByID() error {
-	collection := GetCollection("crypto-exchange", "users")
+	collection := GetCollection(Database, "users")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -41,3 +44,69 @@ func (user *User) GetUserByID() error {
 	}
 	return nil
 }
+
+// GetUserByNameOrEmail retrieves a user with the user name or the email,
+// regardless of their case, ErrNotFound when there is none
+func GetUserByNameOrEmail(userName, email string) (User, error) {
+	collection := GetCollection(Database, "users")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// strength 2 compares the strings without their case
+	opts := options.FindOne().SetCollation(caseInsensitive)
+	filter := bson.M{"$or": bson.A{bson.M{"UserName": userName}, bson.M{"Email": email}}}
+
+	var user User
+	err := collection.FindOne(ctx, filter, opts).Decode(&user)
+	return user, err
+}
+
+// GetLastUserID retrieves the highest user ID, 0 when there are no users
+func GetLastUserID() (int64, error) {
+	collection := GetCollection(Database, "users")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user User
+	err := collection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"ID": -1})).Decode(&user)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return user.ID, nil
+}
+
+// GetUsers retrieves all users
+func GetUsers() ([]User, error) {
+	collection := GetCollection(Database, "users")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var users []User
+	for cursor.Next(ctx) {
+		var user User
+		if err := cursor.Decode(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// SetUserFrozen freezes or unfreezes the account of a user
+func SetUserFrozen(userID int64, frozen bool) error {
+	collection := GetCollection(Database, "users")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateOne(ctx, bson.M{"ID": userID}, bson.M{"$set": bson.M{"Frozen": frozen}})
+	return err
+}
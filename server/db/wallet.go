@@ -2,12 +2,7 @@ package db
 
 import (
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
-	"io"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -22,81 +17,26 @@ type Wallet struct {
 	LastAddrBalance float64 `bson:"LastAddrBalance"`
 }
 
-// SetEncryptPrivateKey encrypts the given privateKey string and stores it in w.PrivateKey.
-func (w *Wallet) SetEncryptPrivateKey(privateKey string) error {
-	passphrase := string(w.UserID)
-
-	// Convert the private key to bytes
-	keyBytes := []byte(privateKey)
-
-	// Create AES cipher block
-	block, err := aes.NewCipher(createAESKey(passphrase))
+// SetEncryptPrivateKey encrypts the private key with EncryptSecret under the
+// 32 byte key and stores it in w.PrivateKey.
+func (w *Wallet) SetEncryptPrivateKey(key []byte, privateKey string) error {
+	encrypted, err := EncryptSecret(key, privateKey)
 	if err != nil {
-		return fmt.Errorf("failed to create cipher: %v", err)
+		return err
 	}
-
-	// Generate a random IV
-	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return fmt.Errorf("failed to generate IV: %v", err)
-	}
-
-	// Encrypt using CFB mode
-	ciphertext := make([]byte, len(keyBytes))
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext, keyBytes)
-
-	// Prepend IV to ciphertext
-	encryptedData := append(iv, ciphertext...)
-
-	// Base64 encode
-	w.PrivateKey = base64.StdEncoding.EncodeToString(encryptedData)
+	w.PrivateKey = encrypted
 	return nil
 }
 
-// GetDecryptPrivateKey decrypts w.PrivateKey and returns the original private key string.
-func (w *Wallet) GetDecryptPrivateKey() (string, error) {
-	passphrase := string(w.UserID)
-
-	// Decode base64
-	encryptedData, err := base64.StdEncoding.DecodeString(w.PrivateKey)
-	if err != nil {
-		return "", fmt.Errorf("failed to decode base64: %v", err)
-	}
-
-	if len(encryptedData) < aes.BlockSize {
-		return "", fmt.Errorf("encrypted data is too short")
-	}
-
-	// Extract IV and ciphertext
-	iv := encryptedData[:aes.BlockSize]
-	ciphertext := encryptedData[aes.BlockSize:]
-
-	// Create AES cipher block
-	block, err := aes.NewCipher(createAESKey(passphrase))
-	if err != nil {
-		return "", fmt.Errorf("failed to create cipher: %v", err)
-	}
-
-	// Decrypt using CFB mode
-	plainText := make([]byte, len(ciphertext))
-	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(plainText, ciphertext)
-
-	// Convert bytes to string
-	return string(plainText), nil
-}
-
-// Example createAESKey function (should return a 32-byte key)
-func createAESKey(passphrase string) []byte {
-	key := make([]byte, 32)
-	copy(key, []byte(passphrase))
-	return key
+// GetDecryptPrivateKey decrypts w.PrivateKey with the key it was encrypted
+// under and returns the original private key string.
+func (w *Wallet) GetDecryptPrivateKey(key []byte) (string, error) {
+	return DecryptSecret(key, w.PrivateKey)
 }
 
 // InsertWallet inserts a new wallet into the database
 func (w *Wallet) InsertWallet() error {
-	collection := GetCollection("crypto-exchange", "wallets")
+	collection := GetCollection(Database, "wallets")
 	if collection == nil {
 		fmt.Println("collection Faile")
 	}
@@ -110,7 +50,7 @@ func (w *Wallet) InsertWallet() error {
 
 // GetWalletsByUserID retrieves all wallets associated with a user
 func GetWalletsByUserID(userID int64) ([]Wallet, error) {
-	collection := GetCollection("crypto-exchange", "wallets")
+	collection := GetCollection(Database, "wallets")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
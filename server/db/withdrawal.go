@@ -0,0 +1,153 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Withdrawal struct {
+	ID        int64   `bson:"ID"`
+	UserID    int64   `bson:"UserID"`
+	Asset     string  `bson:"Asset"`
+	Amount    float64 `bson:"Amount"`
+	Address   string  `bson:"Address"`
+	State     string  `bson:"State"`
+	TxHash    string  `bson:"TxHash"`
+	Nonce     int64   `bson:"Nonce"`
+	Reason    string  `bson:"Reason"`
+	CreatedAt int64   `bson:"CreatedAt"`
+	UpdatedAt int64   `bson:"UpdatedAt"`
+}
+
+// WithdrawalAddress is an address a user whitelisted to withdraw to
+type WithdrawalAddress struct {
+	UserID   int64  `bson:"UserID"`
+	Asset    string `bson:"Asset"`
+	Address  string `bson:"Address"`
+	Label    string `bson:"Label"`
+	AddedAt  int64  `bson:"AddedAt"`
+	UsableAt int64  `bson:"UsableAt"`
+}
+
+// UpsertWithdrawal inserts the withdrawal or replaces the stored one with the
+// same ID
+func (w *Withdrawal) UpsertWithdrawal() error {
+	collection := GetCollection(Database, "withdrawals")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.ReplaceOne(ctx, bson.M{"ID": w.ID}, w, options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetWithdrawalByID retrieves a withdrawal by ID, ErrNotFound when there is
+// none
+func (w *Withdrawal) GetWithdrawalByID() error {
+	collection := GetCollection(Database, "withdrawals")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return collection.FindOne(ctx, bson.M{"ID": w.ID}).Decode(w)
+}
+
+// GetWithdrawalsByUserID retrieves all withdrawals of a user
+func GetWithdrawalsByUserID(userID int64) ([]Withdrawal, error) {
+	return findWithdrawals(bson.M{"UserID": userID})
+}
+
+// GetWithdrawalsByState retrieves the withdrawals in any of the states
+func GetWithdrawalsByState(states ...string) ([]Withdrawal, error) {
+	return findWithdrawals(bson.M{"State": bson.M{"$in": states}})
+}
+
+// GetLastWithdrawalID retrieves the highest withdrawal ID, 0 when there are
+// no withdrawals
+func GetLastWithdrawalID() (int64, error) {
+	collection := GetCollection(Database, "withdrawals")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var w Withdrawal
+	err := collection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"ID": -1})).Decode(&w)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	return w.ID, err
+}
+
+func findWithdrawals(filter bson.M) ([]Withdrawal, error) {
+	collection := GetCollection(Database, "withdrawals")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"ID": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var withdrawals []Withdrawal
+	for cursor.Next(ctx) {
+		var w Withdrawal
+		if err := cursor.Decode(&w); err != nil {
+			return nil, err
+		}
+		withdrawals = append(withdrawals, w)
+	}
+	return withdrawals, nil
+}
+
+// InsertWithdrawalAddress whitelists the address for the user
+func (a *WithdrawalAddress) InsertWithdrawalAddress() error {
+	collection := GetCollection(Database, "withdrawal_addresses")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := collection.InsertOne(ctx, a)
+	return err
+}
+
+// GetWithdrawalAddresses retrieves the whitelisted addresses of a user
+func GetWithdrawalAddresses(userID int64) ([]WithdrawalAddress, error) {
+	collection := GetCollection(Database, "withdrawal_addresses")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"UserID": userID}, options.Find().SetSort(bson.M{"AddedAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var addresses []WithdrawalAddress
+	for cursor.Next(ctx) {
+		var a WithdrawalAddress
+		if err := cursor.Decode(&a); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, a)
+	}
+	return addresses, nil
+}
+
+// DeleteWithdrawalAddress removes an address from the whitelist of the user,
+// ErrNotFound when it is not on it
+func (a *WithdrawalAddress) DeleteWithdrawalAddress() error {
+	collection := GetCollection(Database, "withdrawal_addresses")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := collection.DeleteOne(ctx, bson.M{"UserID": a.UserID, "Address": a.Address})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
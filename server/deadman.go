@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DeadMansSwitch cancels all open orders of a user once the user stops
+// sending heartbeats for longer than the timeout it was armed with.
+type DeadMansSwitch struct {
+	mu       sync.Mutex
+	timers   map[int64]*deadmanTimer
+	onExpire func(userID int64)
+	// afterFunc runs f once the duration passed, it is time.AfterFunc
+	// outside of the tests
+	afterFunc func(d time.Duration, f func()) stoppable
+}
+
+// stoppable is a timer that can be stopped before it fires.
+type stoppable interface {
+	Stop() bool
+}
+
+type deadmanTimer struct {
+	timeout time.Duration
+	timer   stoppable
+	// generation guards against a timer that already fired racing with a
+	// heartbeat that re-armed it.
+	generation uint64
+}
+
+func NewDeadMansSwitch(onExpire func(userID int64)) *DeadMansSwitch {
+	return &DeadMansSwitch{
+		timers:   make(map[int64]*deadmanTimer),
+		onExpire: onExpire,
+		afterFunc: func(d time.Duration, f func()) stoppable {
+			return time.AfterFunc(d, f)
+		},
+	}
+}
+
+// Arm starts (or restarts) the cancel-after timer of the user.
+// A timeout <= 0 disarms the switch.
+func (d *DeadMansSwitch) Arm(userID int64, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		d.Disarm(userID)
+		return time.Time{}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.timers[userID]
+	if !ok {
+		t = &deadmanTimer{}
+		d.timers[userID] = t
+	}
+	t.timeout = timeout
+	d.reset(userID, t)
+
+	logrus.WithFields(logrus.Fields{
+		"userID":  userID,
+		"timeout": timeout,
+	}).Info("dead man's switch armed")
+
+	return time.Now().Add(timeout)
+}
+
+// Heartbeat pushes the deadline of an armed switch forward by its timeout.
+func (d *DeadMansSwitch) Heartbeat(userID int64) (time.Time, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.timers[userID]
+	if !ok {
+		return time.Time{}, fmt.Errorf("dead man's switch not armed for user: %d", userID)
+	}
+	d.reset(userID, t)
+
+	return time.Now().Add(t.timeout), nil
+}
+
+// Disarm stops the timer of the user without cancelling their orders.
+func (d *DeadMansSwitch) Disarm(userID int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if t, ok := d.timers[userID]; ok {
+		t.timer.Stop()
+		delete(d.timers, userID)
+	}
+}
+
+// Disconnect is called by persistent connection transports when the
+// connection of a user drops. If the switch is armed it fires right away.
+func (d *DeadMansSwitch) Disconnect(userID int64) {
+	d.mu.Lock()
+	t, ok := d.timers[userID]
+	if ok {
+		t.timer.Stop()
+		delete(d.timers, userID)
+	}
+	d.mu.Unlock()
+
+	if ok {
+		d.fire(userID, "disconnect")
+	}
+}
+
+// Stop disarms the switch of every user, no orders get cancelled by it
+// afterwards.
+func (d *DeadMansSwitch) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for userID, t := range d.timers {
+		t.timer.Stop()
+		delete(d.timers, userID)
+	}
+}
+
+// Armed reports whether the switch of the user is currently armed.
+func (d *DeadMansSwitch) Armed(userID int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.timers[userID]
+	return ok
+}
+
+// reset must be called with d.mu held.
+func (d *DeadMansSwitch) reset(userID int64, t *deadmanTimer) {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.generation++
+	generation := t.generation
+
+	t.timer = d.afterFunc(t.timeout, func() {
+		d.mu.Lock()
+		current, ok := d.timers[userID]
+		if !ok || current != t || t.generation != generation {
+			d.mu.Unlock()
+			return
+		}
+		delete(d.timers, userID)
+		d.mu.Unlock()
+
+		d.fire(userID, "heartbeat timeout")
+	})
+}
+
+func (d *DeadMansSwitch) fire(userID int64, reason string) {
+	logrus.WithFields(logrus.Fields{
+		"userID": userID,
+		"reason": reason,
+	}).Warn("dead man's switch fired, cancelling all orders")
+
+	d.onExpire(userID)
+}
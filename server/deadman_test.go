@@ -0,0 +1,138 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+func TestDeadMansSwitchFires(t *testing.T) {
+	fired := make(chan int64, 1)
+	d := NewDeadMansSwitch(func(userID int64) { fired <- userID })
+
+	d.Arm(7, 20*time.Millisecond)
+
+	select {
+	case userID := <-fired:
+		assert(t, userID, int64(7))
+	case <-time.After(time.Second):
+		t.Fatal("dead man's switch did not fire")
+	}
+	assert(t, d.Armed(7), false)
+}
+
+// testClock fires the timers of a switch once the test moves it past their
+// deadline, so the tests never wait on real time.
+type testClock struct {
+	mu     sync.Mutex
+	now    time.Duration
+	timers []*testTimer
+}
+
+type testTimer struct {
+	at      time.Duration
+	f       func()
+	stopped atomic.Bool
+}
+
+func (t *testTimer) Stop() bool {
+	return !t.stopped.Swap(true)
+}
+
+func (c *testClock) afterFunc(d time.Duration, f func()) stoppable {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &testTimer{at: c.now + d, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// advance moves the clock forward and runs the timers that came due.
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now += d
+	var due, pending []*testTimer
+	for _, t := range c.timers {
+		if t.at <= c.now {
+			due = append(due, t)
+		} else {
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	for _, t := range due {
+		if t.Stop() {
+			t.f()
+		}
+	}
+}
+
+func TestDeadMansSwitchHeartbeat(t *testing.T) {
+	var fired atomic.Int32
+	d := NewDeadMansSwitch(func(int64) { fired.Add(1) })
+	clock := &testClock{}
+	d.afterFunc = clock.afterFunc
+
+	_, err := d.Heartbeat(7)
+	assert(t, err != nil, true)
+
+	d.Arm(7, 50*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		clock.advance(40 * time.Millisecond)
+		_, err := d.Heartbeat(7)
+		assert(t, err, nil)
+	}
+	assert(t, fired.Load(), int32(0))
+
+	d.Disarm(7)
+	clock.advance(time.Second)
+	assert(t, fired.Load(), int32(0))
+
+	// without heartbeats it fires once the timeout passed
+	d.Arm(7, 50*time.Millisecond)
+	clock.advance(49 * time.Millisecond)
+	assert(t, fired.Load(), int32(0))
+	clock.advance(time.Millisecond)
+	assert(t, fired.Load(), int32(1))
+	assert(t, d.Armed(7), false)
+}
+
+func TestDeadMansSwitchDisconnect(t *testing.T) {
+	var fired atomic.Int32
+	d := NewDeadMansSwitch(func(int64) { fired.Add(1) })
+
+	// not armed, a disconnect must not cancel anything
+	d.Disconnect(7)
+	assert(t, fired.Load(), int32(0))
+
+	d.Arm(7, time.Minute)
+	d.Disconnect(7)
+	assert(t, fired.Load(), int32(1))
+	assert(t, d.Armed(7), false)
+}
+
+func TestCancelAllOrders(t *testing.T) {
+	ex, _ := newTestExchange(t, 7, 8)
+
+	buyOrder := orderbook.NewOrder(true, 5, 7)
+	sellOrder := orderbook.NewOrder(false, 5, 7)
+	otherOrder := orderbook.NewOrder(false, 5, 8)
+	ex.handlePlaceLimitOrder(token.MarketETHUSDT, 9_000, buyOrder)
+	ex.handlePlaceLimitOrder(token.MarketETHUSDT, 11_000, sellOrder)
+	ex.handlePlaceLimitOrder(token.MarketETHUSDT, 12_000, otherOrder)
+
+	assert(t, ex.cancelAllOrders(7), 2)
+
+	snapshot := bookSnapshot(ex, token.MarketETHUSDT)
+	assert(t, snapshot.BidTotalVolume, 0.0)
+	assert(t, snapshot.AskTotalVolume, 5.0)
+	assert(t, len(ex.Orders.UserOrders(7)), 0)
+	assert(t, len(ex.Orders.UserOrders(8)), 1)
+}
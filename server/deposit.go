@@ -0,0 +1,345 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/config"
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/cryptoClient"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// DepositState is where a deposit is at. Deposits are PENDING from the block
+// their transaction is seen in until it has enough confirmations, they are
+// CREDITED to the user then.
+type DepositState string
+
+const (
+	DepositPending  DepositState = "PENDING"
+	DepositCredited DepositState = "CREDITED"
+)
+
+// maxScanBlocks bounds the blocks scanned in one pass, a scanner far behind
+// the head catches up over several passes.
+const maxScanBlocks = 100
+
+var ErrDepositNotFound = errors.New("deposit not found")
+
+// Deposit is a transfer to the deposit address of a user, it is identified
+// by its transaction.
+type Deposit struct {
+	TxHash  string
+	UserID  int64
+	Asset   token.Asset
+	Amount  float64
+	Address string
+	// Block is the block the transaction was first seen in
+	Block         uint64
+	State         DepositState
+	Confirmations uint64
+	CreatedAt     int64
+	UpdatedAt     int64
+}
+
+// DepositAddress is where a user sends an asset to deposit it.
+type DepositAddress struct {
+	Asset   token.Asset
+	Address string
+}
+
+// DepositPolicy sets how the deposits are picked up from the chain.
+type DepositPolicy struct {
+	// Confirmations is the number of blocks a deposit needs to be credited,
+	// counting its own
+	Confirmations uint64
+	// StartBlock is scanned first when no block was scanned before, 0 starts
+	// at the head of the chain
+	StartBlock uint64
+}
+
+var DefaultDepositPolicy = DepositPolicy{
+	Confirmations: 12,
+}
+
+// depositPolicy is the policy of the deposits section of the config.
+func depositPolicy(cfg config.Deposits) DepositPolicy {
+	return DepositPolicy{
+		Confirmations: uint64(cfg.Confirmations),
+		StartBlock:    uint64(cfg.StartBlock),
+	}
+}
+
+// SetDepositStore replaces the store keeping the deposits, it has to be
+// called before the chain is scanned.
+func (ex *Exchange) SetDepositStore(store DepositStore) {
+	ex.deposits = store
+}
+
+// SetDepositPolicy sets how the deposits are picked up from the next scan
+// on.
+func (ex *Exchange) SetDepositPolicy(policy DepositPolicy) {
+	ex.depositMu.Lock()
+	defer ex.depositMu.Unlock()
+
+	ex.depositPolicy = policy
+}
+
+// runDeposits processes the deposits every interval until ctx is done.
+func (ex *Exchange) runDeposits(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, ex.processDeposits)
+}
+
+// processDeposits scans the new blocks for deposits and credits the pending
+// ones that have enough confirmations.
+func (ex *Exchange) processDeposits() {
+	if ex.chain == nil {
+		return
+	}
+
+	ex.depositMu.Lock()
+	defer ex.depositMu.Unlock()
+
+	if err := ex.scanDeposits(); err != nil {
+		logrus.WithError(err).Error("failed to scan for deposits")
+	}
+
+	pending, err := ex.deposits.GetDepositsInState(DepositPending)
+	if err != nil {
+		logrus.WithError(err).Error("failed to load deposits")
+		return
+	}
+	for _, d := range pending {
+		if err := ex.confirmDeposit(d); err != nil {
+			logrus.WithError(err).WithField("txHash", d.TxHash).Error("failed to confirm deposit")
+		}
+	}
+}
+
+// scanDeposits records the transfers to the deposit addresses in the blocks
+// since the last scan. The blocks that are not final yet are scanned again,
+// a reorg may have replaced them with blocks holding other transfers. The
+// scanned block is stored after each block, so a restart picks up where the
+// scan stopped and the deposits seen again are skipped.
+func (ex *Exchange) scanDeposits() error {
+	eth := ex.chain.Eth
+	head, err := eth.BlockNumber()
+	if err != nil {
+		return err
+	}
+
+	last, started, err := ex.deposits.LastScannedBlock()
+	if err != nil {
+		return err
+	}
+	// the blocks on top of the last one credited can still be replaced
+	unfinal := max(ex.depositPolicy.Confirmations, 1) - 1
+	from := ex.depositPolicy.StartBlock
+	switch {
+	case started:
+		from = last + 1 - min(last, unfinal)
+	case from == 0:
+		from = head
+	}
+	to := min(head, from+maxScanBlocks-1)
+
+	users := ex.depositAddresses()
+	watched := make(map[common.Address]bool, len(users))
+	for address := range users {
+		watched[address] = true
+	}
+
+	for n := from; n <= to; n++ {
+		transfers, err := eth.TransfersTo(n, watched)
+		if err != nil {
+			return err
+		}
+		for _, t := range transfers {
+			if err := ex.recordDeposit(users[t.To], t); err != nil {
+				return err
+			}
+		}
+
+		if !started || n > last {
+			if err := ex.deposits.SetLastScannedBlock(n); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// depositAddresses maps the ETH deposit address of every user to the user.
+func (ex *Exchange) depositAddresses() map[common.Address]int64 {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	addresses := make(map[common.Address]int64, len(ex.Users))
+	for _, user := range ex.Users {
+		if address, ok := depositAddress(user); ok {
+			addresses[address] = user.ID
+		}
+	}
+	return addresses
+}
+
+// depositAddress returns the ETH address of the wallet of the user, the
+// caller has to hold ex.mu.
+func depositAddress(user *User) (common.Address, bool) {
+	wallet, ok := user.Wallet[token.AssetETH]
+	if !ok {
+		return common.Address{}, false
+	}
+	address, err := wallet.GetPublicKey()
+	if err != nil || !common.IsHexAddress(address) {
+		return common.Address{}, false
+	}
+	return common.HexToAddress(address), true
+}
+
+// recordDeposit stores the transfer as a pending deposit of the user, unless
+// it was seen before.
+func (ex *Exchange) recordDeposit(userID int64, t cryptoClient.Transfer) error {
+	_, err := ex.deposits.GetDeposit(t.TxHash.Hex())
+	if !errors.Is(err, ErrDepositNotFound) {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	d := Deposit{
+		TxHash:    t.TxHash.Hex(),
+		UserID:    userID,
+		Asset:     token.AssetETH,
+		Amount:    ex.chain.Eth.BigIntToFloat(t.Amount),
+		Address:   t.To.Hex(),
+		Block:     t.Block,
+		State:     DepositPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := ex.deposits.SaveDeposit(d); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"txHash": d.TxHash,
+		"userID": d.UserID,
+		"amount": d.Amount,
+		"block":  d.Block,
+	}).Info("deposit seen")
+
+	return nil
+}
+
+// confirmDeposit follows the confirmations of a pending deposit and credits
+// it once there are enough. A transaction that left the chain in a reorg has
+// no confirmations and waits until it is mined again.
+func (ex *Exchange) confirmDeposit(d Deposit) error {
+	status, err := ex.chain.Eth.TxStatus(common.HexToHash(d.TxHash))
+	if err != nil {
+		return err
+	}
+
+	confirmations := status.Confirmations
+	if status.Failed {
+		confirmations = 0
+	}
+	if confirmations < ex.depositPolicy.Confirmations {
+		if confirmations == d.Confirmations {
+			return nil
+		}
+		d.Confirmations = confirmations
+		d.UpdatedAt = time.Now().UnixNano()
+		return ex.deposits.SaveDeposit(d)
+	}
+
+	return ex.creditDeposit(d, confirmations)
+}
+
+// creditDeposit posts the deposit to the ledger and stores it credited. The
+// ledger is looked up first, a crash between posting and storing the deposit
+// must not credit it twice.
+func (ex *Exchange) creditDeposit(d Deposit, confirmations uint64) error {
+	ref := depositRef(d.TxHash)
+	if !ex.depositPosted(d.UserID, ref) {
+		_, err := ex.Ledger.Deposit(d.UserID, d.Asset, d.Amount, ref)
+		cryptoClient.RecordDeposit(string(d.Asset), err)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.State = DepositCredited
+	d.Confirmations = confirmations
+	d.UpdatedAt = time.Now().UnixNano()
+	if err := ex.deposits.SaveDeposit(d); err != nil {
+		return err
+	}
+
+	ex.writeAudit(audit.Entry{
+		Actor:  audit.ActorSystem,
+		Action: audit.DepositCredited,
+		UserID: d.UserID,
+	}, map[string]any{
+		"txHash": d.TxHash,
+		"asset":  d.Asset,
+		"amount": d.Amount,
+	})
+	logrus.WithFields(logrus.Fields{
+		"txHash": d.TxHash,
+		"userID": d.UserID,
+		"asset":  d.Asset,
+		"amount": d.Amount,
+	}).Info("deposit credited")
+
+	return nil
+}
+
+// depositPosted tells whether the ledger holds the deposit entry of the ref.
+func (ex *Exchange) depositPosted(userID int64, ref string) bool {
+	for _, entry := range ex.Ledger.History(userID) {
+		if entry.Type == ledger.EntryDeposit && entry.Ref == ref {
+			return true
+		}
+	}
+	return false
+}
+
+func depositRef(txHash string) string {
+	return "deposit:" + txHash
+}
+
+func (ex *Exchange) handleGetDeposits(c echo.Context) error {
+	deposits, err := ex.deposits.GetUserDeposits(authUserID(c))
+	if err != nil {
+		return err
+	}
+	if deposits == nil {
+		deposits = []Deposit{}
+	}
+
+	return c.JSON(http.StatusOK, deposits)
+}
+
+// handleGetDepositAddresses lists the addresses the deposits of the user are
+// picked up from.
+func (ex *Exchange) handleGetDepositAddresses(c echo.Context) error {
+	ex.mu.RLock()
+	user, ok := ex.Users[authUserID(c)]
+	addresses := []DepositAddress{}
+	if ok {
+		if address, ok := depositAddress(user); ok {
+			addresses = append(addresses, DepositAddress{Asset: token.AssetETH, Address: address.Hex()})
+		}
+	}
+	ex.mu.RUnlock()
+
+	return c.JSON(http.StatusOK, addresses)
+}
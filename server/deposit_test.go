@@ -0,0 +1,150 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// sendTestDeposit sends ether from the exchange wallet to the deposit
+// address of the user.
+func sendTestDeposit(t *testing.T, ex *Exchange, userID int64, amount float64) common.Hash {
+	address, ok := depositAddress(ex.Users[userID])
+	if !ok {
+		t.Fatalf("user %d has no deposit address", userID)
+	}
+	hash, err := ex.chain.Eth.Transfer(ex.PrivateKey, address, ex.chain.Eth.FloatToBigInt(amount))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestDeposits(t *testing.T) {
+	ex, e := newTestExchange(t, 1, 2)
+	sim := newTestChain(t, ex, 100)
+	ex.SetDepositPolicy(DepositPolicy{Confirmations: 2})
+	start := getTestBalances(t, ex, 1)[token.AssetETH].Available
+
+	ex.processDeposits()
+	hash := sendTestDeposit(t, ex, 1, 1.5)
+	// transfers to addresses of no user are left alone
+	if _, err := ex.chain.Eth.Transfer(ex.PrivateKey, common.HexToAddress(testWithdrawalAddress), ex.chain.Eth.FloatToBigInt(1)); err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+	ex.processDeposits()
+
+	rec := doUserRequest(e, 1, http.MethodGet, "/v1/deposits", nil)
+	assert(t, rec.Code, http.StatusOK)
+	deposits := decodeTestResponse[[]Deposit](t, rec)
+	assert(t, len(deposits), 1)
+	assert(t, deposits[0].TxHash, hash.Hex())
+	assert(t, deposits[0].State, DepositPending)
+	assert(t, deposits[0].Confirmations, uint64(1))
+	assert(t, deposits[0].Amount, 1.5)
+	assert(t, getTestBalances(t, ex, 1)[token.AssetETH].Available, start)
+
+	sim.Commit()
+	ex.processDeposits()
+	d, _ := ex.deposits.GetDeposit(hash.Hex())
+	assert(t, d.State, DepositCredited)
+	assert(t, getTestBalances(t, ex, 1)[token.AssetETH].Available, start+1.5)
+	assert(t, ex.Ledger.Check(), nil)
+
+	rec = doUserRequest(e, 2, http.MethodGet, "/v1/deposits", nil)
+	assert(t, len(decodeTestResponse[[]Deposit](t, rec)), 0)
+
+	entries := ex.Audit.Search(audit.Filter{UserID: 1, Action: audit.DepositCredited})
+	assert(t, len(entries), 1)
+	assert(t, entries[0].Details["txHash"], hash.Hex())
+}
+
+func TestDepositsAreCreditedOnce(t *testing.T) {
+	ex, _ := newTestExchange(t, 1)
+	sim := newTestChain(t, ex, 100)
+	ex.SetDepositPolicy(DepositPolicy{Confirmations: 1})
+	start := getTestBalances(t, ex, 1)[token.AssetETH].Available
+
+	ex.processDeposits()
+	hash := sendTestDeposit(t, ex, 1, 2)
+	sim.Commit()
+	ex.processDeposits()
+	assert(t, getTestBalances(t, ex, 1)[token.AssetETH].Available, start+2)
+
+	// a crash after the ledger was posted and before anything else was
+	// stored scans the block again and finds the deposit pending
+	d, _ := ex.deposits.GetDeposit(hash.Hex())
+	d.State = DepositPending
+	ex.deposits.SaveDeposit(d)
+	ex.deposits.SetLastScannedBlock(d.Block - 1)
+	sim.Commit()
+	ex.processDeposits()
+	ex.processDeposits()
+
+	d, _ = ex.deposits.GetDeposit(hash.Hex())
+	assert(t, d.State, DepositCredited)
+	assert(t, getTestBalances(t, ex, 1)[token.AssetETH].Available, start+2)
+
+	posted := 0
+	for _, entry := range ex.Ledger.History(1) {
+		if entry.Type == ledger.EntryDeposit && entry.Ref == depositRef(hash.Hex()) {
+			posted++
+		}
+	}
+	assert(t, posted, 1)
+}
+
+// testJournal is a journal that could not write its entries while it fails.
+type testJournal struct {
+	fail bool
+}
+
+func (j *testJournal) Sync() error {
+	if j.fail {
+		return errors.New("journal down")
+	}
+	return nil
+}
+
+func TestDepositWaitsForJournal(t *testing.T) {
+	ex, _ := newTestExchange(t, 1)
+	sim := newTestChain(t, ex, 100)
+	journal := &testJournal{}
+	ex.SetDepositStore(journaledDepositStore{ex.deposits, journal})
+	ex.SetDepositPolicy(DepositPolicy{Confirmations: 2})
+	start := getTestBalances(t, ex, 1)[token.AssetETH].Available
+
+	ex.processDeposits()
+	hash := sendTestDeposit(t, ex, 1, 2)
+	sim.Commit()
+	ex.processDeposits()
+	sim.Commit()
+	journal.fail = true
+	ex.processDeposits()
+
+	// the deposit is not stored credited while its entry may be lost
+	d, err := ex.deposits.GetDeposit(hash.Hex())
+	assert(t, err, nil)
+	assert(t, d.State, DepositPending)
+
+	journal.fail = false
+	ex.processDeposits()
+	d, _ = ex.deposits.GetDeposit(hash.Hex())
+	assert(t, d.State, DepositCredited)
+	assert(t, getTestBalances(t, ex, 1)[token.AssetETH].Available, start+2)
+}
+
+func TestDepositAddresses(t *testing.T) {
+	ex, e := newTestExchange(t, 1)
+	address, _ := ex.Users[1].Wallet[token.AssetETH].GetPublicKey()
+
+	rec := doUserRequest(e, 1, http.MethodGet, "/v1/users/me/deposit-addresses", nil)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, decodeTestResponse[[]DepositAddress](t, rec), []DepositAddress{{Asset: token.AssetETH, Address: address}})
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/anakinrm/crypto-exchange/server/db"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+// DepositStore keeps the deposits seen on chain and how far the chain was
+// scanned for them.
+type DepositStore interface {
+	// SaveDeposit inserts the deposit or replaces the one of the same
+	// transaction
+	SaveDeposit(d Deposit) error
+	// GetDeposit returns ErrDepositNotFound for unknown transactions
+	GetDeposit(txHash string) (Deposit, error)
+	// GetUserDeposits returns all the deposits of the user, oldest first
+	GetUserDeposits(userID int64) ([]Deposit, error)
+	// GetDepositsInState returns the deposits of all users in the state,
+	// oldest first
+	GetDepositsInState(state DepositState) ([]Deposit, error)
+
+	// LastScannedBlock returns false before the first block was scanned
+	LastScannedBlock() (uint64, bool, error)
+	SetLastScannedBlock(block uint64) error
+}
+
+// MemoryDepositStore is a DepositStore that lives as long as the process.
+type MemoryDepositStore struct {
+	mu       sync.RWMutex
+	deposits map[string]Deposit
+	scanned  uint64
+	started  bool
+}
+
+func NewMemoryDepositStore() *MemoryDepositStore {
+	return &MemoryDepositStore{
+		deposits: make(map[string]Deposit),
+	}
+}
+
+func (s *MemoryDepositStore) SaveDeposit(d Deposit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deposits[d.TxHash] = d
+	return nil
+}
+
+func (s *MemoryDepositStore) GetDeposit(txHash string) (Deposit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.deposits[txHash]
+	if !ok {
+		return Deposit{}, ErrDepositNotFound
+	}
+	return d, nil
+}
+
+func (s *MemoryDepositStore) GetUserDeposits(userID int64) ([]Deposit, error) {
+	return s.find(func(d Deposit) bool { return d.UserID == userID }), nil
+}
+
+func (s *MemoryDepositStore) GetDepositsInState(state DepositState) ([]Deposit, error) {
+	return s.find(func(d Deposit) bool { return d.State == state }), nil
+}
+
+func (s *MemoryDepositStore) find(match func(Deposit) bool) []Deposit {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deposits := []Deposit{}
+	for _, d := range s.deposits {
+		if match(d) {
+			deposits = append(deposits, d)
+		}
+	}
+	sort.Slice(deposits, func(i, j int) bool {
+		if deposits[i].Block != deposits[j].Block {
+			return deposits[i].Block < deposits[j].Block
+		}
+		return deposits[i].CreatedAt < deposits[j].CreatedAt
+	})
+
+	return deposits
+}
+
+func (s *MemoryDepositStore) LastScannedBlock() (uint64, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.scanned, s.started, nil
+}
+
+func (s *MemoryDepositStore) SetLastScannedBlock(block uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scanned = block
+	s.started = true
+	return nil
+}
+
+// MongoDepositStore is a DepositStore backed by the deposits and
+// scan_cursors collections, the db has to be initialized with
+// db.InitializeMongo first.
+type MongoDepositStore struct{}
+
+func NewMongoDepositStore() *MongoDepositStore {
+	return &MongoDepositStore{}
+}
+
+func (s *MongoDepositStore) SaveDeposit(d Deposit) error {
+	depositDB := db.Deposit{
+		TxHash:        d.TxHash,
+		UserID:        d.UserID,
+		Asset:         string(d.Asset),
+		Amount:        d.Amount,
+		Address:       d.Address,
+		Block:         int64(d.Block),
+		State:         string(d.State),
+		Confirmations: int64(d.Confirmations),
+		CreatedAt:     d.CreatedAt,
+		UpdatedAt:     d.UpdatedAt,
+	}
+
+	return depositDB.UpsertDeposit()
+}
+
+func (s *MongoDepositStore) GetDeposit(txHash string) (Deposit, error) {
+	depositDB := db.Deposit{
+		TxHash: txHash,
+	}
+	if err := depositDB.GetDepositByTxHash(); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return Deposit{}, ErrDepositNotFound
+		}
+		return Deposit{}, err
+	}
+
+	return newDepositFromDB(depositDB), nil
+}
+
+func (s *MongoDepositStore) GetUserDeposits(userID int64) ([]Deposit, error) {
+	depositsDB, err := db.GetDepositsByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return newDepositsFromDB(depositsDB), nil
+}
+
+func (s *MongoDepositStore) GetDepositsInState(state DepositState) ([]Deposit, error) {
+	depositsDB, err := db.GetDepositsByState(string(state))
+	if err != nil {
+		return nil, err
+	}
+	return newDepositsFromDB(depositsDB), nil
+}
+
+func (s *MongoDepositStore) LastScannedBlock() (uint64, bool, error) {
+	block, ok, err := db.GetScanCursor(string(token.AssetETH))
+	return uint64(block), ok, err
+}
+
+func (s *MongoDepositStore) SetLastScannedBlock(block uint64) error {
+	cursor := db.ScanCursor{
+		Chain: string(token.AssetETH),
+		Block: int64(block),
+	}
+	return cursor.UpsertScanCursor()
+}
+
+func newDepositsFromDB(depositsDB []db.Deposit) []Deposit {
+	deposits := make([]Deposit, len(depositsDB))
+	for i, d := range depositsDB {
+		deposits[i] = newDepositFromDB(d)
+	}
+	return deposits
+}
+
+func newDepositFromDB(d db.Deposit) Deposit {
+	return Deposit{
+		TxHash:        d.TxHash,
+		UserID:        d.UserID,
+		Asset:         token.Asset(d.Asset),
+		Amount:        d.Amount,
+		Address:       d.Address,
+		Block:         uint64(d.Block),
+		State:         DepositState(d.State),
+		Confirmations: uint64(d.Confirmations),
+		CreatedAt:     d.CreatedAt,
+		UpdatedAt:     d.UpdatedAt,
+	}
+}
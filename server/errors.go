@@ -0,0 +1,229 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/reserves"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrorCode is the machine readable part of an APIError. Codes are stable,
+// the messages next to them are not.
+type ErrorCode string
+
+const (
+	// codes of requests failing for no more specific reason, one per status
+	CodeBadRequest       ErrorCode = "BAD_REQUEST"
+	CodeUnauthorized     ErrorCode = "UNAUTHORIZED"
+	CodeForbidden        ErrorCode = "FORBIDDEN"
+	CodeNotFound         ErrorCode = "NOT_FOUND"
+	CodeMethodNotAllowed ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeConflict         ErrorCode = "CONFLICT"
+	CodeInternal         ErrorCode = "INTERNAL_SERVER_ERROR"
+
+	CodeInsufficientBalance   ErrorCode = "INSUFFICIENT_BALANCE"
+	CodeInsufficientLiquidity ErrorCode = "INSUFFICIENT_LIQUIDITY"
+	CodeInvalidOrder          ErrorCode = "INVALID_ORDER"
+	CodeOrderNotFound         ErrorCode = "ORDER_NOT_FOUND"
+	CodeUnknownMarket         ErrorCode = "UNKNOWN_MARKET"
+	CodeMarketListed          ErrorCode = "MARKET_LISTED"
+	CodeMarketCancelOnly      ErrorCode = "MARKET_CANCEL_ONLY"
+	CodeUserNotFound          ErrorCode = "USER_NOT_FOUND"
+	CodeUserExists            ErrorCode = "USER_EXISTS"
+	CodeInvalidCredentials    ErrorCode = "INVALID_CREDENTIALS"
+	CodeSessionNotFound       ErrorCode = "SESSION_NOT_FOUND"
+	CodeSessionExpired        ErrorCode = "SESSION_EXPIRED"
+	CodeAPIKeyNotFound        ErrorCode = "API_KEY_NOT_FOUND"
+	CodeInvalidSignature      ErrorCode = "INVALID_SIGNATURE"
+	CodeReplayedRequest       ErrorCode = "REPLAYED_REQUEST"
+	CodeMissingScope          ErrorCode = "MISSING_SCOPE"
+	CodeTOTPRequired          ErrorCode = "TOTP_REQUIRED"
+	CodeInvalidTOTP           ErrorCode = "INVALID_TOTP"
+	CodeTOTPEnrolled          ErrorCode = "TOTP_ENROLLED"
+	CodeTOTPNotEnrolled       ErrorCode = "TOTP_NOT_ENROLLED"
+	CodeShuttingDown          ErrorCode = "SHUTTING_DOWN"
+	CodeAccountFrozen         ErrorCode = "ACCOUNT_FROZEN"
+	CodeWithdrawalNotFound    ErrorCode = "WITHDRAWAL_NOT_FOUND"
+	CodeInvalidWithdrawal     ErrorCode = "INVALID_WITHDRAWAL_STATE"
+	CodeWithdrawalLimit       ErrorCode = "WITHDRAWAL_LIMIT_EXCEEDED"
+	CodeInvalidAddress        ErrorCode = "INVALID_ADDRESS"
+	CodeAddressNotWhitelisted ErrorCode = "ADDRESS_NOT_WHITELISTED"
+	CodeAddressCoolingDown    ErrorCode = "ADDRESS_COOLING_DOWN"
+	CodeAddressWhitelisted    ErrorCode = "ADDRESS_WHITELISTED"
+	CodeReservesNotFound      ErrorCode = "RESERVES_NOT_FOUND"
+	CodeProofNotFound         ErrorCode = "PROOF_NOT_FOUND"
+	CodeInvalidBatch          ErrorCode = "INVALID_BATCH"
+	CodeBatchAborted          ErrorCode = "BATCH_ABORTED"
+)
+
+// errorCodes maps the errors a handler can return as they are to the code and
+// status of their response.
+var errorCodes = []struct {
+	err    error
+	status int
+	code   ErrorCode
+}{
+	{ledger.ErrInsufficientBalance, http.StatusBadRequest, CodeInsufficientBalance},
+	{orderbook.ErrNotEnoughVolume, http.StatusBadRequest, CodeInsufficientLiquidity},
+	{ErrInvalidOrder, http.StatusBadRequest, CodeInvalidOrder},
+	{ErrOrderNotFound, http.StatusNotFound, CodeOrderNotFound},
+	{ErrMarketNotFound, http.StatusNotFound, CodeUnknownMarket},
+	{ErrMarketListed, http.StatusConflict, CodeMarketListed},
+	{ErrMarketCancelOnly, http.StatusConflict, CodeMarketCancelOnly},
+	{ErrUserNotFound, http.StatusNotFound, CodeUserNotFound},
+	{ErrUserExists, http.StatusConflict, CodeUserExists},
+	{ErrInvalidCredentials, http.StatusUnauthorized, CodeInvalidCredentials},
+	{ErrSessionNotFound, http.StatusUnauthorized, CodeSessionNotFound},
+	{ErrSessionExpired, http.StatusUnauthorized, CodeSessionExpired},
+	{ErrAPIKeyNotFound, http.StatusNotFound, CodeAPIKeyNotFound},
+	{ErrInvalidSignature, http.StatusUnauthorized, CodeInvalidSignature},
+	{ErrReplayedRequest, http.StatusUnauthorized, CodeReplayedRequest},
+	{ErrMissingScope, http.StatusForbidden, CodeMissingScope},
+	{ErrTOTPRequired, http.StatusUnauthorized, CodeTOTPRequired},
+	{ErrInvalidTOTP, http.StatusUnauthorized, CodeInvalidTOTP},
+	{ErrTOTPEnrolled, http.StatusConflict, CodeTOTPEnrolled},
+	{ErrTOTPNotEnrolled, http.StatusNotFound, CodeTOTPNotEnrolled},
+	{ErrShuttingDown, http.StatusServiceUnavailable, CodeShuttingDown},
+	{ErrAccountFrozen, http.StatusForbidden, CodeAccountFrozen},
+	{ErrWithdrawalNotFound, http.StatusNotFound, CodeWithdrawalNotFound},
+	{ErrWithdrawalState, http.StatusConflict, CodeInvalidWithdrawal},
+	{ErrWithdrawalLimit, http.StatusBadRequest, CodeWithdrawalLimit},
+	{ErrInvalidAddress, http.StatusBadRequest, CodeInvalidAddress},
+	{ErrAddressNotWhitelisted, http.StatusForbidden, CodeAddressNotWhitelisted},
+	{ErrAddressCoolingDown, http.StatusForbidden, CodeAddressCoolingDown},
+	{ErrAddressWhitelisted, http.StatusConflict, CodeAddressWhitelisted},
+	{ErrNoReserves, http.StatusNotFound, CodeReservesNotFound},
+	{reserves.ErrUserNotFound, http.StatusNotFound, CodeProofNotFound},
+	{ErrInvalidBatch, http.StatusBadRequest, CodeInvalidBatch},
+	{ErrBatchAborted, http.StatusConflict, CodeBatchAborted},
+}
+
+// ErrorOf returns the error behind a code, so clients can check the errors
+// they got back with errors.Is. Codes of a status only have none.
+func ErrorOf(code ErrorCode) error {
+	for _, c := range errorCodes {
+		if c.code == code {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// statusCode is the code of a status without a more specific error, e.g.
+// TOO_MANY_REQUESTS.
+func statusCode(status int) ErrorCode {
+	text := http.StatusText(status)
+	if text == "" {
+		return CodeInternal
+	}
+	return ErrorCode(strings.ToUpper(strings.ReplaceAll(text, " ", "_")))
+}
+
+// Error is a failed request. Handlers return it and httpErrorHandler sends it
+// to the client as an APIError.
+type Error struct {
+	Status int
+	Code   ErrorCode
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newError fails the request with the status. The code is the one of the
+// error in errorCodes that err wraps, or the code of the status.
+func newError(status int, err error) error {
+	code := statusCode(status)
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			code = c.code
+			break
+		}
+	}
+	return &Error{Status: status, Code: code, Err: err}
+}
+
+func newErrorf(status int, format string, args ...any) error {
+	return newError(status, fmt.Errorf(format, args...))
+}
+
+// toError turns whatever a handler returned into the Error sent to the
+// client. Errors the handler did not describe are internal ones, their
+// message is not handed out.
+func toError(err error) *Error {
+	var (
+		apiErr  *Error
+		httpErr *echo.HTTPError
+	)
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	if errors.As(err, &httpErr) {
+		return &Error{
+			Status: httpErr.Code,
+			Code:   statusCode(httpErr.Code),
+			Err:    fmt.Errorf("%v", httpErr.Message),
+		}
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return &Error{Status: c.status, Code: c.code, Err: err}
+		}
+	}
+
+	return &Error{
+		Status: http.StatusInternalServerError,
+		Code:   CodeInternal,
+		Err:    errors.New("internal server error"),
+	}
+}
+
+// httpErrorHandler sends every failed request as an APIError, tagged with the
+// ID of the request so it can be found in the logs.
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	var (
+		apiErr    = toError(err)
+		requestID = c.Response().Header().Get(echo.HeaderXRequestID)
+	)
+
+	log := logrus.WithFields(logrus.Fields{
+		"requestID": requestID,
+		"method":    c.Request().Method,
+		"path":      c.Request().URL.Path,
+		"status":    apiErr.Status,
+		"code":      apiErr.Code,
+	})
+	if apiErr.Status >= http.StatusInternalServerError {
+		log.WithError(err).Error("request failed")
+	} else {
+		log.WithError(err).Debug("request failed")
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(apiErr.Status)
+	} else {
+		err = c.JSON(apiErr.Status, APIError{
+			Code:      apiErr.Code,
+			Error:     apiErr.Error(),
+			RequestID: requestID,
+		})
+	}
+	if err != nil {
+		log.WithError(err).Error("failed to send error response")
+	}
+}
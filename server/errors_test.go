@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/labstack/echo/v4"
+)
+
+func decodeAPIError(t *testing.T, rec *httptest.ResponseRecorder) APIError {
+	apiErr := APIError{}
+	if err := json.NewDecoder(rec.Body).Decode(&apiErr); err != nil {
+		t.Fatal(err)
+	}
+	return apiErr
+}
+
+func TestErrorResponses(t *testing.T) {
+	e := newRouter(newFundedExchange(t, 10, 1_000, 1))
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   any
+		status int
+		code   ErrorCode
+	}{
+		{http.MethodPost, "/order", PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 10, Price: 1_000, Market: token.MarketETHUSDT}, http.StatusBadRequest, CodeInsufficientBalance},
+		{http.MethodPost, "/order", PlaceOrderRequest{Type: MarketOrder, Size: 1, Market: token.MarketETHUSDT}, http.StatusBadRequest, CodeInsufficientLiquidity},
+		{http.MethodPost, "/order", PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 1_000, Market: "DOGE-USDT"}, http.StatusBadRequest, CodeUnknownMarket},
+		{http.MethodPost, "/order", PlaceOrderRequest{Type: LimitOrder, Size: -1, Price: 1_000, Market: token.MarketETHUSDT}, http.StatusBadRequest, CodeInvalidOrder},
+		{http.MethodDelete, "/order/42", nil, http.StatusNotFound, CodeOrderNotFound},
+		{http.MethodGet, "/order/id/42", nil, http.StatusNotFound, CodeOrderNotFound},
+		{http.MethodGet, "/balances/2", nil, http.StatusForbidden, CodeForbidden},
+	} {
+		rec := doUserRequest(e, 1, tc.method, tc.path, tc.body)
+		assert(t, rec.Code, tc.status)
+
+		apiErr := decodeAPIError(t, rec)
+		assert(t, apiErr.Code, tc.code)
+		assert(t, apiErr.RequestID != "", true)
+		assert(t, apiErr.RequestID, rec.Header().Get(echo.HeaderXRequestID))
+	}
+
+	rec := doRequest(e, http.MethodGet, "/book/DOGE-USDT", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	assert(t, decodeAPIError(t, rec).Code, CodeUnknownMarket)
+
+	rec = doRequest(e, http.MethodGet, "/balances/1", nil)
+	assert(t, rec.Code, http.StatusUnauthorized)
+	assert(t, decodeAPIError(t, rec).Code, CodeUnauthorized)
+
+	rec = doRequest(e, http.MethodGet, "/nothing", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	assert(t, decodeAPIError(t, rec).Code, CodeNotFound)
+}
+
+func TestInternalErrorsAreHidden(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	e.GET("/fail", func(c echo.Context) error {
+		return fmt.Errorf("mongo: connection refused")
+	})
+	e.GET("/balance", func(c echo.Context) error {
+		return fmt.Errorf("settling: %w", ledger.ErrInsufficientBalance)
+	})
+
+	rec := doRequest(e, http.MethodGet, "/fail", nil)
+	assert(t, rec.Code, http.StatusInternalServerError)
+	apiErr := decodeAPIError(t, rec)
+	assert(t, apiErr.Code, CodeInternal)
+	assert(t, apiErr.Error, "internal server error")
+
+	// errors with a code keep it, even when not wrapped in an Error
+	rec = doRequest(e, http.MethodGet, "/balance", nil)
+	assert(t, rec.Code, http.StatusBadRequest)
+	assert(t, decodeAPIError(t, rec).Code, CodeInsufficientBalance)
+
+	assert(t, errors.Is(ErrorOf(CodeOrderNotFound), ErrOrderNotFound), true)
+	assert(t, ErrorOf(CodeBadRequest), nil)
+}
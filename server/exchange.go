@@ -3,14 +3,19 @@ package server
 import (
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/cryptoClient"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
 	"github.com/anakinrm/crypto-exchange/server/token"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/labstack/echo/v4"
@@ -20,132 +25,312 @@ import (
 type Exchange struct {
 	mu    sync.RWMutex
 	Users map[int64]*User
-	//orders maps a user to his order
-	Orders     map[int64][]*orderbook.Order
+	// Orders indexes the open orders of every user
+	Orders *OrderIndex
+	// Ledger holds the balances of the users, the wallets only know about
+	// the on-chain addresses
+	Ledger *ledger.Ledger
+	// Fees assigns the maker and taker rates of every fill
+	Fees *FeeEngine
+	// APIKeys and Sessions authenticate the requests of the users
+	APIKeys    *APIKeyStore
+	Sessions   *SessionStore
 	PrivateKey *ecdsa.PrivateKey
-	orderbooks map[token.Market]*orderbook.Orderbook
+	// every market is owned by the single goroutine of its engine
+	markets    *MarketRegistry
+	orderStore OrderStore
+	userStore  UserStore
+	deadman    *DeadMansSwitch
+	adminToken string
+	// Audit records who changed what on the exchange
+	Audit *audit.Log
+	// totp keeps the two-factor enrollments, totpMu orders the checks of a
+	// code against its replay
+	totp   TOTPStore
+	totpMu sync.Mutex
+	// chain sends the on-chain transactions of the exchange
+	chain *cryptoClient.Client
+	// withdrawals keeps the withdrawals and the whitelisted addresses,
+	// withdrawMu orders the risk checks and the state changes of them
+	withdrawals      WithdrawalStore
+	withdrawalPolicy WithdrawalPolicy
+	withdrawMu       sync.Mutex
+	// deposits keeps the deposits seen on chain, depositMu orders the scans
+	deposits      DepositStore
+	depositPolicy DepositPolicy
+	depositMu     sync.Mutex
+	// sweeps records the sweeps of the deposit addresses and the hot
+	// wallet, sweepMu orders the passes of the sweeper
+	sweeps      SweepStore
+	sweepPolicy SweepPolicy
+	sweepMu     sync.Mutex
+	// hotMu orders the transactions of the hot wallet, each one takes the
+	// next nonce
+	hotMu sync.Mutex
+	// reserves is the proof of reserves published last, reservesID the ID
+	// it was given which the next report counts on from
+	reserves   *ReservesReport
+	reservesID int64
+	reservesMu sync.RWMutex
+	// orderListener gets the order events of every market, it runs on the
+	// engine goroutine and must not block
+	orderListener func(market token.Market, e orderbook.Event)
 }
 
+// NewExchange creates an exchange listing the DefaultMarkets.
 func NewExchange(privateKey string) (*Exchange, error) {
-	orderbooks := make(map[token.Market]*orderbook.Orderbook)
-	orderbooks[token.MarketETH] = orderbook.NewOrderbook()
+	return NewExchangeWithMarkets(privateKey, DefaultMarkets)
+}
+
+func NewExchangeWithMarkets(privateKey string, markets []MarketConfig) (*Exchange, error) {
 	privateKeyECDSA, err := crypto.HexToECDSA(privateKey)
 	if err != nil {
 		return nil, err
 	}
-	return &Exchange{
+	fees, err := NewFeeEngine(DefaultFeeSchedule)
+	if err != nil {
+		return nil, err
+	}
+	ex := &Exchange{
 		Users:      make(map[int64]*User),
-		Orders:     make(map[int64][]*orderbook.Order),
+		Orders:     NewOrderIndex(),
+		Ledger:     ledger.NewLedger(),
+		Fees:       fees,
+		APIKeys:    NewAPIKeyStore(),
+		Sessions:   NewSessionStore(),
 		PrivateKey: privateKeyECDSA,
-		orderbooks: orderbooks,
-	}, nil
+		orderStore: NewMemoryOrderStore(),
+		userStore:  NewMemoryUserStore(),
+		totp:       NewMemoryTOTPStore(),
+		Audit:      audit.NewLog(),
+
+		withdrawals:      NewMemoryWithdrawalStore(),
+		withdrawalPolicy: DefaultWithdrawalPolicy,
+		deposits:         NewMemoryDepositStore(),
+		depositPolicy:    DefaultDepositPolicy,
+		sweeps:           NewMemorySweepStore(),
+		sweepPolicy:      DefaultSweepPolicy,
+	}
+	ex.markets = NewMarketRegistry(ex.orderEventHandler)
+
+	for _, cfg := range markets {
+		if err := ex.markets.List(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	ex.deadman = NewDeadMansSwitch(func(userID int64) {
+		cancelled := ex.cancelAllOrders(userID)
+		ex.writeAudit(audit.Entry{
+			Actor:  audit.ActorSystem,
+			Action: audit.OrdersCancelled,
+			UserID: userID,
+		}, map[string]any{"cancelled": cancelled, "reason": "dead man's switch"})
+	})
+
+	return ex, nil
 }
 
-type GetOrdersResponse struct {
-	Asks []Order
-	Bids []Order
+// SetChainClient sets the client the exchange reaches the chains with.
+func (ex *Exchange) SetChainClient(chain *cryptoClient.Client) {
+	ex.chain = chain
 }
 
-func (ex *Exchange) registerUser(id int64, userName, passWd, email string, phone int64) {
-	user := NewUser(id, userName, passWd, email, phone)
-	ex.Users[id] = user
+// SetOrderStore replaces the store keeping the order history, it has to be
+// called before any order is placed.
+func (ex *Exchange) SetOrderStore(store OrderStore) {
+	ex.orderStore = store
+}
 
-	logrus.WithFields(logrus.Fields{
-		"id": id,
-	}).Info("new exchange user")
+// orderEventHandler keeps the open order index and the order history of the
+// market up to date.
+func (ex *Exchange) orderEventHandler(market token.Market) orderbook.EventHandler {
+	indexHandler := ex.Orders.EventHandler(market)
+	pair, _ := market.Pair()
+
+	return func(e orderbook.Event) {
+		indexHandler(e)
+
+		// orders leaving the book unfilled give back what they held
+		if e.Type == orderbook.EventCancelled || e.Type == orderbook.EventExpired {
+			if e.Bid {
+				ex.releaseHold(e.UserID, pair.Quote, e.Size*e.Price, holdRef(market, e.OrderID))
+			} else {
+				ex.releaseHold(e.UserID, pair.Base, e.Size, holdRef(market, e.OrderID))
+			}
+		}
+		if ex.orderListener != nil {
+			ex.orderListener(market, e)
+		}
+
+		order, err := ex.eventOrder(e.OrderID)
+		if errors.Is(err, ErrOrderNotFound) {
+			order = newOrderFromEvent(market, e)
+		} else if err != nil {
+			logrus.WithError(err).WithField("orderID", e.OrderID).Error("failed to load order")
+			return
+		} else {
+			applyEvent(&order, e)
+		}
+		countOrderEvent(market, order.Type, e.Type)
+
+		if err := ex.orderStore.SaveOrder(order); err != nil {
+			logrus.WithError(err).WithField("orderID", e.OrderID).Error("failed to store order")
+		}
+	}
+}
+
+// eventOrder returns the order an event is about. A buffered store keeps
+// every open order in memory, so it is only asked for what it has in memory
+// and the engine never waits on the storage.
+func (ex *Exchange) eventOrder(id int64) (Order, error) {
+	buffered, ok := ex.orderStore.(*BufferedOrderStore)
+	if !ok {
+		return ex.orderStore.GetOrder(id)
+	}
+	if order, ok := buffered.cachedOrder(id); ok {
+		return order, nil
+	}
+	return Order{}, ErrOrderNotFound
+}
+
+type GetOrdersResponse struct {
+	Asks []Order
+	Bids []Order
 }
 
 func (ex *Exchange) handleGetTrades(c echo.Context) error {
 	market := token.Market(c.Param("market"))
 
-	ob, ok := ex.orderbooks[market]
+	ob, ok := ex.markets.Engine(market)
 	if !ok {
-		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
+		return newErrorf(http.StatusNotFound, "%w: %s", ErrMarketNotFound, market)
 	}
 
-	return c.JSON(http.StatusOK, ob.Trades)
+	return c.JSON(http.StatusOK, ob.Snapshot().Trades)
 
 }
 
+const (
+	OrderFilterOpen   = "open"
+	OrderFilterClosed = "closed"
+	OrderFilterAll    = "all"
+)
+
+// handleGetOrders returns the open orders of the user, the status query
+// parameter selects "closed", "all" or the orders in a single status instead.
 func (ex *Exchange) handleGetOrders(c echo.Context) error {
 	userIDstr := c.Param("userID")
 	userID, err := strconv.Atoi(userIDstr)
 	if err != nil {
-		return err
+		return newError(http.StatusBadRequest, err)
+	}
+
+	var (
+		filter = c.QueryParam("status")
+		orders []Order
+	)
+	if filter == "" || filter == OrderFilterOpen {
+		orders = ex.Orders.UserOrders(int64(userID))
+	} else {
+		allOrders, err := ex.orderStore.GetUserOrders(int64(userID))
+		if err != nil {
+			return err
+		}
+
+		for _, order := range allOrders {
+			if matchesOrderFilter(order, filter) {
+				orders = append(orders, order)
+			}
+		}
 	}
 
-	ex.mu.RLock()
-	orderbookOrders := ex.Orders[int64(userID)]
 	ordersResp := &GetOrdersResponse{
 		Asks: []Order{},
 		Bids: []Order{},
 	}
 
-	for i := 0; i < len(orderbookOrders); i++ {
-		// It could be that the order is getting filled even though its included in this
-		//respnse. we must double check if the limit is not nil
-		if orderbookOrders[i].Limit == nil {
-			continue
-		}
-		order := Order{
-			UserID:    orderbookOrders[i].UserID,
-			ID:        orderbookOrders[i].ID,
-			Price:     orderbookOrders[i].Limit.Price,
-			Size:      orderbookOrders[i].Size,
-			Bid:       orderbookOrders[i].Bid,
-			Timestamp: orderbookOrders[i].Timestamp,
-		}
-
+	for _, order := range orders {
 		if order.Bid {
 			ordersResp.Bids = append(ordersResp.Bids, order)
 		} else {
 			ordersResp.Asks = append(ordersResp.Asks, order)
 		}
 	}
-	ex.mu.RUnlock()
 
 	return c.JSON(http.StatusOK, ordersResp)
 }
 
+func matchesOrderFilter(order Order, filter string) bool {
+	switch filter {
+	case OrderFilterAll:
+		return true
+	case OrderFilterClosed:
+		return order.Status.Closed()
+	case OrderFilterOpen:
+		return !order.Status.Closed()
+	}
+	return string(order.Status) == filter
+}
+
+func (ex *Exchange) handleGetOrder(c echo.Context) error {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	order, err := ex.orderStore.GetOrder(int64(id))
+	if err != nil && !errors.Is(err, ErrOrderNotFound) {
+		return err
+	}
+	// orders of other users look the same as missing ones
+	if err != nil || order.UserID != authUserID(c) {
+		return newErrorf(http.StatusNotFound, "%w: %s", ErrOrderNotFound, idStr)
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+func newOrderFromSnapshot(market token.Market, o orderbook.OrderSnapshot) Order {
+	return Order{
+		Market:    market,
+		UserID:    o.UserID,
+		ID:        o.ID,
+		Price:     o.Price,
+		Size:      o.Size,
+		Bid:       o.Bid,
+		Timestamp: o.Timestamp,
+		Type:      LimitOrder,
+	}
+}
+
 func (ex *Exchange) handleGetBook(c echo.Context) error {
 	market := token.Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
+	ob, ok := ex.markets.Engine(market)
 
 	if !ok {
-		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "market not found"})
+		return newErrorf(http.StatusNotFound, "%w: %s", ErrMarketNotFound, market)
 	}
 
+	snapshot := ob.Snapshot()
 	orderbookData := OrderbookData{
-		TotalBidVolume: ob.BidTotalVolume(),
-		TotalAskVolume: ob.AskTotalVolume(),
+		TotalBidVolume: snapshot.BidTotalVolume,
+		TotalAskVolume: snapshot.AskTotalVolume,
 		Asks:           []*Order{},
 		Bids:           []*Order{},
 	}
 
-	for _, limit := range ob.Asks() {
+	for _, limit := range snapshot.Asks {
 		for _, order := range limit.Orders {
-			o := Order{
-				UserID:    order.UserID,
-				ID:        order.ID,
-				Price:     limit.Price,
-				Size:      order.Size,
-				Bid:       order.Bid,
-				Timestamp: order.Timestamp,
-			}
+			o := newOrderFromSnapshot(market, order)
 			orderbookData.Asks = append(orderbookData.Asks, &o)
 		}
 	}
 
-	for _, limit := range ob.Bids() {
+	for _, limit := range snapshot.Bids {
 		for _, order := range limit.Orders {
-			o := Order{
-				UserID:    order.UserID,
-				ID:        order.ID,
-				Price:     limit.Price,
-				Size:      order.Size,
-				Bid:       order.Bid,
-				Timestamp: order.Timestamp,
-			}
+			o := newOrderFromSnapshot(market, order)
 			orderbookData.Bids = append(orderbookData.Bids, &o)
 		}
 	}
@@ -161,18 +346,21 @@ type PriceResponse struct {
 func (ex *Exchange) handleGetBestBid(c echo.Context) error {
 	var (
 		market = token.Market(c.Param("market"))
-		ob     = ex.orderbooks[market]
 		order  = Order{}
 	)
 
-	if len(ob.Bids()) == 0 {
+	ob, ok := ex.markets.Engine(market)
+	if !ok {
+		return newErrorf(http.StatusNotFound, "%w: %s", ErrMarketNotFound, market)
+	}
+
+	bestLimit, ok := ob.Snapshot().BestBid()
+	if !ok {
 		return c.JSON(http.StatusOK, order)
 	}
-	bestLimit := ob.Bids()[0]
-	bestOrder := bestLimit.Orders[0]
 
 	order.Price = bestLimit.Price
-	order.UserID = bestOrder.UserID
+	order.UserID = bestLimit.Orders[0].UserID
 
 	return c.JSON(http.StatusOK, order)
 }
@@ -180,31 +368,41 @@ func (ex *Exchange) handleGetBestBid(c echo.Context) error {
 func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
 	var (
 		market = token.Market(c.Param("market"))
-		ob     = ex.orderbooks[market]
 		order  = Order{}
 	)
-	if len(ob.Asks()) == 0 {
+
+	ob, ok := ex.markets.Engine(market)
+	if !ok {
+		return newErrorf(http.StatusNotFound, "%w: %s", ErrMarketNotFound, market)
+	}
+
+	bestLimit, ok := ob.Snapshot().BestAsk()
+	if !ok {
 		return c.JSON(http.StatusOK, order)
 	}
-	bestLimit := ob.Asks()[0]
-	bestOrder := bestLimit.Orders[0]
 
 	order.Price = bestLimit.Price
-	order.UserID = bestOrder.UserID
+	order.UserID = bestLimit.Orders[0].UserID
 
 	return c.JSON(http.StatusOK, order)
 }
 
 func (ex *Exchange) cancelOrder(c echo.Context) error {
 	idStr := c.Param("id")
-	id, _ := strconv.Atoi(idStr)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
 
-	ob := ex.orderbooks[token.MarketETH]
-	order, ok := ob.Orders[int64(id)]
-	if !ok {
-		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "can't find order ID: " + idStr})
+	order, err := ex.cancelUserOrder(authUserID(c), int64(id))
+	if err != nil {
+		return newError(http.StatusNotFound, err)
 	}
-	ob.CancelOrder(order)
+
+	ex.recordAudit(c, audit.OrderCancelled, order.UserID, map[string]any{
+		"order":  order.ID,
+		"market": order.Market,
+	})
 
 	log.Println("order canceled id => ", id)
 
@@ -212,10 +410,90 @@ func (ex *Exchange) cancelOrder(c echo.Context) error {
 
 }
 
-func (ex *Exchange) handlePlaceMarketOrder(market token.Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrders) {
-	ob := ex.orderbooks[market]
-	matches := ob.PlaceMarketOrder(order)
+// cancelUserOrder cancels the open order of the user, orders of other users
+// look the same as missing ones.
+func (ex *Exchange) cancelUserOrder(userID, id int64) (Order, error) {
+	order, ok := ex.Orders.Get(id)
+	if !ok || order.UserID != userID {
+		return Order{}, fmt.Errorf("%w: %d", ErrOrderNotFound, id)
+	}
+
+	var err error
+	doErr := ex.markets.Do(order.Market, func(book *orderbook.Orderbook, _ token.Pair) {
+		_, err = orderbook.CancelOrderByID(book, order.ID)
+	})
+	if doErr != nil || err != nil {
+		return Order{}, fmt.Errorf("%w: %d", ErrOrderNotFound, id)
+	}
+
+	return order, nil
+}
+
+// replaceOrder cancels the resting limit order of the user and places order
+// at price in its place, in a single engine step. The size of order counts
+// what the old order already filled, so the replacement never fills more
+// than asked for. The old order stays in the book when the new one can not
+// be placed.
+func (ex *Exchange) replaceOrder(userID int64, market token.Market, oldID int64, price float64, order *orderbook.Order) error {
+	var err error
+	tradeErr := ex.markets.Trade(market, func(book *orderbook.Orderbook, pair token.Pair) {
+		old, ok := book.Orders[oldID]
+		if !ok || old.Limit == nil || old.UserID != userID {
+			err = fmt.Errorf("%w: %d", ErrOrderNotFound, oldID)
+			return
+		}
+		if old.Bid != order.Bid {
+			err = fmt.Errorf("%w: a replace can not change the side", ErrInvalidOrder)
+			return
+		}
+		order.Size -= old.FilledSize
+		if order.Size <= 0 {
+			err = fmt.Errorf("%w: size %.8f is already filled", ErrInvalidOrder, old.FilledSize)
+			return
+		}
+
+		// the new hold is taken from what is available and what the old
+		// order gives back
+		asset, amount := limitOrderHold(pair, price, order)
+		_, released := limitOrderHold(pair, old.Limit.Price, old)
+		if available := ex.Ledger.Balance(ledger.UserAccount(userID, asset)); available+released < amount {
+			err = fmt.Errorf("%w: %s", ledger.ErrInsufficientBalance, asset)
+			return
+		}
+
+		book.CancelOrder(old)
+		err = ex.placeLimitOrder(book, pair, market, price, order)
+	})
+	if tradeErr != nil {
+		return tradeErr
+	}
+
+	return err
+}
+
+// handlePlaceMarketOrder reserves what the order can cost at most, fills it
+// and settles the matches in a single engine step, so the book can not move
+// in between.
+func (ex *Exchange) handlePlaceMarketOrder(market token.Market, order *orderbook.Order) ([]Fill, []*MatchedOrders, error) {
+	var (
+		matches []orderbook.Match
+		fills   []Fill
+		err     error
+	)
+	tradeErr := ex.markets.Trade(market, func(book *orderbook.Orderbook, pair token.Pair) {
+		matches, fills, err = ex.placeMarketOrder(book, pair, market, order)
+	})
+	if tradeErr != nil {
+		return nil, nil, tradeErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// market orders never rest, so the book has no placed event for them
+	countOrderEvent(market, MarketOrder, orderbook.EventPlaced)
+
 	matchOrders := make([]*MatchedOrders, len(matches))
+	takerFills := make([]Fill, len(matches))
 
 	isBid := false
 	if order.Bid {
@@ -232,11 +510,15 @@ func (ex *Exchange) handlePlaceMarketOrder(market token.Market, order *orderbook
 			id = matches[i].Ask.ID
 		}
 
+		// handleMatches settled every match as a taker and a maker fill
+		takerFills[i] = fills[2*i]
 		matchOrders[i] = &MatchedOrders{
-			UserID: limitUserID,
-			Size:   matches[i].SizeFilled,
-			Price:  matches[i].Price,
-			ID:     id,
+			UserID:   limitUserID,
+			Size:     matches[i].SizeFilled,
+			Price:    matches[i].Price,
+			ID:       id,
+			Fee:      fills[2*i+1].Fee,
+			FeeAsset: fills[2*i+1].FeeAsset,
 		}
 
 		totalSizeFilled += matches[i].SizeFilled
@@ -251,97 +533,404 @@ func (ex *Exchange) handlePlaceMarketOrder(market token.Market, order *orderbook
 		"avgPrice": avgPrice,
 	}).Info("filled market order")
 
-	// #TODO: this approch is a shit! try modify a decent one
-	newOrderMap := make(map[int64][]*orderbook.Order)
-	ex.mu.Lock()
-	for userID, orderbookOrders := range ex.Orders {
-		// If the order is not filled we place it in the map copy
-		// this means that size of the order = 0
-		for i := 0; i < len(orderbookOrders); i++ {
-			if !orderbookOrders[i].IsFilled() {
-				newOrderMap[userID] = append(newOrderMap[userID], orderbookOrders[i])
-			}
+	return takerFills, matchOrders, nil
+}
+
+// saveMarketOrder records the market order once it reached its engine step,
+// market orders never rest in the book so the book has no placed event for
+// them. Orders that never reach the book are not recorded.
+func (ex *Exchange) saveMarketOrder(market token.Market, order *orderbook.Order) error {
+	return ex.orderStore.SaveOrder(Order{
+		UserID:    order.UserID,
+		ID:        order.ID,
+		Size:      order.Size,
+		Bid:       order.Bid,
+		Timestamp: order.Timestamp,
+		Market:    market,
+		Type:      MarketOrder,
+		Status:    order.Status,
+		UpdatedAt: order.UpdatedAt,
+	})
+}
+
+// placeMarketOrder holds what the market order can cost at most, fills it
+// and settles the matches. It has to run in an engine step of the market.
+func (ex *Exchange) placeMarketOrder(book *orderbook.Orderbook, pair token.Pair, market token.Market, order *orderbook.Order) ([]orderbook.Match, []Fill, error) {
+	if err := ex.saveMarketOrder(market, order); err != nil {
+		return nil, nil, err
+	}
+
+	asset, amount := pair.Base, order.Size
+	if order.Bid {
+		var err error
+		asset = pair.Quote
+		amount, err = book.MarketCost(true, order.Size)
+		if err != nil {
+			book.RejectOrder(order, 0)
+			return nil, nil, err
 		}
 	}
 
-	ex.Orders = newOrderMap
-	ex.mu.Unlock()
+	ref := holdRef(market, order.ID)
+	if _, err := ex.Ledger.Hold(order.UserID, asset, amount, ref); err != nil {
+		book.RejectOrder(order, 0)
+		return nil, nil, err
+	}
+
+	// the matches are checked against the ledger before they change the
+	// book, a book filling what the ledger can not settle would no longer
+	// agree with it
+	now := time.Now()
+	entry, _, err := ex.settlement(market, order, book.PreviewMarketOrder(order), now)
+	if err == nil && len(entry.Postings) > 0 {
+		err = ex.Ledger.CanPost(entry)
+	}
+	if err != nil {
+		book.RejectOrder(order, 0)
+		ex.releaseHold(order.UserID, asset, amount, ref)
+		return nil, nil, err
+	}
+
+	matches, err := orderbook.PlaceMarketOrderChecked(book, order)
+	if err != nil {
+		ex.releaseHold(order.UserID, asset, amount, ref)
+		return nil, nil, err
+	}
+
+	fills, err := ex.handleMatches(market, order, matches, now)
+
+	// what is left of the hold after the fills is float dust at most, none
+	// of it was spent when the fills could not be settled
+	consumed := order.FilledSize
+	if order.Bid {
+		consumed = order.FilledSize * order.AvgFillPrice
+	}
+	if err != nil {
+		consumed = 0
+	}
+	ex.releaseHold(order.UserID, asset, amount-consumed, ref)
 
-	return matches, matchOrders
+	return matches, fills, err
 }
 
+// handlePlaceLimitOrder reserves price * size of the quote asset for a bid
+// and size of the base asset for an ask before the order enters the book.
 func (ex *Exchange) handlePlaceLimitOrder(market token.Market, price float64, order *orderbook.Order) error {
-	ob := ex.orderbooks[market]
-	ob.PlaceLimitOrder(price, order)
-
-	// keep track of the user orders
-	ex.mu.Lock()
-	ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
-	ex.mu.Unlock()
+	var err error
+	tradeErr := ex.markets.Trade(market, func(book *orderbook.Orderbook, pair token.Pair) {
+		err = ex.placeLimitOrder(book, pair, market, price, order)
+	})
 
 	//og.Printf("new LIMIT order => type:[%t] | price [%2.f] | size [%.2f]", order.Bid, order.Limit.Price, order.Size)
+	if tradeErr != nil {
+		return tradeErr
+	}
+
+	return err
+
+}
+
+// placeLimitOrder holds what the limit order needs and puts it in the book,
+// or rejects it. It has to run in an engine step of the market.
+func (ex *Exchange) placeLimitOrder(book *orderbook.Orderbook, pair token.Pair, market token.Market, price float64, order *orderbook.Order) error {
+	asset, amount := limitOrderHold(pair, price, order)
+	if _, err := ex.Ledger.Hold(order.UserID, asset, amount, holdRef(market, order.ID)); err != nil {
+		book.RejectOrder(order, price)
+		return err
+	}
 
+	book.PlaceLimitOrder(price, order)
 	return nil
+}
 
+// limitOrderHold is what a limit order holds while it rests in the book.
+func limitOrderHold(pair token.Pair, price float64, order *orderbook.Order) (token.Asset, float64) {
+	if order.Bid {
+		return pair.Quote, price * order.Size
+	}
+	return pair.Base, order.Size
 }
 
 type PlaceOrderResponse struct {
 	OrderID int64
+	// Fills of a market order, with the fee paid on each
+	Fills []Fill
+}
+
+var ErrInvalidOrder = errors.New("invalid order")
+
+func (ex *Exchange) validateOrderRequest(req *PlaceOrderRequest) error {
+	if req.Type != LimitOrder && req.Type != MarketOrder {
+		return fmt.Errorf("%w: order type %s", ErrInvalidOrder, req.Type)
+	}
+	if req.Size <= 0 {
+		return fmt.Errorf("%w: size must be positive", ErrInvalidOrder)
+	}
+	if req.Type == LimitOrder && req.Price <= 0 {
+		return fmt.Errorf("%w: price must be positive", ErrInvalidOrder)
+	}
+
+	ex.mu.RLock()
+	_, ok := ex.Users[req.UserID]
+	ex.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUserNotFound, req.UserID)
+	}
+	if ex.userFrozen(req.UserID) {
+		return fmt.Errorf("%w: %d", ErrAccountFrozen, req.UserID)
+	}
+
+	return nil
 }
 
 func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 	var placeOrderData PlaceOrderRequest
 
 	if err := json.NewDecoder(c.Request().Body).Decode(&placeOrderData); err != nil {
-		return err
+		return newError(http.StatusBadRequest, err)
+	}
+	// orders are placed for the owner of the API key, whatever the body says
+	placeOrderData.UserID = authUserID(c)
+
+	if err := ex.validateOrderRequest(&placeOrderData); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrAccountFrozen) {
+			status = http.StatusForbidden
+		}
+		return newError(status, err)
 	}
 
 	market := token.Market(placeOrderData.Market)
 	order := orderbook.NewOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
+	order.ExpiresAt = placeOrderData.ExpiresAt
+	resp := &PlaceOrderResponse{
+		OrderID: order.ID,
+	}
 
 	//limit orders
 	if placeOrderData.Type == LimitOrder {
 		if err := ex.handlePlaceLimitOrder(market, placeOrderData.Price, order); err != nil {
-			return err
+			return placeOrderError(err)
 		}
 
 	}
 
 	// market orders
 	if placeOrderData.Type == MarketOrder {
-		matches, _ := ex.handlePlaceMarketOrder(market, order)
-
-		if err := ex.handleMatches(matches); err != nil {
-			return err
+		fills, _, err := ex.handlePlaceMarketOrder(market, order)
+		if err != nil {
+			return placeOrderError(err)
 		}
+		resp.Fills = fills
+	}
+
+	ex.recordAudit(c, audit.OrderPlaced, placeOrderData.UserID, map[string]any{
+		"order":  order.ID,
+		"market": market,
+		"type":   placeOrderData.Type,
+		"bid":    placeOrderData.Bid,
+		"size":   placeOrderData.Size,
+		"price":  placeOrderData.Price,
+	})
+
+	return c.JSON(http.StatusOK, resp)
 
+}
+
+// placeOrderError fails the request of an order that was not accepted. Orders
+// refused because the exchange is shutting down are worth a retry, so they
+// keep their 503.
+func placeOrderError(err error) error {
+	if errors.Is(err, ErrShuttingDown) {
+		return err
 	}
+	return newError(http.StatusBadRequest, err)
+}
 
-	resp := &PlaceOrderResponse{
-		OrderID: order.ID,
+// handleMatches settles the matches of an engine step in the ledger. All the
+// matches are posted as a single journal entry moving the base asset from the
+// sellers to the buyers and price * size of the quote asset back, so either
+// the whole step is settled or none of it. Both sides pay out of the funds
+// they held for their orders, it has to run in the engine step that filled
+// the orders. The fees are taken from what each side receives and posted to
+// the fee account in the same entry. It returns the taker and the maker fill
+// of every match, in that order.
+func (ex *Exchange) handleMatches(market token.Market, taker *orderbook.Order, matches []orderbook.Match, now time.Time) ([]Fill, error) {
+	entry, fills, err := ex.settlement(market, taker, matches, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return fills, nil
 	}
-	return c.JSON(http.StatusOK, resp)
 
+	if _, err := ex.Ledger.Post(entry); err != nil {
+		logrus.WithError(err).WithField("market", market).Error("failed to settle matches")
+		return nil, fmt.Errorf("settling matches of order %d: %w", taker.ID, err)
+	}
+
+	pair, _ := market.Pair()
+	for _, fill := range fills {
+		ex.Fees.RecordVolume(fill.UserID, pair.Quote, fill.Price*fill.Size, now)
+	}
+	return fills, nil
 }
 
-func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
+// settlement builds the journal entry settling the matches and the fills of
+// both sides, without posting it. restoreVolumes reads the traded volumes
+// back from the order of the postings.
+func (ex *Exchange) settlement(market token.Market, taker *orderbook.Order, matches []orderbook.Match, now time.Time) (ledger.Entry, []Fill, error) {
+	pair, err := market.Pair()
+	if err != nil {
+		return ledger.Entry{}, nil, err
+	}
+
+	entry := ledger.Entry{
+		Type: ledger.EntryTrade,
+		Ref:  holdRef(market, taker.ID),
+	}
+	fills := make([]Fill, 0, 2*len(matches))
 	for _, match := range matches {
-		fromUser, ok := ex.Users[match.Ask.UserID]
-		if !ok {
-			return fmt.Errorf("user not found: %d", match.Ask.UserID)
-		}
+		quoteAmount := match.Price * match.SizeFilled
 
-		err := fromUser.Wallet[token.MarketETH].SubBalance(match.SizeFilled)
-		if err != nil {
-			return fmt.Errorf("From user insufficient balance")
+		bidRates := ex.Fees.Rates(match.Bid.UserID, pair.Quote, now)
+		askRates := ex.Fees.Rates(match.Ask.UserID, pair.Quote, now)
+		bidRate, askRate := bidRates.MakerRate, askRates.TakerRate
+		if match.Bid == taker {
+			bidRate, askRate = bidRates.TakerRate, askRates.MakerRate
+		}
+		// the buyer pays in the base asset, the seller in the quote asset
+		bidFee := bidRate * match.SizeFilled
+		askFee := askRate * quoteAmount
+
+		entry.Postings = append(entry.Postings,
+			ledger.Posting{Account: ledger.HeldAccount(match.Ask.UserID, pair.Base), Amount: -match.SizeFilled},
+			ledger.Posting{Account: ledger.UserAccount(match.Bid.UserID, pair.Base), Amount: match.SizeFilled - bidFee},
+			ledger.Posting{Account: ledger.HeldAccount(match.Bid.UserID, pair.Quote), Amount: -quoteAmount},
+			ledger.Posting{Account: ledger.UserAccount(match.Ask.UserID, pair.Quote), Amount: quoteAmount - askFee},
+		)
+		if bidFee != 0 {
+			entry.Postings = append(entry.Postings, ledger.Posting{Account: ledger.ExchangeAccount(ledger.Fee, pair.Base), Amount: bidFee})
+		}
+		if askFee != 0 {
+			entry.Postings = append(entry.Postings, ledger.Posting{Account: ledger.ExchangeAccount(ledger.Fee, pair.Quote), Amount: askFee})
 		}
 
-		toUser, ok := ex.Users[match.Bid.UserID]
-		if !ok {
-			return fmt.Errorf("user not found: %d", match.Bid.UserID)
+		bidFill := Fill{
+			OrderID:  match.Bid.ID,
+			UserID:   match.Bid.UserID,
+			Market:   market,
+			Bid:      true,
+			Maker:    match.Bid != taker,
+			Price:    match.Price,
+			Size:     match.SizeFilled,
+			Fee:      bidFee,
+			FeeAsset: pair.Base,
+		}
+		askFill := Fill{
+			OrderID:  match.Ask.ID,
+			UserID:   match.Ask.UserID,
+			Market:   market,
+			Maker:    match.Ask != taker,
+			Price:    match.Price,
+			Size:     match.SizeFilled,
+			Fee:      askFee,
+			FeeAsset: pair.Quote,
 		}
-		err = toUser.Wallet[token.MarketETH].AddBalance(match.SizeFilled)
+		if bidFill.Maker {
+			fills = append(fills, askFill, bidFill)
+		} else {
+			fills = append(fills, bidFill, askFill)
+		}
+	}
+	return entry, fills, nil
+}
 
+func (ex *Exchange) handleGetLedger(c echo.Context) error {
+	userIDstr := c.Param("userID")
+	userID, err := strconv.Atoi(userIDstr)
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
 	}
-	return nil
+
+	return c.JSON(http.StatusOK, ex.Ledger.History(int64(userID)))
+}
+
+// cancelAllOrders cancels every open order of the user across all the
+// orderbooks and returns how many orders were cancelled.
+func (ex *Exchange) cancelAllOrders(userID int64) int {
+	ordersByMarket := make(map[token.Market][]int64)
+	for _, order := range ex.Orders.UserOrders(userID) {
+		ordersByMarket[order.Market] = append(ordersByMarket[order.Market], order.ID)
+	}
+
+	cancelled := 0
+	for market, orderIDs := range ordersByMarket {
+		// a delisted market already cancelled its orders
+		ex.markets.Do(market, func(book *orderbook.Orderbook, _ token.Pair) {
+			for _, id := range orderIDs {
+				// the order could have been filled in the meantime
+				if _, err := orderbook.CancelOrderByID(book, id); err == nil {
+					cancelled++
+				}
+			}
+		})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID":    userID,
+		"cancelled": cancelled,
+	}).Info("cancelled all user orders")
+
+	return cancelled
+}
+
+type CancelAfterRequest struct {
+	UserID int64
+	// Timeout in milliseconds, 0 disarms the dead man's switch
+	Timeout int64
+}
+
+type HeartbeatRequest struct {
+	UserID int64
+}
+
+type CancelAfterResponse struct {
+	UserID int64
+	// ExpiresAt is the unix nano time the orders get cancelled at, 0 when disarmed
+	ExpiresAt int64
+}
+
+func (ex *Exchange) handleCancelAfter(c echo.Context) error {
+	var req CancelAfterRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	req.UserID = authUserID(c)
+
+	resp := CancelAfterResponse{UserID: req.UserID}
+	expiresAt := ex.deadman.Arm(req.UserID, time.Duration(req.Timeout)*time.Millisecond)
+	if !expiresAt.IsZero() {
+		resp.ExpiresAt = expiresAt.UnixNano()
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (ex *Exchange) handleHeartbeat(c echo.Context) error {
+	var req HeartbeatRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	req.UserID = authUserID(c)
+
+	expiresAt, err := ex.deadman.Heartbeat(req.UserID)
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	return c.JSON(http.StatusOK, CancelAfterResponse{
+		UserID:    req.UserID,
+		ExpiresAt: expiresAt.UnixNano(),
+	})
 }
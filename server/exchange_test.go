@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/labstack/echo/v4"
+)
+
+const testPrivateKey = "6b93be18f885aa07271e5be6f9cf2db740a63a1b73a24778f7e597e4a1cbfbe9"
+
+func newTestExchange(t *testing.T, userIDs ...int64) (*Exchange, *echo.Echo) {
+	ex, err := NewExchange(testPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the settlement tests assert exact balances, fees are tested on their own
+	if err := ex.Fees.SetSchedule(FeeSchedule{Tiers: []FeeTier{{}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range userIDs {
+		wallet, err := token.GenerateWallet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.Users[id] = &User{ID: id, Wallet: wallet}
+		ex.APIKeys.add(testAPIKey(id))
+		for _, asset := range []token.Asset{token.AssetETH, token.AssetBTC, token.AssetUSDT} {
+			if _, err := ex.Ledger.Deposit(id, asset, 1_000_000, "test"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return ex, newRouter(ex)
+}
+
+func bookSnapshot(ex *Exchange, market token.Market) *orderbook.Snapshot {
+	ob, _ := ex.markets.Engine(market)
+	return ob.Snapshot()
+}
+
+// testAPIKey is the key the test users sign their requests with.
+func testAPIKey(userID int64) APIKey {
+	return APIKey{
+		Key:    fmt.Sprintf("key-%d", userID),
+		Secret: fmt.Sprintf("secret-%d", userID),
+		UserID: userID,
+		Scopes: []Scope{ScopeRead, ScopeTrade, ScopeWithdraw},
+	}
+}
+
+var testNonce atomic.Int64
+
+// doUserRequest sends a request signed with the test API key of the user.
+func doUserRequest(e *echo.Echo, userID int64, method, path string, body any) *httptest.ResponseRecorder {
+	var reqBody bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&reqBody).Encode(body)
+	}
+
+	key := testAPIKey(userID)
+	timestamp := time.Now().UnixMilli()
+	nonce := strconv.FormatInt(testNonce.Add(1), 10)
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(reqBody.Bytes()))
+	req.Header.Set(APIKeyHeader, key.Key)
+	req.Header.Set(APITimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(APINonceHeader, nonce)
+	req.Header.Set(APISignatureHeader, SignRequest(key.Secret, timestamp, nonce, method, req.URL.RequestURI(), reqBody.Bytes()))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func doRequest(e *echo.Echo, method, path string, body any) *httptest.ResponseRecorder {
+	var reqBody bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&reqBody).Encode(body)
+	}
+
+	req := httptest.NewRequest(method, path, &reqBody)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// TestExchangeConcurrent hammers the HTTP handlers with places, cancels and
+// reads from many goroutines, run it with -race.
+func TestExchangeConcurrent(t *testing.T) {
+	_, e := newTestExchange(t, 1, 2, 3, 4)
+
+	var wg sync.WaitGroup
+	for w := 1; w <= 4; w++ {
+		wg.Add(1)
+		go func(userID int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(userID))
+
+			var placed []int64
+			for i := 0; i < 100; i++ {
+				switch r.Intn(5) {
+				case 0:
+					bid := r.Intn(2) == 0
+					price := 1_000.0 + float64(r.Intn(10))
+					if bid {
+						price -= 20
+					}
+					rec := doRequest(e, http.MethodPost, "/order", PlaceOrderRequest{
+						UserID: userID,
+						Type:   LimitOrder,
+						Bid:    bid,
+						Size:   float64(1 + r.Intn(3)),
+						Price:  price,
+						Market: token.MarketETHUSDT,
+					})
+					resp := PlaceOrderResponse{}
+					json.NewDecoder(rec.Body).Decode(&resp)
+					placed = append(placed, resp.OrderID)
+				case 1:
+					if len(placed) > 0 {
+						doRequest(e, http.MethodDelete, fmt.Sprintf("/order/%d", placed[r.Intn(len(placed))]), nil)
+					}
+				case 2:
+					doRequest(e, http.MethodPost, "/order", PlaceOrderRequest{
+						UserID: userID,
+						Type:   MarketOrder,
+						Bid:    r.Intn(2) == 0,
+						Size:   1,
+						Market: token.MarketETHUSDT,
+					})
+				case 3:
+					doRequest(e, http.MethodGet, "/book/ETH-USDT", nil)
+					doRequest(e, http.MethodGet, "/book/ETH-USDT/bestbid", nil)
+					doRequest(e, http.MethodGet, "/book/ETH-USDT/bestask", nil)
+				case 4:
+					doUserRequest(e, userID, http.MethodGet, fmt.Sprintf("/order/%d", userID), nil)
+					doRequest(e, http.MethodGet, "/trades/ETH-USDT", nil)
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+
+	rec := doRequest(e, http.MethodGet, "/book/ETH-USDT", nil)
+	book := OrderbookData{}
+	assert(t, json.NewDecoder(rec.Body).Decode(&book), nil)
+
+	total := 0.0
+	for _, order := range book.Asks {
+		total += order.Size
+	}
+	assert(t, total, book.TotalAskVolume)
+}
+
+func TestMatchesSettleInLedger(t *testing.T) {
+	ex, e := newTestExchange(t, 1, 2)
+
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 10, Price: 1_000, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 4, Market: token.MarketETHUSDT})
+
+	assert(t, ex.Ledger.Balance(ledger.UserAccount(1, token.AssetETH)), 1_000_000.0-10)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetETH)), 6.0)
+	assert(t, ex.Ledger.Balance(ledger.UserAccount(1, token.AssetUSDT)), 1_000_000.0+4_000)
+	assert(t, ex.Ledger.Balance(ledger.UserAccount(2, token.AssetETH)), 1_000_000.0+4)
+	assert(t, ex.Ledger.Balance(ledger.UserAccount(2, token.AssetUSDT)), 1_000_000.0-4_000)
+	assert(t, ex.Ledger.Check(), nil)
+
+	rec := doUserRequest(e, 2, http.MethodGet, "/ledger/2", nil)
+	history := []ledger.Entry{}
+	assert(t, json.NewDecoder(rec.Body).Decode(&history), nil)
+	// three deposits, the hold of the market order and the trade
+	assert(t, len(history), 5)
+	assert(t, history[3].Type, ledger.EntryHold)
+	assert(t, history[4].Type, ledger.EntryTrade)
+	assert(t, len(history[4].Postings), 4)
+}
+
+func TestMatchSettlesBothLegsAtomically(t *testing.T) {
+	ex, _ := newTestExchange(t, 1)
+	ex.Users[2] = &User{ID: 2}
+	ex.APIKeys.add(testAPIKey(2))
+	ex.Ledger.Deposit(2, token.AssetBTC, 1, "test")
+
+	// user 2 can pay for 1 ETH but not for 50
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 100, Price: 0.05, Market: token.MarketETHBTC})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 1, Market: token.MarketETHBTC})
+	assert(t, ex.Ledger.Balance(ledger.UserAccount(2, token.AssetETH)), 1.0)
+	assert(t, ex.Ledger.Balance(ledger.UserAccount(2, token.AssetBTC)), 0.95)
+
+	// rejected up front, the book is left as it was
+	rec := doUserRequest(newRouter(ex), 2, http.MethodPost, "/order", PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 50, Market: token.MarketETHBTC})
+	assert(t, rec.Code, http.StatusBadRequest)
+	assert(t, ex.Ledger.Balance(ledger.UserAccount(2, token.AssetETH)), 1.0)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetETH)), 99.0)
+	assert(t, bookSnapshot(ex, token.MarketETHBTC).AskTotalVolume, 99.0)
+	assert(t, ex.Ledger.Check(), nil)
+}
+
+func TestMatchesOfAStepSettleTogether(t *testing.T) {
+	ex, _ := newTestExchange(t, 1, 2, 3)
+
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 1_000, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 3, Type: LimitOrder, Size: 2, Price: 1_100, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 3, Market: token.MarketETHUSDT})
+
+	history := ex.Ledger.History(2)
+	trade := history[len(history)-1]
+	assert(t, trade.Type, ledger.EntryTrade)
+	assert(t, len(trade.Postings), 8)
+	assert(t, ex.Ledger.Balance(ledger.UserAccount(2, token.AssetUSDT)), 1_000_000.0-3_100)
+
+	// the second maker's held funds are gone, so the whole order is refused
+	// before it touches the book
+	ex.Ledger.Release(3, token.AssetETH, 1, "test")
+	rec := doUserRequest(newRouter(ex), 2, http.MethodPost, "/order", PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: 1, Market: token.MarketETHUSDT})
+	assert(t, rec.Code, http.StatusBadRequest)
+	assert(t, bookSnapshot(ex, token.MarketETHUSDT).AskTotalVolume, 1.0)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(2, token.AssetUSDT)), 0.0)
+	assert(t, ex.Ledger.Balance(ledger.UserAccount(2, token.AssetETH)), 1_000_000.0+3)
+	assert(t, ex.Ledger.Check(), nil)
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// volumeWindowDays is how far back the traded volume of a user counts
+	// towards the fee tier.
+	volumeWindowDays = 30
+	day              = int64(24 * time.Hour)
+)
+
+// FeeTier applies its rates to users that traded at least MinVolume in the
+// last 30 days. Rates are fractions of the traded amount, a negative maker
+// rate is a rebate paid to the maker.
+type FeeTier struct {
+	MinVolume float64
+	MakerRate float64
+	TakerRate float64
+}
+
+// FeeSchedule holds the tiers sorted by MinVolume, the first tier starts at
+// zero volume. The volume of a user is counted in the quote asset of the
+// market being traded, so a tier is reached per quote asset. The same volume
+// is worth a lot more in BTC than in USDT, so QuoteTiers gives the quote
+// assets tiers of their own, Tiers apply to the ones without.
+type FeeSchedule struct {
+	Tiers      []FeeTier
+	QuoteTiers map[token.Asset][]FeeTier `json:",omitempty"`
+}
+
+// FeeRates are the rates a user pays, either from a tier or an override.
+type FeeRates struct {
+	MakerRate float64
+	TakerRate float64
+}
+
+// DefaultFeeSchedule is used until an admin sets a schedule. Markets quoted
+// in other assets pay the base rates whatever their volume.
+var DefaultFeeSchedule = FeeSchedule{
+	Tiers: []FeeTier{
+		{MinVolume: 0, MakerRate: 0.001, TakerRate: 0.002},
+	},
+	QuoteTiers: map[token.Asset][]FeeTier{
+		token.AssetUSDT: {
+			{MinVolume: 0, MakerRate: 0.001, TakerRate: 0.002},
+			{MinVolume: 1_000_000, MakerRate: 0.0005, TakerRate: 0.0015},
+			{MinVolume: 10_000_000, MakerRate: -0.0001, TakerRate: 0.001},
+		},
+		token.AssetBTC: {
+			{MinVolume: 0, MakerRate: 0.001, TakerRate: 0.002},
+			{MinVolume: 15, MakerRate: 0.0005, TakerRate: 0.0015},
+			{MinVolume: 150, MakerRate: -0.0001, TakerRate: 0.001},
+		},
+	},
+}
+
+func (r FeeRates) Validate() error {
+	if r.TakerRate < 0 || r.TakerRate >= 1 || r.MakerRate >= 1 {
+		return fmt.Errorf("fee rates must be below 1 and the taker rate can not be negative")
+	}
+	// the taker fee has to pay for the rebate of the maker
+	if r.MakerRate+r.TakerRate < 0 {
+		return fmt.Errorf("maker rebate %f is larger than the taker fee %f", -r.MakerRate, r.TakerRate)
+	}
+	return nil
+}
+
+// Validate sorts the tiers and checks their rates.
+func (s *FeeSchedule) Validate() error {
+	if err := validateTiers(s.Tiers); err != nil {
+		return err
+	}
+	for asset, tiers := range s.QuoteTiers {
+		if err := validateTiers(tiers); err != nil {
+			return fmt.Errorf("%s: %w", asset, err)
+		}
+	}
+
+	return nil
+}
+
+func validateTiers(tiers []FeeTier) error {
+	if len(tiers) == 0 {
+		return fmt.Errorf("fee schedule needs at least one tier")
+	}
+
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinVolume < tiers[j].MinVolume })
+	if tiers[0].MinVolume != 0 {
+		return fmt.Errorf("first fee tier must start at zero volume")
+	}
+
+	for i, tier := range tiers {
+		if i > 0 && tier.MinVolume == tiers[i-1].MinVolume {
+			return fmt.Errorf("duplicate fee tier for volume %f", tier.MinVolume)
+		}
+		if err := (FeeRates{MakerRate: tier.MakerRate, TakerRate: tier.TakerRate}).Validate(); err != nil {
+			return fmt.Errorf("fee tier %f: %w", tier.MinVolume, err)
+		}
+	}
+
+	return nil
+}
+
+// clone copies the schedule, so the copy shares no tiers with it.
+func (s *FeeSchedule) clone() FeeSchedule {
+	schedule := FeeSchedule{Tiers: append([]FeeTier{}, s.Tiers...)}
+	if s.QuoteTiers != nil {
+		schedule.QuoteTiers = make(map[token.Asset][]FeeTier, len(s.QuoteTiers))
+		for asset, tiers := range s.QuoteTiers {
+			schedule.QuoteTiers[asset] = append([]FeeTier{}, tiers...)
+		}
+	}
+	return schedule
+}
+
+// tiers returns the tiers of the markets quoted in the asset.
+func (s *FeeSchedule) tiers(asset token.Asset) []FeeTier {
+	if tiers, ok := s.QuoteTiers[asset]; ok {
+		return tiers
+	}
+	return s.Tiers
+}
+
+type volumeKey struct {
+	userID int64
+	asset  token.Asset
+}
+
+// FeeEngine assigns the fee rates of every fill. It keeps the rolling 30 day
+// volume of every user in daily buckets.
+type FeeEngine struct {
+	mu        sync.RWMutex
+	schedule  FeeSchedule
+	overrides map[int64]FeeRates
+	// volumes maps a user and quote asset to the volume per day
+	volumes map[volumeKey]map[int64]float64
+}
+
+func NewFeeEngine(schedule FeeSchedule) (*FeeEngine, error) {
+	if err := schedule.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &FeeEngine{
+		schedule:  schedule,
+		overrides: make(map[int64]FeeRates),
+		volumes:   make(map[volumeKey]map[int64]float64),
+	}, nil
+}
+
+func (f *FeeEngine) Schedule() FeeSchedule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.schedule.clone()
+}
+
+func (f *FeeEngine) SetSchedule(schedule FeeSchedule) error {
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.schedule = schedule
+	return nil
+}
+
+// SetOverride makes the user pay the given rates whatever their volume is.
+func (f *FeeEngine) SetOverride(userID int64, rates FeeRates) error {
+	if err := rates.Validate(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.overrides[userID] = rates
+	return nil
+}
+
+func (f *FeeEngine) RemoveOverride(userID int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.overrides, userID)
+}
+
+// Rates returns the rates the user pays in markets quoted in the asset.
+func (f *FeeEngine) Rates(userID int64, asset token.Asset, now time.Time) FeeRates {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if rates, ok := f.overrides[userID]; ok {
+		return rates
+	}
+
+	volume := f.volume(userID, asset, now)
+	tiers := f.schedule.tiers(asset)
+	tier := tiers[0]
+	for _, t := range tiers {
+		if volume < t.MinVolume {
+			break
+		}
+		tier = t
+	}
+
+	return FeeRates{MakerRate: tier.MakerRate, TakerRate: tier.TakerRate}
+}
+
+// Volume returns what the user traded in the last 30 days, in the quote
+// asset.
+func (f *FeeEngine) Volume(userID int64, asset token.Asset, now time.Time) float64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.volume(userID, asset, now)
+}
+
+// volume must be called with f.mu held.
+func (f *FeeEngine) volume(userID int64, asset token.Asset, now time.Time) float64 {
+	today := now.UnixNano() / day
+
+	volume := 0.0
+	for d, v := range f.volumes[volumeKey{userID, asset}] {
+		if today-d < volumeWindowDays {
+			volume += v
+		}
+	}
+	return volume
+}
+
+// RecordVolume adds the quote amount of a fill to the volume of the user.
+func (f *FeeEngine) RecordVolume(userID int64, asset token.Asset, amount float64, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := volumeKey{userID, asset}
+	days, ok := f.volumes[key]
+	if !ok {
+		days = make(map[int64]float64)
+		f.volumes[key] = days
+	}
+
+	today := now.UnixNano() / day
+	days[today] += amount
+
+	// buckets that left the window are not needed anymore
+	for d := range days {
+		if today-d >= volumeWindowDays {
+			delete(days, d)
+		}
+	}
+}
+
+// restoreVolumes rebuilds the 30 day volume of the users from the trades in
+// the journal, the fee engine only keeps it in memory. It returns how many
+// trade entries were read.
+func (ex *Exchange) restoreVolumes(now time.Time) int {
+	// the oldest daily bucket still in the window starts at midnight
+	since := (now.UnixNano()/day - volumeWindowDays + 1) * day
+
+	trades := 0
+	for _, entry := range ex.Ledger.EntriesSince(since) {
+		if entry.Type != ledger.EntryTrade {
+			continue
+		}
+		market, _, _ := strings.Cut(entry.Ref, ":")
+		pair, err := token.Market(market).Pair()
+		if err != nil {
+			continue
+		}
+
+		// every match pays out of the held base asset of the seller first,
+		// then out of the held quote asset of the buyer
+		at, seller := time.Unix(0, entry.Timestamp), int64(0)
+		for _, p := range entry.Postings {
+			if p.Account.Type != ledger.Held {
+				continue
+			}
+			switch p.Account.Asset {
+			case pair.Base:
+				seller = p.Account.UserID
+			case pair.Quote:
+				ex.Fees.RecordVolume(p.Account.UserID, pair.Quote, -p.Amount, at)
+				ex.Fees.RecordVolume(seller, pair.Quote, -p.Amount, at)
+			}
+		}
+		trades++
+	}
+
+	return trades
+}
+
+// Fill is one side of a match as it was settled.
+type Fill struct {
+	OrderID int64
+	UserID  int64
+	Market  token.Market
+	Bid     bool
+	Maker   bool
+	Price   float64
+	Size    float64
+	// Fee is taken from what the user received, a negative fee is a rebate
+	Fee      float64
+	FeeAsset token.Asset
+}
+
+type GetFeesResponse struct {
+	UserID int64
+	Rates  map[token.Asset]FeeRates
+	Volume map[token.Asset]float64
+}
+
+// handleGetFees returns the rates of the user per quote asset.
+func (ex *Exchange) handleGetFees(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	var (
+		now  = time.Now()
+		resp = GetFeesResponse{
+			UserID: int64(userID),
+			Rates:  make(map[token.Asset]FeeRates),
+			Volume: make(map[token.Asset]float64),
+		}
+	)
+	for _, market := range ex.markets.Markets() {
+		resp.Rates[market.Quote] = ex.Fees.Rates(int64(userID), market.Quote, now)
+		resp.Volume[market.Quote] = ex.Fees.Volume(int64(userID), market.Quote, now)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (ex *Exchange) handleGetFeeSchedule(c echo.Context) error {
+	return c.JSON(http.StatusOK, ex.Fees.Schedule())
+}
+
+func (ex *Exchange) handleSetFeeSchedule(c echo.Context) error {
+	var schedule FeeSchedule
+	if err := json.NewDecoder(c.Request().Body).Decode(&schedule); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	if err := schedule.Validate(); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	if err := ex.userStore.SetFeeSchedule(schedule); err != nil {
+		return err
+	}
+	if err := ex.Fees.SetSchedule(schedule); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	ex.recordAudit(c, audit.FeeScheduleChanged, 0, map[string]any{"tiers": len(schedule.Tiers)})
+
+	logrus.WithField("tiers", len(schedule.Tiers)).Info("fee schedule changed")
+
+	return c.JSON(http.StatusOK, ex.Fees.Schedule())
+}
+
+func (ex *Exchange) handleSetFeeOverride(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	var rates FeeRates
+	if err := json.NewDecoder(c.Request().Body).Decode(&rates); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	if err := rates.Validate(); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	if err := ex.userStore.SetFeeOverride(int64(userID), &rates); err != nil {
+		return err
+	}
+	if err := ex.Fees.SetOverride(int64(userID), rates); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	ex.recordAudit(c, audit.FeeOverrideSet, int64(userID), map[string]any{
+		"makerRate": rates.MakerRate,
+		"takerRate": rates.TakerRate,
+	})
+
+	logrus.WithFields(logrus.Fields{
+		"userID":    userID,
+		"makerRate": rates.MakerRate,
+		"takerRate": rates.TakerRate,
+	}).Info("fee override set")
+
+	return c.JSON(http.StatusOK, rates)
+}
+
+func (ex *Exchange) handleRemoveFeeOverride(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	if err := ex.userStore.SetFeeOverride(int64(userID), nil); err != nil {
+		return err
+	}
+	ex.Fees.RemoveOverride(int64(userID))
+	ex.recordAudit(c, audit.FeeOverrideRemoved, int64(userID), nil)
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "fee override removed"})
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+var testFeeSchedule = FeeSchedule{
+	Tiers: []FeeTier{
+		{MinVolume: 0, MakerRate: 0.001, TakerRate: 0.002},
+		{MinVolume: 10_000, MakerRate: -0.0005, TakerRate: 0.001},
+	},
+}
+
+func TestFeeTiers(t *testing.T) {
+	fees, err := NewFeeEngine(testFeeSchedule)
+	assert(t, err, nil)
+
+	now := time.Now()
+	assert(t, fees.Rates(1, token.AssetUSDT, now), FeeRates{MakerRate: 0.001, TakerRate: 0.002})
+
+	fees.RecordVolume(1, token.AssetUSDT, 6_000, now.Add(-40*24*time.Hour))
+	fees.RecordVolume(1, token.AssetUSDT, 6_000, now.Add(-20*24*time.Hour))
+	assert(t, fees.Volume(1, token.AssetUSDT, now), 6_000.0)
+	fees.RecordVolume(1, token.AssetUSDT, 4_000, now)
+	assert(t, fees.Rates(1, token.AssetUSDT, now), FeeRates{MakerRate: -0.0005, TakerRate: 0.001})
+	// the volume is counted per quote asset
+	assert(t, fees.Rates(1, token.AssetBTC, now), FeeRates{MakerRate: 0.001, TakerRate: 0.002})
+	// the old volume leaves the window
+	assert(t, fees.Rates(1, token.AssetUSDT, now.Add(11*24*time.Hour)), FeeRates{MakerRate: 0.001, TakerRate: 0.002})
+
+	// BTC volume reaches its own tiers
+	assert(t, fees.SetSchedule(FeeSchedule{
+		Tiers:      testFeeSchedule.Tiers,
+		QuoteTiers: map[token.Asset][]FeeTier{token.AssetBTC: {{TakerRate: 0.002}, {MinVolume: 1, TakerRate: 0.001}}},
+	}), nil)
+	fees.RecordVolume(1, token.AssetBTC, 2, now)
+	assert(t, fees.Rates(1, token.AssetBTC, now), FeeRates{TakerRate: 0.001})
+	assert(t, fees.Rates(1, token.AssetUSDT, now), FeeRates{MakerRate: -0.0005, TakerRate: 0.001})
+
+	assert(t, fees.SetOverride(1, FeeRates{MakerRate: 0, TakerRate: 0.0001}), nil)
+	assert(t, fees.Rates(1, token.AssetUSDT, now), FeeRates{MakerRate: 0, TakerRate: 0.0001})
+	fees.RemoveOverride(1)
+	assert(t, fees.Rates(1, token.AssetUSDT, now), FeeRates{MakerRate: -0.0005, TakerRate: 0.001})
+}
+
+func TestFeeScheduleValidate(t *testing.T) {
+	assert(t, (&FeeSchedule{}).Validate() != nil, true)
+	assert(t, (&FeeSchedule{Tiers: []FeeTier{{MinVolume: 10}}}).Validate() != nil, true)
+	assert(t, (&FeeSchedule{Tiers: []FeeTier{{TakerRate: -0.001}}}).Validate() != nil, true)
+	// the rebate can not be larger than the taker fee paying for it
+	assert(t, (&FeeSchedule{Tiers: []FeeTier{{MakerRate: -0.002, TakerRate: 0.001}}}).Validate() != nil, true)
+
+	schedule := FeeSchedule{Tiers: []FeeTier{{MinVolume: 100, TakerRate: 0.001}, {TakerRate: 0.002}}}
+	assert(t, schedule.Validate(), nil)
+	assert(t, schedule.Tiers[0].MinVolume, 0.0)
+}
+
+func TestMatchesPayFees(t *testing.T) {
+	ex, _ := newTestExchange(t, 1, 2)
+	assert(t, ex.Fees.SetSchedule(testFeeSchedule), nil)
+
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 10, Price: 1_000, Market: token.MarketETHUSDT})
+
+	rec := doUserRequest(newRouter(ex), 2, http.MethodPost, "/order", PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 4, Market: token.MarketETHUSDT})
+	resp := PlaceOrderResponse{}
+	assert(t, json.NewDecoder(rec.Body).Decode(&resp), nil)
+	assert(t, len(resp.Fills), 1)
+	assert(t, resp.Fills[0].Maker, false)
+	assert(t, resp.Fills[0].Fee, 0.008)
+	assert(t, resp.Fills[0].FeeAsset, token.AssetETH)
+
+	// the taker pays in the base asset it bought, the maker in the quote
+	assert(t, ex.Ledger.Balance(ledger.UserAccount(2, token.AssetETH)), 1_000_000.0+4-0.008)
+	assert(t, ex.Ledger.Balance(ledger.UserAccount(1, token.AssetUSDT)), 1_000_000.0+4_000-4)
+	assert(t, ex.Ledger.Balance(ledger.ExchangeAccount(ledger.Fee, token.AssetETH)), 0.008)
+	assert(t, ex.Ledger.Balance(ledger.ExchangeAccount(ledger.Fee, token.AssetUSDT)), 4.0)
+
+	// the 8000 traded since put the maker into the rebate tier
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 6, Market: token.MarketETHUSDT})
+	assert(t, ex.Fees.Volume(1, token.AssetUSDT, time.Now()), 10_000.0)
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1, Price: 1_000, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 1, Market: token.MarketETHUSDT})
+	assert(t, ex.Ledger.Balance(ledger.ExchangeAccount(ledger.Fee, token.AssetUSDT)), 4.0+6-0.5)
+
+	assert(t, ex.Ledger.Check(), nil)
+}
+
+func TestFeeAdmin(t *testing.T) {
+	ex, e := newTestExchange(t, 1)
+	ex.SetAdminToken(testAdminToken)
+
+	rec := doAdminRequest(e, http.MethodPut, "/admin/fees", testFeeSchedule)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, ex.Fees.Schedule(), testFeeSchedule)
+
+	rec = doAdminRequest(e, http.MethodPut, "/admin/fees", FeeSchedule{})
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	rec = doAdminRequest(e, http.MethodPut, "/admin/fees/users/1", FeeRates{MakerRate: -0.0001, TakerRate: 0.0005})
+	assert(t, rec.Code, http.StatusOK)
+
+	rec = doUserRequest(e, 1, http.MethodGet, "/fees/1", nil)
+	fees := GetFeesResponse{}
+	assert(t, json.NewDecoder(rec.Body).Decode(&fees), nil)
+	assert(t, fees.Rates[token.AssetUSDT], FeeRates{MakerRate: -0.0001, TakerRate: 0.0005})
+
+	rec = doAdminRequest(e, http.MethodDelete, "/admin/fees/users/1", nil)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, ex.Fees.Rates(1, token.AssetUSDT, time.Now()), FeeRates{MakerRate: 0.001, TakerRate: 0.002})
+}
+
+func TestRestoreVolumes(t *testing.T) {
+	ex, _ := newTestExchange(t, 1, 2, 3)
+
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 1_000, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 3, Type: LimitOrder, Bid: true, Size: 1, Price: 0.05, Market: token.MarketETHBTC})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 2, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Size: 1, Market: token.MarketETHBTC})
+
+	// the next start only has the journal
+	next, _ := newTestExchange(t)
+	next.Ledger = ex.Ledger
+	assert(t, next.restoreVolumes(time.Now()), 2)
+	for _, want := range []struct {
+		userID int64
+		asset  token.Asset
+		volume float64
+	}{{1, token.AssetUSDT, 2_000}, {2, token.AssetUSDT, 2_000}, {2, token.AssetBTC, 0.05}, {3, token.AssetBTC, 0.05}, {3, token.AssetUSDT, 0}} {
+		assert(t, next.Fees.Volume(want.userID, want.asset, time.Now()), want.volume)
+	}
+
+	// trades older than the window do not count
+	later, _ := newTestExchange(t)
+	later.Ledger = ex.Ledger
+	assert(t, later.restoreVolumes(time.Now().Add(31*24*time.Hour)), 0)
+}
@@ -0,0 +1,245 @@
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := NewMessage(MsgTypeMarketDataRequest).
+		Add(TagMDReqID, "md-1").
+		AddInt(TagNoMDEntryTypes, 2).
+		Add(TagMDEntryType, "0").
+		Add(TagMDEntryType, "1").
+		AddInt(TagNoRelatedSym, 1).
+		Add(TagSymbol, "ETH-USDT")
+	// header fields go first whatever order they were added in
+	m.Add(TagSenderCompID, "CLIENT").Add(TagTargetCompID, "EXCHANGE").AddInt(TagMsgSeqNum, 7)
+
+	b := m.Bytes()
+	assert(t, strings.HasPrefix(string(b), "8=FIX.4.4\x019="), true)
+	assert(t, strings.Contains(string(b), "\x0135=V\x0149=CLIENT\x0156=EXCHANGE\x0134=7\x01262=md-1"), true)
+
+	read, err := ReadMessage(bufio.NewReader(bytes.NewReader(b)))
+	assert(t, err, nil)
+	assert(t, read.Type(), MsgTypeMarketDataRequest)
+	assert(t, read.SeqNum(), 7)
+
+	types := read.Groups(TagNoMDEntryTypes, TagMDEntryType)
+	assert(t, len(types), 2)
+	v, _ := types[1].Get(TagMDEntryType)
+	assert(t, v, "1")
+	symbols := read.Groups(TagNoRelatedSym, TagSymbol)
+	assert(t, len(symbols), 1)
+
+	// a garbled message is skipped, the next one still reads
+	garbled := bytes.Replace(b, []byte("md-1"), []byte("md-2"), 1)
+	r := bufio.NewReader(bytes.NewReader(append(garbled, b...)))
+	_, err = ReadMessage(r)
+	assert(t, errors.Is(err, ErrGarbled), true)
+	read, err = ReadMessage(r)
+	assert(t, err, nil)
+	id, _ := read.Get(TagMDReqID)
+	assert(t, id, "md-1")
+}
+
+// testApp hands the application messages over to the test.
+type testApp struct {
+	messages chan *Message
+	refuse   error
+}
+
+func (a *testApp) OnLogon(s *Session, logon *Message) error { return a.refuse }
+func (a *testApp) OnLogout(s *Session)                      {}
+func (a *testApp) FromApp(s *Session, m *Message)           { a.messages <- m }
+
+func newTestAcceptor(t *testing.T) (*Acceptor, *testApp, string) {
+	app := &testApp{messages: make(chan *Message, 16)}
+	acceptor := NewAcceptor("EXCHANGE", app)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go acceptor.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		acceptor.Shutdown(ctx)
+	})
+
+	return acceptor, app, ln.Addr().String()
+}
+
+func dialTestInitiator(t *testing.T, addr string) *Initiator {
+	i, err := Dial(addr, "CLIENT", "EXCHANGE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { i.Close() })
+	return i
+}
+
+func waitLoggedOut(t *testing.T, s *Session) {
+	for deadline := time.Now().Add(5 * time.Second); s.LoggedOn(); {
+		if time.Now().After(deadline) {
+			t.Fatal("session still logged on")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionHeartbeats(t *testing.T) {
+	_, _, addr := newTestAcceptor(t)
+	i := dialTestInitiator(t, addr)
+
+	reply, err := i.Logon(1, true)
+	assert(t, err, nil)
+	assert(t, reply.Bool(TagResetSeqNumFlag), true)
+
+	// a quiet initiator gets heartbeats, then a test request it answers
+	_, err = i.Expect(MsgTypeHeartbeat, 3*time.Second)
+	assert(t, err, nil)
+	req, err := i.Expect(MsgTypeTestRequest, 3*time.Second)
+	assert(t, err, nil)
+	id, _ := req.Get(TagTestReqID)
+	assert(t, id != "", true)
+
+	i.Send(NewMessage(MsgTypeTestRequest).Add(TagTestReqID, "ping"))
+	for {
+		hb, err := i.Expect(MsgTypeHeartbeat, 3*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, _ := hb.Get(TagTestReqID); id == "ping" {
+			break
+		}
+	}
+
+	assert(t, i.Logout(), nil)
+}
+
+func TestSessionResendsMissedMessages(t *testing.T) {
+	acceptor, _, addr := newTestAcceptor(t)
+	i := dialTestInitiator(t, addr)
+	_, err := i.Logon(30, true)
+	assert(t, err, nil)
+
+	s, _ := acceptor.Session("CLIENT")
+	s.Send(NewMessage(MsgTypeExecutionReport).Add(TagText, "one"))
+	m, err := i.Expect(MsgTypeExecutionReport, time.Second)
+	assert(t, err, nil)
+	assert(t, m.SeqNum(), 2)
+
+	assert(t, i.Logout(), nil)
+	i.Close()
+	waitLoggedOut(t, s)
+
+	// sent while the initiator is away, they are kept for a resend
+	s.Send(NewMessage(MsgTypeExecutionReport).Add(TagText, "two"))
+	s.Send(NewMessage(MsgTypeExecutionReport).Add(TagText, "three"))
+
+	i2 := dialTestInitiator(t, addr)
+	i2.SetNextSeqNum(i.NextSeqNum())
+	reply, err := i2.Logon(30, false)
+	assert(t, err, nil)
+	assert(t, reply.SeqNum(), 6)
+
+	i2.Send(NewMessage(MsgTypeResendRequest).AddInt(TagBeginSeqNo, 4).AddInt(TagEndSeqNo, 0))
+	for _, want := range []struct {
+		seq  int
+		text string
+	}{{4, "two"}, {5, "three"}} {
+		m, err := i2.Expect(MsgTypeExecutionReport, time.Second)
+		assert(t, err, nil)
+		assert(t, m.SeqNum(), want.seq)
+		assert(t, m.Bool(TagPossDupFlag), true)
+		text, _ := m.Get(TagText)
+		assert(t, text, want.text)
+		_, ok := m.Get(TagOrigSendingTime)
+		assert(t, ok, true)
+	}
+	// the logon is a session message, it is gap filled
+	gap, err := i2.Expect(MsgTypeSequenceReset, time.Second)
+	assert(t, err, nil)
+	assert(t, gap.SeqNum(), 6)
+	assert(t, gap.Bool(TagGapFillFlag), true)
+	newSeq, _ := gap.Int(TagNewSeqNo)
+	assert(t, newSeq, int64(7))
+}
+
+func TestSessionRequestsResendOfGaps(t *testing.T) {
+	acceptor, app, addr := newTestAcceptor(t)
+	i := dialTestInitiator(t, addr)
+	_, err := i.Logon(30, true)
+	assert(t, err, nil)
+
+	order := func(id string) *Message {
+		return NewMessage(MsgTypeNewOrderSingle).Add(TagClOrdID, id)
+	}
+	i.Send(order("a"))
+	i.SendWithSeqNum(order("c"), 4)
+	i.SetNextSeqNum(5)
+
+	req, err := i.Expect(MsgTypeResendRequest, time.Second)
+	assert(t, err, nil)
+	begin, _ := req.Int(TagBeginSeqNo)
+	assert(t, begin, int64(3))
+
+	// the resend covers the message queued by the acceptor, which drops it
+	i.SendWithSeqNum(order("b").Add(TagPossDupFlag, "Y"), 3)
+	i.SendWithSeqNum(order("c").Add(TagPossDupFlag, "Y"), 4)
+	i.Send(order("d"))
+
+	for _, want := range []string{"a", "b", "c", "d"} {
+		select {
+		case m := <-app.messages:
+			id, _ := m.Get(TagClOrdID)
+			assert(t, id, want)
+		case <-time.After(time.Second):
+			t.Fatalf("order %s not handed over", want)
+		}
+	}
+	s, _ := acceptor.Session("CLIENT")
+	_, nextIn := s.SeqNums()
+	assert(t, nextIn, 6)
+
+	// a too low sequence number without PossDupFlag ends the session
+	i.SendWithSeqNum(order("e"), 2)
+	logout, err := i.Expect(MsgTypeLogout, time.Second)
+	assert(t, err, nil)
+	text, _ := logout.Get(TagText)
+	assert(t, strings.Contains(text, "MsgSeqNum too low"), true)
+}
+
+func TestSessionRefusesLogons(t *testing.T) {
+	_, app, addr := newTestAcceptor(t)
+	app.refuse = errors.New("invalid credentials")
+
+	i := dialTestInitiator(t, addr)
+	reply, err := i.Logon(30, true)
+	assert(t, err != nil, true)
+	assert(t, reply.Type(), MsgTypeLogout)
+	text, _ := reply.Get(TagText)
+	assert(t, text, "invalid credentials")
+
+	// logons to another comp ID are dropped without an answer
+	other, err := Dial(addr, "CLIENT", "OTHER")
+	assert(t, err, nil)
+	defer other.Close()
+	_, err = other.Logon(30, true)
+	assert(t, err != nil, true)
+}
@@ -0,0 +1,179 @@
+package fix
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Initiator is a minimal FIX client. It numbers and sends the messages it
+// is given and reads what comes back, answering the test requests of the
+// acceptor on its own. Anything else of the session, like resends, is up to
+// its user.
+type Initiator struct {
+	SenderCompID string
+	TargetCompID string
+
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu      sync.Mutex
+	nextOut int
+}
+
+// Dial connects to the acceptor at addr.
+func Dial(addr, senderCompID, targetCompID string) (*Initiator, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Initiator{
+		SenderCompID: senderCompID,
+		TargetCompID: targetCompID,
+		conn:         conn,
+		r:            bufio.NewReader(conn),
+		nextOut:      1,
+	}, nil
+}
+
+// NextSeqNum returns the sequence number of the next message sent.
+func (i *Initiator) NextSeqNum() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.nextOut
+}
+
+// SetNextSeqNum sets the sequence number of the next message sent.
+func (i *Initiator) SetNextSeqNum(seq int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.nextOut = seq
+}
+
+// Send sends m with the next sequence number.
+func (i *Initiator) Send(m *Message) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	seq := i.nextOut
+	i.nextOut++
+	return i.write(m, seq)
+}
+
+// SendWithSeqNum sends m with the sequence number seq, leaving the next one
+// as it is. It is meant for resends and for testing gaps.
+func (i *Initiator) SendWithSeqNum(m *Message, seq int) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.write(m, seq)
+}
+
+func (i *Initiator) write(m *Message, seq int) error {
+	m.Set(TagSenderCompID, i.SenderCompID)
+	m.Set(TagTargetCompID, i.TargetCompID)
+	m.Set(TagMsgSeqNum, strconv.Itoa(seq))
+	if _, ok := m.Get(TagSendingTime); !ok {
+		m.AddTime(TagSendingTime, time.Now())
+	}
+
+	_, err := i.conn.Write(m.Bytes())
+	return err
+}
+
+// Logon sends a logon with the heartbeat interval and the extra fields, like
+// the credentials, and waits for the logon of the acceptor. A refused logon
+// returns the text of the logout.
+func (i *Initiator) Logon(heartBtInt int, reset bool, fields ...Field) (*Message, error) {
+	logon := NewMessage(MsgTypeLogon).
+		AddInt(TagEncryptMethod, 0).
+		AddInt(TagHeartBtInt, int64(heartBtInt))
+	if reset {
+		logon.Add(TagResetSeqNumFlag, "Y")
+		i.SetNextSeqNum(1)
+	}
+	for _, f := range fields {
+		logon.Add(f.Tag, f.Value)
+	}
+	if err := i.Send(logon); err != nil {
+		return nil, err
+	}
+
+	reply, err := i.Receive(10 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type() != MsgTypeLogon {
+		text, _ := reply.Get(TagText)
+		return reply, fmt.Errorf("logon refused with %s: %s", reply.Type(), text)
+	}
+	return reply, nil
+}
+
+// Receive reads the next message, test requests are answered and returned
+// like every other message.
+func (i *Initiator) Receive(timeout time.Duration) (*Message, error) {
+	i.conn.SetReadDeadline(time.Now().Add(timeout))
+	m, err := ReadMessage(i.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Type() == MsgTypeTestRequest {
+		reply := NewMessage(MsgTypeHeartbeat)
+		if id, ok := m.Get(TagTestReqID); ok {
+			reply.Add(TagTestReqID, id)
+		}
+		if err := i.Send(reply); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ErrTimeout is returned by Expect when no message of the type arrived in
+// time.
+var ErrTimeout = errors.New("timed out waiting for message")
+
+// Expect reads messages until one of the type arrives and returns it, the
+// other messages read on the way are dropped.
+func (i *Initiator) Expect(msgType string, timeout time.Duration) (*Message, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, fmt.Errorf("%w: %s", ErrTimeout, msgType)
+		}
+		m, err := i.Receive(left)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%w: %s", ErrTimeout, msgType)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m.Type() == msgType {
+			return m, nil
+		}
+	}
+}
+
+// Logout sends a logout and waits for the one of the acceptor.
+func (i *Initiator) Logout() error {
+	if err := i.Send(NewMessage(MsgTypeLogout)); err != nil {
+		return err
+	}
+	_, err := i.Expect(MsgTypeLogout, 10*time.Second)
+	return err
+}
+
+func (i *Initiator) Close() error {
+	return i.conn.Close()
+}
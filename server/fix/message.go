@@ -0,0 +1,403 @@
+// Package fix speaks the FIX 4.4 session protocol: it encodes and parses the
+// tag=value messages and runs the sessions of an acceptor, with their logon,
+// heartbeats, sequence numbers and resends. What the application messages
+// mean is up to the Application of the acceptor.
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// BeginString is the only version spoken.
+const BeginString = "FIX.4.4"
+
+// soh separates the fields of a message.
+const soh = '\x01'
+
+// TimeFormat is the UTCTimestamp format of the time fields, in milliseconds.
+const TimeFormat = "20060102-15:04:05.000"
+
+// Tags of the fields in use.
+const (
+	TagAvgPx                   = 6
+	TagBeginSeqNo              = 7
+	TagBeginString             = 8
+	TagBodyLength              = 9
+	TagCheckSum                = 10
+	TagClOrdID                 = 11
+	TagCumQty                  = 14
+	TagEndSeqNo                = 16
+	TagExecID                  = 17
+	TagLastPx                  = 31
+	TagLastQty                 = 32
+	TagMsgSeqNum               = 34
+	TagMsgType                 = 35
+	TagNewSeqNo                = 36
+	TagOrderID                 = 37
+	TagOrderQty                = 38
+	TagOrdStatus               = 39
+	TagOrdType                 = 40
+	TagOrigClOrdID             = 41
+	TagPossDupFlag             = 43
+	TagPrice                   = 44
+	TagRefSeqNum               = 45
+	TagSenderCompID            = 49
+	TagSendingTime             = 52
+	TagSide                    = 54
+	TagSymbol                  = 55
+	TagTargetCompID            = 56
+	TagText                    = 58
+	TagTransactTime            = 60
+	TagEncryptMethod           = 98
+	TagCxlRejReason            = 102
+	TagOrdRejReason            = 103
+	TagHeartBtInt              = 108
+	TagTestReqID               = 112
+	TagOrigSendingTime         = 122
+	TagGapFillFlag             = 123
+	TagExpireTime              = 126
+	TagResetSeqNumFlag         = 141
+	TagNoRelatedSym            = 146
+	TagExecType                = 150
+	TagLeavesQty               = 151
+	TagMDReqID                 = 262
+	TagSubscriptionRequestType = 263
+	TagMarketDepth             = 264
+	TagMDUpdateType            = 265
+	TagNoMDEntryTypes          = 267
+	TagNoMDEntries             = 268
+	TagMDEntryType             = 269
+	TagMDEntryPx               = 270
+	TagMDEntrySize             = 271
+	TagMDUpdateAction          = 279
+	TagMDReqRejReason          = 281
+	TagRefTagID                = 371
+	TagRefMsgType              = 372
+	TagSessionRejectReason     = 373
+	TagBusinessRejectReason    = 380
+	TagCxlRejResponseTo        = 434
+	TagUsername                = 553
+	TagPassword                = 554
+)
+
+// Types of the messages in use.
+const (
+	MsgTypeHeartbeat                 = "0"
+	MsgTypeTestRequest               = "1"
+	MsgTypeResendRequest             = "2"
+	MsgTypeReject                    = "3"
+	MsgTypeSequenceReset             = "4"
+	MsgTypeLogout                    = "5"
+	MsgTypeExecutionReport           = "8"
+	MsgTypeOrderCancelReject         = "9"
+	MsgTypeLogon                     = "A"
+	MsgTypeNewOrderSingle            = "D"
+	MsgTypeOrderCancelRequest        = "F"
+	MsgTypeOrderCancelReplaceRequest = "G"
+	MsgTypeMarketDataRequest         = "V"
+	MsgTypeMarketDataSnapshot        = "W"
+	MsgTypeMarketDataIncremental     = "X"
+	MsgTypeMarketDataRequestReject   = "Y"
+	MsgTypeBusinessMessageReject     = "j"
+)
+
+var (
+	// ErrGarbled is a message with a wrong length or checksum, the session
+	// ignores it and waits for it to be resent.
+	ErrGarbled = errors.New("garbled message")
+	// ErrFieldMissing is a required field the message does not carry.
+	ErrFieldMissing = errors.New("required field missing")
+)
+
+// headerTags are written right after the MsgType, in this order.
+var headerTags = []int{TagSenderCompID, TagTargetCompID, TagMsgSeqNum, TagSendingTime, TagPossDupFlag, TagOrigSendingTime}
+
+type Field struct {
+	Tag   int
+	Value string
+}
+
+// Message is a FIX message, its fields in the order they were received or
+// added. BeginString, BodyLength and CheckSum are only added by Bytes.
+type Message struct {
+	Fields []Field
+}
+
+func NewMessage(msgType string) *Message {
+	return &Message{Fields: []Field{{Tag: TagMsgType, Value: msgType}}}
+}
+
+func (m *Message) Type() string {
+	msgType, _ := m.Get(TagMsgType)
+	return msgType
+}
+
+// Add appends the field, repeating groups are added field by field.
+func (m *Message) Add(tag int, value string) *Message {
+	m.Fields = append(m.Fields, Field{Tag: tag, Value: value})
+	return m
+}
+
+func (m *Message) AddInt(tag int, value int64) *Message {
+	return m.Add(tag, strconv.FormatInt(value, 10))
+}
+
+func (m *Message) AddFloat(tag int, value float64) *Message {
+	return m.Add(tag, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (m *Message) AddTime(tag int, t time.Time) *Message {
+	return m.Add(tag, t.UTC().Format(TimeFormat))
+}
+
+// Set replaces the first field with the tag, or adds it.
+func (m *Message) Set(tag int, value string) *Message {
+	for i := range m.Fields {
+		if m.Fields[i].Tag == tag {
+			m.Fields[i].Value = value
+			return m
+		}
+	}
+	return m.Add(tag, value)
+}
+
+// Remove drops every field with the tag.
+func (m *Message) Remove(tag int) {
+	fields := m.Fields[:0]
+	for _, f := range m.Fields {
+		if f.Tag != tag {
+			fields = append(fields, f)
+		}
+	}
+	m.Fields = fields
+}
+
+// Get returns the first field with the tag.
+func (m *Message) Get(tag int) (string, bool) {
+	for _, f := range m.Fields {
+		if f.Tag == tag {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// String returns the required field with the tag.
+func (m *Message) String(tag int) (string, error) {
+	v, ok := m.Get(tag)
+	if !ok || v == "" {
+		return "", fmt.Errorf("%w: %d", ErrFieldMissing, tag)
+	}
+	return v, nil
+}
+
+func (m *Message) Int(tag int) (int64, error) {
+	v, err := m.String(tag)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("tag %d: %w", tag, err)
+	}
+	return i, nil
+}
+
+func (m *Message) Float(tag int) (float64, error) {
+	v, err := m.String(tag)
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("tag %d: %w", tag, err)
+	}
+	return f, nil
+}
+
+func (m *Message) Time(tag int) (time.Time, error) {
+	v, err := m.String(tag)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// the seconds only format of FIX parses as well
+	t, err := time.Parse("20060102-15:04:05", v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("tag %d: %w", tag, err)
+	}
+	return t, nil
+}
+
+// Bool is a Y/N field, missing ones are false.
+func (m *Message) Bool(tag int) bool {
+	v, _ := m.Get(tag)
+	return v == "Y"
+}
+
+// SeqNum is the MsgSeqNum of the message, 0 when it has none.
+func (m *Message) SeqNum() int {
+	seq, _ := m.Int(TagMsgSeqNum)
+	return int(seq)
+}
+
+// Groups returns the instances of the repeating group counted by countTag.
+// tags are the fields of the group, the first one starts every instance.
+func (m *Message) Groups(countTag int, tags ...int) []*Message {
+	member := make(map[int]bool, len(tags))
+	for _, tag := range tags {
+		member[tag] = true
+	}
+
+	var groups []*Message
+	for i, f := range m.Fields {
+		if f.Tag != countTag {
+			continue
+		}
+		for _, f := range m.Fields[i+1:] {
+			if !member[f.Tag] {
+				break
+			}
+			if f.Tag == tags[0] {
+				groups = append(groups, &Message{})
+			}
+			if len(groups) > 0 {
+				groups[len(groups)-1].Add(f.Tag, f.Value)
+			}
+		}
+		break
+	}
+	return groups
+}
+
+// Bytes encodes the message with its BeginString, BodyLength and CheckSum.
+// The header fields are written first, whatever order they were added in.
+func (m *Message) Bytes() []byte {
+	var body bytes.Buffer
+	write := func(tag int, value string) {
+		body.WriteString(strconv.Itoa(tag))
+		body.WriteByte('=')
+		body.WriteString(value)
+		body.WriteByte(soh)
+	}
+
+	write(TagMsgType, m.Type())
+	for _, tag := range headerTags {
+		if v, ok := m.Get(tag); ok {
+			write(tag, v)
+		}
+	}
+	for _, f := range m.Fields {
+		if !isHeaderTag(f.Tag) {
+			write(f.Tag, f.Value)
+		}
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "%d=%s%c%d=%d%c", TagBeginString, BeginString, soh, TagBodyLength, body.Len(), soh)
+	msg.Write(body.Bytes())
+	fmt.Fprintf(&msg, "%d=%03d%c", TagCheckSum, checksum(msg.Bytes()), soh)
+
+	return msg.Bytes()
+}
+
+func isHeaderTag(tag int) bool {
+	switch tag {
+	case TagBeginString, TagBodyLength, TagCheckSum, TagMsgType:
+		return true
+	}
+	for _, t := range headerTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func checksum(b []byte) int {
+	sum := 0
+	for _, c := range b {
+		sum += int(c)
+	}
+	return sum % 256
+}
+
+// maxBodyLength bounds the messages read, nothing sent to the exchange
+// comes close.
+const maxBodyLength = 64 << 10
+
+// ReadMessage reads the next message. A message of the wrong version or too
+// long to read fails the stream, a garbled one fails with ErrGarbled and the
+// stream can be read on.
+func ReadMessage(r *bufio.Reader) (*Message, error) {
+	begin, err := readField(r)
+	if err != nil {
+		return nil, err
+	}
+	if begin.Tag != TagBeginString || begin.Value != BeginString {
+		return nil, fmt.Errorf("unexpected begin string %d=%s", begin.Tag, begin.Value)
+	}
+
+	length, err := readField(r)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(length.Value)
+	if length.Tag != TagBodyLength || err != nil || n <= 0 || n > maxBodyLength {
+		return nil, fmt.Errorf("unexpected body length %d=%s", length.Tag, length.Value)
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	trailer, err := readField(r)
+	if err != nil {
+		return nil, err
+	}
+
+	header := fmt.Sprintf("%d=%s%c%d=%s%c", TagBeginString, begin.Value, soh, TagBodyLength, length.Value, soh)
+	sum := checksum(append([]byte(header), body...))
+	if trailer.Tag != TagCheckSum || trailer.Value != fmt.Sprintf("%03d", sum) {
+		return nil, fmt.Errorf("%w: checksum %d=%s, expected %03d", ErrGarbled, trailer.Tag, trailer.Value, sum)
+	}
+
+	m := &Message{}
+	for _, raw := range bytes.Split(bytes.TrimSuffix(body, []byte{soh}), []byte{soh}) {
+		f, err := parseField(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrGarbled, err)
+		}
+		m.Fields = append(m.Fields, f)
+	}
+	if len(m.Fields) == 0 || m.Fields[0].Tag != TagMsgType {
+		return nil, fmt.Errorf("%w: MsgType is not the first field", ErrGarbled)
+	}
+
+	return m, nil
+}
+
+func readField(r *bufio.Reader) (Field, error) {
+	raw, err := r.ReadSlice(soh)
+	if err != nil {
+		return Field{}, err
+	}
+	return parseField(raw[:len(raw)-1])
+}
+
+func parseField(raw []byte) (Field, error) {
+	tag, value, ok := bytes.Cut(raw, []byte{'='})
+	if !ok {
+		return Field{}, fmt.Errorf("field %q has no tag", raw)
+	}
+	t, err := strconv.Atoi(string(tag))
+	if err != nil || t <= 0 {
+		return Field{}, fmt.Errorf("field %q has no valid tag", raw)
+	}
+	return Field{Tag: t, Value: string(value)}, nil
+}
@@ -0,0 +1,712 @@
+package fix
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultLogonTimeout bounds the wait for the logon of a new connection.
+	DefaultLogonTimeout = 10 * time.Second
+	// maxStored is how many sent messages a session keeps for resends, older
+	// ones are gap filled.
+	maxStored = 10_000
+	// outQueue is how many messages can wait for a slow connection before it
+	// is dropped, they are still stored for a resend after the next logon.
+	outQueue     = 4096
+	writeTimeout = 10 * time.Second
+)
+
+// Application handles the messages of the sessions of an Acceptor.
+type Application interface {
+	// OnLogon authenticates the logon of the session, an error refuses it
+	// and is sent back as the text of the logout.
+	OnLogon(s *Session, logon *Message) error
+	// OnLogout is called once the session was disconnected.
+	OnLogout(s *Session)
+	// FromApp handles an application message. The messages of a session are
+	// handed over one at a time, in the order of their sequence numbers.
+	FromApp(s *Session, m *Message)
+}
+
+// Acceptor accepts the FIX sessions of the counterparties. Sessions outlive
+// their connections: the sequence numbers and the messages sent carry over to
+// the next logon of the same SenderCompID, until one of them asks for a reset.
+type Acceptor struct {
+	compID string
+	app    Application
+	// LogonTimeout bounds the wait for the logon of a new connection
+	LogonTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	listener net.Listener
+	conns    map[*conn]bool
+	closed   bool
+	handlers sync.WaitGroup
+}
+
+func NewAcceptor(compID string, app Application) *Acceptor {
+	return &Acceptor{
+		compID:       compID,
+		app:          app,
+		LogonTimeout: DefaultLogonTimeout,
+		sessions:     make(map[string]*Session),
+		conns:        make(map[*conn]bool),
+	}
+}
+
+// Serve accepts connections on ln until the acceptor is shut down.
+func (a *Acceptor) Serve(ln net.Listener) error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return ln.Close()
+	}
+	a.listener = ln
+	a.mu.Unlock()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			a.mu.Lock()
+			closed := a.closed
+			a.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		a.handlers.Add(1)
+		go a.handle(nc)
+	}
+}
+
+// Shutdown stops accepting connections, logs every session out and waits for
+// the connections to close. Once ctx is done the connections are dropped.
+func (a *Acceptor) Shutdown(ctx context.Context) error {
+	a.mu.Lock()
+	a.closed = true
+	if a.listener != nil {
+		a.listener.Close()
+	}
+	sessions := make([]*Session, 0, len(a.sessions))
+	for _, s := range a.sessions {
+		sessions = append(sessions, s)
+	}
+	a.mu.Unlock()
+
+	for _, s := range sessions {
+		s.logout("exchange shutting down")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		a.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		a.mu.Lock()
+		for c := range a.conns {
+			c.close()
+		}
+		a.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Session returns the session of the counterparty with the SenderCompID.
+func (a *Acceptor) Session(compID string) (*Session, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.sessions[compID]
+	return s, ok
+}
+
+func (a *Acceptor) session(compID string) *Session {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.sessions[compID]
+	if !ok {
+		s = &Session{
+			acceptor: a,
+			compID:   compID,
+			nextOut:  1,
+			nextIn:   1,
+			sent:     make(map[int]*Message),
+			queue:    make(map[int]*Message),
+		}
+		a.sessions[compID] = s
+	}
+	return s
+}
+
+func (a *Acceptor) handle(nc net.Conn) {
+	defer a.handlers.Done()
+
+	c := newConn(nc)
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		nc.Close()
+		return
+	}
+	a.conns[c] = true
+	a.mu.Unlock()
+	go c.writeLoop()
+	defer func() {
+		// a logout still queued is written before the connection closes
+		c.closeAfterWrites()
+		select {
+		case <-c.done:
+		case <-time.After(writeTimeout):
+			c.close()
+		}
+		a.mu.Lock()
+		delete(a.conns, c)
+		a.mu.Unlock()
+	}()
+
+	log := logrus.WithField("remote", nc.RemoteAddr().String())
+	r := bufio.NewReader(nc)
+
+	nc.SetReadDeadline(time.Now().Add(a.LogonTimeout))
+	logon, err := ReadMessage(r)
+	if err != nil {
+		log.WithError(err).Warn("fix connection closed before logon")
+		return
+	}
+	nc.SetReadDeadline(time.Time{})
+
+	s, err := a.logon(c, logon)
+	if err != nil {
+		log.WithError(err).Warn("fix logon refused")
+		return
+	}
+	log = log.WithField("session", s.compID)
+	log.Info("fix session logged on")
+
+	go s.keepalive(c)
+	for {
+		m, err := ReadMessage(r)
+		if errors.Is(err, ErrGarbled) {
+			log.WithError(err).Warn("ignoring garbled fix message")
+			continue
+		}
+		if err != nil {
+			break
+		}
+		c.received()
+
+		if !s.receive(c, m) {
+			break
+		}
+	}
+
+	s.detach(c)
+	a.app.OnLogout(s)
+	log.Info("fix session logged out")
+}
+
+// logon checks the first message of a connection and attaches the
+// connection to the session of its SenderCompID.
+func (a *Acceptor) logon(c *conn, m *Message) (*Session, error) {
+	if m.Type() != MsgTypeLogon {
+		return nil, fmt.Errorf("first message is %s, not a logon", m.Type())
+	}
+	target, _ := m.Get(TagTargetCompID)
+	if target != a.compID {
+		return nil, fmt.Errorf("logon to TargetCompID %q", target)
+	}
+	sender, err := m.String(TagSenderCompID)
+	if err != nil {
+		return nil, err
+	}
+	heartBtInt, err := m.Int(TagHeartBtInt)
+	if err != nil || heartBtInt <= 0 {
+		return nil, fmt.Errorf("logon without a valid HeartBtInt")
+	}
+	if encrypt, ok := m.Get(TagEncryptMethod); ok && encrypt != "0" {
+		return nil, fmt.Errorf("unsupported EncryptMethod %s", encrypt)
+	}
+	c.heartBtInt = time.Duration(heartBtInt) * time.Second
+
+	s := a.session(sender)
+	reset := m.Bool(TagResetSeqNumFlag)
+	seq := m.SeqNum()
+
+	s.mu.Lock()
+	if s.conn != nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("session %s is already logged on", sender)
+	}
+	if reset {
+		s.nextOut, s.nextIn = 1, 1
+		s.sent = make(map[int]*Message)
+		s.queue = make(map[int]*Message)
+	}
+	nextIn := s.nextIn
+	s.conn = c
+	s.mu.Unlock()
+
+	refuse := func(text string) (*Session, error) {
+		s.logout(text)
+		s.detach(c)
+		return nil, errors.New(text)
+	}
+	if seq < nextIn {
+		return refuse(fmt.Sprintf("MsgSeqNum too low, expecting %d but received %d", nextIn, seq))
+	}
+	if err := a.app.OnLogon(s, m); err != nil {
+		return refuse(err.Error())
+	}
+
+	reply := NewMessage(MsgTypeLogon).
+		AddInt(TagEncryptMethod, 0).
+		AddInt(TagHeartBtInt, heartBtInt)
+	if reset {
+		reply.Add(TagResetSeqNumFlag, "Y")
+	}
+	s.sendAdmin(reply)
+
+	// the logon counts as received, a gap in front of it is resent
+	s.receive(c, m)
+
+	return s, nil
+}
+
+// Session is the state a counterparty keeps across its connections.
+type Session struct {
+	acceptor *Acceptor
+	compID   string
+
+	mu      sync.Mutex
+	nextOut int
+	nextIn  int
+	// sent keeps the application messages for resends, by sequence number
+	sent map[int]*Message
+	// queue keeps the messages received ahead of a gap until it is filled,
+	// nil for the ones already handled
+	queue      map[int]*Message
+	resending  bool
+	conn       *conn
+	loggingOut bool
+}
+
+// CompID is the SenderCompID of the counterparty.
+func (s *Session) CompID() string {
+	return s.compID
+}
+
+// LoggedOn reports whether the counterparty is connected.
+func (s *Session) LoggedOn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn != nil
+}
+
+// SeqNums returns the sequence number of the next message sent and of the
+// next one expected.
+func (s *Session) SeqNums() (nextOut, nextIn int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.nextOut, s.nextIn
+}
+
+// Send sends an application message with the next sequence number, the
+// session keeps it and must be its only user. Messages sent while the
+// counterparty is logged out are resent once it asks for them.
+func (s *Session) Send(m *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := s.send(m)
+	s.sent[seq] = m
+	delete(s.sent, seq-maxStored)
+}
+
+// sendAdmin sends a session message, these are gap filled on resends.
+func (s *Session) sendAdmin(m *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.send(m)
+}
+
+// send takes the next sequence number for m and writes it, s.mu must be held.
+func (s *Session) send(m *Message) int {
+	seq := s.nextOut
+	s.nextOut++
+	m.Set(TagMsgSeqNum, strconv.Itoa(seq))
+	m.Set(TagSendingTime, time.Now().UTC().Format(TimeFormat))
+	s.write(m)
+
+	return seq
+}
+
+// write sends m as it is numbered, s.mu must be held.
+func (s *Session) write(m *Message) {
+	m.Set(TagSenderCompID, s.acceptor.compID)
+	m.Set(TagTargetCompID, s.compID)
+	if s.conn != nil {
+		s.conn.write(m.Bytes())
+	}
+}
+
+// logout sends a logout and closes the connection once it is written.
+func (s *Session) logout(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil || s.loggingOut {
+		return
+	}
+	s.loggingOut = true
+	s.send(NewMessage(MsgTypeLogout).Add(TagText, text))
+	s.conn.closeAfterWrites()
+}
+
+func (s *Session) detach(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == c {
+		s.conn = nil
+		s.loggingOut = false
+		s.resending = false
+	}
+	c.closeAfterWrites()
+}
+
+// receive checks the sequence number of m and handles it and the messages
+// queued behind it. It returns false once the connection has to close.
+func (s *Session) receive(c *conn, m *Message) bool {
+	seq := m.SeqNum()
+	if seq == 0 {
+		s.logout("MsgSeqNum missing")
+		return false
+	}
+	if sender, _ := m.Get(TagSenderCompID); sender != s.compID {
+		s.reject(seq, 9, "CompID problem")
+		s.logout("CompID problem")
+		return false
+	}
+
+	// a sequence reset without gap fill ignores the sequence numbers
+	if m.Type() == MsgTypeSequenceReset && !m.Bool(TagGapFillFlag) {
+		newSeq, err := m.Int(TagNewSeqNo)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err != nil || int(newSeq) < s.nextIn {
+			s.rejectLocked(seq, 5, "NewSeqNo can not lower the expected MsgSeqNum")
+			return true
+		}
+		s.advanceLocked(int(newSeq))
+		return true
+	}
+
+	s.mu.Lock()
+	nextIn := s.nextIn
+	s.mu.Unlock()
+
+	switch {
+	case seq < nextIn:
+		if m.Bool(TagPossDupFlag) {
+			return true
+		}
+		s.logout(fmt.Sprintf("MsgSeqNum too low, expecting %d but received %d", nextIn, seq))
+		return false
+	case seq > nextIn:
+		s.mu.Lock()
+		if m.Type() == MsgTypeResendRequest || m.Type() == MsgTypeLogon {
+			// both are handled right away, the gap behind them may need them
+			s.queue[seq] = nil
+		} else {
+			s.queue[seq] = m
+		}
+		if !s.resending {
+			s.resending = true
+			s.send(NewMessage(MsgTypeResendRequest).
+				AddInt(TagBeginSeqNo, int64(nextIn)).
+				AddInt(TagEndSeqNo, 0))
+		}
+		s.mu.Unlock()
+
+		if m.Type() == MsgTypeResendRequest {
+			return s.handle(c, m)
+		}
+		return true
+	}
+
+	for {
+		next := seq + 1
+		open := true
+		if m != nil {
+			if m.Type() == MsgTypeSequenceReset {
+				if newSeq, err := m.Int(TagNewSeqNo); err == nil && int(newSeq) > next {
+					next = int(newSeq)
+				}
+			} else if m.Type() != MsgTypeLogon {
+				open = s.handle(c, m)
+			}
+		}
+
+		// a logout counts as received too, the next logon goes on after it
+		s.mu.Lock()
+		s.advanceLocked(next)
+		queued, ok := s.queue[s.nextIn]
+		if ok {
+			delete(s.queue, s.nextIn)
+		}
+		seq = s.nextIn
+		s.mu.Unlock()
+
+		if !open {
+			return false
+		}
+		if !ok {
+			return true
+		}
+		m = queued
+	}
+}
+
+// advanceLocked expects next as the next sequence number, s.mu must be held.
+func (s *Session) advanceLocked(next int) {
+	s.nextIn = next
+	for seq := range s.queue {
+		if seq < next {
+			delete(s.queue, seq)
+		}
+	}
+	s.resending = len(s.queue) > 0
+}
+
+// handle handles a message in sequence. It returns false once the
+// connection has to close.
+func (s *Session) handle(c *conn, m *Message) bool {
+	switch m.Type() {
+	case MsgTypeHeartbeat, MsgTypeReject:
+	case MsgTypeTestRequest:
+		reply := NewMessage(MsgTypeHeartbeat)
+		if id, ok := m.Get(TagTestReqID); ok {
+			reply.Add(TagTestReqID, id)
+		}
+		s.sendAdmin(reply)
+	case MsgTypeResendRequest:
+		begin, err1 := m.Int(TagBeginSeqNo)
+		end, err2 := m.Int(TagEndSeqNo)
+		if err := errors.Join(err1, err2); err != nil {
+			s.reject(m.SeqNum(), 1, err.Error())
+			return true
+		}
+		s.resend(int(begin), int(end))
+	case MsgTypeLogout:
+		s.mu.Lock()
+		initiated := s.loggingOut
+		s.mu.Unlock()
+		if !initiated {
+			s.logout("logout acknowledged")
+		}
+		return false
+	case MsgTypeLogon:
+		s.logout("already logged on")
+		return false
+	default:
+		s.acceptor.app.FromApp(s, m)
+	}
+	return true
+}
+
+// resend sends the stored messages from begin to end again, 0 ends at the
+// last one sent. Session messages and the messages no longer stored are
+// gap filled.
+func (s *Session) resend(begin, end int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if end == 0 || end >= s.nextOut {
+		end = s.nextOut - 1
+	}
+	gapStart := 0
+	for seq := max(begin, 1); seq <= end; seq++ {
+		m, ok := s.sent[seq]
+		if !ok {
+			if gapStart == 0 {
+				gapStart = seq
+			}
+			continue
+		}
+		if gapStart != 0 {
+			s.gapFillLocked(gapStart, seq)
+			gapStart = 0
+		}
+
+		resent := &Message{Fields: append([]Field{}, m.Fields...)}
+		sendingTime, _ := m.Get(TagSendingTime)
+		resent.Set(TagPossDupFlag, "Y")
+		resent.Set(TagOrigSendingTime, sendingTime)
+		resent.Set(TagSendingTime, time.Now().UTC().Format(TimeFormat))
+		s.write(resent)
+	}
+	if gapStart != 0 {
+		s.gapFillLocked(gapStart, end+1)
+	}
+}
+
+func (s *Session) gapFillLocked(seq, newSeq int) {
+	s.write(NewMessage(MsgTypeSequenceReset).
+		AddInt(TagMsgSeqNum, int64(seq)).
+		AddTime(TagSendingTime, time.Now()).
+		Add(TagPossDupFlag, "Y").
+		Add(TagGapFillFlag, "Y").
+		AddInt(TagNewSeqNo, int64(newSeq)))
+}
+
+// reject refuses a message that broke the session rules.
+func (s *Session) reject(refSeq, reason int, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rejectLocked(refSeq, reason, text)
+}
+
+func (s *Session) rejectLocked(refSeq, reason int, text string) {
+	s.send(NewMessage(MsgTypeReject).
+		AddInt(TagRefSeqNum, int64(refSeq)).
+		AddInt(TagSessionRejectReason, int64(reason)).
+		Add(TagText, text))
+}
+
+// keepalive sends a heartbeat when nothing was sent for a heartbeat
+// interval and a test request when nothing was received. The connection is
+// dropped when the test request stays unanswered.
+func (s *Session) keepalive(c *conn) {
+	ticker := time.NewTicker(c.heartBtInt / 4)
+	defer ticker.Stop()
+
+	grace := c.heartBtInt / 5
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, c.lastSent.Load())) >= c.heartBtInt {
+				s.sendAdmin(NewMessage(MsgTypeHeartbeat))
+			}
+
+			silent := now.Sub(time.Unix(0, c.lastReceived.Load()))
+			switch {
+			case silent >= 2*c.heartBtInt+grace:
+				logrus.WithField("session", s.compID).Warn("fix test request unanswered, disconnecting")
+				c.close()
+				return
+			case silent >= c.heartBtInt+grace && !c.testRequested.Swap(true):
+				s.sendAdmin(NewMessage(MsgTypeTestRequest).AddInt(TagTestReqID, now.UnixNano()))
+			}
+		}
+	}
+}
+
+// conn writes the messages of a session on its own goroutine, so sending
+// never waits for the network.
+type conn struct {
+	net.Conn
+	heartBtInt time.Duration
+
+	out           chan []byte
+	done          chan struct{}
+	closeOnce     sync.Once
+	lastSent      atomic.Int64
+	lastReceived  atomic.Int64
+	testRequested atomic.Bool
+}
+
+func newConn(nc net.Conn) *conn {
+	c := &conn{
+		Conn: nc,
+		out:  make(chan []byte, outQueue),
+		done: make(chan struct{}),
+	}
+	now := time.Now().UnixNano()
+	c.lastSent.Store(now)
+	c.lastReceived.Store(now)
+	return c
+}
+
+func (c *conn) received() {
+	c.lastReceived.Store(time.Now().UnixNano())
+	c.testRequested.Store(false)
+}
+
+// write queues b, a connection that can not keep up is dropped.
+func (c *conn) write(b []byte) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	select {
+	case c.out <- b:
+		c.lastSent.Store(time.Now().UnixNano())
+	default:
+		logrus.WithField("remote", c.RemoteAddr().String()).Warn("fix connection too slow, disconnecting")
+		c.close()
+	}
+}
+
+// closeAfterWrites closes the connection once the queued messages are
+// written.
+func (c *conn) closeAfterWrites() {
+	select {
+	case c.out <- nil:
+	case <-c.done:
+	default:
+		c.close()
+	}
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.Conn.Close()
+	})
+}
+
+func (c *conn) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case b := <-c.out:
+			if b == nil {
+				c.close()
+				return
+			}
+			c.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := c.Conn.Write(b); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
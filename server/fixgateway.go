@@ -0,0 +1,702 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/fix"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+// fixLogonMethod takes the place of the HTTP method in the signature of a
+// logon.
+const fixLogonMethod = "FIX"
+
+// The values of the FIX fields the gateway reads and writes.
+const (
+	fixSideBuy  = "1"
+	fixSideSell = "2"
+
+	fixOrdTypeMarket = "1"
+	fixOrdTypeLimit  = "2"
+
+	fixExecTypeNew      = "0"
+	fixExecTypeCanceled = "4"
+	fixExecTypeReplaced = "5"
+	fixExecTypeRejected = "8"
+	fixExecTypeExpired  = "C"
+	fixExecTypeTrade    = "F"
+
+	fixOrdStatusRejected = "8"
+
+	fixCxlRejResponseToCancel  = 1
+	fixCxlRejResponseToReplace = 2
+)
+
+// ErrDuplicateClOrdID refuses an order with the ClOrdID of an open order of
+// the session.
+var ErrDuplicateClOrdID = errors.New("duplicate ClOrdID")
+
+// SignLogon signs the logon of a FIX session with the secret of an API key,
+// it is sent as the Password next to the key as the Username. The logon
+// signs its SendingTime, which has to be sendingTime formatted with
+// fix.TimeFormat, and the comp IDs of both sides.
+func SignLogon(secret string, sendingTime time.Time, senderCompID, targetCompID string) string {
+	sent := sendingTime.UTC().Truncate(time.Millisecond)
+	return SignRequest(secret, sent.UnixMilli(), sent.Format(fix.TimeFormat), fixLogonMethod, senderCompID+"/"+targetCompID, nil)
+}
+
+// FIXLogonFields are the fields a logon authenticates with.
+func FIXLogonFields(key, secret, senderCompID, targetCompID string, now time.Time) []fix.Field {
+	return []fix.Field{
+		{Tag: fix.TagSendingTime, Value: now.UTC().Format(fix.TimeFormat)},
+		{Tag: fix.TagUsername, Value: key},
+		{Tag: fix.TagPassword, Value: SignLogon(secret, now, senderCompID, targetCompID)},
+	}
+}
+
+// FIXGateway serves the exchange over FIX 4.4. Orders entered over FIX are
+// placed, cancelled and replaced like the ones of the HTTP API, their
+// execution reports follow the order events of the books. Market data is
+// sent as a snapshot and, for subscriptions, as incremental refreshes of the
+// books.
+type FIXGateway struct {
+	ex       *Exchange
+	acceptor *fix.Acceptor
+	compID   string
+
+	mu sync.Mutex
+	// clients are the counterparties by SenderCompID, a comp ID stays bound
+	// to the user that logged on with it first
+	clients map[string]*fixClient
+	// orders are the open orders placed over FIX, by order ID
+	orders map[int64]*fixOrder
+	execID int64
+}
+
+type fixClient struct {
+	session *fix.Session
+	userID  int64
+	// trade and read are the scopes of the API key of the logon
+	trade bool
+	read  bool
+	// orders are the open orders of the client by ClOrdID
+	orders map[string]*fixOrder
+	// subscriptions are the market data subscriptions by MDReqID, they end
+	// with the session
+	subscriptions map[string]*mdSubscription
+}
+
+type fixOrder struct {
+	client  *fixClient
+	id      int64
+	clOrdID string
+	// origClOrdID is the ClOrdID of the order this one replaced
+	origClOrdID string
+	market      token.Market
+	bid         bool
+	ordType     string
+	// qty is the OrderQty, with what the replaced orders filled
+	qty   float64
+	price float64
+	acked bool
+	// cancelClOrdID is the ClOrdID of the cancel in flight
+	cancelClOrdID string
+	// replacement is the order replacing this one while the replace runs
+	replacement *fixOrder
+	// priorFilled and priorAvgPx are what the replaced orders filled
+	priorFilled float64
+	priorAvgPx  float64
+}
+
+// NewFIXGateway creates the gateway of the exchange, compID is its
+// SenderCompID. It has to be created before orders are placed, it follows
+// the order events from then on.
+func NewFIXGateway(ex *Exchange, compID string) *FIXGateway {
+	g := &FIXGateway{
+		ex:      ex,
+		compID:  compID,
+		clients: make(map[string]*fixClient),
+		orders:  make(map[int64]*fixOrder),
+	}
+	g.acceptor = fix.NewAcceptor(compID, g)
+	ex.orderListener = g.onOrderEvent
+
+	return g
+}
+
+// Serve accepts FIX sessions on ln until the gateway is shut down.
+func (g *FIXGateway) Serve(ln net.Listener) error {
+	return g.acceptor.Serve(ln)
+}
+
+// Shutdown logs every session out and waits for the connections to close.
+func (g *FIXGateway) Shutdown(ctx context.Context) error {
+	return g.acceptor.Shutdown(ctx)
+}
+
+// OnLogon authenticates the logon with the API key in its Username and the
+// signature in its Password, see SignLogon.
+func (g *FIXGateway) OnLogon(s *fix.Session, logon *fix.Message) error {
+	key, _ := logon.Get(fix.TagUsername)
+	signature, _ := logon.Get(fix.TagPassword)
+	if key == "" || signature == "" {
+		return fmt.Errorf("%w: logon without Username and Password", ErrInvalidSignature)
+	}
+	sendingTime, _ := logon.Get(fix.TagSendingTime)
+	sent, err := logon.Time(fix.TagSendingTime)
+	if err != nil {
+		return err
+	}
+
+	apiKey, err := g.ex.APIKeys.Verify(SignedRequest{
+		Key:        key,
+		Signature:  signature,
+		Timestamp:  sent.UnixMilli(),
+		Nonce:      sendingTime,
+		Method:     fixLogonMethod,
+		RequestURI: s.CompID() + "/" + g.compID,
+	}, time.Now())
+	if err != nil {
+		return err
+	}
+	if !apiKey.HasScope(ScopeRead) && !apiKey.HasScope(ScopeTrade) {
+		return fmt.Errorf("%w: the API key can neither read nor trade", ErrMissingScope)
+	}
+	if g.ex.userFrozen(apiKey.UserID) {
+		return fmt.Errorf("%w: %d", ErrAccountFrozen, apiKey.UserID)
+	}
+
+	g.mu.Lock()
+	c, ok := g.clients[s.CompID()]
+	if ok && c.userID != apiKey.UserID {
+		g.mu.Unlock()
+		return fmt.Errorf("SenderCompID %s belongs to another user", s.CompID())
+	}
+	if !ok {
+		c = &fixClient{
+			session: s,
+			userID:  apiKey.UserID,
+			orders:  make(map[string]*fixOrder),
+		}
+		g.clients[s.CompID()] = c
+	}
+	c.trade = apiKey.HasScope(ScopeTrade)
+	c.read = apiKey.HasScope(ScopeRead)
+	c.subscriptions = make(map[string]*mdSubscription)
+	g.mu.Unlock()
+
+	g.ex.writeAudit(audit.Entry{
+		Actor:  userActor(apiKey.UserID),
+		Action: audit.Login,
+		UserID: apiKey.UserID,
+	}, map[string]any{"fix": s.CompID(), "key": apiKey.Key})
+
+	return nil
+}
+
+// OnLogout ends the market data subscriptions of the session. A logout is a
+// dropped connection to the dead man's switch of the user.
+func (g *FIXGateway) OnLogout(s *fix.Session) {
+	g.mu.Lock()
+	c, ok := g.clients[s.CompID()]
+	if ok {
+		c.subscriptions = make(map[string]*mdSubscription)
+	}
+	g.mu.Unlock()
+
+	if ok {
+		g.ex.deadman.Disconnect(c.userID)
+	}
+}
+
+func (g *FIXGateway) FromApp(s *fix.Session, m *fix.Message) {
+	g.mu.Lock()
+	c := g.clients[s.CompID()]
+	g.mu.Unlock()
+
+	switch m.Type() {
+	case fix.MsgTypeNewOrderSingle:
+		g.newOrderSingle(c, m)
+	case fix.MsgTypeOrderCancelRequest:
+		g.orderCancelRequest(c, m)
+	case fix.MsgTypeOrderCancelReplaceRequest:
+		g.orderCancelReplaceRequest(c, m)
+	case fix.MsgTypeMarketDataRequest:
+		g.marketDataRequest(c, m)
+	default:
+		businessReject(c, m, 3, "unsupported message type")
+	}
+}
+
+// businessReject refuses an application message the gateway can not handle.
+func businessReject(c *fixClient, m *fix.Message, reason int64, text string) {
+	c.session.Send(fix.NewMessage(fix.MsgTypeBusinessMessageReject).
+		AddInt(fix.TagRefSeqNum, int64(m.SeqNum())).
+		Add(fix.TagRefMsgType, m.Type()).
+		AddInt(fix.TagBusinessRejectReason, reason).
+		Add(fix.TagText, text))
+}
+
+// parseFIXOrder reads the order of a NewOrderSingle or an
+// OrderCancelReplaceRequest.
+func parseFIXOrder(m *fix.Message) (PlaceOrderRequest, error) {
+	var req PlaceOrderRequest
+
+	symbol, err := m.String(fix.TagSymbol)
+	if err != nil {
+		return req, err
+	}
+	req.Market = token.Market(symbol)
+
+	switch side, _ := m.Get(fix.TagSide); side {
+	case fixSideBuy:
+		req.Bid = true
+	case fixSideSell:
+	default:
+		return req, fmt.Errorf("%w: unsupported Side %q", ErrInvalidOrder, side)
+	}
+
+	if req.Size, err = m.Float(fix.TagOrderQty); err != nil {
+		return req, err
+	}
+
+	switch ordType, _ := m.Get(fix.TagOrdType); ordType {
+	case fixOrdTypeMarket:
+		req.Type = MarketOrder
+	case fixOrdTypeLimit:
+		req.Type = LimitOrder
+		if req.Price, err = m.Float(fix.TagPrice); err != nil {
+			return req, err
+		}
+	default:
+		return req, fmt.Errorf("%w: unsupported OrdType %q", ErrInvalidOrder, ordType)
+	}
+
+	if _, ok := m.Get(fix.TagExpireTime); ok {
+		expires, err := m.Time(fix.TagExpireTime)
+		if err != nil {
+			return req, err
+		}
+		req.ExpiresAt = expires.UnixNano()
+	}
+
+	return req, nil
+}
+
+func fixSide(bid bool) string {
+	if bid {
+		return fixSideBuy
+	}
+	return fixSideSell
+}
+
+func fixOrdStatus(status orderbook.OrderStatus) string {
+	switch status {
+	case orderbook.StatusPartiallyFilled:
+		return "1"
+	case orderbook.StatusFilled:
+		return "2"
+	case orderbook.StatusCancelled:
+		return "4"
+	case orderbook.StatusRejected:
+		return fixOrdStatusRejected
+	case orderbook.StatusExpired:
+		return "C"
+	}
+	return "0"
+}
+
+// nextExecID numbers the execution reports, g.mu must be held.
+func (g *FIXGateway) nextExecID() string {
+	g.execID++
+	return strconv.FormatInt(g.execID, 10)
+}
+
+// rejectOrder reports an order that was not accepted, g.mu must not be held.
+func (g *FIXGateway) rejectOrder(c *fixClient, clOrdID string, req PlaceOrderRequest, err error) {
+	reason := int64(99)
+	switch {
+	case errors.Is(err, ErrMarketNotFound):
+		reason = 1
+	case errors.Is(err, ledger.ErrInsufficientBalance):
+		reason = 3
+	case errors.Is(err, ErrDuplicateClOrdID):
+		reason = 6
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c.session.Send(fix.NewMessage(fix.MsgTypeExecutionReport).
+		Add(fix.TagOrderID, "NONE").
+		Add(fix.TagClOrdID, clOrdID).
+		Add(fix.TagExecID, g.nextExecID()).
+		Add(fix.TagExecType, fixExecTypeRejected).
+		Add(fix.TagOrdStatus, fixOrdStatusRejected).
+		Add(fix.TagSymbol, string(req.Market)).
+		Add(fix.TagSide, fixSide(req.Bid)).
+		AddFloat(fix.TagOrderQty, req.Size).
+		AddInt(fix.TagOrdRejReason, reason).
+		AddFloat(fix.TagLeavesQty, 0).
+		AddFloat(fix.TagCumQty, 0).
+		AddFloat(fix.TagAvgPx, 0).
+		AddTime(fix.TagTransactTime, time.Now()).
+		Add(fix.TagText, err.Error()))
+}
+
+func (g *FIXGateway) newOrderSingle(c *fixClient, m *fix.Message) {
+	clOrdID, err := m.String(fix.TagClOrdID)
+	if err != nil {
+		businessReject(c, m, 5, err.Error())
+		return
+	}
+	req, err := parseFIXOrder(m)
+	if err != nil {
+		g.rejectOrder(c, clOrdID, req, err)
+		return
+	}
+	if !c.trade {
+		g.rejectOrder(c, clOrdID, req, fmt.Errorf("%w: %s", ErrMissingScope, ScopeTrade))
+		return
+	}
+	req.UserID = c.userID
+	if err := g.ex.validateOrderRequest(&req); err != nil {
+		g.rejectOrder(c, clOrdID, req, err)
+		return
+	}
+
+	order := orderbook.NewOrder(req.Bid, req.Size, c.userID)
+	order.ExpiresAt = req.ExpiresAt
+	o := &fixOrder{
+		client:  c,
+		id:      order.ID,
+		clOrdID: clOrdID,
+		market:  req.Market,
+		bid:     req.Bid,
+		ordType: fixOrdTypeMarket,
+		qty:     req.Size,
+		price:   req.Price,
+	}
+	if req.Type == LimitOrder {
+		o.ordType = fixOrdTypeLimit
+	}
+
+	// the order is known before the book reports on it
+	g.mu.Lock()
+	if _, ok := c.orders[clOrdID]; ok {
+		g.mu.Unlock()
+		g.rejectOrder(c, clOrdID, req, fmt.Errorf("%w: %s", ErrDuplicateClOrdID, clOrdID))
+		return
+	}
+	c.orders[clOrdID] = o
+	g.orders[order.ID] = o
+	g.mu.Unlock()
+
+	if req.Type == LimitOrder {
+		err = g.ex.handlePlaceLimitOrder(req.Market, req.Price, order)
+	} else {
+		_, _, err = g.ex.handlePlaceMarketOrder(req.Market, order)
+	}
+	if err != nil {
+		g.forget(o)
+		g.rejectOrder(c, clOrdID, req, err)
+		return
+	}
+
+	g.ex.writeAudit(audit.Entry{
+		Actor:  userActor(c.userID),
+		Action: audit.OrderPlaced,
+		UserID: c.userID,
+	}, map[string]any{
+		"order":   order.ID,
+		"market":  req.Market,
+		"type":    req.Type,
+		"bid":     req.Bid,
+		"size":    req.Size,
+		"price":   req.Price,
+		"fix":     c.session.CompID(),
+		"clOrdID": clOrdID,
+	})
+}
+
+// forget drops an order that did not make it into the book.
+func (g *FIXGateway) forget(o *fixOrder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.orders[o.id] == o {
+		delete(g.orders, o.id)
+	}
+	if o.client.orders[o.clOrdID] == o {
+		delete(o.client.orders, o.clOrdID)
+	}
+}
+
+// cancelReject refuses a cancel or a replace of the order.
+func (g *FIXGateway) cancelReject(c *fixClient, m *fix.Message, o *fixOrder, responseTo, reason int64, text string) {
+	clOrdID, _ := m.Get(fix.TagClOrdID)
+	origClOrdID, _ := m.Get(fix.TagOrigClOrdID)
+
+	orderID, status := "NONE", fixOrdStatusRejected
+	if o != nil {
+		orderID = strconv.FormatInt(o.id, 10)
+		status = "0"
+		if order, err := g.ex.orderStore.GetOrder(o.id); err == nil {
+			status = fixOrdStatus(order.Status)
+		}
+	}
+
+	c.session.Send(fix.NewMessage(fix.MsgTypeOrderCancelReject).
+		Add(fix.TagOrderID, orderID).
+		Add(fix.TagClOrdID, clOrdID).
+		Add(fix.TagOrigClOrdID, origClOrdID).
+		Add(fix.TagOrdStatus, status).
+		AddInt(fix.TagCxlRejResponseTo, responseTo).
+		AddInt(fix.TagCxlRejReason, reason).
+		Add(fix.TagText, text))
+}
+
+// pendingOrder returns the open order the cancel or replace m refers to and
+// its ClOrdID, or rejects m. g.mu must be held.
+func (g *FIXGateway) pendingOrder(c *fixClient, m *fix.Message, responseTo int64) (*fixOrder, string, bool) {
+	clOrdID, err := m.String(fix.TagClOrdID)
+	if err != nil {
+		businessReject(c, m, 5, err.Error())
+		return nil, "", false
+	}
+	origClOrdID, _ := m.Get(fix.TagOrigClOrdID)
+	o, ok := c.orders[origClOrdID]
+	switch {
+	case !ok:
+		g.cancelReject(c, m, nil, responseTo, 1, fmt.Sprintf("unknown order %q", origClOrdID))
+		return nil, "", false
+	case !c.trade:
+		g.cancelReject(c, m, o, responseTo, 2, fmt.Sprintf("%s: %s", ErrMissingScope, ScopeTrade))
+		return nil, "", false
+	case o.cancelClOrdID != "" || o.replacement != nil:
+		g.cancelReject(c, m, o, responseTo, 3, "a cancel or replace of the order is pending")
+		return nil, "", false
+	}
+	return o, clOrdID, true
+}
+
+func (g *FIXGateway) orderCancelRequest(c *fixClient, m *fix.Message) {
+	g.mu.Lock()
+	o, clOrdID, ok := g.pendingOrder(c, m, fixCxlRejResponseToCancel)
+	if !ok {
+		g.mu.Unlock()
+		return
+	}
+	o.cancelClOrdID = clOrdID
+	g.mu.Unlock()
+
+	if _, err := g.ex.cancelUserOrder(c.userID, o.id); err != nil {
+		g.mu.Lock()
+		o.cancelClOrdID = ""
+		g.cancelReject(c, m, o, fixCxlRejResponseToCancel, 0, err.Error())
+		g.mu.Unlock()
+		return
+	}
+
+	g.ex.writeAudit(audit.Entry{
+		Actor:  userActor(c.userID),
+		Action: audit.OrderCancelled,
+		UserID: c.userID,
+	}, map[string]any{
+		"order":  o.id,
+		"market": o.market,
+		"fix":    c.session.CompID(),
+	})
+}
+
+// orderCancelReplaceRequest replaces a resting limit order with a new one of
+// the same market and side. The replacement is a new order of the exchange,
+// it is reported with the OrderID of its own.
+func (g *FIXGateway) orderCancelReplaceRequest(c *fixClient, m *fix.Message) {
+	req, err := parseFIXOrder(m)
+
+	g.mu.Lock()
+	o, clOrdID, ok := g.pendingOrder(c, m, fixCxlRejResponseToReplace)
+	if !ok {
+		g.mu.Unlock()
+		return
+	}
+	reject := func(reason int64, text string) {
+		g.cancelReject(c, m, o, fixCxlRejResponseToReplace, reason, text)
+		g.mu.Unlock()
+	}
+	switch {
+	case err != nil:
+		reject(99, err.Error())
+		return
+	case req.Type != LimitOrder || o.ordType != fixOrdTypeLimit:
+		reject(99, "only limit orders can be replaced")
+		return
+	case req.Market != o.market || req.Bid != o.bid:
+		reject(99, "a replace can not change the symbol or the side")
+		return
+	case req.Size <= 0 || req.Price <= 0:
+		reject(99, "OrderQty and Price must be positive")
+		return
+	}
+	if _, dup := c.orders[clOrdID]; dup {
+		reject(99, fmt.Sprintf("%s: %s", ErrDuplicateClOrdID, clOrdID))
+		return
+	}
+
+	order := orderbook.NewOrder(req.Bid, req.Size, c.userID)
+	order.ExpiresAt = req.ExpiresAt
+	r := &fixOrder{
+		client:      c,
+		id:          order.ID,
+		clOrdID:     clOrdID,
+		origClOrdID: o.clOrdID,
+		market:      o.market,
+		bid:         o.bid,
+		ordType:     fixOrdTypeLimit,
+		qty:         req.Size,
+		price:       req.Price,
+	}
+	o.replacement = r
+	c.orders[clOrdID] = r
+	g.orders[order.ID] = r
+	g.mu.Unlock()
+
+	if err := g.ex.replaceOrder(c.userID, o.market, o.id, req.Price, order); err != nil {
+		g.forget(r)
+		g.mu.Lock()
+		o.replacement = nil
+		reason := int64(99)
+		if errors.Is(err, ErrOrderNotFound) {
+			reason = 0
+		}
+		g.cancelReject(c, m, o, fixCxlRejResponseToReplace, reason, err.Error())
+		g.mu.Unlock()
+		return
+	}
+
+	g.ex.writeAudit(audit.Entry{
+		Actor:  userActor(c.userID),
+		Action: audit.OrderPlaced,
+		UserID: c.userID,
+	}, map[string]any{
+		"order":    order.ID,
+		"replaces": o.id,
+		"market":   o.market,
+		"type":     LimitOrder,
+		"bid":      o.bid,
+		"size":     order.Size,
+		"price":    req.Price,
+		"fix":      c.session.CompID(),
+		"clOrdID":  clOrdID,
+	})
+}
+
+// onOrderEvent reports the events of the orders placed over FIX, it runs on
+// the engine goroutine of the market.
+func (g *FIXGateway) onOrderEvent(market token.Market, e orderbook.Event) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	o, ok := g.orders[e.OrderID]
+	if !ok {
+		return
+	}
+	if e.Done() {
+		delete(g.orders, o.id)
+		if o.client.orders[o.clOrdID] == o {
+			delete(o.client.orders, o.clOrdID)
+		}
+	}
+
+	switch e.Type {
+	case orderbook.EventPlaced:
+		o.acked = true
+		execType := fixExecTypeNew
+		if o.origClOrdID != "" {
+			execType = fixExecTypeReplaced
+		}
+		o.client.session.Send(g.report(o, execType, e))
+
+	case orderbook.EventFilled:
+		// market orders never rest, their first fill acks them
+		if !o.acked {
+			o.acked = true
+			ack := e
+			ack.Status = orderbook.StatusNew
+			ack.Size += e.SizeFilled
+			ack.FilledSize, ack.AvgFillPrice = 0, 0
+			o.client.session.Send(g.report(o, fixExecTypeNew, ack))
+		}
+		o.client.session.Send(g.report(o, fixExecTypeTrade, e).
+			AddFloat(fix.TagLastQty, e.SizeFilled).
+			AddFloat(fix.TagLastPx, e.Price))
+
+	case orderbook.EventCancelled:
+		// the replacement reports the end of the order it replaced
+		if r := o.replacement; r != nil {
+			r.priorFilled, r.priorAvgPx = o.filled(e)
+			return
+		}
+		m := g.report(o, fixExecTypeCanceled, e)
+		if o.cancelClOrdID != "" {
+			m.Set(fix.TagClOrdID, o.cancelClOrdID)
+			m.Set(fix.TagOrigClOrdID, o.clOrdID)
+		}
+		o.client.session.Send(m)
+
+	case orderbook.EventExpired:
+		o.client.session.Send(g.report(o, fixExecTypeExpired, e))
+	}
+}
+
+// filled returns what the order and the orders it replaced filled, at which
+// average price.
+func (o *fixOrder) filled(e orderbook.Event) (float64, float64) {
+	cum := o.priorFilled + e.FilledSize
+	if cum == 0 {
+		return 0, 0
+	}
+	return cum, (o.priorFilled*o.priorAvgPx + e.FilledSize*e.AvgFillPrice) / cum
+}
+
+// report returns the execution report of the event, g.mu must be held.
+func (g *FIXGateway) report(o *fixOrder, execType string, e orderbook.Event) *fix.Message {
+	cum, avgPx := o.filled(e)
+	leaves := e.Size
+	if e.Done() {
+		leaves = 0
+	}
+
+	m := fix.NewMessage(fix.MsgTypeExecutionReport).
+		AddInt(fix.TagOrderID, o.id).
+		Add(fix.TagClOrdID, o.clOrdID)
+	if o.origClOrdID != "" {
+		m.Add(fix.TagOrigClOrdID, o.origClOrdID)
+	}
+	m.Add(fix.TagExecID, g.nextExecID()).
+		Add(fix.TagExecType, execType).
+		Add(fix.TagOrdStatus, fixOrdStatus(e.Status)).
+		Add(fix.TagSymbol, string(o.market)).
+		Add(fix.TagSide, fixSide(o.bid)).
+		AddFloat(fix.TagOrderQty, o.qty).
+		Add(fix.TagOrdType, o.ordType)
+	if o.ordType == fixOrdTypeLimit {
+		m.AddFloat(fix.TagPrice, o.price)
+	}
+	m.AddFloat(fix.TagLeavesQty, leaves).
+		AddFloat(fix.TagCumQty, cum).
+		AddFloat(fix.TagAvgPx, avgPx).
+		AddTime(fix.TagTransactTime, time.Unix(0, e.Timestamp))
+
+	return m
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/fix"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+const testFIXCompID = "EXCHANGE"
+
+func newTestFIXGateway(t *testing.T, userIDs ...int64) (*Exchange, *FIXGateway, string) {
+	ex, _ := newTestExchange(t, userIDs...)
+	g := NewFIXGateway(ex, testFIXCompID)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		g.Shutdown(ctx)
+	})
+
+	return ex, g, ln.Addr().String()
+}
+
+// logonTestFIX logs the user on with its test API key.
+func logonTestFIX(t *testing.T, addr string, userID int64) *fix.Initiator {
+	sender := fmt.Sprintf("CLIENT-%d", userID)
+	i, err := fix.Dial(addr, sender, testFIXCompID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { i.Close() })
+
+	key := testAPIKey(userID)
+	if _, err := i.Logon(30, true, FIXLogonFields(key.Key, key.Secret, sender, testFIXCompID, time.Now())...); err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func expectFIX(t *testing.T, i *fix.Initiator, msgType string) *fix.Message {
+	t.Helper()
+	m, err := i.Expect(msgType, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func fixField(m *fix.Message, tag int) string {
+	v, _ := m.Get(tag)
+	return v
+}
+
+func newOrderSingle(clOrdID string, bid bool, ordType string, qty, price float64) *fix.Message {
+	m := fix.NewMessage(fix.MsgTypeNewOrderSingle).
+		Add(fix.TagClOrdID, clOrdID).
+		Add(fix.TagSymbol, string(token.MarketETHUSDT)).
+		Add(fix.TagSide, fixSide(bid)).
+		AddTime(fix.TagTransactTime, time.Now()).
+		AddFloat(fix.TagOrderQty, qty).
+		Add(fix.TagOrdType, ordType)
+	if ordType == fixOrdTypeLimit {
+		m.AddFloat(fix.TagPrice, price)
+	}
+	return m
+}
+
+func TestFIXLogon(t *testing.T) {
+	_, _, addr := newTestFIXGateway(t, 1, 2)
+
+	i, err := fix.Dial(addr, "CLIENT-1", testFIXCompID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	reply, err := i.Logon(30, true, FIXLogonFields("key-1", "wrong", "CLIENT-1", testFIXCompID, time.Now())...)
+	assert(t, err != nil, true)
+	assert(t, fixField(reply, fix.TagText), ErrInvalidSignature.Error())
+
+	logonTestFIX(t, addr, 1).Logout()
+
+	// the comp ID stays bound to the first user
+	other, err := fix.Dial(addr, "CLIENT-1", testFIXCompID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	key := testAPIKey(2)
+	reply, err = other.Logon(30, true, FIXLogonFields(key.Key, key.Secret, "CLIENT-1", testFIXCompID, time.Now())...)
+	assert(t, err != nil, true)
+	assert(t, strings.Contains(fixField(reply, fix.TagText), "belongs to another user"), true)
+}
+
+func TestFIXOrderEntry(t *testing.T) {
+	ex, _, addr := newTestFIXGateway(t, 1, 2)
+	i := logonTestFIX(t, addr, 1)
+
+	i.Send(newOrderSingle("o1", true, fixOrdTypeLimit, 2, 1_000))
+	ack := expectFIX(t, i, fix.MsgTypeExecutionReport)
+	assert(t, fixField(ack, fix.TagClOrdID), "o1")
+	assert(t, fixField(ack, fix.TagExecType), fixExecTypeNew)
+	assert(t, fixField(ack, fix.TagOrdStatus), "0")
+	assert(t, fixField(ack, fix.TagLeavesQty), "2")
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetUSDT)), 2_000.0)
+
+	// a fill from an order of the HTTP API
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Size: 0.5, Market: token.MarketETHUSDT})
+	fill := expectFIX(t, i, fix.MsgTypeExecutionReport)
+	assert(t, fixField(fill, fix.TagExecType), fixExecTypeTrade)
+	assert(t, fixField(fill, fix.TagOrdStatus), "1")
+	assert(t, fixField(fill, fix.TagLastQty), "0.5")
+	assert(t, fixField(fill, fix.TagLastPx), "1000")
+	assert(t, fixField(fill, fix.TagCumQty), "0.5")
+	assert(t, fixField(fill, fix.TagLeavesQty), "1.5")
+
+	// the replacement keeps what the order filled
+	i.Send(newOrderSingle("o2", true, fixOrdTypeLimit, 3, 990).
+		Set(fix.TagMsgType, fix.MsgTypeOrderCancelReplaceRequest).
+		Add(fix.TagOrigClOrdID, "o1"))
+	replaced := expectFIX(t, i, fix.MsgTypeExecutionReport)
+	assert(t, fixField(replaced, fix.TagExecType), fixExecTypeReplaced)
+	assert(t, fixField(replaced, fix.TagClOrdID), "o2")
+	assert(t, fixField(replaced, fix.TagOrigClOrdID), "o1")
+	assert(t, fixField(replaced, fix.TagCumQty), "0.5")
+	assert(t, fixField(replaced, fix.TagLeavesQty), "2.5")
+	assert(t, fixField(replaced, fix.TagAvgPx), "1000")
+	book := bookSnapshot(ex, token.MarketETHUSDT)
+	assert(t, len(book.Bids), 1)
+	assert(t, book.Bids[0].Price, 990.0)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetUSDT)), 2_475.0)
+
+	i.Send(fix.NewMessage(fix.MsgTypeOrderCancelRequest).
+		Add(fix.TagClOrdID, "c1").
+		Add(fix.TagOrigClOrdID, "o2").
+		Add(fix.TagSymbol, string(token.MarketETHUSDT)).
+		Add(fix.TagSide, fixSideBuy))
+	cancelled := expectFIX(t, i, fix.MsgTypeExecutionReport)
+	assert(t, fixField(cancelled, fix.TagExecType), fixExecTypeCanceled)
+	assert(t, fixField(cancelled, fix.TagClOrdID), "c1")
+	assert(t, fixField(cancelled, fix.TagOrigClOrdID), "o2")
+	assert(t, fixField(cancelled, fix.TagOrdStatus), "4")
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetUSDT)), 0.0)
+
+	// the order is gone, the next cancel is refused
+	i.Send(fix.NewMessage(fix.MsgTypeOrderCancelRequest).
+		Add(fix.TagClOrdID, "c2").
+		Add(fix.TagOrigClOrdID, "o2"))
+	reject := expectFIX(t, i, fix.MsgTypeOrderCancelReject)
+	assert(t, fixField(reject, fix.TagCxlRejReason), "1")
+	assert(t, fixField(reject, fix.TagCxlRejResponseTo), "1")
+
+	// a market order is acked by its first fill
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Size: 1, Price: 1_010, Market: token.MarketETHUSDT})
+	i.Send(newOrderSingle("m1", true, fixOrdTypeMarket, 1, 0))
+	ack = expectFIX(t, i, fix.MsgTypeExecutionReport)
+	assert(t, fixField(ack, fix.TagExecType), fixExecTypeNew)
+	assert(t, fixField(ack, fix.TagLeavesQty), "1")
+	fill = expectFIX(t, i, fix.MsgTypeExecutionReport)
+	assert(t, fixField(fill, fix.TagExecType), fixExecTypeTrade)
+	assert(t, fixField(fill, fix.TagOrdStatus), "2")
+	assert(t, fixField(fill, fix.TagLastPx), "1010")
+	assert(t, fixField(fill, fix.TagLeavesQty), "0")
+
+	// orders the exchange refuses are rejected with the reason
+	i.Send(newOrderSingle("r1", false, fixOrdTypeLimit, 1, 1_000).Set(fix.TagSymbol, "DOGE-USDT"))
+	rejected := expectFIX(t, i, fix.MsgTypeExecutionReport)
+	assert(t, fixField(rejected, fix.TagExecType), fixExecTypeRejected)
+	assert(t, fixField(rejected, fix.TagOrdRejReason), "1")
+	i.Send(newOrderSingle("r2", false, fixOrdTypeLimit, 5_000_000, 1_000))
+	rejected = expectFIX(t, i, fix.MsgTypeExecutionReport)
+	assert(t, fixField(rejected, fix.TagClOrdID), "r2")
+	assert(t, fixField(rejected, fix.TagOrdRejReason), "3")
+
+	i.Send(fix.NewMessage("AE"))
+	businessReject := expectFIX(t, i, fix.MsgTypeBusinessMessageReject)
+	assert(t, fixField(businessReject, fix.TagRefMsgType), "AE")
+}
+
+func marketDataRequest(id, subscriptionType string, symbol string) *fix.Message {
+	return fix.NewMessage(fix.MsgTypeMarketDataRequest).
+		Add(fix.TagMDReqID, id).
+		Add(fix.TagSubscriptionRequestType, subscriptionType).
+		AddInt(fix.TagMarketDepth, 0).
+		Add(fix.TagMDUpdateType, fixMDUpdateTypeIncremental).
+		AddInt(fix.TagNoMDEntryTypes, 3).
+		Add(fix.TagMDEntryType, fixMDEntryBid).
+		Add(fix.TagMDEntryType, fixMDEntryOffer).
+		Add(fix.TagMDEntryType, fixMDEntryTrade).
+		AddInt(fix.TagNoRelatedSym, 1).
+		Add(fix.TagSymbol, symbol)
+}
+
+func mdEntries(m *fix.Message) []*fix.Message {
+	if m.Type() == fix.MsgTypeMarketDataSnapshot {
+		return m.Groups(fix.TagNoMDEntries, fix.TagMDEntryType, fix.TagMDEntryPx, fix.TagMDEntrySize)
+	}
+	return m.Groups(fix.TagNoMDEntries, fix.TagMDUpdateAction, fix.TagMDEntryType, fix.TagSymbol, fix.TagMDEntryPx, fix.TagMDEntrySize)
+}
+
+func TestFIXMarketData(t *testing.T) {
+	ex, g, addr := newTestFIXGateway(t, 1, 2)
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Bid: true, Size: 2, Price: 990, Market: token.MarketETHUSDT})
+	i := logonTestFIX(t, addr, 1)
+
+	i.Send(marketDataRequest("md-1", fixSubscriptionSubscribe, string(token.MarketETHUSDT)))
+	snapshot := expectFIX(t, i, fix.MsgTypeMarketDataSnapshot)
+	assert(t, fixField(snapshot, fix.TagSymbol), string(token.MarketETHUSDT))
+	entries := mdEntries(snapshot)
+	assert(t, len(entries), 1)
+	assert(t, fixField(entries[0], fix.TagMDEntryType), fixMDEntryBid)
+	assert(t, fixField(entries[0], fix.TagMDEntryPx), "990")
+	assert(t, fixField(entries[0], fix.TagMDEntrySize), "2")
+
+	// a new ask level and a trade taking part of the bid
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Size: 1, Price: 1_010, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Size: 0.5, Market: token.MarketETHUSDT})
+	g.publishMarketData()
+
+	update := expectFIX(t, i, fix.MsgTypeMarketDataIncremental)
+	assert(t, fixField(update, fix.TagMDReqID), "md-1")
+	entries = mdEntries(update)
+	assert(t, len(entries), 3)
+	for n, want := range [][]string{
+		{fixMDActionChange, fixMDEntryBid, "990", "1.5"},
+		{fixMDActionNew, fixMDEntryOffer, "1010", "1"},
+		{fixMDActionNew, fixMDEntryTrade, "990", "0.5"},
+	} {
+		assert(t, []string{
+			fixField(entries[n], fix.TagMDUpdateAction),
+			fixField(entries[n], fix.TagMDEntryType),
+			fixField(entries[n], fix.TagMDEntryPx),
+			fixField(entries[n], fix.TagMDEntrySize),
+		}, want)
+	}
+
+	// emptied levels are deleted
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 1, Market: token.MarketETHUSDT})
+	g.publishMarketData()
+	update = expectFIX(t, i, fix.MsgTypeMarketDataIncremental)
+	entries = mdEntries(update)
+	assert(t, len(entries), 2)
+	assert(t, fixField(entries[0], fix.TagMDUpdateAction), fixMDActionDelete)
+	assert(t, fixField(entries[0], fix.TagMDEntryPx), "1010")
+	assert(t, fixField(entries[1], fix.TagMDEntryType), fixMDEntryTrade)
+
+	i.Send(marketDataRequest("md-1", fixSubscriptionSubscribe, string(token.MarketETHUSDT)))
+	reject := expectFIX(t, i, fix.MsgTypeMarketDataRequestReject)
+	assert(t, fixField(reject, fix.TagMDReqRejReason), "1")
+	i.Send(marketDataRequest("md-2", fixSubscriptionSnapshot, "DOGE-USDT"))
+	reject = expectFIX(t, i, fix.MsgTypeMarketDataRequestReject)
+	assert(t, fixField(reject, fix.TagMDReqRejReason), "0")
+
+	// nothing is sent once unsubscribed
+	i.Send(marketDataRequest("md-1", fixSubscriptionUnsubscribe, string(token.MarketETHUSDT)))
+	i.Send(fix.NewMessage(fix.MsgTypeTestRequest).Add(fix.TagTestReqID, "sync"))
+	expectFIX(t, i, fix.MsgTypeHeartbeat)
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Size: 1, Price: 1_020, Market: token.MarketETHUSDT})
+	g.publishMarketData()
+	_, err := i.Expect(fix.MsgTypeMarketDataIncremental, 200*time.Millisecond)
+	assert(t, err != nil, true)
+}
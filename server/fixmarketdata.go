@@ -0,0 +1,341 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/fix"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+const (
+	fixMDEntryBid   = "0"
+	fixMDEntryOffer = "1"
+	fixMDEntryTrade = "2"
+
+	fixMDActionNew    = "0"
+	fixMDActionChange = "1"
+	fixMDActionDelete = "2"
+
+	fixSubscriptionSnapshot    = "0"
+	fixSubscriptionSubscribe   = "1"
+	fixSubscriptionUnsubscribe = "2"
+
+	fixMDUpdateTypeFullRefresh = "0"
+	fixMDUpdateTypeIncremental = "1"
+)
+
+// The reasons of a MarketDataRequestReject.
+const (
+	mdRejectUnknownSymbol      = 0
+	mdRejectDuplicateMDReqID   = 1
+	mdRejectPermissions        = 3
+	mdRejectSubscriptionType   = 4
+	mdRejectMarketDepth        = 5
+	mdRejectMDUpdateType       = 6
+	mdRejectUnsupportedMDEntry = 8
+)
+
+// mdSubscription is a MarketDataRequest subscribed to the books of its
+// symbols.
+type mdSubscription struct {
+	id      string
+	markets []token.Market
+	// depth is how many levels of each side are sent, 0 for all of them
+	depth  int
+	bids   bool
+	offers bool
+	trades bool
+	// incremental subscriptions get the changes of the books, the others a
+	// snapshot every time a book changed
+	incremental bool
+	// books are what the subscriber was last sent of every book
+	books map[token.Market]*mdBook
+}
+
+// mdBook is a book as far as a subscriber knows it.
+type mdBook struct {
+	sequence uint64
+	bids     map[float64]float64
+	asks     map[float64]float64
+	trades   int
+}
+
+func (sub *mdSubscription) levels(limits []orderbook.LimitSnapshot) []orderbook.LimitSnapshot {
+	if sub.depth > 0 && len(limits) > sub.depth {
+		return limits[:sub.depth]
+	}
+	return limits
+}
+
+func (sub *mdSubscription) book(snapshot *orderbook.Snapshot) *mdBook {
+	book := &mdBook{
+		sequence: snapshot.Sequence,
+		bids:     make(map[float64]float64),
+		asks:     make(map[float64]float64),
+		trades:   len(snapshot.Trades),
+	}
+	for _, l := range sub.levels(snapshot.Bids) {
+		book.bids[l.Price] = l.TotalVolume
+	}
+	for _, l := range sub.levels(snapshot.Asks) {
+		book.asks[l.Price] = l.TotalVolume
+	}
+	return book
+}
+
+// marketDataRequest answers a snapshot request, or subscribes to or
+// unsubscribes from the books.
+func (g *FIXGateway) marketDataRequest(c *fixClient, m *fix.Message) {
+	id, err := m.String(fix.TagMDReqID)
+	if err != nil {
+		businessReject(c, m, 5, err.Error())
+		return
+	}
+	reject := func(reason int64, text string) {
+		c.session.Send(fix.NewMessage(fix.MsgTypeMarketDataRequestReject).
+			Add(fix.TagMDReqID, id).
+			AddInt(fix.TagMDReqRejReason, reason).
+			Add(fix.TagText, text))
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	subscriptionType, _ := m.Get(fix.TagSubscriptionRequestType)
+	switch subscriptionType {
+	case fixSubscriptionSnapshot, fixSubscriptionSubscribe:
+	case fixSubscriptionUnsubscribe:
+		if _, ok := c.subscriptions[id]; !ok {
+			businessReject(c, m, 1, "unknown MDReqID "+id)
+			return
+		}
+		delete(c.subscriptions, id)
+		return
+	default:
+		reject(mdRejectSubscriptionType, "unsupported SubscriptionRequestType "+subscriptionType)
+		return
+	}
+
+	if !c.read {
+		reject(mdRejectPermissions, ErrMissingScope.Error()+": "+string(ScopeRead))
+		return
+	}
+	if _, ok := c.subscriptions[id]; ok {
+		reject(mdRejectDuplicateMDReqID, "duplicate MDReqID "+id)
+		return
+	}
+
+	sub := &mdSubscription{
+		id:          id,
+		incremental: true,
+		books:       make(map[token.Market]*mdBook),
+	}
+	if _, ok := m.Get(fix.TagMarketDepth); ok {
+		depth, err := m.Int(fix.TagMarketDepth)
+		if err != nil || depth < 0 {
+			reject(mdRejectMarketDepth, "invalid MarketDepth")
+			return
+		}
+		sub.depth = int(depth)
+	}
+	switch updateType, _ := m.Get(fix.TagMDUpdateType); updateType {
+	case "", fixMDUpdateTypeIncremental:
+	case fixMDUpdateTypeFullRefresh:
+		sub.incremental = false
+	default:
+		reject(mdRejectMDUpdateType, "unsupported MDUpdateType "+updateType)
+		return
+	}
+
+	entryTypes := m.Groups(fix.TagNoMDEntryTypes, fix.TagMDEntryType)
+	if len(entryTypes) == 0 {
+		reject(mdRejectUnsupportedMDEntry, "no MDEntryType requested")
+		return
+	}
+	for _, group := range entryTypes {
+		switch entryType, _ := group.Get(fix.TagMDEntryType); entryType {
+		case fixMDEntryBid:
+			sub.bids = true
+		case fixMDEntryOffer:
+			sub.offers = true
+		case fixMDEntryTrade:
+			sub.trades = true
+		default:
+			reject(mdRejectUnsupportedMDEntry, "unsupported MDEntryType "+entryType)
+			return
+		}
+	}
+
+	symbols := m.Groups(fix.TagNoRelatedSym, fix.TagSymbol)
+	if len(symbols) == 0 {
+		reject(mdRejectUnknownSymbol, "no Symbol requested")
+		return
+	}
+	snapshots := make([]*orderbook.Snapshot, len(symbols))
+	for i, group := range symbols {
+		symbol, _ := group.Get(fix.TagSymbol)
+		engine, ok := g.ex.markets.Engine(token.Market(symbol))
+		if !ok {
+			reject(mdRejectUnknownSymbol, ErrMarketNotFound.Error()+": "+symbol)
+			return
+		}
+		sub.markets = append(sub.markets, token.Market(symbol))
+		snapshots[i] = engine.Snapshot()
+	}
+
+	for i, market := range sub.markets {
+		c.session.Send(sub.snapshot(market, snapshots[i]))
+		sub.books[market] = sub.book(snapshots[i])
+	}
+	if subscriptionType == fixSubscriptionSubscribe {
+		c.subscriptions[id] = sub
+	}
+}
+
+// snapshot is the MarketDataSnapshotFullRefresh of the book, with the last
+// trade when the subscription asked for trades.
+func (sub *mdSubscription) snapshot(market token.Market, snapshot *orderbook.Snapshot) *fix.Message {
+	entries, n := &fix.Message{}, 0
+	add := func(entryType string, price, size float64) {
+		entries.Add(fix.TagMDEntryType, entryType).
+			AddFloat(fix.TagMDEntryPx, price).
+			AddFloat(fix.TagMDEntrySize, size)
+		n++
+	}
+	if sub.bids {
+		for _, l := range sub.levels(snapshot.Bids) {
+			add(fixMDEntryBid, l.Price, l.TotalVolume)
+		}
+	}
+	if sub.offers {
+		for _, l := range sub.levels(snapshot.Asks) {
+			add(fixMDEntryOffer, l.Price, l.TotalVolume)
+		}
+	}
+	if sub.trades && len(snapshot.Trades) > 0 {
+		trade := snapshot.Trades[len(snapshot.Trades)-1]
+		add(fixMDEntryTrade, trade.Price, trade.Size)
+	}
+
+	m := fix.NewMessage(fix.MsgTypeMarketDataSnapshot).
+		Add(fix.TagMDReqID, sub.id).
+		Add(fix.TagSymbol, string(market)).
+		AddInt(fix.TagNoMDEntries, int64(n))
+	m.Fields = append(m.Fields, entries.Fields...)
+	return m
+}
+
+// incrementalRefresh is the MarketDataIncrementalRefresh from what the
+// subscriber knows of the book to the snapshot, nil when nothing it asked
+// for changed.
+func (sub *mdSubscription) incrementalRefresh(market token.Market, known, book *mdBook, snapshot *orderbook.Snapshot) *fix.Message {
+	entries, n := &fix.Message{}, 0
+	add := func(action, entryType string, price, size float64) {
+		entries.Add(fix.TagMDUpdateAction, action).
+			Add(fix.TagMDEntryType, entryType).
+			Add(fix.TagSymbol, string(market)).
+			AddFloat(fix.TagMDEntryPx, price)
+		if action != fixMDActionDelete {
+			entries.AddFloat(fix.TagMDEntrySize, size)
+		}
+		n++
+	}
+	diff := func(entryType string, known, levels map[float64]float64) {
+		for _, price := range sortedPrices(known) {
+			if _, ok := levels[price]; !ok {
+				add(fixMDActionDelete, entryType, price, 0)
+			}
+		}
+		for _, price := range sortedPrices(levels) {
+			size, ok := known[price]
+			switch {
+			case !ok:
+				add(fixMDActionNew, entryType, price, levels[price])
+			case size != levels[price]:
+				add(fixMDActionChange, entryType, price, levels[price])
+			}
+		}
+	}
+
+	if sub.bids {
+		diff(fixMDEntryBid, known.bids, book.bids)
+	}
+	if sub.offers {
+		diff(fixMDEntryOffer, known.asks, book.asks)
+	}
+	if sub.trades {
+		for _, trade := range snapshot.Trades[min(known.trades, len(snapshot.Trades)):] {
+			add(fixMDActionNew, fixMDEntryTrade, trade.Price, trade.Size)
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+
+	m := fix.NewMessage(fix.MsgTypeMarketDataIncremental).
+		Add(fix.TagMDReqID, sub.id).
+		AddInt(fix.TagNoMDEntries, int64(n))
+	m.Fields = append(m.Fields, entries.Fields...)
+	return m
+}
+
+func sortedPrices(levels map[float64]float64) []float64 {
+	prices := make([]float64, 0, len(levels))
+	for price := range levels {
+		prices = append(prices, price)
+	}
+	sort.Float64s(prices)
+	return prices
+}
+
+// runMarketData sends the subscribers the changes of the books every
+// interval until ctx is done.
+func (g *FIXGateway) runMarketData(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, g.publishMarketData)
+}
+
+// publishMarketData sends every subscription the books that changed since it
+// was sent them last.
+func (g *FIXGateway) publishMarketData() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	snapshots := make(map[token.Market]*orderbook.Snapshot)
+	for _, c := range g.clients {
+		for _, sub := range c.subscriptions {
+			for _, market := range sub.markets {
+				snapshot, ok := snapshots[market]
+				if !ok {
+					// a delisted market has no more updates
+					engine, listed := g.ex.markets.Engine(market)
+					if !listed {
+						continue
+					}
+					snapshot = engine.Snapshot()
+					snapshots[market] = snapshot
+				}
+
+				known := sub.books[market]
+				if snapshot.Sequence == known.sequence {
+					continue
+				}
+				book := sub.book(snapshot)
+				sub.books[market] = book
+
+				// changes beyond the depth or of other entry types are
+				// not sent
+				m := sub.incrementalRefresh(market, known, book, snapshot)
+				switch {
+				case m == nil:
+				case sub.incremental:
+					c.session.Send(m)
+				default:
+					c.session.Send(sub.snapshot(market, snapshot))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+)
+
+// journalSyncer writes the journal entries posted so far, like
+// ledger.BufferedStore does.
+type journalSyncer interface {
+	Sync() error
+}
+
+// The stores below sync the journal before every save. The orders, deposits,
+// withdrawals and sweeps are saved after the entries they caused were posted,
+// so once they are stored the entries are too and a restart never finds them
+// without their holds or credits.
+
+type journaledOrderStore struct {
+	OrderStore
+	journal journalSyncer
+}
+
+func (s journaledOrderStore) SaveOrder(order Order) error {
+	if err := s.journal.Sync(); err != nil {
+		return fmt.Errorf("syncing journal: %w", err)
+	}
+	return s.OrderStore.SaveOrder(order)
+}
+
+type journaledDepositStore struct {
+	DepositStore
+	journal journalSyncer
+}
+
+func (s journaledDepositStore) SaveDeposit(d Deposit) error {
+	if err := s.journal.Sync(); err != nil {
+		return fmt.Errorf("syncing journal: %w", err)
+	}
+	return s.DepositStore.SaveDeposit(d)
+}
+
+type journaledWithdrawalStore struct {
+	WithdrawalStore
+	journal journalSyncer
+}
+
+func (s journaledWithdrawalStore) SaveWithdrawal(w Withdrawal) error {
+	if err := s.journal.Sync(); err != nil {
+		return fmt.Errorf("syncing journal: %w", err)
+	}
+	return s.WithdrawalStore.SaveWithdrawal(w)
+}
+
+type journaledSweepStore struct {
+	SweepStore
+	journal journalSyncer
+}
+
+func (s journaledSweepStore) SaveSweep(sweep Sweep) error {
+	if err := s.journal.Sync(); err != nil {
+		return fmt.Errorf("syncing journal: %w", err)
+	}
+	return s.SweepStore.SaveSweep(sweep)
+}
@@ -0,0 +1,462 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+// ExchangeUserID owns the accounts of the exchange itself.
+const ExchangeUserID int64 = -1
+
+// epsilon is the tolerance used when checking float amounts.
+const epsilon = 1e-9
+
+const (
+	// Available holds the funds a user can trade or withdraw.
+	Available AccountType = "AVAILABLE"
+	// Held holds the funds reserved for the open orders of a user.
+	Held AccountType = "HELD"
+	// Custody mirrors all the funds that entered the exchange, it goes
+	// negative by the amount the exchange owes its users.
+	Custody AccountType = "CUSTODY"
+	// Fee collects the trading fees, it goes negative when the exchange
+	// pays out more rebates than it collected.
+	Fee AccountType = "FEE"
+	// Adjustment is the counterpart of the manual adjustments of the admins,
+	// it goes negative by what they credited to the users.
+	Adjustment AccountType = "ADJUSTMENT"
+)
+
+const (
+	EntryDeposit    EntryType = "DEPOSIT"
+	EntryWithdrawal EntryType = "WITHDRAWAL"
+	EntryTrade      EntryType = "TRADE"
+	EntryFee        EntryType = "FEE"
+	EntryHold       EntryType = "HOLD"
+	EntryRelease    EntryType = "RELEASE"
+	EntryAdjustment EntryType = "ADJUSTMENT"
+)
+
+var (
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrUnbalancedEntry     = errors.New("unbalanced journal entry")
+)
+
+type (
+	AccountType string
+	EntryType   string
+)
+
+type Account struct {
+	UserID int64
+	Asset  token.Asset
+	Type   AccountType
+}
+
+func UserAccount(userID int64, asset token.Asset) Account {
+	return Account{UserID: userID, Asset: asset, Type: Available}
+}
+
+func HeldAccount(userID int64, asset token.Asset) Account {
+	return Account{UserID: userID, Asset: asset, Type: Held}
+}
+
+func ExchangeAccount(accountType AccountType, asset token.Asset) Account {
+	return Account{UserID: ExchangeUserID, Asset: asset, Type: accountType}
+}
+
+// IsExchange reports whether the account belongs to the exchange. Only
+// exchange accounts are allowed to go negative.
+func (a Account) IsExchange() bool {
+	return a.UserID == ExchangeUserID
+}
+
+func (a Account) String() string {
+	return fmt.Sprintf("%d:%s:%s", a.UserID, a.Asset, a.Type)
+}
+
+// Posting moves Amount into the account, a negative amount moves it out.
+type Posting struct {
+	Account Account
+	Amount  float64
+}
+
+// Entry is a journal entry. The postings of every asset sum up to zero.
+type Entry struct {
+	ID   int64
+	Type EntryType
+	// Ref points to what caused the entry, like an order or a transaction
+	Ref       string
+	Postings  []Posting
+	Timestamp int64
+}
+
+// Validate checks that the entry is balanced per asset.
+func (e *Entry) Validate() error {
+	if len(e.Postings) < 2 {
+		return fmt.Errorf("%w: entry needs at least two postings", ErrUnbalancedEntry)
+	}
+
+	sums := make(map[token.Asset]float64)
+	for _, p := range e.Postings {
+		if math.IsNaN(p.Amount) || math.IsInf(p.Amount, 0) {
+			return fmt.Errorf("invalid amount %f for account %s", p.Amount, p.Account)
+		}
+		sums[p.Account.Asset] += p.Amount
+	}
+
+	for asset, sum := range sums {
+		if math.Abs(sum) > epsilon {
+			return fmt.Errorf("%w: %s postings sum up to %f", ErrUnbalancedEntry, asset, sum)
+		}
+	}
+
+	return nil
+}
+
+// Store persists the journal. Entries are appended in the order they were
+// posted and loaded back in the same order.
+type Store interface {
+	Append(Entry) error
+	Load() ([]Entry, error)
+}
+
+// Ledger is the double-entry book of all balance movements. The balances are
+// derived from the journal and every entry is applied atomically.
+type Ledger struct {
+	mu       sync.RWMutex
+	store    Store
+	entries  []*Entry
+	balances map[Account]float64
+	// userEntries maps a user to the index of the entries touching the user
+	userEntries map[int64][]int
+	nextID      int64
+}
+
+// NewLedger creates a ledger that only lives in memory.
+func NewLedger() *Ledger {
+	return &Ledger{
+		balances:    make(map[Account]float64),
+		userEntries: make(map[int64][]int),
+		nextID:      1,
+	}
+}
+
+// LoadLedger creates a ledger persisted to the store and replays the journal
+// already in it.
+func LoadLedger(store Store) (*Ledger, error) {
+	l := NewLedger()
+
+	entries, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if err := entry.Validate(); err != nil {
+			return nil, fmt.Errorf("journal entry %d: %w", entry.ID, err)
+		}
+		l.apply(entry)
+	}
+	l.store = store
+
+	return l, nil
+}
+
+// Post validates the entry and applies it. Either all the postings are
+// applied or none of them is.
+func (l *Ledger) Post(entry Entry) (Entry, error) {
+	if err := entry.Validate(); err != nil {
+		return Entry{}, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.covered(entry); err != nil {
+		return Entry{}, err
+	}
+
+	entry.ID = l.nextID
+	if entry.Timestamp == 0 {
+		entry.Timestamp = time.Now().UnixNano()
+	}
+
+	if l.store != nil {
+		if err := l.store.Append(entry); err != nil {
+			return Entry{}, err
+		}
+	}
+	l.apply(entry)
+
+	return entry, nil
+}
+
+// CanPost reports why the entry could not be posted right now, nil when it
+// could.
+func (l *Ledger) CanPost(entry Entry) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.covered(entry)
+}
+
+// covered checks that no user account goes negative with the entry, it must
+// be called with l.mu held.
+func (l *Ledger) covered(entry Entry) error {
+	// the postings could touch the same account twice, so sum them up first
+	changes := make(map[Account]float64)
+	for _, p := range entry.Postings {
+		changes[p.Account] += p.Amount
+	}
+	for account, change := range changes {
+		if account.IsExchange() {
+			continue
+		}
+		if l.balances[account]+change < -epsilon {
+			return fmt.Errorf("%w: account %s has %f, needs %f", ErrInsufficientBalance, account, l.balances[account], -change)
+		}
+	}
+
+	return nil
+}
+
+// apply must be called with l.mu held or before the ledger is shared.
+func (l *Ledger) apply(entry Entry) {
+	e := &entry
+	l.entries = append(l.entries, e)
+	index := len(l.entries) - 1
+
+	seen := make(map[int64]bool)
+	for _, p := range e.Postings {
+		l.balances[p.Account] += p.Amount
+		// keep tiny float leftovers from showing up as balances
+		if math.Abs(l.balances[p.Account]) < epsilon {
+			l.balances[p.Account] = 0
+		}
+
+		if !seen[p.Account.UserID] {
+			seen[p.Account.UserID] = true
+			l.userEntries[p.Account.UserID] = append(l.userEntries[p.Account.UserID], index)
+		}
+	}
+
+	if e.ID >= l.nextID {
+		l.nextID = e.ID + 1
+	}
+}
+
+func (l *Ledger) Balance(account Account) float64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.balances[account]
+}
+
+// Balances returns all the non empty accounts of the user.
+func (l *Ledger) Balances(userID int64) map[Account]float64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	balances := make(map[Account]float64)
+	for account, balance := range l.balances {
+		if account.UserID == userID && balance != 0 {
+			balances[account] = balance
+		}
+	}
+
+	return balances
+}
+
+// Liabilities returns what the exchange owes each user per asset, the
+// available and the held funds together, all taken at the same point of the
+// journal.
+func (l *Ledger) Liabilities() map[int64]map[token.Asset]float64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	liabilities := make(map[int64]map[token.Asset]float64)
+	for account, balance := range l.balances {
+		if account.IsExchange() || balance == 0 {
+			continue
+		}
+		if liabilities[account.UserID] == nil {
+			liabilities[account.UserID] = make(map[token.Asset]float64)
+		}
+		liabilities[account.UserID][account.Asset] += balance
+	}
+
+	return liabilities
+}
+
+// History returns the journal entries touching the user, oldest first.
+func (l *Ledger) History(userID int64) []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	history := make([]Entry, len(l.userEntries[userID]))
+	for i, index := range l.userEntries[userID] {
+		history[i] = *l.entries[index]
+	}
+
+	return history
+}
+
+// EntriesSince returns the journal entries posted at or after timestamp (unix
+// nano), oldest first.
+func (l *Ledger) EntriesSince(timestamp int64) []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var entries []Entry
+	for _, e := range l.entries {
+		if e.Timestamp >= timestamp {
+			entries = append(entries, *e)
+		}
+	}
+
+	return entries
+}
+
+// Check recomputes every balance from the journal and compares it with the
+// running balances, it also checks the journal is balanced as a whole.
+func (l *Ledger) Check() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	balances := make(map[Account]float64)
+	totals := make(map[token.Asset]float64)
+	for _, e := range l.entries {
+		for _, p := range e.Postings {
+			balances[p.Account] += p.Amount
+			totals[p.Account.Asset] += p.Amount
+		}
+	}
+
+	for asset, total := range totals {
+		if math.Abs(total) > epsilon*float64(len(l.entries)+1) {
+			return fmt.Errorf("%w: %s journal sums up to %f", ErrUnbalancedEntry, asset, total)
+		}
+	}
+
+	accounts := make([]Account, 0, len(balances))
+	for account := range balances {
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].String() < accounts[j].String() })
+
+	for _, account := range accounts {
+		if math.Abs(balances[account]-l.balances[account]) > epsilon*float64(len(l.entries)+1) {
+			return fmt.Errorf("account %s balance %f does not match the journal %f", account, l.balances[account], balances[account])
+		}
+	}
+
+	return nil
+}
+
+// Deposit credits funds that entered the exchange to the user.
+func (l *Ledger) Deposit(userID int64, asset token.Asset, amount float64, ref string) (Entry, error) {
+	if amount <= 0 {
+		return Entry{}, fmt.Errorf("amount must be positive")
+	}
+
+	return l.Post(Entry{
+		Type: EntryDeposit,
+		Ref:  ref,
+		Postings: []Posting{
+			{Account: ExchangeAccount(Custody, asset), Amount: -amount},
+			{Account: UserAccount(userID, asset), Amount: amount},
+		},
+	})
+}
+
+// Withdraw debits funds that leave the exchange from the user.
+func (l *Ledger) Withdraw(userID int64, asset token.Asset, amount float64, ref string) (Entry, error) {
+	if amount <= 0 {
+		return Entry{}, fmt.Errorf("amount must be positive")
+	}
+
+	return l.Post(Entry{
+		Type: EntryWithdrawal,
+		Ref:  ref,
+		Postings: []Posting{
+			{Account: UserAccount(userID, asset), Amount: -amount},
+			{Account: ExchangeAccount(Custody, asset), Amount: amount},
+		},
+	})
+}
+
+// WithdrawHeld debits held funds that left the exchange from the user, like a
+// withdrawal that stayed on hold until it was confirmed on chain.
+func (l *Ledger) WithdrawHeld(userID int64, asset token.Asset, amount float64, ref string) (Entry, error) {
+	if amount <= 0 {
+		return Entry{}, fmt.Errorf("amount must be positive")
+	}
+
+	return l.Post(Entry{
+		Type: EntryWithdrawal,
+		Ref:  ref,
+		Postings: []Posting{
+			{Account: HeldAccount(userID, asset), Amount: -amount},
+			{Account: ExchangeAccount(Custody, asset), Amount: amount},
+		},
+	})
+}
+
+// Adjust credits the amount to the user, a negative amount debits it. It is
+// how admins correct a balance by hand.
+func (l *Ledger) Adjust(userID int64, asset token.Asset, amount float64, ref string) (Entry, error) {
+	if amount == 0 || math.IsNaN(amount) {
+		return Entry{}, fmt.Errorf("amount must not be zero")
+	}
+
+	return l.Post(Entry{
+		Type: EntryAdjustment,
+		Ref:  ref,
+		Postings: []Posting{
+			{Account: ExchangeAccount(Adjustment, asset), Amount: -amount},
+			{Account: UserAccount(userID, asset), Amount: amount},
+		},
+	})
+}
+
+// Hold moves funds of the user from available to held.
+func (l *Ledger) Hold(userID int64, asset token.Asset, amount float64, ref string) (Entry, error) {
+	if amount <= 0 {
+		return Entry{}, fmt.Errorf("amount must be positive")
+	}
+
+	return l.Post(Entry{
+		Type: EntryHold,
+		Ref:  ref,
+		Postings: []Posting{
+			{Account: UserAccount(userID, asset), Amount: -amount},
+			{Account: HeldAccount(userID, asset), Amount: amount},
+		},
+	})
+}
+
+// Release moves held funds of the user back to available.
+func (l *Ledger) Release(userID int64, asset token.Asset, amount float64, ref string) (Entry, error) {
+	if amount <= 0 {
+		return Entry{}, fmt.Errorf("amount must be positive")
+	}
+
+	return l.Post(Entry{
+		Type: EntryRelease,
+		Ref:  ref,
+		Postings: []Posting{
+			{Account: HeldAccount(userID, asset), Amount: -amount},
+			{Account: UserAccount(userID, asset), Amount: amount},
+		},
+	})
+}
@@ -0,0 +1,197 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+type memoryStore struct {
+	entries []Entry
+	fail    bool
+}
+
+func (s *memoryStore) Append(entry Entry) error {
+	if s.fail {
+		return errors.New("store down")
+	}
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *memoryStore) Load() ([]Entry, error) {
+	return s.entries, nil
+}
+
+func TestDepositWithdraw(t *testing.T) {
+	l := NewLedger()
+
+	_, err := l.Deposit(1, token.AssetETH, 10, "tx1")
+	assert(t, err, nil)
+	assert(t, l.Balance(UserAccount(1, token.AssetETH)), 10.0)
+	assert(t, l.Balance(ExchangeAccount(Custody, token.AssetETH)), -10.0)
+
+	_, err = l.Withdraw(1, token.AssetETH, 11, "tx2")
+	assert(t, errors.Is(err, ErrInsufficientBalance), true)
+	assert(t, l.Balance(UserAccount(1, token.AssetETH)), 10.0)
+
+	_, err = l.Withdraw(1, token.AssetETH, 4, "tx3")
+	assert(t, err, nil)
+	assert(t, l.Balance(UserAccount(1, token.AssetETH)), 6.0)
+
+	history := l.History(1)
+	assert(t, len(history), 2)
+	assert(t, history[0].Type, EntryDeposit)
+	assert(t, history[1].Type, EntryWithdrawal)
+	assert(t, l.Check(), nil)
+}
+
+func TestWithdrawHeld(t *testing.T) {
+	l := NewLedger()
+	l.Deposit(1, token.AssetETH, 10, "tx1")
+	l.Hold(1, token.AssetETH, 4, "withdrawal:1")
+
+	_, err := l.WithdrawHeld(1, token.AssetETH, 5, "withdrawal:1")
+	assert(t, errors.Is(err, ErrInsufficientBalance), true)
+
+	entry, err := l.WithdrawHeld(1, token.AssetETH, 4, "withdrawal:1")
+	assert(t, err, nil)
+	assert(t, entry.Type, EntryWithdrawal)
+	assert(t, l.Balance(UserAccount(1, token.AssetETH)), 6.0)
+	assert(t, l.Balance(HeldAccount(1, token.AssetETH)), 0.0)
+	assert(t, l.Balance(ExchangeAccount(Custody, token.AssetETH)), -6.0)
+	assert(t, l.Check(), nil)
+}
+
+func TestLiabilities(t *testing.T) {
+	l := NewLedger()
+	l.Deposit(1, token.AssetETH, 10, "tx1")
+	l.Hold(1, token.AssetETH, 4, "order:1")
+	l.Deposit(2, token.AssetUSDT, 100, "tx2")
+	l.Withdraw(2, token.AssetUSDT, 100, "tx3")
+
+	assert(t, l.Liabilities(), map[int64]map[token.Asset]float64{
+		1: {token.AssetETH: 10},
+	})
+}
+
+func TestAdjust(t *testing.T) {
+	l := NewLedger()
+
+	_, err := l.Adjust(1, token.AssetETH, 5, "adjustment:1")
+	assert(t, err, nil)
+	assert(t, l.Balance(UserAccount(1, token.AssetETH)), 5.0)
+	assert(t, l.Balance(ExchangeAccount(Adjustment, token.AssetETH)), -5.0)
+
+	_, err = l.Adjust(1, token.AssetETH, -6, "adjustment:2")
+	assert(t, errors.Is(err, ErrInsufficientBalance), true)
+
+	entry, err := l.Adjust(1, token.AssetETH, -2, "adjustment:3")
+	assert(t, err, nil)
+	assert(t, entry.Type, EntryAdjustment)
+	assert(t, l.Balance(UserAccount(1, token.AssetETH)), 3.0)
+
+	_, err = l.Adjust(1, token.AssetETH, 0, "adjustment:4")
+	assert(t, err != nil, true)
+	assert(t, l.Check(), nil)
+}
+
+func TestUnbalancedEntry(t *testing.T) {
+	l := NewLedger()
+
+	_, err := l.Post(Entry{
+		Type: EntryTrade,
+		Postings: []Posting{
+			{Account: UserAccount(1, token.AssetETH), Amount: -1},
+			{Account: UserAccount(2, token.AssetETH), Amount: 2},
+		},
+	})
+	assert(t, errors.Is(err, ErrUnbalancedEntry), true)
+	assert(t, len(l.History(2)), 0)
+}
+
+func TestEntryIsAtomic(t *testing.T) {
+	l := NewLedger()
+	l.Deposit(1, token.AssetETH, 5, "tx1")
+
+	// the second leg can not be covered, so the first one must not apply
+	_, err := l.Post(Entry{
+		Type: EntryTrade,
+		Postings: []Posting{
+			{Account: UserAccount(1, token.AssetETH), Amount: -5},
+			{Account: UserAccount(2, token.AssetETH), Amount: 5},
+			{Account: UserAccount(2, "USDT"), Amount: -100},
+			{Account: UserAccount(1, "USDT"), Amount: 100},
+		},
+	})
+	assert(t, errors.Is(err, ErrInsufficientBalance), true)
+	assert(t, l.Balance(UserAccount(1, token.AssetETH)), 5.0)
+	assert(t, l.Balance(UserAccount(2, token.AssetETH)), 0.0)
+	assert(t, l.Check(), nil)
+}
+
+func TestLoadLedger(t *testing.T) {
+	store := &memoryStore{}
+	l, err := LoadLedger(store)
+	assert(t, err, nil)
+
+	l.Deposit(1, token.AssetETH, 5, "tx1")
+	l.Deposit(2, token.AssetETH, 3, "tx2")
+
+	store.fail = true
+	_, err = l.Deposit(1, token.AssetETH, 5, "tx3")
+	assert(t, err != nil, true)
+	assert(t, l.Balance(UserAccount(1, token.AssetETH)), 5.0)
+	store.fail = false
+
+	reloaded, err := LoadLedger(store)
+	assert(t, err, nil)
+	assert(t, reloaded.Balance(UserAccount(1, token.AssetETH)), 5.0)
+	assert(t, reloaded.Balance(UserAccount(2, token.AssetETH)), 3.0)
+
+	entry, err := reloaded.Deposit(2, token.AssetETH, 1, "tx4")
+	assert(t, err, nil)
+	assert(t, entry.ID, int64(3))
+}
+
+func TestBufferedStore(t *testing.T) {
+	store := &memoryStore{fail: true}
+	buffered := NewBufferedStore(store)
+	l, err := LoadLedger(buffered)
+	assert(t, err, nil)
+
+	// posting does not wait on the storage, the entries wait for it
+	_, err = l.Deposit(1, token.AssetETH, 5, "tx1")
+	assert(t, err, nil)
+	l.Deposit(2, token.AssetETH, 3, "tx2")
+	assert(t, l.Balance(UserAccount(1, token.AssetETH)), 5.0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert(t, buffered.Flush(ctx) != nil, true)
+	assert(t, len(store.entries), 0)
+
+	store.fail = false
+	assert(t, buffered.Sync(), nil)
+	assert(t, len(store.entries), 2)
+	l.Deposit(1, token.AssetETH, 1, "tx3")
+	assert(t, buffered.Flush(context.Background()), nil)
+	assert(t, len(store.entries), 3)
+	for i, entry := range store.entries {
+		assert(t, entry.ID, int64(i+1))
+	}
+
+	reloaded, err := LoadLedger(store)
+	assert(t, err, nil)
+	assert(t, reloaded.Balance(UserAccount(1, token.AssetETH)), 6.0)
+}
@@ -0,0 +1,174 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/db"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/sirupsen/logrus"
+)
+
+// BufferedStore appends the entries to its store in the background, so
+// posting never waits on the storage. The ledger in memory is the source of
+// truth, the entries reach the store in the order they were posted. Anything
+// stored outside the journal because of an entry has to call Sync first, so
+// the journal is never behind it after a crash.
+type BufferedStore struct {
+	store Store
+
+	mu      sync.Mutex
+	pending []Entry
+	wake    chan struct{}
+	// writeMu orders the writes of Run and Flush
+	writeMu sync.Mutex
+}
+
+func NewBufferedStore(store Store) *BufferedStore {
+	return &BufferedStore{
+		store: store,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+func (s *BufferedStore) Append(entry Entry) error {
+	s.mu.Lock()
+	s.pending = append(s.pending, entry)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (s *BufferedStore) Load() ([]Entry, error) {
+	return s.store.Load()
+}
+
+// Run appends the posted entries to the store until ctx is done, the appends
+// that failed are retried every second.
+func (s *BufferedStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+		if err := s.write(); err != nil {
+			logrus.WithError(err).Error("failed to write journal entries")
+		}
+	}
+}
+
+// Flush appends the entries posted since the last write, it is the last step
+// before the store goes away. It retries until ctx is done.
+func (s *BufferedStore) Flush(ctx context.Context) error {
+	for {
+		err := s.write()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Sync appends the entries posted so far, it returns once all of them are in
+// the store.
+func (s *BufferedStore) Sync() error {
+	return s.write()
+}
+
+// write appends the pending entries in order, it stops at the first failing
+// one so none is appended before an older one.
+func (s *BufferedStore) write() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	entries := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	for i, entry := range entries {
+		if err := s.store.Append(entry); err != nil {
+			s.mu.Lock()
+			s.pending = append(entries[i:len(entries):len(entries)], s.pending...)
+			s.mu.Unlock()
+			return fmt.Errorf("journal entry %d: %w", entry.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// MongoStore keeps the journal in the journal collection, the db has to be
+// initialized with db.InitializeMongo first.
+type MongoStore struct{}
+
+func NewMongoStore() *MongoStore {
+	return &MongoStore{}
+}
+
+func (s *MongoStore) Append(entry Entry) error {
+	entryDB := db.JournalEntry{
+		ID:        entry.ID,
+		Type:      string(entry.Type),
+		Ref:       entry.Ref,
+		Postings:  make([]db.JournalPosting, len(entry.Postings)),
+		Timestamp: entry.Timestamp,
+	}
+	for i, p := range entry.Postings {
+		entryDB.Postings[i] = db.JournalPosting{
+			UserID:      p.Account.UserID,
+			Asset:       string(p.Account.Asset),
+			AccountType: string(p.Account.Type),
+			Amount:      p.Amount,
+		}
+	}
+
+	return entryDB.InsertJournalEntry()
+}
+
+func (s *MongoStore) Load() ([]Entry, error) {
+	entriesDB, err := db.GetJournalEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, len(entriesDB))
+	for i, entryDB := range entriesDB {
+		entries[i] = Entry{
+			ID:        entryDB.ID,
+			Type:      EntryType(entryDB.Type),
+			Ref:       entryDB.Ref,
+			Postings:  make([]Posting, len(entryDB.Postings)),
+			Timestamp: entryDB.Timestamp,
+		}
+		for j, p := range entryDB.Postings {
+			entries[i].Postings[j] = Posting{
+				Account: Account{
+					UserID: p.UserID,
+					Asset:  token.Asset(p.Asset),
+					Type:   AccountType(p.AccountType),
+				},
+				Amount: p.Amount,
+			}
+		}
+	}
+
+	return entries, nil
+}
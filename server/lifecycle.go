@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/sirupsen/logrus"
+)
+
+// Lifecycle owns the long-running components of the exchange. Workers run
+// until the lifecycle shuts down, shutdown steps then tear down what they
+// were registered for in reverse order, like deferred calls.
+type Lifecycle struct {
+	mu       sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	workers  sync.WaitGroup
+	steps    []shutdownStep
+	shutdown bool
+}
+
+type shutdownStep struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+func NewLifecycle() *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Lifecycle{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Go runs fn in its own goroutine. fn has to return once ctx is done, which
+// happens first thing on shutdown.
+func (l *Lifecycle) Go(name string, fn func(ctx context.Context)) {
+	l.workers.Add(1)
+	go func() {
+		defer l.workers.Done()
+		fn(l.ctx)
+
+		logrus.WithField("worker", name).Info("worker stopped")
+	}()
+}
+
+// runEvery calls fn every interval until ctx is done, it is the loop of the
+// workers polling the chain.
+func runEvery(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// OnShutdown registers a step of the shutdown. Steps run after the workers
+// stopped, the last registered one first.
+func (l *Lifecycle) OnShutdown(name string, fn func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.steps = append(l.steps, shutdownStep{name: name, fn: fn})
+}
+
+// Shutdown stops the workers and runs the shutdown steps. A failing step does
+// not keep the others from running, all their errors are returned. Once ctx is
+// done the remaining steps still run, but should give up quickly. Calling
+// Shutdown again does nothing.
+func (l *Lifecycle) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	if l.shutdown {
+		l.mu.Unlock()
+		return nil
+	}
+	l.shutdown = true
+	steps := l.steps
+	l.mu.Unlock()
+
+	l.cancel()
+
+	var errs []error
+
+	stopped := make(chan struct{})
+	go func() {
+		l.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("waiting for workers: %w", ctx.Err()))
+	}
+
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		if err := step.fn(ctx); err != nil {
+			logrus.WithError(err).WithField("step", step.name).Error("shutdown step failed")
+			errs = append(errs, fmt.Errorf("%s: %w", step.name, err))
+			continue
+		}
+		logrus.WithField("step", step.name).Info("shutdown step done")
+	}
+
+	return errors.Join(errs...)
+}
+
+// restoreOrders puts the open limit orders of the order store back into their
+// books, oldest first so they keep their time priority. What the orders hold
+// stayed in the ledger, so they rest just like before the restart. Orders of
+// markets no longer listed are cancelled instead.
+func (ex *Exchange) restoreOrders() (int, error) {
+	orders, err := ex.orderStore.GetOpenOrders()
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	for _, o := range orders {
+		order := &orderbook.Order{
+			ID:           o.ID,
+			UserID:       o.UserID,
+			Size:         o.Size,
+			Bid:          o.Bid,
+			Timestamp:    o.Timestamp,
+			ExpiresAt:    o.ExpiresAt,
+			Status:       o.Status,
+			FilledSize:   o.FilledSize,
+			AvgFillPrice: o.AvgFillPrice,
+			UpdatedAt:    o.UpdatedAt,
+		}
+
+		err := ex.markets.Do(o.Market, func(book *orderbook.Orderbook, _ token.Pair) {
+			book.PlaceLimitOrder(o.Price, order)
+		})
+		if errors.Is(err, ErrMarketNotFound) {
+			if err := ex.cancelStoredOrder(o); err != nil {
+				return restored, err
+			}
+			continue
+		}
+		if err != nil {
+			return restored, err
+		}
+		restored++
+	}
+
+	return restored, nil
+}
+
+// cancelStoredOrder cancels an open order that is in no book and gives back
+// what it held.
+func (ex *Exchange) cancelStoredOrder(order Order) error {
+	pair, err := order.Market.Pair()
+	if err != nil {
+		return err
+	}
+
+	if order.Bid {
+		ex.releaseHold(order.UserID, pair.Quote, order.Size*order.Price, holdRef(order.Market, order.ID))
+	} else {
+		ex.releaseHold(order.UserID, pair.Base, order.Size, holdRef(order.Market, order.ID))
+	}
+	order.Status = orderbook.StatusCancelled
+	order.UpdatedAt = time.Now().UnixNano()
+
+	logrus.WithFields(logrus.Fields{
+		"orderID": order.ID,
+		"market":  order.Market,
+	}).Warn("cancelled open order of unlisted market")
+
+	return ex.orderStore.SaveOrder(order)
+}
+
+// stopMarkets stops the engines of all markets. With cancelOrders the resting
+// orders are cancelled first, which releases what they held, otherwise they
+// stay open in the order store for restoreOrders.
+func (ex *Exchange) stopMarkets(cancelOrders bool) {
+	resting, cancelled := 0, 0
+	ex.markets.Stop(func(_ token.Market, book *orderbook.Orderbook) {
+		for _, order := range book.Orders {
+			if order.Limit == nil {
+				continue
+			}
+			if cancelOrders {
+				book.CancelOrder(order)
+				cancelled++
+			} else {
+				resting++
+			}
+		}
+	})
+
+	logrus.WithFields(logrus.Fields{
+		"resting":   resting,
+		"cancelled": cancelled,
+	}).Info("markets stopped")
+}
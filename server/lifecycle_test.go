@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+func TestLifecycleShutdown(t *testing.T) {
+	lc := NewLifecycle()
+
+	var (
+		calls     []string
+		workerErr = errors.New("step failed")
+	)
+	stopped := make(chan struct{})
+	lc.Go("worker", func(ctx context.Context) {
+		<-ctx.Done()
+		close(stopped)
+	})
+	lc.OnShutdown("first", func(context.Context) error {
+		calls = append(calls, "first")
+		return nil
+	})
+	lc.OnShutdown("second", func(context.Context) error {
+		// workers stop before any step runs
+		select {
+		case <-stopped:
+			calls = append(calls, "second")
+		default:
+			t.Error("worker still running")
+		}
+		return workerErr
+	})
+
+	err := lc.Shutdown(context.Background())
+	assert(t, errors.Is(err, workerErr), true)
+	assert(t, calls, []string{"second", "first"})
+
+	// shutting down twice does nothing
+	assert(t, lc.Shutdown(context.Background()), nil)
+	assert(t, len(calls), 2)
+}
+
+func TestLifecycleShutdownTimeout(t *testing.T) {
+	lc := NewLifecycle()
+
+	block := make(chan struct{})
+	defer close(block)
+	lc.Go("stuck", func(context.Context) {
+		<-block
+	})
+	ran := false
+	lc.OnShutdown("step", func(context.Context) error {
+		ran = true
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := lc.Shutdown(ctx)
+	assert(t, errors.Is(err, context.DeadlineExceeded), true)
+	assert(t, ran, true)
+}
+
+func TestHaltTrading(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1)
+	e := newRouter(ex)
+
+	id := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 5, Price: 1_000, Market: token.MarketETHUSDT})
+
+	ex.markets.Halt()
+
+	rec := doUserRequest(e, 1, http.MethodPost, "/order", PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 1_100, Market: token.MarketETHUSDT})
+	assert(t, rec.Code, http.StatusServiceUnavailable)
+	assert(t, decodeAPIError(t, rec).Code, CodeShuttingDown)
+
+	// cancels still go through while the requests drain
+	rec = doUserRequest(e, 1, http.MethodDelete, fmt.Sprintf("/order/%d", id), nil)
+	assert(t, rec.Code, http.StatusOK)
+
+	ex.stopMarkets(false)
+	rec = doUserRequest(e, 1, http.MethodDelete, fmt.Sprintf("/order/%d", id), nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	assert(t, ex.markets.List(MarketConfig{Market: token.MarketETHUSDT}), ErrShuttingDown)
+}
+
+func TestCancelOrdersOnShutdown(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1)
+
+	bidID := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 5, Price: 1_000, Market: token.MarketETHUSDT})
+	askID := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 4, Price: 1_100, Market: token.MarketETHUSDT})
+
+	ex.stopMarkets(true)
+
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetUSDT)), 0.0)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetETH)), 0.0)
+	assert(t, getTestOrder(t, ex, bidID).Status, orderbook.StatusCancelled)
+	assert(t, getTestOrder(t, ex, askID).Status, orderbook.StatusCancelled)
+	assert(t, len(ex.Orders.UserOrders(1)), 0)
+	assert(t, ex.Ledger.Check(), nil)
+}
+
+func TestRestoreOrders(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1, 2)
+
+	expiresAt := time.Now().Add(time.Hour).UnixNano()
+	firstID := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 5, Price: 1_000, Market: token.MarketETHUSDT})
+	secondID := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Bid: true, Size: 2, Price: 1_000, Market: token.MarketETHUSDT, ExpiresAt: expiresAt})
+	askID := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Size: 3, Price: 1_200, Market: token.MarketETHBTC})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Size: 1, Market: token.MarketETHUSDT})
+
+	ex.stopMarkets(false)
+
+	// the next start shares the storage of the last one
+	next := newFundedExchange(t, 0, 0, 1)
+	next.Ledger = ex.Ledger
+	next.SetOrderStore(ex.orderStore)
+
+	restored, err := next.restoreOrders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, restored, 3)
+
+	book := bookSnapshot(next, token.MarketETHUSDT)
+	assert(t, len(book.Bids), 1)
+	assert(t, book.Bids[0].TotalVolume, 6.0)
+	// the partially filled order keeps its fill and its time priority
+	assert(t, book.Bids[0].Orders[0].ID, firstID)
+	assert(t, book.Bids[0].Orders[0].Size, 4.0)
+
+	first, ok := next.Orders.Get(firstID)
+	assert(t, ok, true)
+	assert(t, first.Status, orderbook.StatusPartiallyFilled)
+	assert(t, first.FilledSize, 1.0)
+	second, _ := next.Orders.Get(secondID)
+	assert(t, second.ExpiresAt, expiresAt)
+	_, ok = next.Orders.Get(askID)
+	assert(t, ok, true)
+
+	// the restored orders still hold their funds and give them back
+	assert(t, next.Ledger.Balance(ledger.HeldAccount(1, token.AssetUSDT)), 4_000.0)
+	rec := doUserRequest(newRouter(next), 1, http.MethodDelete, fmt.Sprintf("/order/%d", firstID), nil)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, next.Ledger.Balance(ledger.HeldAccount(1, token.AssetUSDT)), 0.0)
+	assert(t, next.Ledger.Check(), nil)
+}
+
+func TestRestoreOrdersOfUnlistedMarket(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1)
+	id := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 5, Price: 1_000, Market: token.MarketETHUSDT})
+	ex.stopMarkets(false)
+
+	next, err := NewExchangeWithMarkets(testPrivateKey, []MarketConfig{{Market: token.MarketBTCUSDT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Ledger = ex.Ledger
+	next.SetOrderStore(ex.orderStore)
+
+	restored, err := next.restoreOrders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, restored, 0)
+
+	order, _ := next.orderStore.GetOrder(id)
+	assert(t, order.Status, orderbook.StatusCancelled)
+	assert(t, next.Ledger.Balance(ledger.HeldAccount(1, token.AssetUSDT)), 0.0)
+	assert(t, next.Ledger.Check(), nil)
+}
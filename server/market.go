@@ -0,0 +1,386 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MarketActive markets accept new orders and cancels.
+	MarketActive MarketState = "ACTIVE"
+	// MarketCancelOnly markets only accept cancels, the resting orders stay
+	// in the book until they are cancelled or expire.
+	MarketCancelOnly MarketState = "CANCEL_ONLY"
+)
+
+var (
+	ErrMarketNotFound   = errors.New("market not found")
+	ErrMarketListed     = errors.New("market already listed")
+	ErrMarketCancelOnly = errors.New("market is in cancel-only mode")
+	ErrShuttingDown     = errors.New("exchange is shutting down")
+)
+
+type MarketState string
+
+func (s MarketState) Valid() bool {
+	return s == MarketActive || s == MarketCancelOnly
+}
+
+// MarketConfig describes a market the exchange lists on start.
+type MarketConfig struct {
+	Market token.Market
+	// State defaults to ACTIVE
+	State MarketState
+}
+
+// DefaultMarkets are listed when no market config is given.
+var DefaultMarkets = []MarketConfig{
+	{Market: token.MarketETHUSDT},
+	{Market: token.MarketBTCUSDT},
+	{Market: token.MarketETHBTC},
+}
+
+// LoadMarketConfigs reads a JSON list of market configs from the file.
+func LoadMarketConfigs(path string) ([]MarketConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	configs := []MarketConfig{}
+	if err := json.NewDecoder(f).Decode(&configs); err != nil {
+		return nil, fmt.Errorf("market config %s: %w", path, err)
+	}
+
+	return configs, nil
+}
+
+// MarketInfo is what clients get to discover the markets.
+type MarketInfo struct {
+	Market token.Market
+	Base   token.Asset
+	Quote  token.Asset
+	State  MarketState
+}
+
+type listedMarket struct {
+	engine *orderbook.Engine
+	pair   token.Pair
+	state  MarketState
+}
+
+// MarketRegistry holds the listed markets and the engines running their
+// orderbooks. Markets are listed and delisted at runtime, commands sent
+// through the registry never reach an engine that was already stopped.
+type MarketRegistry struct {
+	mu      sync.RWMutex
+	markets map[token.Market]*listedMarket
+	// halted registries take no new orders, stopped ones no command at all
+	halted  bool
+	stopped bool
+	// newHandler wires the events of a new orderbook to the exchange
+	newHandler func(market token.Market) orderbook.EventHandler
+}
+
+func NewMarketRegistry(newHandler func(market token.Market) orderbook.EventHandler) *MarketRegistry {
+	return &MarketRegistry{
+		markets:    make(map[token.Market]*listedMarket),
+		newHandler: newHandler,
+	}
+}
+
+// List creates the orderbook of the market and starts its engine. Both
+// assets of the pair need a token definition.
+func (r *MarketRegistry) List(cfg MarketConfig) error {
+	pair, err := cfg.Market.Pair()
+	if err != nil {
+		return err
+	}
+	if !token.IsKnownAsset(pair.Base) || !token.IsKnownAsset(pair.Quote) {
+		return fmt.Errorf("unknown asset in market: %s", cfg.Market)
+	}
+
+	state := cfg.State
+	if state == "" {
+		state = MarketActive
+	}
+	if !state.Valid() {
+		return fmt.Errorf("invalid market state: %s", state)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return ErrShuttingDown
+	}
+	if _, ok := r.markets[cfg.Market]; ok {
+		return fmt.Errorf("%w: %s", ErrMarketListed, cfg.Market)
+	}
+
+	ob := orderbook.NewOrderbook()
+	ob.Market = string(cfg.Market)
+	if r.newHandler != nil {
+		ob.OnEvent = r.newHandler(cfg.Market)
+	}
+	engine := orderbook.NewEngine(ob)
+	engine.Start()
+
+	r.markets[cfg.Market] = &listedMarket{
+		engine: engine,
+		pair:   pair,
+		state:  state,
+	}
+
+	return nil
+}
+
+// Delist runs fn as the last command of the market, so it can clear the
+// book, then stops the engine. The market accepts no command afterwards.
+func (r *MarketRegistry) Delist(market token.Market, fn func(book *orderbook.Orderbook)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return ErrShuttingDown
+	}
+	m, ok := r.markets[market]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrMarketNotFound, market)
+	}
+
+	if fn != nil {
+		m.engine.Do(fn)
+	}
+	m.engine.Stop()
+	delete(r.markets, market)
+
+	return nil
+}
+
+// Halt stops every market from taking new orders, cancels still go through.
+func (r *MarketRegistry) Halt() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.halted = true
+}
+
+// Stop runs fn as the last command of every market, then stops all the
+// engines. The registry accepts no command afterwards.
+func (r *MarketRegistry) Stop(fn func(market token.Market, book *orderbook.Orderbook)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return
+	}
+	r.halted, r.stopped = true, true
+
+	for market, m := range r.markets {
+		if fn != nil {
+			m.engine.Do(func(book *orderbook.Orderbook) {
+				fn(market, book)
+			})
+		}
+		m.engine.Stop()
+	}
+}
+
+// SetState switches a listed market between active and cancel-only.
+func (r *MarketRegistry) SetState(market token.Market, state MarketState) error {
+	if !state.Valid() {
+		return fmt.Errorf("invalid market state: %s", state)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.markets[market]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrMarketNotFound, market)
+	}
+	m.state = state
+
+	return nil
+}
+
+// Engine returns the engine of a listed market, for reading its snapshots.
+func (r *MarketRegistry) Engine(market token.Market) (*orderbook.Engine, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m, ok := r.markets[market]
+	if !ok {
+		return nil, false
+	}
+	return m.engine, true
+}
+
+// Do runs fn in an engine step of the market, whatever its state is. Use it
+// for cancels.
+func (r *MarketRegistry) Do(market token.Market, fn func(book *orderbook.Orderbook, pair token.Pair)) error {
+	return r.do(market, false, fn)
+}
+
+// Trade runs fn in an engine step of the market if it accepts new orders.
+func (r *MarketRegistry) Trade(market token.Market, fn func(book *orderbook.Orderbook, pair token.Pair)) error {
+	return r.do(market, true, fn)
+}
+
+func (r *MarketRegistry) do(market token.Market, trading bool, fn func(book *orderbook.Orderbook, pair token.Pair)) error {
+	// the read lock is held for the whole step so the engine can not be
+	// stopped under it
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.stopped || (trading && r.halted) {
+		return ErrShuttingDown
+	}
+	m, ok := r.markets[market]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrMarketNotFound, market)
+	}
+	if trading && m.state != MarketActive {
+		return fmt.Errorf("%w: %s", ErrMarketCancelOnly, market)
+	}
+
+	m.engine.Do(func(book *orderbook.Orderbook) {
+		fn(book, m.pair)
+	})
+
+	return nil
+}
+
+// Markets returns the listed markets sorted by name.
+func (r *MarketRegistry) Markets() []MarketInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	markets := make([]MarketInfo, 0, len(r.markets))
+	for market, m := range r.markets {
+		markets = append(markets, MarketInfo{
+			Market: market,
+			Base:   m.pair.Base,
+			Quote:  m.pair.Quote,
+			State:  m.state,
+		})
+	}
+	sort.Slice(markets, func(i, j int) bool { return markets[i].Market < markets[j].Market })
+
+	return markets
+}
+
+// delistMarket cancels every resting order of the market, which releases
+// what the orders held, and tears the market down.
+func (ex *Exchange) delistMarket(market token.Market) error {
+	cancelled := 0
+	err := ex.markets.Delist(market, func(book *orderbook.Orderbook) {
+		for _, order := range book.Orders {
+			if order.Limit != nil {
+				book.CancelOrder(order)
+				cancelled++
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"market":    market,
+		"cancelled": cancelled,
+	}).Info("market delisted")
+
+	return nil
+}
+
+func (ex *Exchange) handleGetMarkets(c echo.Context) error {
+	return c.JSON(http.StatusOK, ex.markets.Markets())
+}
+
+type SetMarketStateRequest struct {
+	State MarketState
+}
+
+func (ex *Exchange) handleListMarket(c echo.Context) error {
+	var cfg MarketConfig
+	if err := json.NewDecoder(c.Request().Body).Decode(&cfg); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	if err := ex.markets.List(cfg); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrMarketListed) {
+			status = http.StatusConflict
+		}
+		return newError(status, err)
+	}
+
+	ex.recordAudit(c, audit.MarketListed, 0, map[string]any{"market": cfg.Market})
+
+	logrus.WithField("market", cfg.Market).Info("market listed")
+
+	return c.JSON(http.StatusOK, ex.marketInfo(cfg.Market))
+}
+
+func (ex *Exchange) handleDelistMarket(c echo.Context) error {
+	market := token.Market(c.Param("market"))
+
+	if err := ex.delistMarket(market); err != nil {
+		return newError(http.StatusNotFound, err)
+	}
+	ex.recordAudit(c, audit.MarketDelisted, 0, map[string]any{"market": market})
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "market delisted"})
+}
+
+func (ex *Exchange) handleSetMarketState(c echo.Context) error {
+	market := token.Market(c.Param("market"))
+
+	var req SetMarketStateRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	if err := ex.markets.SetState(market, req.State); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrMarketNotFound) {
+			status = http.StatusNotFound
+		}
+		return newError(status, err)
+	}
+
+	ex.recordAudit(c, audit.MarketStateChanged, 0, map[string]any{
+		"market": market,
+		"state":  req.State,
+	})
+
+	logrus.WithFields(logrus.Fields{
+		"market": market,
+		"state":  req.State,
+	}).Info("market state changed")
+
+	return c.JSON(http.StatusOK, ex.marketInfo(market))
+}
+
+func (ex *Exchange) marketInfo(market token.Market) MarketInfo {
+	for _, info := range ex.markets.Markets() {
+		if info.Market == market {
+			return info
+		}
+	}
+	return MarketInfo{}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/config"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/labstack/echo/v4"
+)
+
+const testAdminToken = "secret"
+
+func doAdminRequest(e *echo.Echo, method, path string, body any) *httptest.ResponseRecorder {
+	var reqBody bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&reqBody).Encode(body)
+	}
+
+	req := httptest.NewRequest(method, path, &reqBody)
+	req.Header.Set(AdminTokenHeader, testAdminToken)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func getTestMarkets(t *testing.T, e *echo.Echo) []MarketInfo {
+	rec := doRequest(e, http.MethodGet, "/markets", nil)
+	markets := []MarketInfo{}
+	if err := json.NewDecoder(rec.Body).Decode(&markets); err != nil {
+		t.Fatal(err)
+	}
+	return markets
+}
+
+func TestGetMarkets(t *testing.T) {
+	_, e := newTestExchange(t)
+
+	markets := getTestMarkets(t, e)
+	assert(t, len(markets), 3)
+	assert(t, markets[0], MarketInfo{Market: token.MarketBTCUSDT, Base: token.AssetBTC, Quote: token.AssetUSDT, State: MarketActive})
+	assert(t, markets[2].Market, token.MarketETHUSDT)
+}
+
+func TestAdminAuth(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	rec := doRequest(e, http.MethodPost, "/admin/markets", MarketConfig{Market: token.NewMarket(token.AssetBTC, token.AssetETH)})
+	assert(t, rec.Code, http.StatusForbidden)
+
+	ex.SetAdminToken(testAdminToken)
+	rec = doRequest(e, http.MethodPost, "/admin/markets", MarketConfig{Market: token.NewMarket(token.AssetBTC, token.AssetETH)})
+	assert(t, rec.Code, http.StatusUnauthorized)
+	assert(t, len(getTestMarkets(t, e)), 3)
+}
+
+func TestListMarket(t *testing.T) {
+	ex, _ := newTestExchange(t, 1)
+	ex.SetAdminToken(testAdminToken)
+	market := token.NewMarket(token.AssetBTC, token.AssetETH)
+
+	rec := doAdminRequest(newRouter(ex), http.MethodPost, "/admin/markets", MarketConfig{Market: market})
+	assert(t, rec.Code, http.StatusOK)
+	rec = doAdminRequest(newRouter(ex), http.MethodPost, "/admin/markets", MarketConfig{Market: market})
+	assert(t, rec.Code, http.StatusConflict)
+	rec = doAdminRequest(newRouter(ex), http.MethodPost, "/admin/markets", MarketConfig{Market: "DOGE-USDT"})
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	assert(t, len(getTestMarkets(t, newRouter(ex))), 4)
+
+	// the new market trades and settles right away
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 20, Market: market})
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetBTC)), 2.0)
+}
+
+func TestCancelOnlyMarket(t *testing.T) {
+	ex, _ := newTestExchange(t, 1)
+	ex.SetAdminToken(testAdminToken)
+
+	orderID := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 1_000, Market: token.MarketETHUSDT})
+
+	rec := doAdminRequest(newRouter(ex), http.MethodPut, "/admin/markets/ETH-USDT", SetMarketStateRequest{State: MarketCancelOnly})
+	assert(t, rec.Code, http.StatusOK)
+
+	rec = doUserRequest(newRouter(ex), 1, http.MethodPost, "/order", PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 1_000, Market: token.MarketETHUSDT})
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doUserRequest(newRouter(ex), 1, http.MethodPost, "/order", PlaceOrderRequest{UserID: 1, Type: MarketOrder, Size: 1, Market: token.MarketETHUSDT})
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doUserRequest(newRouter(ex), 1, http.MethodPost, "/v1/orders/batch", BatchPlaceOrdersRequest{
+		Market: token.MarketETHUSDT,
+		Orders: []PlaceOrderRequest{{Type: MarketOrder, Size: 1}},
+	})
+	assert(t, rec.Code, http.StatusBadRequest)
+	// the market orders that never reached the book are not left behind NEW
+	orders, err := ex.orderStore.GetUserOrders(1)
+	assert(t, err, nil)
+	assert(t, len(orders), 1)
+
+	rec = doUserRequest(newRouter(ex), 1, http.MethodDelete, fmt.Sprintf("/order/%d", orderID), nil)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetETH)), 0.0)
+
+	rec = doAdminRequest(newRouter(ex), http.MethodPut, "/admin/markets/ETH-USDT", SetMarketStateRequest{State: MarketActive})
+	assert(t, rec.Code, http.StatusOK)
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 1_000, Market: token.MarketETHUSDT})
+
+	rec = doAdminRequest(newRouter(ex), http.MethodPut, "/admin/markets/DOGE-USDT", SetMarketStateRequest{State: MarketActive})
+	assert(t, rec.Code, http.StatusNotFound)
+}
+
+func TestDelistMarket(t *testing.T) {
+	ex, _ := newTestExchange(t, 1)
+	ex.SetAdminToken(testAdminToken)
+
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 1_000, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 3, Price: 900, Market: token.MarketETHUSDT})
+
+	rec := doAdminRequest(newRouter(ex), http.MethodDelete, "/admin/markets/ETH-USDT", nil)
+	assert(t, rec.Code, http.StatusOK)
+
+	// the resting orders were cancelled and gave back their holds
+	assert(t, len(ex.Orders.UserOrders(1)), 0)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetETH)), 0.0)
+	assert(t, ex.Ledger.Balance(ledger.HeldAccount(1, token.AssetUSDT)), 0.0)
+	assert(t, ex.Ledger.Check(), nil)
+
+	rec = doUserRequest(newRouter(ex), 1, http.MethodPost, "/order", PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 1_000, Market: token.MarketETHUSDT})
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doRequest(newRouter(ex), http.MethodGet, "/book/ETH-USDT", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	assert(t, len(getTestMarkets(t, newRouter(ex))), 2)
+
+	rec = doAdminRequest(newRouter(ex), http.MethodDelete, "/admin/markets/ETH-USDT", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+
+	// a delisted market can be listed again with an empty book
+	rec = doAdminRequest(newRouter(ex), http.MethodPost, "/admin/markets", MarketConfig{Market: token.MarketETHUSDT})
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, bookSnapshot(ex, token.MarketETHUSDT).AskTotalVolume, 0.0)
+}
+
+func TestMarketConfigs(t *testing.T) {
+	cfg := config.Default()
+
+	markets, err := marketConfigs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, markets, DefaultMarkets)
+
+	cfg.Markets = []config.Market{{Market: "ETH-USDT"}, {Market: "BTC-USDT", State: "CANCEL_ONLY"}}
+	markets, err = marketConfigs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, markets, []MarketConfig{
+		{Market: token.MarketETHUSDT},
+		{Market: token.MarketBTCUSDT, State: MarketCancelOnly},
+	})
+}
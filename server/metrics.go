@@ -0,0 +1,105 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "exchange",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the API requests by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	ordersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "exchange",
+		Name:      "orders_total",
+		Help:      "Order lifecycle events, event is PLACED, CANCELLED, EXPIRED or REJECTED.",
+	}, []string{"market", "type", "event"})
+)
+
+// httpMetrics times every request, labelled with its route rather than its
+// path so the IDs in paths do not blow up the series.
+func httpMetrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			status = toError(err).Status
+		}
+		httpDuration.WithLabelValues(c.Request().Method, c.Path(), strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// countOrderEvent counts the events ending up in the order history, fills
+// are counted as trades by the orderbook.
+func countOrderEvent(market token.Market, orderType OrderType, eventType orderbook.EventType) {
+	if eventType == orderbook.EventFilled {
+		return
+	}
+	ordersTotal.WithLabelValues(string(market), string(orderType), string(eventType)).Inc()
+}
+
+var (
+	bookVolumeDesc = prometheus.NewDesc("exchange_book_volume", "Volume resting in the book by side.", []string{"market", "side"}, nil)
+	bookLevelsDesc = prometheus.NewDesc("exchange_book_levels", "Price levels in the book by side.", []string{"market", "side"}, nil)
+	bookSpreadDesc = prometheus.NewDesc("exchange_book_spread", "Best ask minus best bid, only set when both sides have orders.", []string{"market"}, nil)
+)
+
+// marketCollector reads the depth and spread of every book from its last
+// snapshot when the metrics are scraped, so they cost nothing otherwise.
+type marketCollector struct {
+	markets *MarketRegistry
+}
+
+func (c marketCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bookVolumeDesc
+	ch <- bookLevelsDesc
+	ch <- bookSpreadDesc
+}
+
+func (c marketCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, info := range c.markets.Markets() {
+		engine, ok := c.markets.Engine(info.Market)
+		if !ok {
+			continue
+		}
+		var (
+			snapshot = engine.Snapshot()
+			market   = string(info.Market)
+		)
+
+		ch <- prometheus.MustNewConstMetric(bookVolumeDesc, prometheus.GaugeValue, snapshot.BidTotalVolume, market, "bid")
+		ch <- prometheus.MustNewConstMetric(bookVolumeDesc, prometheus.GaugeValue, snapshot.AskTotalVolume, market, "ask")
+		ch <- prometheus.MustNewConstMetric(bookLevelsDesc, prometheus.GaugeValue, float64(len(snapshot.Bids)), market, "bid")
+		ch <- prometheus.MustNewConstMetric(bookLevelsDesc, prometheus.GaugeValue, float64(len(snapshot.Asks)), market, "ask")
+
+		bestBid, hasBid := snapshot.BestBid()
+		bestAsk, hasAsk := snapshot.BestAsk()
+		if hasBid && hasAsk {
+			ch <- prometheus.MustNewConstMetric(bookSpreadDesc, prometheus.GaugeValue, bestAsk.Price-bestBid.Price, market)
+		}
+	}
+}
+
+// metricsHandler serves the metrics of the process and of the markets of the
+// exchange in the Prometheus text format.
+func (ex *Exchange) metricsHandler() echo.HandlerFunc {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(marketCollector{markets: ex.markets})
+
+	return echo.WrapHandler(promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, registry}, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1, 2)
+	e := newRouter(ex)
+
+	placed := ordersTotal.WithLabelValues(string(token.MarketETHUSDT), string(LimitOrder), string(orderbook.EventPlaced))
+	marketPlaced := ordersTotal.WithLabelValues(string(token.MarketETHUSDT), string(MarketOrder), string(orderbook.EventPlaced))
+	rejected := ordersTotal.WithLabelValues(string(token.MarketETHUSDT), string(LimitOrder), string(orderbook.EventRejected))
+	var (
+		placedBefore       = testutil.ToFloat64(placed)
+		marketPlacedBefore = testutil.ToFloat64(marketPlaced)
+		rejectedBefore     = testutil.ToFloat64(rejected)
+	)
+
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 5, Price: 1_000, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Size: 3, Price: 1_050, Market: token.MarketETHUSDT})
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Size: 1, Market: token.MarketETHUSDT})
+	rec := doUserRequest(e, 1, http.MethodPost, "/order", PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 100, Price: 1_000, Market: token.MarketETHUSDT})
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	assert(t, testutil.ToFloat64(placed)-placedBefore, 2.0)
+	assert(t, testutil.ToFloat64(marketPlaced)-marketPlacedBefore, 1.0)
+	assert(t, testutil.ToFloat64(rejected)-rejectedBefore, 1.0)
+
+	rec = doRequest(e, http.MethodGet, "/metrics", nil)
+	assert(t, rec.Code, http.StatusOK)
+	body, _ := io.ReadAll(rec.Body)
+	for _, line := range []string{
+		`exchange_book_volume{market="ETH-USDT",side="bid"} 4`,
+		`exchange_book_volume{market="ETH-USDT",side="ask"} 3`,
+		`exchange_book_levels{market="BTC-USDT",side="bid"} 0`,
+		`exchange_book_spread{market="ETH-USDT"} 50`,
+		`exchange_orderbook_trades_total{market="ETH-USDT"}`,
+		`exchange_http_request_duration_seconds_count{method="POST",route="/order",status="400"}`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("metrics miss %s", line)
+		}
+	}
+	// books without orders on both sides have no spread
+	assert(t, strings.Contains(string(body), `exchange_book_spread{market="BTC-USDT"}`), false)
+}
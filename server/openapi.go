@@ -0,0 +1,40 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// openAPISpec describes the /v1 API, TestOpenAPISpec keeps it in line with
+// the routes.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func handleGetOpenAPI(c echo.Context) error {
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSON, openAPISpec)
+}
+
+// deprecated flags the responses of a legacy route as deprecated and links
+// them to the successor route, its :params are filled in from the request.
+func deprecated(successor string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			segments := strings.Split(successor, "/")
+			for i, segment := range segments {
+				if name, ok := strings.CutPrefix(segment, ":"); ok {
+					segments[i] = c.Param(name)
+				}
+			}
+
+			h := c.Response().Header()
+			h.Set("Deprecation", "true")
+			h.Add("Link", "<"+strings.Join(segments, "/")+`>; rel="successor-version"`)
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+type testOpenAPISpec struct {
+	OpenAPI string
+	Servers []struct {
+		URL string
+	}
+	Paths map[string]map[string]struct {
+		OperationID string
+		Parameters  []struct {
+			Name string
+			In   string
+		}
+	}
+	Components struct {
+		Schemas map[string]json.RawMessage
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	e := newRouter(newFundedExchange(t, 0, 0))
+
+	rec := doRequest(e, http.MethodGet, "/v1/openapi.json", nil)
+	assert(t, rec.Code, http.StatusOK)
+	spec := testOpenAPISpec{}
+	if err := json.NewDecoder(rec.Body).Decode(&spec); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, strings.HasPrefix(spec.OpenAPI, "3."), true)
+	assert(t, spec.Servers[0].URL, "/v1")
+
+	var (
+		params  = regexp.MustCompile(`:([A-Za-z]+)`)
+		routes  = []string{}
+		inSpec  = []string{}
+		methods = map[string]bool{
+			http.MethodGet:    true,
+			http.MethodPost:   true,
+			http.MethodPut:    true,
+			http.MethodDelete: true,
+		}
+	)
+	for _, r := range e.Routes() {
+		path, ok := strings.CutPrefix(r.Path, "/v1")
+		if !ok || !methods[r.Method] {
+			continue
+		}
+		routes = append(routes, r.Method+" "+params.ReplaceAllString(path, "{$1}"))
+	}
+
+	for path, ops := range spec.Paths {
+		for method, op := range ops {
+			inSpec = append(inSpec, strings.ToUpper(method)+" "+path)
+
+			// every {param} of the path is declared, and nothing else
+			declared := []string{}
+			for _, p := range op.Parameters {
+				if p.In == "path" {
+					declared = append(declared, p.Name)
+				}
+			}
+			want := []string{}
+			for _, m := range regexp.MustCompile(`{([A-Za-z]+)}`).FindAllStringSubmatch(path, -1) {
+				want = append(want, m[1])
+			}
+			sort.Strings(declared)
+			sort.Strings(want)
+			if len(want) > 0 || len(declared) > 0 {
+				assert(t, declared, want)
+			}
+			assert(t, op.OperationID != "", true)
+		}
+	}
+
+	sort.Strings(routes)
+	sort.Strings(inSpec)
+	assert(t, routes, inSpec)
+
+	// every schema reference resolves
+	refs := regexp.MustCompile(`"#/components/schemas/([A-Za-z]+)"`)
+	for _, m := range refs.FindAllStringSubmatch(string(openAPISpec), -1) {
+		if _, ok := spec.Components.Schemas[m[1]]; !ok {
+			t.Errorf("unknown schema %s", m[1])
+		}
+	}
+}
+
+func TestLegacyRoutes(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1)
+	e := newRouter(ex)
+	id := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 5, Price: 1_000, Market: token.MarketETHUSDT})
+
+	legacy := doRequest(e, http.MethodGet, "/book/ETH-USDT", nil)
+	assert(t, legacy.Code, http.StatusOK)
+	assert(t, legacy.Header().Get("Deprecation"), "true")
+	assert(t, legacy.Header().Get("Link"), `</v1/markets/ETH-USDT/book>; rel="successor-version"`)
+
+	v1 := doRequest(e, http.MethodGet, "/v1/markets/ETH-USDT/book", nil)
+	assert(t, v1.Code, http.StatusOK)
+	assert(t, v1.Header().Get("Deprecation"), "")
+	assert(t, v1.Body.String(), legacy.Body.String())
+
+	rec := doUserRequest(e, 1, http.MethodGet, "/order/id/1", nil)
+	assert(t, rec.Header().Get("Link"), `</v1/orders/1>; rel="successor-version"`)
+
+	rec = doUserRequest(e, 1, http.MethodGet, "/v1/users/1/orders", nil)
+	assert(t, rec.Code, http.StatusOK)
+	orders := GetOrdersResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&orders); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, orders.Bids[0].ID, id)
+
+	// the :userID routes only serve the authenticated user
+	rec = doUserRequest(e, 1, http.MethodGet, "/v1/users/2/balances", nil)
+	assert(t, rec.Code, http.StatusForbidden)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+// OrderIndex keeps the open orders of every user. It is not rebuilt from the
+// books, the orderbooks keep it up to date through their lifecycle events, so
+// every event costs O(1).
+type OrderIndex struct {
+	mu sync.RWMutex
+	// orders maps a user to the open orders of the user by order ID
+	orders map[int64]map[int64]*Order
+	// owners maps an open order ID to the user owning it
+	owners map[int64]int64
+}
+
+func NewOrderIndex() *OrderIndex {
+	return &OrderIndex{
+		orders: make(map[int64]map[int64]*Order),
+		owners: make(map[int64]int64),
+	}
+}
+
+// EventHandler returns the handler an orderbook of the market has to call.
+func (idx *OrderIndex) EventHandler(market token.Market) orderbook.EventHandler {
+	return func(e orderbook.Event) {
+		idx.HandleEvent(market, e)
+	}
+}
+
+func (idx *OrderIndex) HandleEvent(market token.Market, e orderbook.Event) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	switch {
+	case e.Type == orderbook.EventPlaced:
+		userOrders, ok := idx.orders[e.UserID]
+		if !ok {
+			userOrders = make(map[int64]*Order)
+			idx.orders[e.UserID] = userOrders
+		}
+		order := newOrderFromEvent(market, e)
+		userOrders[e.OrderID] = &order
+		idx.owners[e.OrderID] = e.UserID
+
+	case e.Done():
+		if userOrders, ok := idx.orders[e.UserID]; ok {
+			delete(userOrders, e.OrderID)
+			if len(userOrders) == 0 {
+				delete(idx.orders, e.UserID)
+			}
+		}
+		delete(idx.owners, e.OrderID)
+
+	case e.Type == orderbook.EventFilled:
+		// market orders are never placed in the book, so they are not found
+		if order, ok := idx.orders[e.UserID][e.OrderID]; ok {
+			applyEvent(order, e)
+		}
+	}
+}
+
+// UserOrders returns a copy of the open orders of the user.
+func (idx *OrderIndex) UserOrders(userID int64) []Order {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	orders := make([]Order, 0, len(idx.orders[userID]))
+	for _, order := range idx.orders[userID] {
+		orders = append(orders, *order)
+	}
+
+	return orders
+}
+
+// Get returns a copy of the open order with the given ID.
+func (idx *OrderIndex) Get(orderID int64) (Order, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	userID, ok := idx.owners[orderID]
+	if !ok {
+		return Order{}, false
+	}
+
+	return *idx.orders[userID][orderID], true
+}
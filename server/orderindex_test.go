@@ -0,0 +1,93 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+func newIndexedOrderbook(idx *OrderIndex, market token.Market) *orderbook.Orderbook {
+	ob := orderbook.NewOrderbook()
+	ob.OnEvent = idx.EventHandler(market)
+	return ob
+}
+
+func TestOrderIndexPartialFill(t *testing.T) {
+	idx := NewOrderIndex()
+	ob := newIndexedOrderbook(idx, token.MarketETHUSDT)
+
+	sellOrder := orderbook.NewOrder(false, 10, 1)
+	ob.PlaceLimitOrder(10_000, sellOrder)
+	assert(t, len(idx.UserOrders(1)), 1)
+
+	ob.PlaceMarketOrder(orderbook.NewOrder(true, 4, 2))
+	order, ok := idx.Get(sellOrder.ID)
+	assert(t, ok, true)
+	assert(t, order.Size, 6.0)
+	assert(t, order.Price, 10_000.0)
+	// the market order never rested in the book
+	assert(t, len(idx.UserOrders(2)), 0)
+
+	ob.PlaceMarketOrder(orderbook.NewOrder(true, 6, 2))
+	_, ok = idx.Get(sellOrder.ID)
+	assert(t, ok, false)
+	assert(t, len(idx.UserOrders(1)), 0)
+}
+
+func TestOrderIndexCancel(t *testing.T) {
+	idx := NewOrderIndex()
+	ob := newIndexedOrderbook(idx, token.MarketETHUSDT)
+
+	buyOrderA := orderbook.NewOrder(true, 5, 1)
+	buyOrderB := orderbook.NewOrder(true, 5, 1)
+	ob.PlaceLimitOrder(9_000, buyOrderA)
+	ob.PlaceLimitOrder(9_000, buyOrderB)
+	assert(t, len(idx.UserOrders(1)), 2)
+
+	ob.CancelOrder(buyOrderA)
+	orders := idx.UserOrders(1)
+	assert(t, len(orders), 1)
+	assert(t, orders[0].ID, buyOrderB.ID)
+
+	_, ok := idx.Get(buyOrderA.ID)
+	assert(t, ok, false)
+}
+
+func TestOrderIndexExpire(t *testing.T) {
+	idx := NewOrderIndex()
+	ob := newIndexedOrderbook(idx, token.MarketETHUSDT)
+
+	order := orderbook.NewOrder(false, 5, 1)
+	order.ExpiresAt = 100
+	ob.PlaceLimitOrder(10_000, order)
+
+	assert(t, len(ob.ExpireOrders(99)), 0)
+	assert(t, len(idx.UserOrders(1)), 1)
+
+	assert(t, len(ob.ExpireOrders(100)), 1)
+	assert(t, len(idx.UserOrders(1)), 0)
+}
+
+func TestOrderIndexMultipleMarkets(t *testing.T) {
+	idx := NewOrderIndex()
+	btc := token.MarketBTCUSDT
+	obETH := newIndexedOrderbook(idx, token.MarketETHUSDT)
+	obBTC := newIndexedOrderbook(idx, btc)
+
+	ethOrder := orderbook.NewOrder(false, 5, 1)
+	btcOrder := orderbook.NewOrder(false, 3, 1)
+	obETH.PlaceLimitOrder(2_000, ethOrder)
+	obBTC.PlaceLimitOrder(60_000, btcOrder)
+	assert(t, len(idx.UserOrders(1)), 2)
+
+	order, _ := idx.Get(btcOrder.ID)
+	assert(t, order.Market, btc)
+	order, _ = idx.Get(ethOrder.ID)
+	assert(t, order.Market, token.MarketETHUSDT)
+
+	obBTC.PlaceMarketOrder(orderbook.NewOrder(true, 3, 2))
+	orders := idx.UserOrders(1)
+	assert(t, len(orders), 1)
+	assert(t, orders[0].ID, ethOrder.ID)
+}
@@ -0,0 +1,448 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/db"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrOrderNotFound = errors.New("order not found")
+
+// OrderStore keeps every order the exchange accepted, open or closed, so
+// orders can still be looked up once they left the book.
+type OrderStore interface {
+	SaveOrder(order Order) error
+	// GetOrder returns ErrOrderNotFound for unknown IDs
+	GetOrder(id int64) (Order, error)
+	// GetUserOrders returns all the orders of the user, oldest first
+	GetUserOrders(userID int64) ([]Order, error)
+	// GetOpenOrders returns the limit orders of all users still resting in
+	// a book, oldest first
+	GetOpenOrders() ([]Order, error)
+	// LastOrderID returns the highest ID of the stored orders, 0 when there
+	// are none
+	LastOrderID() (int64, error)
+}
+
+// sortOrders sorts the orders oldest first, which is also their time
+// priority in the book.
+func sortOrders(orders []Order) {
+	sort.SliceStable(orders, func(i, j int) bool { return orders[i].Timestamp < orders[j].Timestamp })
+}
+
+// applyEvent updates the order with the state carried by the event.
+func applyEvent(order *Order, e orderbook.Event) {
+	order.Size = e.Size
+	order.Status = e.Status
+	order.FilledSize = e.FilledSize
+	order.AvgFillPrice = e.AvgFillPrice
+	order.UpdatedAt = e.Timestamp
+}
+
+// seedOrderIDs makes the IDs of new orders continue after the stored ones, it
+// has to be called before any order is placed.
+func (ex *Exchange) seedOrderIDs() error {
+	id, err := ex.orderStore.LastOrderID()
+	if err != nil {
+		return err
+	}
+	orderbook.SeedOrderIDs(id)
+
+	return nil
+}
+
+// newOrderFromEvent builds the order for an event of an unknown order,
+// usually the placement or rejection of a limit order.
+func newOrderFromEvent(market token.Market, e orderbook.Event) Order {
+	order := Order{
+		UserID:    e.UserID,
+		ID:        e.OrderID,
+		Bid:       e.Bid,
+		Timestamp: e.CreatedAt,
+		Market:    market,
+		Type:      LimitOrder,
+		ExpiresAt: e.ExpiresAt,
+	}
+	if e.Type == orderbook.EventPlaced || e.Type == orderbook.EventRejected {
+		order.Price = e.Price
+	}
+	applyEvent(&order, e)
+
+	return order
+}
+
+// MemoryOrderStore is an OrderStore that lives as long as the process.
+type MemoryOrderStore struct {
+	mu         sync.RWMutex
+	orders     map[int64]Order
+	userOrders map[int64][]int64
+	lastID     int64
+}
+
+func NewMemoryOrderStore() *MemoryOrderStore {
+	return &MemoryOrderStore{
+		orders:     make(map[int64]Order),
+		userOrders: make(map[int64][]int64),
+	}
+}
+
+func (s *MemoryOrderStore) SaveOrder(order Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[order.ID]; !ok {
+		s.userOrders[order.UserID] = append(s.userOrders[order.UserID], order.ID)
+	}
+	s.orders[order.ID] = order
+	s.lastID = max(s.lastID, order.ID)
+
+	return nil
+}
+
+func (s *MemoryOrderStore) GetOrder(id int64) (Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, ok := s.orders[id]
+	if !ok {
+		return Order{}, ErrOrderNotFound
+	}
+
+	return order, nil
+}
+
+func (s *MemoryOrderStore) GetUserOrders(userID int64) ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := make([]Order, len(s.userOrders[userID]))
+	for i, id := range s.userOrders[userID] {
+		orders[i] = s.orders[id]
+	}
+
+	return orders, nil
+}
+
+func (s *MemoryOrderStore) GetOpenOrders() ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := []Order{}
+	for _, order := range s.orders {
+		if order.Type == LimitOrder && !order.Status.Closed() {
+			orders = append(orders, order)
+		}
+	}
+	sortOrders(orders)
+
+	return orders, nil
+}
+
+func (s *MemoryOrderStore) LastOrderID() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.lastID, nil
+}
+
+// BufferedOrderStore keeps the open orders and the changes not yet written
+// in memory and writes them to its store in the background, so saving an
+// order never waits on the storage. Memory is the source of truth, reads fall
+// back to the store for the orders that are no longer kept in memory.
+type BufferedOrderStore struct {
+	store OrderStore
+
+	mu sync.Mutex
+	// orders are the open orders and the closed ones not yet written
+	orders map[int64]Order
+	dirty  map[int64]bool
+	wake   chan struct{}
+	// writeMu orders the writes of Run and Flush
+	writeMu sync.Mutex
+}
+
+func NewBufferedOrderStore(store OrderStore) *BufferedOrderStore {
+	return &BufferedOrderStore{
+		store:  store,
+		orders: make(map[int64]Order),
+		dirty:  make(map[int64]bool),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func (s *BufferedOrderStore) SaveOrder(order Order) error {
+	s.mu.Lock()
+	s.orders[order.ID] = order
+	s.dirty[order.ID] = true
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (s *BufferedOrderStore) GetOrder(id int64) (Order, error) {
+	if order, ok := s.cachedOrder(id); ok {
+		return order, nil
+	}
+	return s.store.GetOrder(id)
+}
+
+// cachedOrder returns the order when it is kept in memory, which every open
+// order is.
+func (s *BufferedOrderStore) cachedOrder(id int64) (Order, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[id]
+	return order, ok
+}
+
+func (s *BufferedOrderStore) GetUserOrders(userID int64) ([]Order, error) {
+	stored, err := s.store.GetUserOrders(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.merge(stored, func(order Order) bool { return order.UserID == userID }), nil
+}
+
+// GetOpenOrders also keeps the open orders of the store in memory, they are
+// loaded once on start to be restored.
+func (s *BufferedOrderStore) GetOpenOrders() ([]Order, error) {
+	stored, err := s.store.GetOpenOrders()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	for _, order := range stored {
+		if _, ok := s.orders[order.ID]; !ok {
+			s.orders[order.ID] = order
+		}
+	}
+	s.mu.Unlock()
+
+	orders := []Order{}
+	for _, order := range s.merge(stored, func(Order) bool { return true }) {
+		if order.Type == LimitOrder && !order.Status.Closed() {
+			orders = append(orders, order)
+		}
+	}
+
+	return orders, nil
+}
+
+// merge replaces the stored orders with the ones in memory and adds the
+// orders in memory selected by keep that were not stored yet.
+func (s *BufferedOrderStore) merge(stored []Order, keep func(Order) bool) []Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[int64]bool, len(stored))
+	orders := make([]Order, 0, len(stored))
+	for _, order := range stored {
+		if cached, ok := s.orders[order.ID]; ok {
+			order = cached
+		}
+		seen[order.ID] = true
+		orders = append(orders, order)
+	}
+	for id, order := range s.orders {
+		if !seen[id] && keep(order) {
+			orders = append(orders, order)
+		}
+	}
+	sortOrders(orders)
+
+	return orders
+}
+
+func (s *BufferedOrderStore) LastOrderID() (int64, error) {
+	id, err := s.store.LastOrderID()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for orderID := range s.orders {
+		id = max(id, orderID)
+	}
+	return id, nil
+}
+
+// Run writes the saved orders to the store until ctx is done, the writes
+// that failed are retried every second.
+func (s *BufferedOrderStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+		if err := s.write(); err != nil {
+			logrus.WithError(err).Error("failed to write orders")
+		}
+	}
+}
+
+// Flush writes the orders saved since the last write, it is the last step
+// before the store goes away. It retries until ctx is done.
+func (s *BufferedOrderStore) Flush(ctx context.Context) error {
+	for {
+		err := s.write()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// write writes the orders saved since the last write. Closed orders are only
+// kept in memory until they are written.
+func (s *BufferedOrderStore) write() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	orders := make([]Order, 0, len(s.dirty))
+	for id := range s.dirty {
+		orders = append(orders, s.orders[id])
+	}
+	s.dirty = make(map[int64]bool)
+	s.mu.Unlock()
+
+	var errs []error
+	for _, order := range orders {
+		err := s.store.SaveOrder(order)
+
+		s.mu.Lock()
+		switch {
+		case err != nil:
+			// a newer save of the order is written instead
+			s.dirty[order.ID] = true
+			errs = append(errs, fmt.Errorf("order %d: %w", order.ID, err))
+		case order.Status.Closed() && !s.dirty[order.ID]:
+			delete(s.orders, order.ID)
+		}
+		s.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// MongoOrderStore is an OrderStore backed by the orders collection, the db
+// has to be initialized with db.InitializeMongo first.
+type MongoOrderStore struct{}
+
+func NewMongoOrderStore() *MongoOrderStore {
+	return &MongoOrderStore{}
+}
+
+func (s *MongoOrderStore) SaveOrder(order Order) error {
+	orderDB := db.Order{
+		ID:           order.ID,
+		UserID:       order.UserID,
+		Market:       string(order.Market),
+		Type:         string(order.Type),
+		Bid:          order.Bid,
+		Price:        order.Price,
+		Size:         order.Size,
+		Status:       string(order.Status),
+		FilledSize:   order.FilledSize,
+		AvgFillPrice: order.AvgFillPrice,
+		Timestamp:    order.Timestamp,
+		UpdatedAt:    order.UpdatedAt,
+		ExpiresAt:    order.ExpiresAt,
+	}
+
+	return orderDB.UpsertOrder()
+}
+
+func (s *MongoOrderStore) GetOrder(id int64) (Order, error) {
+	orderDB := db.Order{
+		ID: id,
+	}
+	if err := orderDB.GetOrderByID(); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return Order{}, ErrOrderNotFound
+		}
+		return Order{}, err
+	}
+
+	return newOrderFromDB(orderDB), nil
+}
+
+func (s *MongoOrderStore) GetUserOrders(userID int64) ([]Order, error) {
+	ordersDB, err := db.GetOrdersByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	orders := make([]Order, len(ordersDB))
+	for i, orderDB := range ordersDB {
+		orders[i] = newOrderFromDB(orderDB)
+	}
+	sortOrders(orders)
+
+	return orders, nil
+}
+
+func (s *MongoOrderStore) GetOpenOrders() ([]Order, error) {
+	ordersDB, err := db.GetOrdersByStatus(string(LimitOrder), string(orderbook.StatusNew), string(orderbook.StatusPartiallyFilled))
+	if err != nil {
+		return nil, err
+	}
+
+	orders := make([]Order, len(ordersDB))
+	for i, orderDB := range ordersDB {
+		orders[i] = newOrderFromDB(orderDB)
+	}
+	sortOrders(orders)
+
+	return orders, nil
+}
+
+func (s *MongoOrderStore) LastOrderID() (int64, error) {
+	return db.GetLastOrderID()
+}
+
+func newOrderFromDB(o db.Order) Order {
+	return Order{
+		UserID:       o.UserID,
+		ID:           o.ID,
+		Price:        o.Price,
+		Size:         o.Size,
+		Bid:          o.Bid,
+		Timestamp:    o.Timestamp,
+		Market:       token.Market(o.Market),
+		Type:         OrderType(o.Type),
+		Status:       orderbook.OrderStatus(o.Status),
+		FilledSize:   o.FilledSize,
+		AvgFillPrice: o.AvgFillPrice,
+		UpdatedAt:    o.UpdatedAt,
+		ExpiresAt:    o.ExpiresAt,
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+func placeTestOrder(t *testing.T, ex *Exchange, req PlaceOrderRequest) int64 {
+	rec := doUserRequest(newRouter(ex), req.UserID, http.MethodPost, "/order", req)
+	resp := PlaceOrderResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.OrderID
+}
+
+func getTestOrder(t *testing.T, ex *Exchange, id int64) Order {
+	// only the owner of an order can read it
+	owner, err := ex.orderStore.GetOrder(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := doUserRequest(newRouter(ex), owner.UserID, http.MethodGet, fmt.Sprintf("/order/id/%d", id), nil)
+	assert(t, rec.Code, http.StatusOK)
+
+	order := Order{}
+	if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	ex, e := newTestExchange(t, 1, 2)
+
+	askID := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 10, Price: 1_000, Market: token.MarketETHUSDT})
+	bidID := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 10, Price: 900, Market: token.MarketETHUSDT})
+	assert(t, getTestOrder(t, ex, askID).Status, orderbook.StatusNew)
+
+	marketA := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 4, Market: token.MarketETHUSDT})
+	ask := getTestOrder(t, ex, askID)
+	assert(t, ask.Status, orderbook.StatusPartiallyFilled)
+	assert(t, ask.FilledSize, 4.0)
+	assert(t, ask.Size, 6.0)
+	assert(t, ask.AvgFillPrice, 1_000.0)
+
+	market := getTestOrder(t, ex, marketA)
+	assert(t, market.Type, MarketOrder)
+	assert(t, market.Status, orderbook.StatusFilled)
+	assert(t, market.FilledSize, 4.0)
+
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 6, Market: token.MarketETHUSDT})
+	assert(t, getTestOrder(t, ex, askID).Status, orderbook.StatusFilled)
+
+	// the book is empty now
+	rec := doUserRequest(e, 2, http.MethodPost, "/order", PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 1, Market: token.MarketETHUSDT})
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	doUserRequest(e, 1, http.MethodDelete, fmt.Sprintf("/order/%d", bidID), nil)
+	assert(t, getTestOrder(t, ex, bidID).Status, orderbook.StatusCancelled)
+
+	// the filled ask and the cancelled bid are gone from the open orders
+	rec = doUserRequest(e, 1, http.MethodGet, "/order/1", nil)
+	resp := GetOrdersResponse{}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	assert(t, len(resp.Asks)+len(resp.Bids), 0)
+
+	rec = doUserRequest(e, 1, http.MethodGet, "/order/1?status=closed", nil)
+	resp = GetOrdersResponse{}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	assert(t, len(resp.Asks), 1)
+	assert(t, len(resp.Bids), 1)
+	assert(t, resp.Asks[0].ID, askID)
+
+	rec = doUserRequest(e, 2, http.MethodGet, "/order/2?status=REJECTED", nil)
+	resp = GetOrdersResponse{}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	assert(t, len(resp.Bids), 1)
+	assert(t, resp.Bids[0].Status, orderbook.StatusRejected)
+	assert(t, resp.Bids[0].Size, 1.0)
+
+	rec = doUserRequest(e, 1, http.MethodGet, fmt.Sprintf("/order/id/%d", bidID+1_000), nil)
+	assert(t, rec.Code, http.StatusNotFound)
+}
+
+// failingOrderStore fails the saves while fail is set.
+type failingOrderStore struct {
+	*MemoryOrderStore
+	fail atomic.Bool
+}
+
+func (s *failingOrderStore) SaveOrder(order Order) error {
+	if s.fail.Load() {
+		return errors.New("storage down")
+	}
+	return s.MemoryOrderStore.SaveOrder(order)
+}
+
+func TestBufferedOrderStore(t *testing.T) {
+	ex := newFundedExchange(t, 10, 10_000, 1)
+	backing := &failingOrderStore{MemoryOrderStore: NewMemoryOrderStore()}
+	backing.fail.Store(true)
+	store := NewBufferedOrderStore(backing)
+	ex.SetOrderStore(store)
+
+	// orders are placed and read back while the storage is down
+	id := placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 5, Price: 1_000, Market: token.MarketETHUSDT})
+	assert(t, getTestOrder(t, ex, id).Status, orderbook.StatusNew)
+	doUserRequest(newRouter(ex), 1, http.MethodDelete, fmt.Sprintf("/order/%d", id), nil)
+	assert(t, getTestOrder(t, ex, id).Status, orderbook.StatusCancelled)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert(t, store.Flush(ctx) != nil, true)
+	_, err := backing.GetOrder(id)
+	assert(t, err, ErrOrderNotFound)
+
+	// the flush writes the last state, the closed order then is only read
+	// from the storage
+	backing.fail.Store(false)
+	assert(t, store.Flush(context.Background()), nil)
+	stored, err := backing.GetOrder(id)
+	assert(t, err, nil)
+	assert(t, stored.Status, orderbook.StatusCancelled)
+	_, cached := store.cachedOrder(id)
+	assert(t, cached, false)
+	orders, _ := store.GetUserOrders(1)
+	assert(t, len(orders), 1)
+	assert(t, getTestOrder(t, ex, id).Status, orderbook.StatusCancelled)
+}
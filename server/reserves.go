@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/reserves"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrNoReserves = errors.New("no proof of reserves published yet")
+
+// ReservesReport is a published proof of reserves. The root commits to what
+// every user is owed, the holdings are read from the addresses of the
+// exchange on chain. Assets without a chain have liabilities only.
+type ReservesReport struct {
+	ID        int64
+	Timestamp int64
+	// Root sums up the liabilities in units of reserves.Scale
+	Root        reserves.Node
+	Users       int
+	Liabilities map[token.Asset]float64
+	// Block is the block the holdings were read at, 0 without a chain
+	Block     uint64 `json:",omitempty"`
+	Holdings  map[token.Asset]float64
+	Addresses []ReserveAddress
+
+	tree *reserves.Tree
+}
+
+// ReserveAddress is an address of the exchange holding funds.
+type ReserveAddress struct {
+	Asset   token.Asset
+	Address string
+	Balance float64
+}
+
+// runReserves publishes a proof of reserves right away and then every
+// interval until ctx is done.
+func (ex *Exchange) runReserves(ctx context.Context, interval time.Duration) {
+	publish := func() {
+		if _, err := ex.publishReserves(); err != nil {
+			logrus.WithError(err).Error("failed to publish the proof of reserves")
+		}
+	}
+
+	publish()
+	runEvery(ctx, interval, publish)
+}
+
+// publishReserves builds the tree of the liabilities in the ledger, reads
+// the holdings from the chain and publishes both as the latest proof of
+// reserves.
+func (ex *Exchange) publishReserves() (*ReservesReport, error) {
+	liabilities := ex.Ledger.Liabilities()
+	accounts := make([]reserves.Account, 0, len(liabilities))
+	for userID, assets := range liabilities {
+		balances := make(reserves.Balances, len(assets))
+		for asset, amount := range assets {
+			balances[asset] = reserves.ToUnits(amount)
+		}
+		accounts = append(accounts, reserves.Account{UserID: userID, Balances: balances})
+	}
+
+	tree, err := reserves.Build(accounts)
+	if err != nil {
+		return nil, err
+	}
+	report := &ReservesReport{
+		Timestamp:   time.Now().UnixNano(),
+		Root:        tree.Root(),
+		Users:       len(accounts),
+		Liabilities: make(map[token.Asset]float64),
+		Holdings:    make(map[token.Asset]float64),
+		Addresses:   []ReserveAddress{},
+		tree:        tree,
+	}
+	for asset, units := range report.Root.Sums {
+		report.Liabilities[asset] = reserves.FromUnits(units)
+	}
+	if ex.chain != nil {
+		if err := ex.attestHoldings(report); err != nil {
+			return nil, err
+		}
+	}
+
+	ex.reservesMu.Lock()
+	ex.reservesID++
+	report.ID = ex.reservesID
+	ex.reserves = report
+	ex.reservesMu.Unlock()
+
+	ex.writeAudit(audit.Entry{
+		Actor:  audit.ActorSystem,
+		Action: audit.ReservesPublished,
+	}, map[string]any{
+		"report": report.ID,
+		"root":   report.Root.Hash,
+		"block":  report.Block,
+	})
+	logrus.WithFields(logrus.Fields{
+		"report": report.ID,
+		"root":   report.Root.Hash,
+		"users":  report.Users,
+	}).Info("proof of reserves published")
+
+	return report, nil
+}
+
+// seedReservesID makes the IDs of new reports continue after the ones
+// recorded in the audit log, so an ID never names two roots. It has to be
+// called before the first report is published.
+func (ex *Exchange) seedReservesID() {
+	var last int64
+	for _, entry := range ex.Audit.Search(audit.Filter{Action: audit.ReservesPublished}) {
+		id, err := strconv.ParseInt(entry.Details["report"], 10, 64)
+		if err != nil {
+			logrus.WithError(err).WithField("entry", entry.ID).Warn("audit entry names no report")
+			continue
+		}
+		last = max(last, id)
+	}
+
+	ex.reservesMu.Lock()
+	ex.reservesID = max(ex.reservesID, last)
+	ex.reservesMu.Unlock()
+}
+
+// attestHoldings reads the ETH of the hot wallet, the cold address and the
+// deposit addresses, all at the same block.
+func (ex *Exchange) attestHoldings(report *ReservesReport) error {
+	eth := ex.chain.Eth
+	block, err := eth.BlockNumber()
+	if err != nil {
+		return err
+	}
+
+	addresses := []common.Address{crypto.PubkeyToAddress(ex.PrivateKey.PublicKey)}
+	ex.sweepMu.Lock()
+	cold := ex.sweepPolicy.ColdAddress
+	ex.sweepMu.Unlock()
+	if common.IsHexAddress(cold) {
+		addresses = append(addresses, common.HexToAddress(cold))
+	}
+	deposits := []common.Address{}
+	for address := range ex.depositAddresses() {
+		deposits = append(deposits, address)
+	}
+	slices.SortFunc(deposits, func(a, b common.Address) int { return strings.Compare(a.Hex(), b.Hex()) })
+	addresses = append(addresses, deposits...)
+
+	total := new(big.Int)
+	for _, address := range addresses {
+		balance, err := eth.BalanceAtBlock(address, block)
+		if err != nil {
+			return err
+		}
+		if balance.Sign() == 0 {
+			continue
+		}
+		total.Add(total, balance)
+		report.Addresses = append(report.Addresses, ReserveAddress{
+			Asset:   token.AssetETH,
+			Address: address.Hex(),
+			Balance: eth.BigIntToFloat(balance),
+		})
+	}
+
+	report.Block = block
+	report.Holdings[token.AssetETH] = eth.BigIntToFloat(total)
+	return nil
+}
+
+// latestReserves returns the proof of reserves published last.
+func (ex *Exchange) latestReserves() (*ReservesReport, error) {
+	ex.reservesMu.RLock()
+	defer ex.reservesMu.RUnlock()
+
+	if ex.reserves == nil {
+		return nil, ErrNoReserves
+	}
+	return ex.reserves, nil
+}
+
+func (ex *Exchange) handleGetReserves(c echo.Context) error {
+	report, err := ex.latestReserves()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// handleGetReservesProof returns the proof that the balances of the user are
+// part of the latest proof of reserves, which reserves.Verify checks.
+func (ex *Exchange) handleGetReservesProof(c echo.Context) error {
+	report, err := ex.latestReserves()
+	if err != nil {
+		return err
+	}
+
+	proof, err := report.tree.Proof(authUserID(c))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, proof)
+}
+
+// handlePublishReserves publishes a proof of reserves without waiting for
+// the next one.
+func (ex *Exchange) handlePublishReserves(c echo.Context) error {
+	report, err := ex.publishReserves()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
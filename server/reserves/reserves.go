@@ -0,0 +1,322 @@
+// Package reserves proves the liabilities of the exchange with a Merkle sum
+// tree. Every leaf commits to the balances of one user under a salted hash
+// of its ID, every node to the hashes and the balance sums of its children.
+// The root sums up to the total liabilities, and a user checks with the
+// path from its leaf to the root that its balances are part of them.
+package reserves
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+// Scale is the number of units of an asset, the balances are committed to
+// as integers so that the sums add up exactly.
+const Scale = 1e8
+
+var (
+	ErrInvalidProof = errors.New("invalid proof of reserves")
+	ErrUserNotFound = errors.New("user not in the tree")
+)
+
+// Balances are the units of every asset.
+type Balances map[token.Asset]int64
+
+// ToUnits converts an amount of an asset to its units.
+func ToUnits(amount float64) int64 {
+	return int64(math.Round(amount * Scale))
+}
+
+// FromUnits converts units of an asset back to an amount.
+func FromUnits(units int64) float64 {
+	return float64(units) / Scale
+}
+
+// encode writes the balances sorted by asset, which fixes what is hashed.
+func (b Balances) encode() string {
+	var sb strings.Builder
+	for _, asset := range b.Assets() {
+		sb.WriteString(string(asset) + "=" + strconv.FormatInt(b[asset], 10) + ";")
+	}
+	return sb.String()
+}
+
+// Assets returns the assets of the balances, sorted.
+func (b Balances) Assets() []token.Asset {
+	assets := make([]token.Asset, 0, len(b))
+	for asset := range b {
+		assets = append(assets, asset)
+	}
+	slices.Sort(assets)
+	return assets
+}
+
+// add sums up the balances of two nodes, which have to hold the same assets
+// and can not be negative.
+func add(a, b Balances) (Balances, error) {
+	if len(a) != len(b) {
+		return nil, fmt.Errorf("%w: nodes hold different assets", ErrInvalidProof)
+	}
+	sum := make(Balances, len(a))
+	for asset, units := range a {
+		other, ok := b[asset]
+		if !ok {
+			return nil, fmt.Errorf("%w: nodes hold different assets", ErrInvalidProof)
+		}
+		if units < 0 || other < 0 {
+			return nil, fmt.Errorf("%w: negative %s balance", ErrInvalidProof, asset)
+		}
+		sum[asset] = units + other
+	}
+	return sum, nil
+}
+
+func hash(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+// UserHash hides the user ID of a leaf. The nonce is handed to the user
+// with its proof only, without it the IDs can not be guessed from the
+// hashes.
+func UserHash(userID int64, nonce string) string {
+	return hash("user", strconv.FormatInt(userID, 10), nonce)
+}
+
+// Node is a node of the tree, Sums holds the balances of all the leaves
+// under it.
+type Node struct {
+	Hash string
+	Sums Balances
+}
+
+func (n Node) clone() Node {
+	return Node{Hash: n.Hash, Sums: maps.Clone(n.Sums)}
+}
+
+func leaf(userHash string, balances Balances) Node {
+	return Node{
+		Hash: hash("leaf", userHash, balances.encode()),
+		Sums: balances,
+	}
+}
+
+// parent hashes the sums of both children next to their hashes, so a node
+// can not claim other sums than its children hold.
+func parent(left, right Node) (Node, error) {
+	sums, err := add(left.Sums, right.Sums)
+	if err != nil {
+		return Node{}, err
+	}
+	return Node{
+		Hash: hash("node", left.Hash, left.Sums.encode(), right.Hash, right.Sums.encode()),
+		Sums: sums,
+	}, nil
+}
+
+// Account is what a user is owed, the leaf of the user in the tree.
+type Account struct {
+	UserID   int64
+	Balances Balances
+}
+
+// Tree is a Merkle sum tree over the accounts of the users.
+type Tree struct {
+	// levels go from the leaves up to the root
+	levels [][]Node
+	nonces map[int64]string
+	// index maps a user to its leaf
+	index map[int64]int
+}
+
+// Build builds the tree of the accounts. Every leaf commits to all the
+// assets of the tree, the ones a user does not hold as 0. The leaves are
+// ordered by their hash, which does not tell anything about the users.
+func Build(accounts []Account) (*Tree, error) {
+	assets := make(map[token.Asset]bool)
+	for _, a := range accounts {
+		for asset, units := range a.Balances {
+			if units < 0 {
+				return nil, fmt.Errorf("user %d has a negative %s balance", a.UserID, asset)
+			}
+			assets[asset] = true
+		}
+	}
+	zero := make(Balances, len(assets))
+	for asset := range assets {
+		zero[asset] = 0
+	}
+
+	t := &Tree{
+		nonces: make(map[int64]string, len(accounts)),
+		index:  make(map[int64]int, len(accounts)),
+	}
+	type entry struct {
+		userID int64
+		node   Node
+	}
+	entries := make([]entry, 0, len(accounts))
+	for _, a := range accounts {
+		if _, ok := t.nonces[a.UserID]; ok {
+			return nil, fmt.Errorf("user %d is in the tree twice", a.UserID)
+		}
+		nonce, err := newNonce()
+		if err != nil {
+			return nil, err
+		}
+		t.nonces[a.UserID] = nonce
+
+		balances := make(Balances, len(assets))
+		for asset := range assets {
+			balances[asset] = a.Balances[asset]
+		}
+		entries = append(entries, entry{a.UserID, leaf(UserHash(a.UserID, nonce), balances)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].node.Hash < entries[j].node.Hash })
+
+	level := make([]Node, len(entries))
+	for i, e := range entries {
+		level[i] = e.node
+		t.index[e.userID] = i
+	}
+	if len(level) == 0 {
+		level = append(level, padding(zero))
+	}
+
+	for {
+		t.levels = append(t.levels, level)
+		if len(level) == 1 {
+			return t, nil
+		}
+		if len(level)%2 == 1 {
+			level = append(level, padding(zero))
+			t.levels[len(t.levels)-1] = level
+		}
+
+		next := make([]Node, len(level)/2)
+		for i := range next {
+			node, err := parent(level[2*i], level[2*i+1])
+			if err != nil {
+				return nil, err
+			}
+			next[i] = node
+		}
+		level = next
+	}
+}
+
+// padding fills up the levels with an odd number of nodes.
+func padding(zero Balances) Node {
+	return Node{Hash: hash("padding"), Sums: zero}
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Root is the root of the tree, its sums are the total liabilities.
+func (t *Tree) Root() Node {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Step is a step of the path from a leaf to the root.
+type Step struct {
+	Sibling Node
+	// Left tells that the sibling is the left child of the parent
+	Left bool
+}
+
+// Proof shows that the balances of a user are part of the tree with the
+// root.
+type Proof struct {
+	Root     Node
+	UserID   int64
+	Nonce    string
+	Balances Balances
+	Path     []Step
+}
+
+// Proof returns the inclusion proof of the user, ErrUserNotFound when the
+// user has no leaf.
+func (t *Tree) Proof(userID int64) (Proof, error) {
+	i, ok := t.index[userID]
+	if !ok {
+		return Proof{}, fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+	}
+
+	// the proof gets copies, changing it must not change the tree
+	p := Proof{
+		Root:     t.Root().clone(),
+		UserID:   userID,
+		Nonce:    t.nonces[userID],
+		Balances: maps.Clone(t.levels[0][i].Sums),
+	}
+	for _, level := range t.levels[:len(t.levels)-1] {
+		p.Path = append(p.Path, Step{Sibling: level[i^1].clone(), Left: i%2 == 1})
+		i /= 2
+	}
+	return p, nil
+}
+
+// Verify recomputes the root from the balances of the user and the path.
+// Every node on the way has to hold the same assets and no negative sums,
+// a negative sibling could hide the balances of the user from the total.
+func Verify(p Proof) error {
+	node := leaf(UserHash(p.UserID, p.Nonce), p.Balances)
+	for asset, units := range p.Balances {
+		if units < 0 {
+			return fmt.Errorf("%w: negative %s balance", ErrInvalidProof, asset)
+		}
+	}
+
+	for _, step := range p.Path {
+		var err error
+		if step.Left {
+			node, err = parent(step.Sibling, node)
+		} else {
+			node, err = parent(node, step.Sibling)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if node.Hash != p.Root.Hash {
+		return fmt.Errorf("%w: path leads to root %s, not %s", ErrInvalidProof, node.Hash, p.Root.Hash)
+	}
+	if node.Sums.encode() != p.Root.Sums.encode() {
+		return fmt.Errorf("%w: root sums do not match", ErrInvalidProof)
+	}
+	return nil
+}
+
+// ReadProof reads a proof saved as JSON.
+func ReadProof(path string) (Proof, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Proof{}, err
+	}
+
+	var p Proof
+	if err := json.Unmarshal(b, &p); err != nil {
+		return Proof{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,99 @@
+package reserves
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func testAccounts() []Account {
+	return []Account{
+		{UserID: 1, Balances: Balances{token.AssetETH: ToUnits(1.5)}},
+		{UserID: 2, Balances: Balances{token.AssetETH: ToUnits(2), token.AssetUSDT: ToUnits(1_000)}},
+		{UserID: 3, Balances: Balances{token.AssetUSDT: ToUnits(0.25)}},
+		{UserID: 4, Balances: Balances{token.AssetBTC: ToUnits(0.1)}},
+		{UserID: 5, Balances: Balances{token.AssetETH: 1}},
+	}
+}
+
+func TestTree(t *testing.T) {
+	tree, err := Build(testAccounts())
+	assert(t, err, nil)
+	assert(t, tree.Root().Sums, Balances{
+		token.AssetETH:  ToUnits(3.5) + 1,
+		token.AssetBTC:  ToUnits(0.1),
+		token.AssetUSDT: ToUnits(1_000.25),
+	})
+
+	for _, a := range testAccounts() {
+		p, err := tree.Proof(a.UserID)
+		assert(t, err, nil)
+		assert(t, len(p.Path), 3)
+		assert(t, p.Balances[token.AssetETH], a.Balances[token.AssetETH])
+		assert(t, Verify(p), nil)
+	}
+
+	_, err = tree.Proof(6)
+	assert(t, errors.Is(err, ErrUserNotFound), true)
+
+	// a tree of one user is its leaf
+	tree, _ = Build(testAccounts()[:1])
+	p, _ := tree.Proof(1)
+	assert(t, len(p.Path), 0)
+	assert(t, Verify(p), nil)
+
+	_, err = Build([]Account{{UserID: 1, Balances: Balances{token.AssetETH: -1}}})
+	assert(t, err != nil, true)
+}
+
+func TestVerifyRejectsTamperedProofs(t *testing.T) {
+	tree, _ := Build(testAccounts())
+
+	for name, tamper := range map[string]func(p *Proof){
+		"balance":   func(p *Proof) { p.Balances[token.AssetETH]-- },
+		"user":      func(p *Proof) { p.UserID = 3 },
+		"nonce":     func(p *Proof) { p.Nonce = "00" },
+		"root sums": func(p *Proof) { p.Root.Sums[token.AssetETH]++ },
+		"sibling":   func(p *Proof) { p.Path[0].Sibling.Sums[token.AssetUSDT]++ },
+		"side":      func(p *Proof) { p.Path[1].Left = !p.Path[1].Left },
+		// a negative sibling could take the balance of the user out of the
+		// total
+		"negative": func(p *Proof) {
+			p.Path[0].Sibling.Sums[token.AssetETH] = -p.Balances[token.AssetETH]
+		},
+	} {
+		p, _ := tree.Proof(2)
+		tamper(&p)
+		if err := Verify(p); !errors.Is(err, ErrInvalidProof) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestReadProof(t *testing.T) {
+	tree, _ := Build(testAccounts())
+	p, _ := tree.Proof(4)
+
+	b, err := json.Marshal(p)
+	assert(t, err, nil)
+	path := filepath.Join(t.TempDir(), "proof.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadProof(path)
+	assert(t, err, nil)
+	assert(t, read, p)
+	assert(t, Verify(read), nil)
+}
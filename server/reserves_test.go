@@ -0,0 +1,87 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/config"
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/reserves"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestProofOfReserves(t *testing.T) {
+	ex := newFundedExchange(t, 10, 1_000, 1, 2)
+	ex.SetAdminToken(testAdminToken)
+	newTestChain(t, ex, 100)
+	ex.Users[3] = &User{ID: 3}
+	ex.APIKeys.add(testAPIKey(3))
+	e := newRouter(ex)
+
+	rec := doRequest(e, http.MethodGet, "/v1/reserves", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	assert(t, decodeAPIError(t, rec).Code, CodeReservesNotFound)
+
+	// held funds are owed to the user as well
+	placeTestOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 1, Price: 100, Market: token.MarketETHUSDT})
+
+	rec = doAdminRequest(e, http.MethodPost, "/v1/admin/reserves", nil)
+	assert(t, rec.Code, http.StatusOK)
+	rec = doRequest(e, http.MethodGet, "/v1/reserves", nil)
+	assert(t, rec.Code, http.StatusOK)
+	report := decodeTestResponse[ReservesReport](t, rec)
+	assert(t, report.ID, int64(1))
+	assert(t, report.Users, 2)
+	assert(t, report.Liabilities, map[token.Asset]float64{token.AssetETH: 20, token.AssetUSDT: 2_000})
+	assert(t, report.Holdings, map[token.Asset]float64{token.AssetETH: 100})
+	assert(t, report.Addresses, []ReserveAddress{{
+		Asset:   token.AssetETH,
+		Address: crypto.PubkeyToAddress(ex.PrivateKey.PublicKey).Hex(),
+		Balance: 100,
+	}})
+
+	rec = doUserRequest(e, 1, http.MethodGet, "/v1/users/me/reserves-proof", nil)
+	assert(t, rec.Code, http.StatusOK)
+	proof := decodeTestResponse[reserves.Proof](t, rec)
+	assert(t, proof.Root, report.Root)
+	assert(t, proof.Balances, reserves.Balances{token.AssetETH: reserves.ToUnits(10), token.AssetUSDT: reserves.ToUnits(1_000)})
+	assert(t, reserves.Verify(proof), nil)
+
+	// users owed nothing are not in the tree
+	rec = doUserRequest(e, 3, http.MethodGet, "/v1/users/me/reserves-proof", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	assert(t, decodeAPIError(t, rec).Code, CodeProofNotFound)
+
+	entries := ex.Audit.Search(audit.Filter{Action: audit.ReservesPublished})
+	assert(t, len(entries), 1)
+	assert(t, entries[0].Details["root"], report.Root.Hash)
+}
+
+func TestReservesIDsContinueAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	start := func() *Exchange {
+		ex := newFundedExchange(t, 10, 0, 1)
+		store, err := openAuditStore(config.Audit{Backend: config.AuditFile, Path: path})
+		assert(t, err, nil)
+		if ex.Audit, err = audit.Open(store); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.(io.Closer).Close() })
+		ex.seedReservesID()
+		return ex
+	}
+
+	ex := start()
+	for range 2 {
+		_, err := ex.publishReserves()
+		assert(t, err, nil)
+	}
+
+	// the audit log names the reports published before the restart
+	report, err := start().publishReserves()
+	assert(t, err, nil)
+	assert(t, report.ID, int64(3))
+}
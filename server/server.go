@@ -1,31 +1,47 @@
 package server
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net"
+	"net/http"
+	"time"
 
+	"github.com/anakinrm/crypto-exchange/config"
+	"github.com/anakinrm/crypto-exchange/orderbook"
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/cryptoClient"
+	"github.com/anakinrm/crypto-exchange/server/db"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
 	"github.com/anakinrm/crypto-exchange/server/token"
 
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/sirupsen/logrus"
 )
 
 const (
 	MarketOrder OrderType = "MARKET"
 	LimitOrder  OrderType = "LIMIT"
-
-	exchangePrivateKey = "6b93be18f885aa07271e5be6f9cf2db740a63a1b73a24778f7e597e4a1cbfbe9"
 )
 
 type (
 	OrderType string
 
 	PlaceOrderRequest struct {
+		// UserID is ignored, orders are placed for the owner of the API key
 		UserID int64
 		Type   OrderType // limit or market
 		Bid    bool
 		Size   float64
 		Price  float64
 		Market token.Market
+		// ExpiresAt is the unix nano time a limit order expires at,
+		// 0 keeps it until it is filled or cancelled
+		ExpiresAt int64
 	}
 
 	Order struct {
@@ -35,6 +51,16 @@ type (
 		Size      float64
 		Bid       bool
 		Timestamp int64
+		Market    token.Market
+
+		Type         OrderType
+		Status       orderbook.OrderStatus
+		FilledSize   float64
+		AvgFillPrice float64
+		UpdatedAt    int64
+		// ExpiresAt is the unix nano time a limit order expires at, 0 if it
+		// does not
+		ExpiresAt int64
 	}
 
 	OrderbookData struct {
@@ -49,40 +75,385 @@ type (
 		Price  float64
 		Size   float64
 		ID     int64
+		// Fee paid by the resting order on this match
+		Fee      float64
+		FeeAsset token.Asset
 	}
 
+	// APIError is the body of every failed request
 	APIError struct {
+		Code  ErrorCode
 		Error string
+		// RequestID is also sent in the X-Request-Id header
+		RequestID string `json:",omitempty"`
 	}
 )
 
-func StartServer() {
-	e := echo.New()
-	e.HTTPErrorHandler = httpErrorHandler
+// StartServer starts the exchange as configured and serves it in the
+// background. Its shutdown is registered with lc: new orders are refused
+// first, then the requests in flight are drained, the resting orders are
+// cancelled or kept for the next start, the engines are stopped and the
+// storage is flushed.
+func StartServer(cfg *config.Config, lc *Lifecycle) error {
+	markets, err := marketConfigs(cfg)
+	if err != nil {
+		return err
+	}
+
+	ex, err := NewExchangeWithMarkets(cfg.Server.PrivateKey.Value(), markets)
+	if err != nil {
+		return err
+	}
+	ex.SetAdminToken(cfg.Server.AdminToken.Value())
+	ex.SetWithdrawalPolicy(withdrawalPolicy(cfg.Withdrawals))
+	ex.SetDepositPolicy(depositPolicy(cfg.Deposits))
+	ex.SetSweepPolicy(sweepPolicy(cfg.Sweeper))
+
+	// the gateway hooks into the order events before any order is placed
+	var fixGateway *FIXGateway
+	if cfg.FIX.Addr != "" {
+		fixGateway = NewFIXGateway(ex, cfg.FIX.CompID)
+	}
+
+	if cfg.Mongo.URI.Value() != "" {
+		if err := ex.useMongo(cfg, lc); err != nil {
+			return err
+		}
+	}
+
+	auditStore, err := openAuditStore(cfg.Audit)
+	if err != nil {
+		return err
+	}
+	if auditStore != nil {
+		if ex.Audit, err = audit.Open(auditStore); err != nil {
+			return fmt.Errorf("audit log: %w", err)
+		}
+	}
+	if closer, ok := auditStore.(io.Closer); ok {
+		lc.OnShutdown("audit log", func(context.Context) error {
+			return closer.Close()
+		})
+	}
+
+	users, err := ex.restoreUsers()
+	if err != nil {
+		return fmt.Errorf("restoring users: %w", err)
+	}
+	logrus.WithField("users", users).Info("restored users")
+	if err := ex.seedOrderIDs(); err != nil {
+		return fmt.Errorf("seeding order IDs: %w", err)
+	}
+	restored, err := ex.restoreOrders()
+	if err != nil {
+		return fmt.Errorf("restoring orders: %w", err)
+	}
+	logrus.WithField("orders", restored).Info("restored open orders")
+	trades := ex.restoreVolumes(time.Now())
+	logrus.WithField("trades", trades).Info("restored trading volumes")
+	ex.seedReservesID()
+
+	chain, err := cryptoClient.NewClient(cryptoClient.Config{
+		EthRPCURL:  cfg.Chain.RPCURL,
+		EthChainID: cfg.Chain.ChainID,
+	})
+	if err != nil {
+		return err
+	}
+	ex.SetChainClient(chain)
+	lc.Go("withdrawals", func(ctx context.Context) {
+		ex.runWithdrawals(ctx, cfg.Withdrawals.PollInterval)
+	})
+	lc.Go("deposits", func(ctx context.Context) {
+		ex.runDeposits(ctx, cfg.Deposits.PollInterval)
+	})
+	lc.Go("sweeper", func(ctx context.Context) {
+		ex.runSweeps(ctx, cfg.Sweeper.PollInterval)
+	})
+	if cfg.Reserves.Interval > 0 {
+		lc.Go("reserves", func(ctx context.Context) {
+			ex.runReserves(ctx, cfg.Reserves.Interval)
+		})
+	}
+
+	e := newRouter(ex)
+	// listening up front reports a taken address before anything runs
+	e.Listener, err = net.Listen("tcp", cfg.Server.Addr)
+	if err != nil {
+		return err
+	}
+
+	lc.OnShutdown("markets", func(context.Context) error {
+		ex.stopMarkets(cfg.Server.CancelOrdersOnShutdown)
+		return nil
+	})
+	lc.OnShutdown("dead man's switch", func(context.Context) error {
+		ex.deadman.Stop()
+		return nil
+	})
+	lc.OnShutdown("http", e.Shutdown)
+	if fixGateway != nil {
+		fixListener, err := net.Listen("tcp", cfg.FIX.Addr)
+		if err != nil {
+			return err
+		}
+		lc.OnShutdown("fix", fixGateway.Shutdown)
+		lc.Go("fix market data", func(ctx context.Context) {
+			fixGateway.runMarketData(ctx, cfg.FIX.MarketDataInterval)
+		})
+		go func() {
+			if err := fixGateway.Serve(fixListener); err != nil {
+				logrus.WithError(err).Error("fix gateway stopped")
+			}
+		}()
+	}
+	lc.OnShutdown("trading", func(context.Context) error {
+		ex.markets.Halt()
+		return nil
+	})
+
+	go func() {
+		if err := e.Start(cfg.Server.Addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithError(err).Error("server stopped")
+		}
+	}()
+
+	return nil
+}
+
+// marketConfigs returns the markets to list on start, the DefaultMarkets
+// when the config names none.
+func marketConfigs(cfg *config.Config) ([]MarketConfig, error) {
+	if cfg.MarketsFile != "" {
+		return LoadMarketConfigs(cfg.MarketsFile)
+	}
+	if len(cfg.Markets) == 0 {
+		return DefaultMarkets, nil
+	}
+
+	markets := make([]MarketConfig, len(cfg.Markets))
+	for i, m := range cfg.Markets {
+		markets[i] = MarketConfig{
+			Market: token.Market(m.Market),
+			State:  MarketState(m.State),
+		}
+	}
+	return markets, nil
+}
+
+// useMongo keeps the users with their wallets, API keys and sessions, the
+// orders, the ledger, the withdrawals, the deposits, the sweeps and the TOTP
+// secrets in MongoDB. It has to be called before the exchange serves any
+// request.
+// The orders and the journal are written in the background and flushed on
+// shutdown, once the markets stopped. Every order, deposit, withdrawal and
+// sweep is only written once the journal entries posted before it are.
+func (ex *Exchange) useMongo(cfg *config.Config, lc *Lifecycle) error {
+	db.Database = cfg.Mongo.Database
+	db.InitializeMongo(cfg.Mongo.URI.Value())
+	lc.OnShutdown("storage", db.DisconnectMongo)
+	if err := db.CreateIndexes(); err != nil {
+		return err
+	}
 
-	ex, err := NewExchange(exchangePrivateKey)
+	journal := ledger.NewBufferedStore(ledger.NewMongoStore())
+	l, err := ledger.LoadLedger(journal)
+	if err != nil {
+		return err
+	}
+	ex.Ledger = l
+	lc.Go("journal writer", journal.Run)
+	lc.OnShutdown("journal", journal.Flush)
+	orders := NewBufferedOrderStore(journaledOrderStore{NewMongoOrderStore(), journal})
+	ex.SetOrderStore(orders)
+	lc.Go("order writer", orders.Run)
+	lc.OnShutdown("order store", orders.Flush)
+	ex.SetWithdrawalStore(journaledWithdrawalStore{NewMongoWithdrawalStore(), journal})
+	ex.SetDepositStore(journaledDepositStore{NewMongoDepositStore(), journal})
+	ex.SetSweepStore(journaledSweepStore{NewMongoSweepStore(), journal})
+
+	// the secrets the exchange has to read back are encrypted under the key
+	key, err := hex.DecodeString(cfg.Server.TOTPKey.Value())
+	if err != nil {
+		return err
+	}
+	totp, err := NewMongoTOTPStore(key)
+	if err != nil {
+		return err
+	}
+	ex.SetTOTPStore(totp)
+	users, err := NewMongoUserStore(key)
+	if err != nil {
+		return err
+	}
+	ex.SetUserStore(users)
+	apiKeys, err := NewMongoAPIKeyBackend(key)
+	if err != nil {
+		return err
+	}
+	keys, err := ex.APIKeys.Load(apiKeys)
+	if err != nil {
+		return fmt.Errorf("loading api keys: %w", err)
+	}
+	sessions, err := ex.Sessions.Load(NewMongoSessionBackend(), time.Now())
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("loading sessions: %w", err)
 	}
+	logrus.WithFields(logrus.Fields{
+		"apiKeys":  keys,
+		"sessions": sessions,
+	}).Info("loaded api keys and sessions")
 
-	// ex.registerUser("f9065c72318979b6a164ed215bffbceec4d5f90e752d3c8d1192c0475bc473f6", 7)
-	// ex.registerUser("d2fa31763861778a3e19f29da5127539f96908d0406f75d69bd1cc32934b2934", 8)
-	// ex.registerUser("5e8f0213af74ba333b924a0d1db3a7c295e0918ccd06c8d89c1cb9046cca3be4", 666)
+	return nil
+}
+
+func newRouter(ex *Exchange) *echo.Echo {
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	e.Use(middleware.RequestID())
+	e.Use(httpMetrics)
+
+	// requests of users carry a session token or are signed with an API key
+	var (
+		read     = ex.auth(ScopeRead)
+		trade    = ex.auth(ScopeTrade)
+		withdraw = ex.auth(ScopeWithdraw)
+	)
+
+	v1 := e.Group("/v1")
+	v1.GET("/openapi.json", handleGetOpenAPI)
+
+	v1.POST("/users", ex.handleRegisterUser)
+	v1.GET("/users/me", ex.handleGetCurrentUser, read)
+	v1.DELETE("/users/me/sessions", ex.handleRevokeSessions, ex.sessionAuth)
+	v1.POST("/users/me/totp", ex.handleEnrollTOTP, ex.sessionAuth)
+	v1.POST("/users/me/totp/confirm", ex.handleConfirmTOTP, ex.sessionAuth)
+	v1.DELETE("/users/me/totp", ex.handleDisableTOTP, ex.sessionAuth)
+	v1.GET("/users/me/deposit-addresses", ex.handleGetDepositAddresses, read)
+	v1.GET("/users/me/reserves-proof", ex.handleGetReservesProof, read)
+	v1.GET("/users/me/withdrawal-addresses", ex.handleGetWithdrawalAddresses, read)
+	v1.POST("/users/me/withdrawal-addresses", ex.handleAddWithdrawalAddress, withdraw)
+	v1.DELETE("/users/me/withdrawal-addresses/:address", ex.handleRemoveWithdrawalAddress, withdraw)
+	v1.GET("/users/:userID/orders", ex.handleGetOrders, read)
+	v1.GET("/users/:userID/ledger", ex.handleGetLedger, read)
+	v1.GET("/users/:userID/balances", ex.handleGetBalances, read)
+	v1.GET("/users/:userID/fees", ex.handleGetFees, read)
+	v1.POST("/sessions", ex.handleLogin)
+	v1.POST("/sessions/refresh", ex.handleRefreshSession)
+	v1.DELETE("/sessions", ex.handleLogout, ex.sessionAuth)
+
+	// API keys are managed from a session only, a key can not create others
+	v1.GET("/apikeys", ex.handleGetAPIKeys, ex.sessionAuth)
+	v1.POST("/apikeys", ex.handleCreateAPIKey, ex.sessionAuth)
+	v1.DELETE("/apikeys/:key", ex.handleRevokeAPIKey, ex.sessionAuth)
+
+	v1.POST("/orders", ex.handlePlaceOrder, trade)
+	v1.POST("/orders/batch", ex.handlePlaceOrders, trade)
+	v1.DELETE("/orders/batch", ex.handleCancelOrders, trade)
+	v1.GET("/orders/:id", ex.handleGetOrder, read)
+	v1.DELETE("/orders/:id", ex.cancelOrder, trade)
+	v1.POST("/orders/cancel-after", ex.handleCancelAfter, trade)
+	v1.POST("/orders/heartbeat", ex.handleHeartbeat, trade)
+
+	v1.GET("/deposits", ex.handleGetDeposits, read)
+	v1.POST("/withdrawals", ex.handleRequestWithdrawal, withdraw)
+	v1.GET("/withdrawals", ex.handleGetWithdrawals, read)
+	v1.GET("/withdrawals/:id", ex.handleGetWithdrawal, read)
+	v1.DELETE("/withdrawals/:id", ex.handleCancelWithdrawal, withdraw)
 
-	e.POST("/order", ex.handlePlaceOrder)
-	e.DELETE("/order/:id", ex.cancelOrder)
+	v1.GET("/reserves", ex.handleGetReserves)
 
-	e.GET("/trades/:market", ex.handleGetTrades)
-	e.GET("/order/:userID", ex.handleGetOrders)
-	e.GET("/book/:market/asks", ex.handleGetBook)
-	e.GET("/book/:market", ex.handleGetBook)
-	e.GET("/book/:market/bestbid", ex.handleGetBestBid)
-	e.GET("/book/:market/bestask", ex.handleGetBestAsk)
+	v1.GET("/markets", ex.handleGetMarkets)
+	v1.GET("/markets/:market/book", ex.handleGetBook)
+	v1.GET("/markets/:market/book/bestbid", ex.handleGetBestBid)
+	v1.GET("/markets/:market/book/bestask", ex.handleGetBestAsk)
+	v1.GET("/markets/:market/trades", ex.handleGetTrades)
 
-	e.Start(":3000")
+	admin := v1.Group("/admin", ex.adminAuth)
+	admin.POST("/markets", ex.handleListMarket)
+	admin.PUT("/markets/:market", ex.handleSetMarketState)
+	admin.DELETE("/markets/:market", ex.handleDelistMarket)
+	admin.GET("/fees", ex.handleGetFeeSchedule)
+	admin.PUT("/fees", ex.handleSetFeeSchedule)
+	admin.PUT("/fees/users/:userID", ex.handleSetFeeOverride)
+	admin.DELETE("/fees/users/:userID", ex.handleRemoveFeeOverride)
+	admin.GET("/users/:userID/apikeys", ex.handleAdminGetAPIKeys)
+	admin.POST("/users/:userID/apikeys", ex.handleAdminCreateAPIKey)
+	admin.DELETE("/apikeys/:key", ex.handleAdminRevokeAPIKey)
+	admin.GET("/users", ex.handleAdminGetUsers)
+	admin.GET("/users/:userID", ex.handleAdminGetUser)
+	admin.POST("/users/:userID/freeze", ex.handleFreezeUser)
+	admin.POST("/users/:userID/unfreeze", ex.handleUnfreezeUser)
+	admin.POST("/users/:userID/adjustments", ex.handleAdjustBalance)
+	admin.DELETE("/users/:userID/orders", ex.handleAdminCancelOrders)
+	admin.GET("/stats", ex.handleGetEngineStats)
+	admin.GET("/withdrawals", ex.handleAdminGetWithdrawals)
+	admin.POST("/withdrawals/:id/approve", ex.handleApproveWithdrawal)
+	admin.POST("/withdrawals/:id/reject", ex.handleRejectWithdrawal)
+	admin.GET("/sweeps", ex.handleAdminGetSweeps)
+	admin.POST("/reserves", ex.handlePublishReserves)
+	admin.GET("/audit", ex.handleGetAudit)
+	admin.GET("/audit/verify", ex.handleVerifyAudit)
 
+	e.GET("/metrics", ex.metricsHandler())
+
+	ex.legacyRoutes(e)
+
+	return e
 }
 
-func httpErrorHandler(err error, c echo.Context) {
-	fmt.Println(err)
+// legacyRoutes registers the unversioned routes from before /v1. They serve
+// the handlers of their /v1 successors, but every response is flagged as
+// deprecated and links to the successor.
+func (ex *Exchange) legacyRoutes(e *echo.Echo) {
+	var (
+		read  = ex.auth(ScopeRead)
+		trade = ex.auth(ScopeTrade)
+	)
+	alias := func(method, path, successor string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) {
+		e.Add(method, path, h, append([]echo.MiddlewareFunc{deprecated(successor)}, m...)...)
+	}
+
+	alias(http.MethodPost, "/users", "/v1/users", ex.handleRegisterUser)
+	alias(http.MethodGet, "/users/me", "/v1/users/me", ex.handleGetCurrentUser, read)
+	alias(http.MethodDelete, "/users/me/sessions", "/v1/users/me/sessions", ex.handleRevokeSessions, ex.sessionAuth)
+	alias(http.MethodPost, "/users/me/totp", "/v1/users/me/totp", ex.handleEnrollTOTP, ex.sessionAuth)
+	alias(http.MethodPost, "/users/me/totp/confirm", "/v1/users/me/totp/confirm", ex.handleConfirmTOTP, ex.sessionAuth)
+	alias(http.MethodDelete, "/users/me/totp", "/v1/users/me/totp", ex.handleDisableTOTP, ex.sessionAuth)
+	alias(http.MethodPost, "/sessions", "/v1/sessions", ex.handleLogin)
+	alias(http.MethodPost, "/sessions/refresh", "/v1/sessions/refresh", ex.handleRefreshSession)
+	alias(http.MethodDelete, "/sessions", "/v1/sessions", ex.handleLogout, ex.sessionAuth)
+
+	alias(http.MethodGet, "/apikeys", "/v1/apikeys", ex.handleGetAPIKeys, ex.sessionAuth)
+	alias(http.MethodPost, "/apikeys", "/v1/apikeys", ex.handleCreateAPIKey, ex.sessionAuth)
+	alias(http.MethodDelete, "/apikeys/:key", "/v1/apikeys/:key", ex.handleRevokeAPIKey, ex.sessionAuth)
+
+	alias(http.MethodPost, "/order", "/v1/orders", ex.handlePlaceOrder, trade)
+	alias(http.MethodDelete, "/order/:id", "/v1/orders/:id", ex.cancelOrder, trade)
+	alias(http.MethodPost, "/cancelafter", "/v1/orders/cancel-after", ex.handleCancelAfter, trade)
+	alias(http.MethodPost, "/heartbeat", "/v1/orders/heartbeat", ex.handleHeartbeat, trade)
+
+	alias(http.MethodGet, "/order/:userID", "/v1/users/:userID/orders", ex.handleGetOrders, read)
+	alias(http.MethodGet, "/order/id/:id", "/v1/orders/:id", ex.handleGetOrder, read)
+	alias(http.MethodGet, "/ledger/:userID", "/v1/users/:userID/ledger", ex.handleGetLedger, read)
+	alias(http.MethodGet, "/balances/:userID", "/v1/users/:userID/balances", ex.handleGetBalances, read)
+	alias(http.MethodGet, "/fees/:userID", "/v1/users/:userID/fees", ex.handleGetFees, read)
+
+	alias(http.MethodGet, "/trades/:market", "/v1/markets/:market/trades", ex.handleGetTrades)
+	alias(http.MethodGet, "/book/:market/asks", "/v1/markets/:market/book", ex.handleGetBook)
+	alias(http.MethodGet, "/book/:market", "/v1/markets/:market/book", ex.handleGetBook)
+	alias(http.MethodGet, "/book/:market/bestbid", "/v1/markets/:market/book/bestbid", ex.handleGetBestBid)
+	alias(http.MethodGet, "/book/:market/bestask", "/v1/markets/:market/book/bestask", ex.handleGetBestAsk)
+	alias(http.MethodGet, "/markets", "/v1/markets", ex.handleGetMarkets)
+
+	alias(http.MethodPost, "/admin/markets", "/v1/admin/markets", ex.handleListMarket, ex.adminAuth)
+	alias(http.MethodPut, "/admin/markets/:market", "/v1/admin/markets/:market", ex.handleSetMarketState, ex.adminAuth)
+	alias(http.MethodDelete, "/admin/markets/:market", "/v1/admin/markets/:market", ex.handleDelistMarket, ex.adminAuth)
+	alias(http.MethodGet, "/admin/fees", "/v1/admin/fees", ex.handleGetFeeSchedule, ex.adminAuth)
+	alias(http.MethodPut, "/admin/fees", "/v1/admin/fees", ex.handleSetFeeSchedule, ex.adminAuth)
+	alias(http.MethodPut, "/admin/fees/users/:userID", "/v1/admin/fees/users/:userID", ex.handleSetFeeOverride, ex.adminAuth)
+	alias(http.MethodDelete, "/admin/fees/users/:userID", "/v1/admin/fees/users/:userID", ex.handleRemoveFeeOverride, ex.adminAuth)
+	alias(http.MethodGet, "/admin/users/:userID/apikeys", "/v1/admin/users/:userID/apikeys", ex.handleAdminGetAPIKeys, ex.adminAuth)
+	alias(http.MethodPost, "/admin/users/:userID/apikeys", "/v1/admin/users/:userID/apikeys", ex.handleAdminCreateAPIKey, ex.adminAuth)
+	alias(http.MethodDelete, "/admin/apikeys/:key", "/v1/admin/apikeys/:key", ex.handleAdminRevokeAPIKey, ex.adminAuth)
 }
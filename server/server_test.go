@@ -17,18 +17,33 @@ func assert(t *testing.T, a, b any) {
 
 func TestDataBase(t *testing.T) {
 
-	user := NewUser(1, "Anakin", "123456@ABC", "anakinrm@gmail.com", 123456789)
+	user, err := NewUser(1, "Anakin", "123456@ABC", "anakinrm@gmail.com", 123456789)
+	if err != nil {
+		t.Fatal(err)
+	}
 
+	key := []byte("0123456789abcdef0123456789abcdef")
 	db.InitializeMongo("mongodb://localhost:27017")
-	user.StoreUserInDataBase()
-	fmt.Println("User", user.Wallet[token.MarketETH])
+	user.StoreUserInDataBase(key)
+	fmt.Println("User", user.Wallet[token.AssetETH])
 
-	getUser, err := GetUserbyID(1)
+	getUser, err := GetUserbyID(1, key)
 	if err != nil {
 		panic(err)
 	}
 
 	fmt.Println(getUser)
-	fmt.Println("getUser", getUser.Wallet[token.MarketETH])
+	fmt.Println("getUser", getUser.Wallet[token.AssetETH])
+
+	// a token missing from the db is stored the first time it is handed out
+	again, err := GetUserbyID(1, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for asset, tok := range getUser.Wallet {
+		address, _ := tok.GetPublicKey()
+		addressAgain, _ := again.Wallet[asset].GetPublicKey()
+		assert(t, addressAgain, address)
+	}
 
 }
@@ -0,0 +1,495 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// SessionTTL is how long a session token is valid, RefreshTTL how long it
+	// can be refreshed for.
+	SessionTTL = 15 * time.Minute
+	RefreshTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExpired  = errors.New("session expired")
+)
+
+// Session is handed to a user on login. The tokens are opaque, the server
+// only keeps their hashes.
+type Session struct {
+	UserID           int64
+	Token            string
+	RefreshToken     string
+	ExpiresAt        int64
+	RefreshExpiresAt int64
+}
+
+type session struct {
+	userID           int64
+	tokenHash        string
+	refreshHash      string
+	expiresAt        time.Time
+	refreshExpiresAt time.Time
+}
+
+// StoredSession is what a SessionBackend keeps of a session, the hashes of
+// its tokens and when they expire.
+type StoredSession struct {
+	UserID           int64
+	TokenHash        string
+	RefreshHash      string
+	ExpiresAt        int64
+	RefreshExpiresAt int64
+}
+
+// SessionBackend keeps the sessions across restarts.
+type SessionBackend interface {
+	SaveSession(StoredSession) error
+	// DeleteSessions removes the sessions of the token hashes
+	DeleteSessions(tokenHashes []string) error
+	GetSessions() ([]StoredSession, error)
+}
+
+// SessionStore keeps the sessions of the logged in users.
+type SessionStore struct {
+	mu sync.Mutex
+	// sessions and refresh map the hashes of both tokens to their session
+	sessions map[string]*session
+	refresh  map[string]*session
+	// backend gets every started and ended session when set
+	backend SessionBackend
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]*session),
+		refresh:  make(map[string]*session),
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Load puts the sessions of the backend that can still be refreshed into the
+// store and writes every later change through to it. It has to be called
+// before any user logs in.
+func (s *SessionStore) Load(backend SessionBackend, now time.Time) (int, error) {
+	stored, err := backend.GetSessions()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loaded := 0
+	for _, st := range stored {
+		sess := &session{
+			userID:           st.UserID,
+			tokenHash:        st.TokenHash,
+			refreshHash:      st.RefreshHash,
+			expiresAt:        time.Unix(0, st.ExpiresAt),
+			refreshExpiresAt: time.Unix(0, st.RefreshExpiresAt),
+		}
+		if now.After(sess.refreshExpiresAt) {
+			continue
+		}
+		s.sessions[sess.tokenHash] = sess
+		s.refresh[sess.refreshHash] = sess
+		loaded++
+	}
+	s.backend = backend
+
+	return loaded, nil
+}
+
+// forget removes the sessions of the token hashes from the backend.
+func (s *SessionStore) forget(tokenHashes []string) error {
+	if s.backend == nil || len(tokenHashes) == 0 {
+		return nil
+	}
+	return s.backend.DeleteSessions(tokenHashes)
+}
+
+// Create starts a new session for the user.
+func (s *SessionStore) Create(userID int64, now time.Time) (Session, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return Session{}, err
+	}
+	refreshToken, err := randomHex(32)
+	if err != nil {
+		return Session{}, err
+	}
+
+	sess := &session{
+		userID:           userID,
+		tokenHash:        hashToken(token),
+		refreshHash:      hashToken(refreshToken),
+		expiresAt:        now.Add(SessionTTL),
+		refreshExpiresAt: now.Add(RefreshTTL),
+	}
+	if s.backend != nil {
+		err := s.backend.SaveSession(StoredSession{
+			UserID:           sess.userID,
+			TokenHash:        sess.tokenHash,
+			RefreshHash:      sess.refreshHash,
+			ExpiresAt:        sess.expiresAt.UnixNano(),
+			RefreshExpiresAt: sess.refreshExpiresAt.UnixNano(),
+		})
+		if err != nil {
+			return Session{}, err
+		}
+	}
+
+	s.mu.Lock()
+	// sessions that can not be refreshed anymore are gone for good
+	var expired []string
+	for hash, old := range s.refresh {
+		if now.After(old.refreshExpiresAt) {
+			s.remove(old)
+			delete(s.refresh, hash)
+			expired = append(expired, old.tokenHash)
+		}
+	}
+	s.sessions[sess.tokenHash] = sess
+	s.refresh[sess.refreshHash] = sess
+	s.mu.Unlock()
+
+	// the next start skips them anyway, they only take up space
+	if err := s.forget(expired); err != nil {
+		logrus.WithError(err).Warn("failed to delete expired sessions")
+	}
+
+	return Session{
+		UserID:           userID,
+		Token:            token,
+		RefreshToken:     refreshToken,
+		ExpiresAt:        sess.expiresAt.UnixNano(),
+		RefreshExpiresAt: sess.refreshExpiresAt.UnixNano(),
+	}, nil
+}
+
+// Resolve returns the user of the session token.
+func (s *SessionStore) Resolve(token string, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[hashToken(token)]
+	if !ok {
+		return 0, ErrSessionNotFound
+	}
+	if now.After(sess.expiresAt) {
+		return 0, ErrSessionExpired
+	}
+	return sess.userID, nil
+}
+
+// Refresh replaces the session of the refresh token with a new one, the old
+// tokens stop working.
+func (s *SessionStore) Refresh(refreshToken string, now time.Time) (Session, error) {
+	s.mu.Lock()
+	sess, ok := s.refresh[hashToken(refreshToken)]
+	if ok {
+		s.remove(sess)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	if err := s.forget([]string{sess.tokenHash}); err != nil {
+		return Session{}, err
+	}
+	if now.After(sess.refreshExpiresAt) {
+		return Session{}, ErrSessionExpired
+	}
+
+	return s.Create(sess.userID, now)
+}
+
+// Revoke ends the session of the token.
+func (s *SessionStore) Revoke(token string) error {
+	s.mu.Lock()
+	sess, ok := s.sessions[hashToken(token)]
+	if ok {
+		s.remove(sess)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return s.forget([]string{sess.tokenHash})
+}
+
+// RevokeUser ends every session of the user and returns how many there were.
+func (s *SessionStore) RevokeUser(userID int64) (int, error) {
+	s.mu.Lock()
+	var revoked []string
+	for _, sess := range s.refresh {
+		if sess.userID == userID {
+			s.remove(sess)
+			revoked = append(revoked, sess.tokenHash)
+		}
+	}
+	s.mu.Unlock()
+
+	return len(revoked), s.forget(revoked)
+}
+
+// remove must be called with s.mu held.
+func (s *SessionStore) remove(sess *session) {
+	delete(s.sessions, sess.tokenHash)
+	delete(s.refresh, sess.refreshHash)
+}
+
+// bearerToken returns the session token of the Authorization header.
+func bearerToken(c echo.Context) string {
+	token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return token
+}
+
+// sessionAuth resolves the session token of the request to its user.
+func (ex *Exchange) sessionAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := ex.Sessions.Resolve(bearerToken(c), time.Now())
+		if err != nil {
+			return newError(http.StatusUnauthorized, err)
+		}
+
+		ex.mu.RLock()
+		_, ok := ex.Users[userID]
+		ex.mu.RUnlock()
+		if !ok {
+			return newError(http.StatusUnauthorized, ErrUserNotFound)
+		}
+
+		if err := checkUserParam(c, userID); err != nil {
+			return newError(http.StatusForbidden, err)
+		}
+
+		c.Set(authUserKey, userID)
+
+		return next(c)
+	}
+}
+
+// auth accepts either a session token or a request signed with an API key
+// holding the scope. Sessions act with every scope of their user.
+func (ex *Exchange) auth(scope Scope) echo.MiddlewareFunc {
+	apiKeyAuth := ex.apiKeyAuth(scope)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		var (
+			withSession = ex.sessionAuth(next)
+			withAPIKey  = apiKeyAuth(next)
+		)
+
+		return func(c echo.Context) error {
+			if bearerToken(c) != "" {
+				return withSession(c)
+			}
+			return withAPIKey(c)
+		}
+	}
+}
+
+// checkUserParam makes routes with a :userID param only serve that user.
+func checkUserParam(c echo.Context, userID int64) error {
+	if param := c.Param("userID"); param != "" && param != strconv.FormatInt(userID, 10) {
+		return fmt.Errorf("not allowed to access user: %s", param)
+	}
+	return nil
+}
+
+type LoginRequest struct {
+	UserName string
+	Password string
+	// TOTPCode is required once the user enabled two-factor authentication
+	TOTPCode string
+}
+
+type RefreshSessionRequest struct {
+	RefreshToken string
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// checkPassword compares against a dummy hash when the user does not exist,
+// so the response time does not tell which user names are taken.
+func checkPassword(user *User, password string) bool {
+	if user == nil {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), passwordCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return CheckPasswordHash(password, user.hashedPassWd)
+}
+
+func (ex *Exchange) handleLogin(c echo.Context) error {
+	var req LoginRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	user, _ := ex.userByName(req.UserName)
+	if !checkPassword(user, req.Password) {
+		var userID int64
+		if user != nil {
+			userID = user.ID
+		}
+		ex.auditLogin(c, audit.LoginFailed, userID, req.UserName, ErrInvalidCredentials)
+		return newError(http.StatusUnauthorized, ErrInvalidCredentials)
+	}
+	if err := ex.verifySecondFactor(user.ID, req.TOTPCode); err != nil {
+		ex.auditLogin(c, audit.LoginFailed, user.ID, req.UserName, err)
+		return newError(http.StatusUnauthorized, err)
+	}
+
+	sess, err := ex.Sessions.Create(user.ID, time.Now())
+	if err != nil {
+		return err
+	}
+	ex.auditLogin(c, audit.Login, user.ID, req.UserName, nil)
+
+	logrus.WithField("userID", user.ID).Info("user logged in")
+
+	return c.JSON(http.StatusOK, sess)
+}
+
+// auditLogin records a login attempt, err is why it failed. The user is not
+// authenticated yet, so the attempt is attributed to the user it was made
+// for.
+func (ex *Exchange) auditLogin(c echo.Context, action audit.Action, userID int64, userName string, err error) {
+	details := map[string]any{
+		"userName": userName,
+		"ip":       c.RealIP(),
+	}
+	if err != nil {
+		details["error"] = err
+	}
+
+	ex.writeAudit(audit.Entry{
+		Actor:     userActor(userID),
+		Action:    action,
+		UserID:    userID,
+		RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+	}, details)
+}
+
+func (ex *Exchange) handleRefreshSession(c echo.Context) error {
+	var req RefreshSessionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	sess, err := ex.Sessions.Refresh(req.RefreshToken, time.Now())
+	if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExpired) {
+		return newError(http.StatusUnauthorized, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, sess)
+}
+
+// handleLogout ends the session the request was made with.
+func (ex *Exchange) handleLogout(c echo.Context) error {
+	err := ex.Sessions.Revoke(bearerToken(c))
+	if errors.Is(err, ErrSessionNotFound) {
+		return newError(http.StatusUnauthorized, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "logged out"})
+}
+
+// handleRevokeSessions ends every session of the user, including the one the
+// request was made with.
+func (ex *Exchange) handleRevokeSessions(c echo.Context) error {
+	userID := authUserID(c)
+	revoked, err := ex.Sessions.RevokeUser(userID)
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID":  userID,
+		"revoked": revoked,
+	}).Info("revoked all user sessions")
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "sessions revoked", "revoked": revoked})
+}
+
+// MongoSessionBackend keeps the sessions in the sessions collection, the db
+// has to be initialized with db.InitializeMongo first.
+type MongoSessionBackend struct{}
+
+func NewMongoSessionBackend() *MongoSessionBackend {
+	return &MongoSessionBackend{}
+}
+
+func (b *MongoSessionBackend) SaveSession(sess StoredSession) error {
+	record := db.Session{
+		UserID:           sess.UserID,
+		TokenHash:        sess.TokenHash,
+		RefreshHash:      sess.RefreshHash,
+		ExpiresAt:        sess.ExpiresAt,
+		RefreshExpiresAt: sess.RefreshExpiresAt,
+	}
+	return record.InsertSession()
+}
+
+func (b *MongoSessionBackend) DeleteSessions(tokenHashes []string) error {
+	return db.DeleteSessions(tokenHashes)
+}
+
+func (b *MongoSessionBackend) GetSessions() ([]StoredSession, error) {
+	records, err := db.GetSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]StoredSession, len(records))
+	for i, record := range records {
+		sessions[i] = StoredSession{
+			UserID:           record.UserID,
+			TokenHash:        record.TokenHash,
+			RefreshHash:      record.RefreshHash,
+			ExpiresAt:        record.ExpiresAt,
+			RefreshExpiresAt: record.RefreshExpiresAt,
+		}
+	}
+	return sessions, nil
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	// the default cost makes every login take a second
+	passwordCost = bcrypt.MinCost
+}
+
+func doSessionRequest(e *echo.Echo, token, method, path string, body any) *httptest.ResponseRecorder {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(reqBody))
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func registerTestUser(t *testing.T, e *echo.Echo, name string) UserResponse {
+	rec := doRequest(e, http.MethodPost, "/users", RegisterUserRequest{
+		UserName: name,
+		Password: "correct horse",
+		Email:    name + "@example.com",
+	})
+	assert(t, rec.Code, http.StatusCreated)
+
+	user := UserResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func loginTestUser(t *testing.T, e *echo.Echo, name string) Session {
+	rec := doRequest(e, http.MethodPost, "/sessions", LoginRequest{UserName: name, Password: "correct horse"})
+	assert(t, rec.Code, http.StatusOK)
+
+	sess := Session{}
+	if err := json.NewDecoder(rec.Body).Decode(&sess); err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func TestRegisterUser(t *testing.T) {
+	_, e := newTestExchange(t, 1)
+
+	user := registerTestUser(t, e, "anakin")
+	assert(t, user.ID, int64(2))
+	assert(t, user.Email, "anakin@example.com")
+
+	rec := doRequest(e, http.MethodPost, "/users", RegisterUserRequest{UserName: "Anakin", Password: "correct horse", Email: "other@example.com"})
+	assert(t, rec.Code, http.StatusConflict)
+	rec = doRequest(e, http.MethodPost, "/users", RegisterUserRequest{UserName: "vader", Password: "correct horse", Email: "ANAKIN@example.com"})
+	assert(t, rec.Code, http.StatusConflict)
+
+	for _, req := range []RegisterUserRequest{
+		{UserName: "a", Password: "correct horse", Email: "a@example.com"},
+		{UserName: "luke skywalker", Password: "correct horse", Email: "luke@example.com"},
+		{UserName: "luke", Password: "short", Email: "luke@example.com"},
+		{UserName: "luke", Password: "correct horse", Email: "luke"},
+	} {
+		rec := doRequest(e, http.MethodPost, "/users", req)
+		assert(t, rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRegisterUserChecksStore(t *testing.T) {
+	ex, e := newTestExchange(t)
+
+	// a user stored by an earlier run, not loaded into memory
+	store := NewMemoryUserStore()
+	assert(t, store.InsertUser(&User{ID: 7, UserName: "anakin", Email: "anakin@example.com"}), nil)
+	ex.SetUserStore(store)
+
+	rec := doRequest(e, http.MethodPost, "/users", RegisterUserRequest{UserName: "ANAKIN", Password: "correct horse", Email: "other@example.com"})
+	assert(t, rec.Code, http.StatusConflict)
+	rec = doRequest(e, http.MethodPost, "/users", RegisterUserRequest{UserName: "vader", Password: "correct horse", Email: "Anakin@example.com"})
+	assert(t, rec.Code, http.StatusConflict)
+
+	// new users are stored, with IDs after the stored ones
+	user := registerTestUser(t, e, "luke")
+	assert(t, user.ID, int64(8))
+	last, err := store.LastUserID()
+	assert(t, err, nil)
+	assert(t, last, int64(8))
+}
+
+func TestLogin(t *testing.T) {
+	_, e := newTestExchange(t)
+	user := registerTestUser(t, e, "anakin")
+
+	rec := doRequest(e, http.MethodPost, "/sessions", LoginRequest{UserName: "anakin", Password: "wrong password"})
+	assert(t, rec.Code, http.StatusUnauthorized)
+	rec = doRequest(e, http.MethodPost, "/sessions", LoginRequest{UserName: "obiwan", Password: "correct horse"})
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	sess := loginTestUser(t, e, "anakin")
+	assert(t, sess.UserID, user.ID)
+
+	rec = doSessionRequest(e, sess.Token, http.MethodGet, "/users/me", nil)
+	assert(t, rec.Code, http.StatusOK)
+	me := UserResponse{}
+	assert(t, json.NewDecoder(rec.Body).Decode(&me), nil)
+	assert(t, me, user)
+
+	// the session acts for its user in the rest of the API
+	rec = doSessionRequest(e, sess.Token, http.MethodGet, fmt.Sprintf("/balances/%d", user.ID), nil)
+	assert(t, rec.Code, http.StatusOK)
+	rec = doSessionRequest(e, sess.Token, http.MethodGet, fmt.Sprintf("/balances/%d", user.ID+1), nil)
+	assert(t, rec.Code, http.StatusForbidden)
+	rec = doSessionRequest(e, "not a token", http.MethodGet, "/users/me", nil)
+	assert(t, rec.Code, http.StatusUnauthorized)
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	_, e := newTestExchange(t)
+	registerTestUser(t, e, "anakin")
+	sess := loginTestUser(t, e, "anakin")
+
+	rec := doRequest(e, http.MethodPost, "/sessions/refresh", RefreshSessionRequest{RefreshToken: sess.RefreshToken})
+	assert(t, rec.Code, http.StatusOK)
+	refreshed := Session{}
+	assert(t, json.NewDecoder(rec.Body).Decode(&refreshed), nil)
+
+	// refreshing replaces both tokens
+	assert(t, doSessionRequest(e, sess.Token, http.MethodGet, "/users/me", nil).Code, http.StatusUnauthorized)
+	rec = doRequest(e, http.MethodPost, "/sessions/refresh", RefreshSessionRequest{RefreshToken: sess.RefreshToken})
+	assert(t, rec.Code, http.StatusUnauthorized)
+	assert(t, doSessionRequest(e, refreshed.Token, http.MethodGet, "/users/me", nil).Code, http.StatusOK)
+
+	assert(t, doSessionRequest(e, refreshed.Token, http.MethodDelete, "/sessions", nil).Code, http.StatusOK)
+	assert(t, doSessionRequest(e, refreshed.Token, http.MethodGet, "/users/me", nil).Code, http.StatusUnauthorized)
+
+	first := loginTestUser(t, e, "anakin")
+	second := loginTestUser(t, e, "anakin")
+	assert(t, doSessionRequest(e, first.Token, http.MethodDelete, "/users/me/sessions", nil).Code, http.StatusOK)
+	assert(t, doSessionRequest(e, second.Token, http.MethodGet, "/users/me", nil).Code, http.StatusUnauthorized)
+}
+
+func TestSessionExpiry(t *testing.T) {
+	sessions := NewSessionStore()
+	now := time.Now()
+
+	sess, err := sessions.Create(1, now)
+	assert(t, err, nil)
+
+	userID, err := sessions.Resolve(sess.Token, now.Add(SessionTTL-time.Second))
+	assert(t, err, nil)
+	assert(t, userID, int64(1))
+
+	_, err = sessions.Resolve(sess.Token, now.Add(SessionTTL+time.Second))
+	assert(t, err, ErrSessionExpired)
+
+	_, err = sessions.Refresh(sess.RefreshToken, now.Add(RefreshTTL+time.Second))
+	assert(t, err, ErrSessionExpired)
+}
+
+func TestAPIKeysFromSession(t *testing.T) {
+	ex, e := newTestExchange(t)
+	user := registerTestUser(t, e, "anakin")
+	sess := loginTestUser(t, e, "anakin")
+
+	rec := doSessionRequest(e, sess.Token, http.MethodPost, "/apikeys", CreateAPIKeyRequest{Scopes: []Scope{ScopeRead}})
+	assert(t, rec.Code, http.StatusOK)
+	key := APIKey{}
+	assert(t, json.NewDecoder(rec.Body).Decode(&key), nil)
+	assert(t, key.UserID, user.ID)
+
+	// the key of another user can not be revoked
+	other, err := ex.APIKeys.Create(user.ID+1, []Scope{ScopeRead})
+	assert(t, err, nil)
+	rec = doSessionRequest(e, sess.Token, http.MethodDelete, "/apikeys/"+other.Key, nil)
+	assert(t, rec.Code, http.StatusNotFound)
+
+	rec = doSessionRequest(e, sess.Token, http.MethodDelete, "/apikeys/"+key.Key, nil)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, len(ex.APIKeys.UserKeys(user.ID)), 0)
+}
+
+// testSessionBackend and testAPIKeyBackend keep what was written through to
+// them, like the collections would across a restart.
+type testSessionBackend struct {
+	sessions map[string]StoredSession
+}
+
+func (b *testSessionBackend) SaveSession(sess StoredSession) error {
+	b.sessions[sess.TokenHash] = sess
+	return nil
+}
+
+func (b *testSessionBackend) DeleteSessions(tokenHashes []string) error {
+	for _, hash := range tokenHashes {
+		delete(b.sessions, hash)
+	}
+	return nil
+}
+
+func (b *testSessionBackend) GetSessions() ([]StoredSession, error) {
+	sessions := []StoredSession{}
+	for _, sess := range b.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions, nil
+}
+
+type testAPIKeyBackend struct {
+	keys map[string]APIKey
+}
+
+func (b *testAPIKeyBackend) SaveAPIKey(apiKey APIKey) error {
+	b.keys[apiKey.Key] = apiKey
+	return nil
+}
+
+func (b *testAPIKeyBackend) DeleteAPIKey(key string) error {
+	delete(b.keys, key)
+	return nil
+}
+
+func (b *testAPIKeyBackend) GetAPIKeys() ([]APIKey, error) {
+	keys := []APIKey{}
+	for _, apiKey := range b.keys {
+		keys = append(keys, apiKey)
+	}
+	return keys, nil
+}
+
+func TestRestoreUsers(t *testing.T) {
+	var (
+		users    = NewMemoryUserStore()
+		sessions = &testSessionBackend{sessions: make(map[string]StoredSession)}
+		apiKeys  = &testAPIKeyBackend{keys: make(map[string]APIKey)}
+	)
+	start := func() (*Exchange, *echo.Echo) {
+		ex, e := newTestExchange(t)
+		ex.SetAdminToken(testAdminToken)
+		ex.SetUserStore(users)
+		_, err := ex.Sessions.Load(sessions, time.Now())
+		assert(t, err, nil)
+		_, err = ex.APIKeys.Load(apiKeys)
+		assert(t, err, nil)
+		_, err = ex.restoreUsers()
+		assert(t, err, nil)
+		return ex, e
+	}
+
+	ex, e := start()
+	user := registerTestUser(t, e, "anakin")
+	registerTestUser(t, e, "obiwan")
+	sess := loginTestUser(t, e, "anakin")
+	revoked := loginTestUser(t, e, "anakin")
+	assert(t, doSessionRequest(e, revoked.Token, http.MethodDelete, "/sessions", nil).Code, http.StatusOK)
+	key, err := ex.APIKeys.Create(user.ID, []Scope{ScopeRead})
+	assert(t, err, nil)
+	assert(t, doAdminRequest(e, http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/freeze", user.ID), FreezeUserRequest{Reason: "chargeback"}).Code, http.StatusOK)
+	assert(t, doAdminRequest(e, http.MethodPut, fmt.Sprintf("/v1/admin/fees/users/%d", user.ID), FeeRates{TakerRate: 0.0005}).Code, http.StatusOK)
+	schedule := FeeSchedule{Tiers: []FeeTier{{MinVolume: 0, MakerRate: 0.001, TakerRate: 0.003}}}
+	assert(t, doAdminRequest(e, http.MethodPut, "/v1/admin/fees", schedule).Code, http.StatusOK)
+	wallet := ex.Users[user.ID].Wallet
+
+	// the next start knows the users, their sessions, keys, freezes and fees
+	next, e := start()
+	assert(t, len(next.Users), 2)
+	assert(t, next.Users[user.ID].Wallet, wallet)
+	assert(t, next.userFrozen(user.ID), true)
+	assert(t, next.Fees.Rates(user.ID, token.AssetUSDT, time.Now()), FeeRates{TakerRate: 0.0005})
+	assert(t, next.Fees.Schedule(), schedule)
+	assert(t, doSessionRequest(e, sess.Token, http.MethodGet, "/users/me", nil).Code, http.StatusOK)
+	assert(t, doSessionRequest(e, revoked.Token, http.MethodGet, "/users/me", nil).Code, http.StatusUnauthorized)
+	assert(t, len(next.APIKeys.UserKeys(user.ID)), 1)
+	assert(t, next.APIKeys.UserKeys(user.ID)[0].Key, key.Key)
+	loginTestUser(t, e, "obiwan")
+
+	// names stay taken and IDs keep counting
+	rec := doRequest(e, http.MethodPost, "/users", RegisterUserRequest{UserName: "Anakin", Password: "correct horse", Email: "other@example.com"})
+	assert(t, rec.Code, http.StatusConflict)
+	assert(t, registerTestUser(t, e, "luke").ID, user.ID+2)
+
+	// a removed override stays removed
+	assert(t, doAdminRequest(e, http.MethodDelete, fmt.Sprintf("/v1/admin/fees/users/%d", user.ID), nil).Code, http.StatusOK)
+	last, _ := start()
+	assert(t, last.Fees.Rates(user.ID, token.AssetUSDT, time.Now()), FeeRates{MakerRate: 0.001, TakerRate: 0.003})
+}
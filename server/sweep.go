@@ -0,0 +1,350 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/config"
+	"github.com/anakinrm/crypto-exchange/server/cryptoClient"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// SweepKind tells which wallets a sweep moved funds between. DEPOSIT sweeps
+// consolidate a deposit address into the hot wallet, COLD ones forward what
+// the hot wallet holds above its ceiling to the cold address.
+type SweepKind string
+
+const (
+	SweepDeposit SweepKind = "DEPOSIT"
+	SweepCold    SweepKind = "COLD"
+)
+
+// SweepState is where the transaction of a sweep is at. A SENT sweep is
+// CONFIRMED once it is mined, it FAILED when the node refused it, it
+// reverted or it was dropped without being mined.
+type SweepState string
+
+const (
+	SweepSent      SweepState = "SENT"
+	SweepConfirmed SweepState = "CONFIRMED"
+	SweepFailed    SweepState = "FAILED"
+)
+
+var sweepStates = []SweepState{SweepSent, SweepConfirmed, SweepFailed}
+
+// Sweep records a transfer between the wallets of the exchange.
+type Sweep struct {
+	ID   int64
+	Kind SweepKind
+	// UserID owns the deposit address swept, 0 for the hot wallet
+	UserID int64 `json:",omitempty"`
+	Asset  token.Asset
+	From   string
+	To     string
+	Amount float64
+	// Fee is the gas the sender paid on top of the amount
+	Fee    float64
+	TxHash string
+	Nonce  uint64
+	State  SweepState
+	// Reason tells why a sweep failed
+	Reason    string `json:",omitempty"`
+	CreatedAt int64
+	UpdatedAt int64
+}
+
+// SweepPolicy sets when the wallets are swept.
+type SweepPolicy struct {
+	// Threshold is the ETH balance from which on a deposit address is swept
+	// into the hot wallet
+	Threshold float64
+	// HotCeiling caps the ETH of the hot wallet, the excess is forwarded to
+	// ColdAddress. 0 does not cap it
+	HotCeiling  float64
+	ColdAddress string
+}
+
+var DefaultSweepPolicy = SweepPolicy{
+	Threshold: 0.1,
+}
+
+// sweepPolicy is the policy of the sweeper section of the config.
+func sweepPolicy(cfg config.Sweeper) SweepPolicy {
+	return SweepPolicy{
+		Threshold:   cfg.Threshold,
+		HotCeiling:  cfg.HotCeiling,
+		ColdAddress: cfg.ColdAddress,
+	}
+}
+
+// SetSweepStore replaces the store keeping the sweeps, it has to be called
+// before the first sweep.
+func (ex *Exchange) SetSweepStore(store SweepStore) {
+	ex.sweeps = store
+}
+
+// SetSweepPolicy sets when the wallets are swept from the next pass on.
+func (ex *Exchange) SetSweepPolicy(policy SweepPolicy) {
+	ex.sweepMu.Lock()
+	defer ex.sweepMu.Unlock()
+
+	ex.sweepPolicy = policy
+}
+
+// runSweeps processes the sweeps every interval until ctx is done.
+func (ex *Exchange) runSweeps(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, ex.processSweeps)
+}
+
+// processSweeps follows the sweeps sent before, then sweeps the deposit
+// addresses above the threshold and forwards the excess of the hot wallet.
+// An address is not swept again while its last sweep is not mined, its
+// balance still holds what the sweep moves.
+func (ex *Exchange) processSweeps() {
+	if ex.chain == nil {
+		return
+	}
+
+	ex.sweepMu.Lock()
+	defer ex.sweepMu.Unlock()
+
+	sweeping, err := ex.trackSweeps()
+	if err != nil {
+		logrus.WithError(err).Error("failed to track sweeps")
+		return
+	}
+	if err := ex.sweepDeposits(sweeping); err != nil {
+		logrus.WithError(err).Error("failed to sweep deposit addresses")
+	}
+	if err := ex.forwardToCold(sweeping); err != nil {
+		logrus.WithError(err).Error("failed to forward to the cold wallet")
+	}
+}
+
+// trackSweeps settles the sent sweeps that were mined or dropped and returns
+// the addresses of the ones still on their way.
+func (ex *Exchange) trackSweeps() (map[string]bool, error) {
+	sent, err := ex.sweeps.GetSweeps(SweepSent)
+	if err != nil {
+		return nil, err
+	}
+
+	eth := ex.chain.Eth
+	sweeping := make(map[string]bool)
+	for _, s := range sent {
+		status, err := eth.TxStatus(common.HexToHash(s.TxHash))
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case status.Mined && status.Failed:
+			s.State, s.Reason = SweepFailed, "transaction reverted"
+		case status.Mined:
+			s.State = SweepConfirmed
+		default:
+			// another transaction took the nonce, this one will never be
+			// mined
+			dropped, err := ex.txDropped(common.HexToHash(s.TxHash), common.HexToAddress(s.From), s.Nonce)
+			if err != nil {
+				return nil, err
+			}
+			if !dropped {
+				sweeping[s.From] = true
+				continue
+			}
+			s.State, s.Reason = SweepFailed, "transaction dropped"
+		}
+
+		s.UpdatedAt = time.Now().UnixNano()
+		if err := ex.sweeps.SaveSweep(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return sweeping, nil
+}
+
+// sweepDeposits moves the whole balance of the deposit addresses holding at
+// least the threshold into the hot wallet, the addresses pay the gas of
+// their sweep themselves.
+func (ex *Exchange) sweepDeposits(sweeping map[string]bool) error {
+	eth := ex.chain.Eth
+	hot := crypto.PubkeyToAddress(ex.PrivateKey.PublicKey)
+	threshold := eth.FloatToBigInt(ex.sweepPolicy.Threshold)
+
+	for _, w := range ex.depositWallets() {
+		if sweeping[w.address.Hex()] {
+			continue
+		}
+		balance, err := eth.BalanceAt(w.address)
+		if err != nil {
+			return err
+		}
+		if balance.Cmp(threshold) < 0 {
+			continue
+		}
+
+		tx, err := w.eth.Sweep(*ex.chain, hot)
+		if errors.Is(err, cryptoClient.ErrBalanceBelowFee) {
+			continue
+		}
+		if tx == nil {
+			logrus.WithError(err).WithField("address", w.address.Hex()).Error("failed to sign sweep")
+			continue
+		}
+		if err := ex.recordSweep(SweepDeposit, w.userID, w.address, tx, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type depositWallet struct {
+	userID  int64
+	address common.Address
+	eth     *token.Eth
+}
+
+// depositWallets returns the ETH wallets of the users.
+func (ex *Exchange) depositWallets() []depositWallet {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	wallets := []depositWallet{}
+	for _, user := range ex.Users {
+		eth, ok := user.Wallet[token.AssetETH].(*token.Eth)
+		if !ok {
+			continue
+		}
+		if address, ok := depositAddress(user); ok {
+			wallets = append(wallets, depositWallet{userID: user.ID, address: address, eth: eth})
+		}
+	}
+	return wallets
+}
+
+// forwardToCold sends what the hot wallet holds above its ceiling to the
+// cold address. The hot wallet pays the gas, which leaves it a little under
+// the ceiling.
+func (ex *Exchange) forwardToCold(sweeping map[string]bool) error {
+	policy := ex.sweepPolicy
+	if policy.HotCeiling <= 0 || policy.ColdAddress == "" {
+		return nil
+	}
+
+	eth := ex.chain.Eth
+	hot := crypto.PubkeyToAddress(ex.PrivateKey.PublicKey)
+	if sweeping[hot.Hex()] {
+		return nil
+	}
+	balance, err := eth.BalanceAt(hot)
+	if err != nil {
+		return err
+	}
+	excess := balance.Sub(balance, eth.FloatToBigInt(policy.HotCeiling))
+	if excess.Sign() <= 0 {
+		return nil
+	}
+
+	ex.hotMu.Lock()
+	defer ex.hotMu.Unlock()
+
+	tx, err := eth.SignTransfer(ex.PrivateKey, common.HexToAddress(policy.ColdAddress), excess)
+	if err != nil {
+		return err
+	}
+	return ex.recordSweep(SweepCold, 0, hot, tx, eth.SendTransaction(tx))
+}
+
+// recordSweep stores the sweep of the transaction, sendErr is why sending it
+// failed. Only a transaction the node rejected fails the sweep, any other
+// error may still have sent it, so the sweep is stored as sent and
+// trackSweeps finds out whether it was mined or dropped. Sweeps are stored
+// once they are sent, a crash in between leaves the funds in a wallet of the
+// exchange either way.
+func (ex *Exchange) recordSweep(kind SweepKind, userID int64, from common.Address, tx *types.Transaction, sendErr error) error {
+	cryptoClient.RecordSweep(string(token.AssetETH), sendErr)
+
+	last, err := ex.sweeps.LastSweepID()
+	if err != nil {
+		return err
+	}
+
+	eth := ex.chain.Eth
+	now := time.Now().UnixNano()
+	s := Sweep{
+		ID:        last + 1,
+		Kind:      kind,
+		UserID:    userID,
+		Asset:     token.AssetETH,
+		From:      from.Hex(),
+		To:        tx.To().Hex(),
+		Amount:    eth.BigIntToFloat(tx.Value()),
+		Fee:       eth.BigIntToFloat(cryptoClient.TransferFee(tx)),
+		TxHash:    tx.Hash().Hex(),
+		Nonce:     tx.Nonce(),
+		State:     SweepSent,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if cryptoClient.IsRejected(sendErr) {
+		s.State = SweepFailed
+		s.Reason = sendErr.Error()
+	}
+	if err := ex.sweeps.SaveSweep(s); err != nil {
+		return err
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"sweepID": s.ID,
+		"kind":    s.Kind,
+		"from":    s.From,
+		"amount":  s.Amount,
+		"txHash":  s.TxHash,
+		"nonce":   s.Nonce,
+		"state":   s.State,
+	})
+	if sendErr != nil && s.State == SweepSent {
+		log.WithError(sendErr).Warn("sweep sent without an answer")
+	} else {
+		log.Info("sweep sent")
+	}
+
+	return nil
+}
+
+// handleAdminGetSweeps lists the sweeps in the states of the state query
+// parameter, a comma separated list, all of them without it.
+func (ex *Exchange) handleAdminGetSweeps(c echo.Context) error {
+	var states []SweepState
+	if s := c.QueryParam("state"); s != "" {
+		for _, state := range strings.Split(s, ",") {
+			state := SweepState(strings.ToUpper(strings.TrimSpace(state)))
+			if !slices.Contains(sweepStates, state) {
+				return newErrorf(http.StatusBadRequest, "unknown sweep state: %s", state)
+			}
+			states = append(states, state)
+		}
+	}
+
+	sweeps, err := ex.sweeps.GetSweeps(states...)
+	if err != nil {
+		return err
+	}
+	if sweeps == nil {
+		sweeps = []Sweep{}
+	}
+
+	return c.JSON(http.StatusOK, sweeps)
+}
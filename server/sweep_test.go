@@ -0,0 +1,108 @@
+package server
+
+import (
+	"math/big"
+	"net/http"
+	"testing"
+
+	"github.com/anakinrm/crypto-exchange/server/cryptoClient"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const testColdAddress = "0x00000000000000000000000000000000000000Cc"
+
+func TestSweeps(t *testing.T) {
+	ex, e := newTestExchange(t, 1, 2)
+	ex.SetAdminToken(testAdminToken)
+	sim := newTestChain(t, ex, 100)
+	ex.SetSweepPolicy(SweepPolicy{Threshold: 1, HotCeiling: 98, ColdAddress: testColdAddress})
+	eth := ex.chain.Eth
+	hot := crypto.PubkeyToAddress(ex.PrivateKey.PublicKey)
+
+	sendTestDeposit(t, ex, 1, 5)
+	// below the threshold
+	sendTestDeposit(t, ex, 2, 0.5)
+	sim.Commit()
+
+	ex.processSweeps()
+	// the sweep is on its way, the address is not swept twice
+	ex.processSweeps()
+	sweeps, _ := ex.sweeps.GetSweeps()
+	assert(t, len(sweeps), 1)
+	swept := sweeps[0]
+	assert(t, swept.Kind, SweepDeposit)
+	assert(t, swept.UserID, int64(1))
+	assert(t, swept.To, hot.Hex())
+	assert(t, swept.State, SweepSent)
+	assert(t, swept.Amount+swept.Fee, 5.0)
+
+	sim.Commit()
+	ex.processSweeps()
+	user1, _ := depositAddress(ex.Users[1])
+	left, _ := eth.BalanceAt(user1)
+	assert(t, left.Sign(), 0)
+	user2, _ := depositAddress(ex.Users[2])
+	left, _ = eth.BalanceAt(user2)
+	assert(t, left, eth.FloatToBigInt(0.5))
+
+	// the sweep took the hot wallet above its ceiling
+	hotBalance, _ := eth.BalanceAt(hot)
+	excess := new(big.Int).Sub(hotBalance, eth.FloatToBigInt(98))
+	sweeps, _ = ex.sweeps.GetSweeps()
+	assert(t, len(sweeps), 2)
+	assert(t, sweeps[0].State, SweepConfirmed)
+	assert(t, sweeps[1].Kind, SweepCold)
+	assert(t, sweeps[1].To, common.HexToAddress(testColdAddress).Hex())
+
+	sim.Commit()
+	ex.processSweeps()
+	cold, _ := eth.BalanceAt(common.HexToAddress(testColdAddress))
+	assert(t, cold, excess)
+	hotBalance, _ = eth.BalanceAt(hot)
+	assert(t, hotBalance.Cmp(eth.FloatToBigInt(98)) < 0, true)
+
+	rec := doAdminRequest(e, http.MethodGet, "/v1/admin/sweeps?state=confirmed", nil)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, len(decodeTestResponse[[]Sweep](t, rec)), 2)
+	rec = doAdminRequest(e, http.MethodGet, "/v1/admin/sweeps?state=LOST", nil)
+	assert(t, rec.Code, http.StatusBadRequest)
+}
+
+func TestSweepSentWithoutAnswer(t *testing.T) {
+	ex, _ := newTestExchange(t)
+	sim := newTestChain(t, ex, 100)
+	backend := &unansweredBackend{Client: sim.Client()}
+	ex.SetChainClient(&cryptoClient.Client{Eth: cryptoClient.NewEthClientWithBackend(backend, 1337)})
+	ex.SetSweepPolicy(SweepPolicy{Threshold: 1, HotCeiling: 98, ColdAddress: testColdAddress})
+	eth := ex.chain.Eth
+
+	// the transaction got lost, the sweep waits for its nonce to be taken
+	ex.processSweeps()
+	sim.Commit()
+	ex.processSweeps()
+	sweeps, _ := ex.sweeps.GetSweeps()
+	assert(t, len(sweeps), 1)
+	assert(t, sweeps[0].State, SweepSent)
+	assert(t, sweeps[0].Nonce, uint64(0))
+
+	// another transaction of the hot wallet took it, the excess is sent again
+	backend.deliver = true
+	eth.Transfer(ex.PrivateKey, common.HexToAddress(testWithdrawalAddress), eth.FloatToBigInt(0.5))
+	sim.Commit()
+	ex.processSweeps()
+	sweeps, _ = ex.sweeps.GetSweeps()
+	assert(t, len(sweeps), 2)
+	assert(t, sweeps[0].State, SweepFailed)
+	assert(t, sweeps[0].Reason, "transaction dropped")
+	assert(t, sweeps[1].State, SweepSent)
+	assert(t, sweeps[1].Nonce, uint64(1))
+
+	// this one reached the chain despite the error
+	sim.Commit()
+	ex.processSweeps()
+	sweeps, _ = ex.sweeps.GetSweeps()
+	assert(t, sweeps[1].State, SweepConfirmed)
+	cold, _ := eth.BalanceAt(common.HexToAddress(testColdAddress))
+	assert(t, cold, eth.FloatToBigInt(sweeps[1].Amount))
+}
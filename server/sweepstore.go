@@ -0,0 +1,134 @@
+package server
+
+import (
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/anakinrm/crypto-exchange/server/db"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+// SweepStore keeps the record of the sweeps.
+type SweepStore interface {
+	// SaveSweep inserts the sweep or replaces the one with the same ID
+	SaveSweep(s Sweep) error
+	// GetSweeps returns the sweeps in any of the states, oldest first, all of
+	// them without states
+	GetSweeps(states ...SweepState) ([]Sweep, error)
+	// LastSweepID returns the highest ID handed out, 0 before the first
+	// sweep
+	LastSweepID() (int64, error)
+}
+
+// MemorySweepStore is a SweepStore that lives as long as the process.
+type MemorySweepStore struct {
+	mu     sync.RWMutex
+	sweeps map[int64]Sweep
+}
+
+func NewMemorySweepStore() *MemorySweepStore {
+	return &MemorySweepStore{
+		sweeps: make(map[int64]Sweep),
+	}
+}
+
+func (s *MemorySweepStore) SaveSweep(sweep Sweep) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweeps[sweep.ID] = sweep
+	return nil
+}
+
+func (s *MemorySweepStore) GetSweeps(states ...SweepState) ([]Sweep, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sweeps := []Sweep{}
+	for _, sweep := range s.sweeps {
+		if len(states) == 0 || slices.Contains(states, sweep.State) {
+			sweeps = append(sweeps, sweep)
+		}
+	}
+	sort.Slice(sweeps, func(i, j int) bool { return sweeps[i].ID < sweeps[j].ID })
+
+	return sweeps, nil
+}
+
+func (s *MemorySweepStore) LastSweepID() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var last int64
+	for id := range s.sweeps {
+		last = max(last, id)
+	}
+	return last, nil
+}
+
+// MongoSweepStore is a SweepStore backed by the sweeps collection, the db has
+// to be initialized with db.InitializeMongo first.
+type MongoSweepStore struct{}
+
+func NewMongoSweepStore() *MongoSweepStore {
+	return &MongoSweepStore{}
+}
+
+func (s *MongoSweepStore) SaveSweep(sweep Sweep) error {
+	sweepDB := db.Sweep{
+		ID:        sweep.ID,
+		Kind:      string(sweep.Kind),
+		UserID:    sweep.UserID,
+		Asset:     string(sweep.Asset),
+		From:      sweep.From,
+		To:        sweep.To,
+		Amount:    sweep.Amount,
+		Fee:       sweep.Fee,
+		TxHash:    sweep.TxHash,
+		Nonce:     int64(sweep.Nonce),
+		State:     string(sweep.State),
+		Reason:    sweep.Reason,
+		CreatedAt: sweep.CreatedAt,
+		UpdatedAt: sweep.UpdatedAt,
+	}
+
+	return sweepDB.UpsertSweep()
+}
+
+func (s *MongoSweepStore) GetSweeps(states ...SweepState) ([]Sweep, error) {
+	names := make([]string, len(states))
+	for i, state := range states {
+		names[i] = string(state)
+	}
+
+	sweepsDB, err := db.GetSweepsByState(names...)
+	if err != nil {
+		return nil, err
+	}
+
+	sweeps := make([]Sweep, len(sweepsDB))
+	for i, s := range sweepsDB {
+		sweeps[i] = Sweep{
+			ID:        s.ID,
+			Kind:      SweepKind(s.Kind),
+			UserID:    s.UserID,
+			Asset:     token.Asset(s.Asset),
+			From:      s.From,
+			To:        s.To,
+			Amount:    s.Amount,
+			Fee:       s.Fee,
+			TxHash:    s.TxHash,
+			Nonce:     uint64(s.Nonce),
+			State:     SweepState(s.State),
+			Reason:    s.Reason,
+			CreatedAt: s.CreatedAt,
+			UpdatedAt: s.UpdatedAt,
+		}
+	}
+	return sweeps, nil
+}
+
+func (s *MongoSweepStore) LastSweepID() (int64, error) {
+	return db.GetLastSweepID()
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/anakinrm/crypto-exchange/server/cryptoClient"
 	"github.com/anakinrm/crypto-exchange/server/db"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
@@ -37,7 +38,7 @@ func (e *Eth) NewToken() Token {
 			PublicKey:       address,
 			Balance:         0.0,
 			privateKey:      string(crypto.FromECDSA(privateKey)),
-			name:            MarketETH,
+			name:            AssetETH,
 			lastAddrBalance: 0.0,
 		},
 	}
@@ -45,12 +46,17 @@ func (e *Eth) NewToken() Token {
 
 // CheckDeposit checks if there has been a deposit to the ETH address.
 // This logic is specific to Eth, so it's implemented here.
+//
+// Deprecated: it credits a balance change without waiting for
+// confirmations, the exchange picks up the deposits by scanning the blocks.
 func (e *Eth) CheckDeposit(c cryptoClient.Client) (bool, error) {
 	walletBalance, err := c.Eth.GetBalance(e.PublicKey)
 	if err != nil {
+		cryptoClient.RecordDeposit(string(AssetETH), err)
 		return false, err
 	}
 	if walletBalance != e.lastAddrBalance {
+		cryptoClient.RecordDeposit(string(AssetETH), nil)
 		e.Balance += (walletBalance - e.lastAddrBalance)
 		e.lastAddrBalance = walletBalance
 		return true, nil
@@ -60,8 +66,10 @@ func (e *Eth) CheckDeposit(c cryptoClient.Client) (bool, error) {
 
 // Withdraw attempts to withdraw a specified amount to a given address.
 // This logic is specific to Eth, so it's implemented here.
-func (e *Eth) Withdraw(c cryptoClient.Client, addr string, amount float64) (float64, error) {
-	privKey, err := crypto.HexToECDSA(e.privateKey)
+func (e *Eth) Withdraw(c cryptoClient.Client, addr string, amount float64) (left float64, err error) {
+	defer func() { cryptoClient.RecordWithdrawal(string(AssetETH), err) }()
+
+	privKey, err := e.key()
 	if err != nil {
 		return 0.0, err
 	}
@@ -99,28 +107,41 @@ func (e *Eth) Withdraw(c cryptoClient.Client, addr string, amount float64) (floa
 // SendToExchange sends all available balance to the specified exchange address.
 // This logic is specific to Eth, so it's implemented here.
 func (e *Eth) SendToExchange(c cryptoClient.Client, addr string) (bool, error) {
-	walletBalance, err := c.Eth.GetBalance(e.PublicKey)
-	if err != nil {
+	if _, err := e.Sweep(c, common.HexToAddress(addr)); err != nil {
 		return false, err
 	}
+	e.lastAddrBalance = 0.0
+	e.Balance = 0.0 // update local balance after sending all funds
+	return true, nil
+}
 
-	privKey, err := crypto.HexToECDSA(e.privateKey)
+// Sweep sends the whole on-chain balance of the address to another one,
+// less the gas the transfer costs, and returns the transaction.
+func (e *Eth) Sweep(c cryptoClient.Client, to common.Address) (*types.Transaction, error) {
+	privKey, err := e.key()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	err = c.Eth.TransferETH(privKey, common.HexToAddress(addr), c.Eth.FloatToBigInt(walletBalance))
+	tx, err := c.Eth.SignSweep(privKey, to)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	e.lastAddrBalance = 0.0
-	e.Balance = 0.0 // update local balance after sending all funds
-	return true, nil
+	return tx, c.Eth.SendTransaction(tx)
+}
+
+// key parses the private key of the address. New keys are kept as their raw
+// bytes, hex encoded ones are accepted too.
+func (e *Eth) key() (*ecdsa.PrivateKey, error) {
+	if len(e.privateKey) == 32 {
+		return crypto.ToECDSA([]byte(e.privateKey))
+	}
+	return crypto.HexToECDSA(e.privateKey)
 }
 
-func (e *Eth) GetTokenFromDataBase(wallet db.Wallet) (Token, error) {
+func (e *Eth) GetTokenFromDataBase(wallet db.Wallet, key []byte) (Token, error) {
 
-	privKey, err := wallet.GetDecryptPrivateKey()
+	privKey, err := wallet.GetDecryptPrivateKey(key)
 	if err != nil {
 		return nil, err
 	}
@@ -130,7 +151,7 @@ func (e *Eth) GetTokenFromDataBase(wallet db.Wallet) (Token, error) {
 			PublicKey:       wallet.PublicKey,
 			Balance:         wallet.Balance,
 			privateKey:      privKey,
-			name:            MarketETH,
+			name:            AssetETH,
 			lastAddrBalance: wallet.LastAddrBalance,
 		},
 	}, nil
@@ -0,0 +1,52 @@
+package token
+
+import (
+	"fmt"
+
+	"github.com/anakinrm/crypto-exchange/server/cryptoClient"
+	"github.com/anakinrm/crypto-exchange/server/db"
+)
+
+// OffChain is a token of an asset without a chain implementation yet. It can
+// be held and traded inside the exchange, but not deposited or withdrawn.
+type OffChain struct {
+	BaseToken
+}
+
+func NewOffChain(asset Asset) *OffChain {
+	return &OffChain{
+		BaseToken: BaseToken{
+			name: asset,
+		},
+	}
+}
+
+// NewToken creates a new instance of the off-chain token, it has no address.
+func (o *OffChain) NewToken() Token {
+	return NewOffChain(o.name)
+}
+
+func (o *OffChain) CheckDeposit(c cryptoClient.Client) (bool, error) {
+	err := fmt.Errorf("%s has no chain implementation", o.name)
+	cryptoClient.RecordDeposit(string(o.name), err)
+	return false, err
+}
+
+func (o *OffChain) Withdraw(c cryptoClient.Client, addr string, amount float64) (float64, error) {
+	err := fmt.Errorf("%s has no chain implementation", o.name)
+	cryptoClient.RecordWithdrawal(string(o.name), err)
+	return amount, err
+}
+
+func (o *OffChain) SendToExchange(c cryptoClient.Client, addr string) (bool, error) {
+	return false, fmt.Errorf("%s has no chain implementation", o.name)
+}
+
+func (o *OffChain) GetTokenFromDataBase(wallet db.Wallet, key []byte) (Token, error) {
+	return &OffChain{
+		BaseToken: BaseToken{
+			Balance: wallet.Balance,
+			name:    Asset(wallet.TokenType),
+		},
+	}, nil
+}
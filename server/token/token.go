@@ -2,23 +2,72 @@ package token
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/anakinrm/crypto-exchange/server/cryptoClient"
 	"github.com/anakinrm/crypto-exchange/server/db"
 )
 
 const (
-	MarketETH Market = "ETH"
+	AssetETH  Asset = "ETH"
+	AssetBTC  Asset = "BTC"
+	AssetUSDT Asset = "USDT"
+
+	MarketETHUSDT Market = "ETH-USDT"
+	MarketBTCUSDT Market = "BTC-USDT"
+	MarketETHBTC  Market = "ETH-BTC"
 )
 
 type (
+	Asset string
+
+	// Market is a trading pair written as BASE-QUOTE, like ETH-USDT.
 	Market string
+
+	// Pair is the base asset traded in a market and the quote asset its price
+	// is expressed in.
+	Pair struct {
+		Base  Asset
+		Quote Asset
+	}
 )
 
-// tokenRegistry holds the initial token definitions.
-// We have Eth as an example. Others could be added similarly.
-var tokenRegistry = map[Market]Token{
-	MarketETH: &Eth{},
+func NewMarket(base, quote Asset) Market {
+	return Market(string(base) + "-" + string(quote))
+}
+
+// Pair splits the market into its base and quote asset.
+func (m Market) Pair() (Pair, error) {
+	base, quote, ok := strings.Cut(string(m), "-")
+	if !ok || base == "" || quote == "" || base == quote {
+		return Pair{}, fmt.Errorf("invalid market: %s", m)
+	}
+
+	return Pair{Base: Asset(base), Quote: Asset(quote)}, nil
+}
+
+// tokenRegistry holds the initial token definitions, every asset the
+// exchange knows about has an entry. Eth lives on-chain, the others are only
+// tracked in the exchange until they get a chain implementation.
+var tokenRegistry = map[Asset]Token{
+	AssetETH:  &Eth{},
+	AssetBTC:  NewOffChain(AssetBTC),
+	AssetUSDT: NewOffChain(AssetUSDT),
+}
+
+// Assets returns every asset held in the wallets.
+func Assets() []Asset {
+	assets := make([]Asset, 0, len(tokenRegistry))
+	for asset := range tokenRegistry {
+		assets = append(assets, asset)
+	}
+	return assets
+}
+
+// IsKnownAsset reports whether the asset has a token definition.
+func IsKnownAsset(asset Asset) bool {
+	_, ok := tokenRegistry[asset]
+	return ok
 }
 
 // Token interface acts like an abstract parent class, requiring all methods to be implemented.
@@ -32,8 +81,9 @@ type Token interface {
 	SendToExchange(cryptoClient.Client, string) (bool, error)
 	AddBalance(float64) error
 	SubBalance(float64) error
-	StoreTokenToDataBase(int64) error
-	GetTokenFromDataBase(db.Wallet) (Token, error)
+	// the private keys are encrypted under the 32 byte key in the database
+	StoreTokenToDataBase(userID int64, key []byte) error
+	GetTokenFromDataBase(wallet db.Wallet, key []byte) (Token, error)
 }
 
 // BaseToken provides common fields and methods for tokens.
@@ -43,11 +93,11 @@ type BaseToken struct {
 	PublicKey       string
 	Balance         float64
 	privateKey      string
-	name            Market
+	name            Asset
 	lastAddrBalance float64
 }
 
-func (b *BaseToken) StoreTokenToDataBase(userID int64) error {
+func (b *BaseToken) StoreTokenToDataBase(userID int64, key []byte) error {
 
 	w := db.Wallet{
 		UserID:          userID,
@@ -56,7 +106,7 @@ func (b *BaseToken) StoreTokenToDataBase(userID int64) error {
 		Balance:         b.Balance,
 		LastAddrBalance: b.lastAddrBalance,
 	}
-	err := w.SetEncryptPrivateKey(b.privateKey)
+	err := w.SetEncryptPrivateKey(key, b.privateKey)
 	if err != nil {
 		return err
 	}
@@ -103,8 +153,8 @@ func (b *BaseToken) SubBalance(amount float64) error {
 }
 
 // GenerateWallet creates a new wallet map with fresh token instances.
-func GenerateWallet() (map[Market]Token, error) {
-	wallet := make(map[Market]Token)
+func GenerateWallet() (map[Asset]Token, error) {
+	wallet := make(map[Asset]Token)
 	for name, token := range tokenRegistry {
 		// Call NewToken to generate a new instance of each token
 		wallet[name] = token.NewToken()
@@ -112,10 +162,11 @@ func GenerateWallet() (map[Market]Token, error) {
 	return wallet, nil
 }
 
-// store the tokens in the wallet into database
-func StoreWalletInDataBase(wallet map[Market]Token, userID int64) error {
+// store the tokens in the wallet into database, the private keys encrypted
+// under the key
+func StoreWalletInDataBase(wallet map[Asset]Token, userID int64, key []byte) error {
 	for _, v := range wallet {
-		err := v.StoreTokenToDataBase(userID)
+		err := v.StoreTokenToDataBase(userID, key)
 		if err != nil {
 			return err
 		}
@@ -123,21 +174,39 @@ func StoreWalletInDataBase(wallet map[Market]Token, userID int64) error {
 	return nil
 }
 
-func GetWalletFromDataBase(userID int64) (map[Market]Token, error) {
+func GetWalletFromDataBase(userID int64, key []byte) (map[Asset]Token, error) {
 	walletDB, err := db.GetWalletsByUserID(userID)
 	if err != nil {
 		return nil, err
 	}
 
-	wallet := make(map[Market]Token)
+	wallet := make(map[Asset]Token)
 
 	for _, v := range walletDB {
+		t, ok := tokenRegistry[Asset(v.TokenType)]
+		if !ok {
+			return nil, fmt.Errorf("unknown asset: %s", v.TokenType)
+		}
 
-		wallet[Market(v.TokenType)], err = tokenRegistry[Market(v.TokenType)].GetTokenFromDataBase(v)
+		wallet[Asset(v.TokenType)], err = t.GetTokenFromDataBase(v, key)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	// assets listed after the wallet was stored, or whose token was never
+	// written, get a token that is stored before it is handed out, so their
+	// deposit address stays the same from one start to the next
+	for asset, t := range tokenRegistry {
+		if _, ok := wallet[asset]; ok {
+			continue
+		}
+		token := t.NewToken()
+		if err := token.StoreTokenToDataBase(userID, key); err != nil {
+			return nil, fmt.Errorf("storing new %s token: %w", asset, err)
+		}
+		wallet[asset] = token
+	}
+
 	return wallet, nil
 }
@@ -0,0 +1,422 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// the RFC 6238 defaults every authenticator app understands
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew accepts codes of the steps right before and after the current
+	// one, to cover clock drift
+	totpSkew = 1
+
+	totpIssuer        = "crypto-exchange"
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrTOTPNotEnrolled = errors.New("two-factor authentication not enrolled")
+	ErrTOTPEnrolled    = errors.New("two-factor authentication already enabled")
+	ErrTOTPRequired    = errors.New("two-factor code required")
+	ErrInvalidTOTP     = errors.New("invalid two-factor code")
+
+	base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// hotp is the RFC 4226 one-time password of the counter.
+func hotp(key []byte, counter uint64, digits int) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// TOTPCode returns the code of the base32 secret at the time.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("invalid totp secret: %w", err)
+	}
+	return hotp(key, uint64(totpStep(t)), totpDigits), nil
+}
+
+// validateTOTP returns the step the code is valid for, codes of steps up to
+// lastStep were used already and are rejected.
+func validateTOTP(secret, code string, lastStep int64, t time.Time) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := totpStep(t)
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step), totpDigits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPURI is the otpauth provisioning URI authenticator apps read from a QR
+// code.
+func TOTPURI(account, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + account)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func generateTOTPSecret() (string, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(key), nil
+}
+
+func generateRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b)
+		code = code[:5] + "-" + code[5:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// TOTPEnrollment is the two-factor state of a user. An enrollment only
+// protects the user once it was confirmed with a first code.
+type TOTPEnrollment struct {
+	UserID  int64
+	Secret  string
+	Enabled bool
+	// RecoveryCodes holds the hashes of the unused recovery codes
+	RecoveryCodes []string
+	// LastStep is the step of the last accepted code, so a code can not be
+	// used twice
+	LastStep int64
+}
+
+// TOTPStore keeps the two-factor enrollments.
+type TOTPStore interface {
+	SaveTOTP(TOTPEnrollment) error
+	// GetTOTP returns ErrTOTPNotEnrolled when the user has no enrollment.
+	GetTOTP(userID int64) (TOTPEnrollment, error)
+	DeleteTOTP(userID int64) error
+}
+
+// MemoryTOTPStore keeps the enrollments in memory only.
+type MemoryTOTPStore struct {
+	mu          sync.RWMutex
+	enrollments map[int64]TOTPEnrollment
+}
+
+func NewMemoryTOTPStore() *MemoryTOTPStore {
+	return &MemoryTOTPStore{
+		enrollments: make(map[int64]TOTPEnrollment),
+	}
+}
+
+func (s *MemoryTOTPStore) SaveTOTP(e TOTPEnrollment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.RecoveryCodes = append([]string{}, e.RecoveryCodes...)
+	s.enrollments[e.UserID] = e
+	return nil
+}
+
+func (s *MemoryTOTPStore) GetTOTP(userID int64) (TOTPEnrollment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.enrollments[userID]
+	if !ok {
+		return TOTPEnrollment{}, ErrTOTPNotEnrolled
+	}
+	e.RecoveryCodes = append([]string{}, e.RecoveryCodes...)
+	return e, nil
+}
+
+func (s *MemoryTOTPStore) DeleteTOTP(userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.enrollments, userID)
+	return nil
+}
+
+// MongoTOTPStore keeps the enrollments in the totp collection with their
+// secrets encrypted under the key, the db has to be initialized with
+// db.InitializeMongo first.
+type MongoTOTPStore struct {
+	key []byte
+}
+
+func NewMongoTOTPStore(key []byte) (*MongoTOTPStore, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("totp encryption key must be 32 bytes, got %d", len(key))
+	}
+	return &MongoTOTPStore{key: key}, nil
+}
+
+func (s *MongoTOTPStore) SaveTOTP(e TOTPEnrollment) error {
+	secret, err := db.EncryptSecret(s.key, e.Secret)
+	if err != nil {
+		return err
+	}
+
+	record := db.TOTP{
+		UserID:        e.UserID,
+		Secret:        secret,
+		Enabled:       e.Enabled,
+		RecoveryCodes: e.RecoveryCodes,
+		LastStep:      e.LastStep,
+	}
+	return record.UpsertTOTP()
+}
+
+func (s *MongoTOTPStore) GetTOTP(userID int64) (TOTPEnrollment, error) {
+	record := db.TOTP{UserID: userID}
+	if err := record.GetTOTPByUserID(); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return TOTPEnrollment{}, ErrTOTPNotEnrolled
+		}
+		return TOTPEnrollment{}, err
+	}
+
+	secret, err := db.DecryptSecret(s.key, record.Secret)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	return TOTPEnrollment{
+		UserID:        record.UserID,
+		Secret:        secret,
+		Enabled:       record.Enabled,
+		RecoveryCodes: record.RecoveryCodes,
+		LastStep:      record.LastStep,
+	}, nil
+}
+
+func (s *MongoTOTPStore) DeleteTOTP(userID int64) error {
+	record := db.TOTP{UserID: userID}
+	return record.DeleteTOTP()
+}
+
+// SetTOTPStore replaces the store keeping the two-factor enrollments, it has
+// to be called before any user enrolls.
+func (ex *Exchange) SetTOTPStore(store TOTPStore) {
+	ex.totp = store
+}
+
+// verifySecondFactor checks the TOTP or recovery code of a user that enabled
+// two-factor authentication. Users without it pass with any code. Login,
+// withdrawals and API key creation go through it.
+func (ex *Exchange) verifySecondFactor(userID int64, code string) error {
+	ex.totpMu.Lock()
+	defer ex.totpMu.Unlock()
+
+	enrollment, err := ex.totp.GetTOTP(userID)
+	if errors.Is(err, ErrTOTPNotEnrolled) || (err == nil && !enrollment.Enabled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if code == "" {
+		return ErrTOTPRequired
+	}
+
+	if step, ok := validateTOTP(enrollment.Secret, code, enrollment.LastStep, time.Now()); ok {
+		enrollment.LastStep = step
+		return ex.totp.SaveTOTP(enrollment)
+	}
+
+	// recovery codes work once
+	hash := hashRecoveryCode(code)
+	for i, h := range enrollment.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			enrollment.RecoveryCodes = append(enrollment.RecoveryCodes[:i], enrollment.RecoveryCodes[i+1:]...)
+			logrus.WithFields(logrus.Fields{
+				"userID": userID,
+				"left":   len(enrollment.RecoveryCodes),
+			}).Warn("recovery code used")
+			return ex.totp.SaveTOTP(enrollment)
+		}
+	}
+
+	return ErrInvalidTOTP
+}
+
+type EnrollTOTPResponse struct {
+	Secret string
+	URI    string
+}
+
+type TOTPCodeRequest struct {
+	Code string
+}
+
+type ConfirmTOTPResponse struct {
+	// RecoveryCodes are shown once, each of them replaces a code one time
+	RecoveryCodes []string
+}
+
+// handleEnrollTOTP starts an enrollment with a new secret. It replaces an
+// enrollment that was not confirmed yet.
+func (ex *Exchange) handleEnrollTOTP(c echo.Context) error {
+	userID := authUserID(c)
+
+	ex.totpMu.Lock()
+	defer ex.totpMu.Unlock()
+
+	enrollment, err := ex.totp.GetTOTP(userID)
+	if err == nil && enrollment.Enabled {
+		return newError(http.StatusConflict, ErrTOTPEnrolled)
+	}
+	if err != nil && !errors.Is(err, ErrTOTPNotEnrolled) {
+		return err
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return err
+	}
+	if err := ex.totp.SaveTOTP(TOTPEnrollment{UserID: userID, Secret: secret}); err != nil {
+		return err
+	}
+
+	ex.mu.RLock()
+	account := ex.Users[userID].UserName
+	ex.mu.RUnlock()
+
+	return c.JSON(http.StatusOK, EnrollTOTPResponse{
+		Secret: secret,
+		URI:    TOTPURI(account, secret),
+	})
+}
+
+// handleConfirmTOTP enables two-factor authentication with the first code of
+// the enrolled secret and hands out the recovery codes.
+func (ex *Exchange) handleConfirmTOTP(c echo.Context) error {
+	userID := authUserID(c)
+
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	ex.totpMu.Lock()
+	defer ex.totpMu.Unlock()
+
+	enrollment, err := ex.totp.GetTOTP(userID)
+	if errors.Is(err, ErrTOTPNotEnrolled) {
+		return newError(http.StatusNotFound, err)
+	}
+	if err != nil {
+		return err
+	}
+	if enrollment.Enabled {
+		return newError(http.StatusConflict, ErrTOTPEnrolled)
+	}
+
+	step, ok := validateTOTP(enrollment.Secret, req.Code, enrollment.LastStep, time.Now())
+	if !ok {
+		return newError(http.StatusUnauthorized, ErrInvalidTOTP)
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	enrollment.Enabled = true
+	enrollment.LastStep = step
+	enrollment.RecoveryCodes = hashes
+	if err := ex.totp.SaveTOTP(enrollment); err != nil {
+		return err
+	}
+
+	logrus.WithField("userID", userID).Info("two-factor authentication enabled")
+
+	return c.JSON(http.StatusOK, ConfirmTOTPResponse{RecoveryCodes: codes})
+}
+
+// handleDisableTOTP turns two-factor authentication off, it takes a valid
+// code to do so.
+func (ex *Exchange) handleDisableTOTP(c echo.Context) error {
+	userID := authUserID(c)
+
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	if err := ex.verifySecondFactor(userID, req.Code); err != nil {
+		return newError(http.StatusUnauthorized, err)
+	}
+
+	ex.totpMu.Lock()
+	defer ex.totpMu.Unlock()
+
+	if err := ex.totp.DeleteTOTP(userID); err != nil {
+		return err
+	}
+
+	logrus.WithField("userID", userID).Warn("two-factor authentication disabled")
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "two-factor authentication disabled"})
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// test vectors of RFC 6238 for SHA1
+	key := []byte("12345678901234567890")
+	for _, v := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+	} {
+		assert(t, hotp(key, uint64(totpStep(time.Unix(v.unix, 0))), 8), v.code)
+	}
+
+	secret := base32.StdEncoding.EncodeToString(key)
+	code, err := TOTPCode(secret, time.Unix(59, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, code, "287082")
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	code, _ := TOTPCode(secret, now)
+
+	step, ok := validateTOTP(secret, code, 0, now)
+	assert(t, ok, true)
+	assert(t, step, totpStep(now))
+
+	// one step of clock drift is fine, two are not
+	_, ok = validateTOTP(secret, code, 0, now.Add(totpPeriod))
+	assert(t, ok, true)
+	_, ok = validateTOTP(secret, code, 0, now.Add(2*totpPeriod))
+	assert(t, ok, false)
+
+	// a used code does not work twice
+	_, ok = validateTOTP(secret, code, step, now)
+	assert(t, ok, false)
+
+	_, ok = validateTOTP(secret, "000000", 0, now)
+	assert(t, ok, false)
+
+	uri := TOTPURI("anakin", secret)
+	assert(t, strings.HasPrefix(uri, "otpauth://totp/crypto-exchange:anakin?"), true)
+	assert(t, strings.Contains(uri, "secret="+secret), true)
+}
+
+func enrollTestTOTP(t *testing.T, ex *Exchange, token string) (string, []string) {
+	e := newRouter(ex)
+
+	rec := doSessionRequest(e, token, http.MethodPost, "/users/me/totp", nil)
+	assert(t, rec.Code, http.StatusOK)
+	enroll := EnrollTOTPResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&enroll); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = doSessionRequest(e, token, http.MethodPost, "/users/me/totp/confirm", TOTPCodeRequest{Code: "000000"})
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	code, _ := TOTPCode(enroll.Secret, time.Now())
+	rec = doSessionRequest(e, token, http.MethodPost, "/users/me/totp/confirm", TOTPCodeRequest{Code: code})
+	assert(t, rec.Code, http.StatusOK)
+	confirm := ConfirmTOTPResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&confirm); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(confirm.RecoveryCodes), recoveryCodeCount)
+
+	return enroll.Secret, confirm.RecoveryCodes
+}
+
+func TestTOTPLogin(t *testing.T) {
+	ex, e := newTestExchange(t, 1)
+
+	registerTestUser(t, e, "anakin")
+	sess := loginTestUser(t, e, "anakin")
+	secret, _ := enrollTestTOTP(t, ex, sess.Token)
+
+	rec := doSessionRequest(e, sess.Token, http.MethodPost, "/users/me/totp", nil)
+	assert(t, rec.Code, http.StatusConflict)
+
+	rec = doRequest(e, http.MethodPost, "/sessions", LoginRequest{UserName: "anakin", Password: "correct horse"})
+	assert(t, rec.Code, http.StatusUnauthorized)
+	rec = doRequest(e, http.MethodPost, "/sessions", LoginRequest{UserName: "anakin", Password: "correct horse", TOTPCode: "000000"})
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	// the code used to confirm is spent, the next one works once
+	code, _ := TOTPCode(secret, time.Now().Add(totpPeriod))
+	rec = doRequest(e, http.MethodPost, "/sessions", LoginRequest{UserName: "anakin", Password: "correct horse", TOTPCode: code})
+	assert(t, rec.Code, http.StatusOK)
+	rec = doRequest(e, http.MethodPost, "/sessions", LoginRequest{UserName: "anakin", Password: "correct horse", TOTPCode: code})
+	assert(t, rec.Code, http.StatusUnauthorized)
+}
+
+func TestTOTPRecoveryCodes(t *testing.T) {
+	ex, e := newTestExchange(t, 1)
+	ex.SetAdminToken(testAdminToken)
+
+	registerTestUser(t, e, "anakin")
+	sess := loginTestUser(t, e, "anakin")
+	_, recovery := enrollTestTOTP(t, ex, sess.Token)
+
+	rec := doSessionRequest(e, sess.Token, http.MethodPost, "/apikeys", CreateAPIKeyRequest{Scopes: []Scope{ScopeRead}})
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	rec = doSessionRequest(e, sess.Token, http.MethodPost, "/apikeys", CreateAPIKeyRequest{Scopes: []Scope{ScopeRead}, TOTPCode: recovery[0]})
+	assert(t, rec.Code, http.StatusOK)
+	rec = doSessionRequest(e, sess.Token, http.MethodPost, "/apikeys", CreateAPIKeyRequest{Scopes: []Scope{ScopeRead}, TOTPCode: recovery[0]})
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	// admins create keys without the code of the user
+	rec = doAdminRequest(e, http.MethodPost, "/admin/users/2/apikeys", CreateAPIKeyRequest{Scopes: []Scope{ScopeRead}})
+	assert(t, rec.Code, http.StatusOK)
+
+	rec = doSessionRequest(e, sess.Token, http.MethodDelete, "/users/me/totp", TOTPCodeRequest{Code: recovery[1]})
+	assert(t, rec.Code, http.StatusOK)
+
+	rec = doSessionRequest(e, sess.Token, http.MethodPost, "/apikeys", CreateAPIKeyRequest{Scopes: []Scope{ScopeRead}})
+	assert(t, rec.Code, http.StatusOK)
+	loginTestUser(t, e, "anakin")
+}
@@ -1,8 +1,18 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+
 	"github.com/anakinrm/crypto-exchange/server/db"
 	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -12,11 +22,16 @@ type User struct {
 	hashedPassWd string
 	Email        string
 	Phone        int64
-	Wallet       map[token.Market]token.Token
+	Wallet       map[token.Asset]token.Token
+	// Frozen accounts can not place orders, admins freeze and unfreeze them
+	Frozen bool
 }
 
+// passwordCost is the bcrypt cost of the password hashes.
+var passwordCost = 14
+
 func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
 	return string(bytes), err
 }
 
@@ -25,16 +40,16 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-func NewUser(id int64, userName, passWd, email string, phone int64) *User {
+func NewUser(id int64, userName, passWd, email string, phone int64) (*User, error) {
 
 	wallet, err := token.GenerateWallet()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	hashedPassWd, err := HashPassword(passWd)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	return &User{
@@ -44,44 +59,42 @@ func NewUser(id int64, userName, passWd, email string, phone int64) *User {
 		Email:        email,
 		Phone:        phone,
 		Wallet:       wallet,
-	}
+	}, nil
 }
 
-func GetUserbyID(id int64) (*User, error) {
+// GetUserbyID reads the user and its wallet from the database, the private
+// keys of the wallet were encrypted under the key.
+func GetUserbyID(id int64, key []byte) (*User, error) {
 	user := User{
 		ID: id,
 	}
-	err := user.GetUserFromDataBase()
+	err := user.GetUserFromDataBase(key)
 	if err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
-func (user *User) StoreUserInDataBase() error {
+// StoreUserInDataBase stores the user and its wallet, the private keys of the
+// wallet encrypted under the key.
+func (user *User) StoreUserInDataBase(key []byte) error {
 	userDB := db.User{
 		ID:       user.ID,
 		UserName: user.UserName,
 		PassWD:   user.hashedPassWd,
 		Email:    user.Email,
 		Phone:    user.Phone,
+		Frozen:   user.Frozen,
 	}
 	err := userDB.InsertUser()
 	if err != nil {
 		return err
 	}
 
-	for _, v := range user.Wallet {
-		err = v.StoreTokenToDataBase(user.ID)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return token.StoreWalletInDataBase(user.Wallet, user.ID, key)
 }
 
-func (user *User) GetUserFromDataBase() error {
+func (user *User) GetUserFromDataBase(key []byte) error {
 	getUser := db.User{
 		ID: user.ID,
 	}
@@ -89,14 +102,156 @@ func (user *User) GetUserFromDataBase() error {
 	if err != nil {
 		return err
 	}
-	user.hashedPassWd = getUser.PassWD
-	user.Email = getUser.Email
-	user.Phone = getUser.Phone
-	user.UserName = getUser.UserName
-	user.Wallet, err = token.GetWalletFromDataBase(user.ID)
+	return user.setFromDataBase(getUser, key)
+}
+
+// setFromDataBase fills the user with what was stored of it and reads its
+// wallet.
+func (user *User) setFromDataBase(userDB db.User, key []byte) (err error) {
+	user.ID = userDB.ID
+	user.hashedPassWd = userDB.PassWD
+	user.Email = userDB.Email
+	user.Phone = userDB.Phone
+	user.UserName = userDB.UserName
+	user.Frozen = userDB.Frozen
+	user.Wallet, err = token.GetWalletFromDataBase(user.ID, key)
+	return err
+}
+
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrUserExists         = errors.New("user already exists")
+	ErrInvalidCredentials = errors.New("invalid user name or password")
+
+	userNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_]{3,32}$`)
+)
+
+type RegisterUserRequest struct {
+	UserName string
+	Password string
+	Email    string
+	Phone    int64
+}
+
+// UserResponse is what the API tells about a user, never the password hash
+// or the wallet keys.
+type UserResponse struct {
+	ID       int64
+	UserName string
+	Email    string
+	Phone    int64
+}
+
+func newUserResponse(user *User) UserResponse {
+	return UserResponse{
+		ID:       user.ID,
+		UserName: user.UserName,
+		Email:    user.Email,
+		Phone:    user.Phone,
+	}
+}
+
+func (req *RegisterUserRequest) Validate() error {
+	if !userNamePattern.MatchString(req.UserName) {
+		return fmt.Errorf("user name must be 3 to 32 letters, digits or underscores")
+	}
+	// bcrypt only looks at the first 72 bytes
+	if len(req.Password) < 8 || len(req.Password) > 72 {
+		return fmt.Errorf("password must be 8 to 72 characters")
+	}
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil || addr.Address != req.Email {
+		return fmt.Errorf("invalid email: %s", req.Email)
+	}
+	if req.Phone < 0 {
+		return fmt.Errorf("invalid phone: %d", req.Phone)
+	}
+	return nil
+}
+
+// registerUser creates the user with the next free ID and stores it. User
+// names and emails are unique, regardless of their case, among the users in
+// memory and the stored ones.
+func (ex *Exchange) registerUser(req RegisterUserRequest) (*User, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	// hashing is slow, it happens before the users are locked
+	user, err := NewUser(0, req.UserName, req.Password, req.Email, req.Phone)
+	if err != nil {
+		return nil, err
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	nextID, err := ex.userStore.LastUserID()
+	if err != nil {
+		return nil, err
+	}
+	nextID++
+	for id, u := range ex.Users {
+		if err := checkUserTaken(u, req.UserName, req.Email); err != nil {
+			return nil, err
+		}
+		if id >= nextID {
+			nextID = id + 1
+		}
+	}
+	user.ID = nextID
+	if err := ex.userStore.InsertUser(user); err != nil {
+		return nil, err
+	}
+	ex.Users[user.ID] = user
+
+	logrus.WithFields(logrus.Fields{
+		"id": user.ID,
+	}).Info("new exchange user")
+
+	return user, nil
+}
+
+// userByName looks a user up by name, regardless of its case.
+func (ex *Exchange) userByName(userName string) (*User, bool) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	for _, u := range ex.Users {
+		if strings.EqualFold(u.UserName, userName) {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+func (ex *Exchange) handleRegisterUser(c echo.Context) error {
+	var req RegisterUserRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	if err := req.Validate(); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	user, err := ex.registerUser(req)
+	if errors.Is(err, ErrUserExists) {
+		return newError(http.StatusConflict, err)
+	}
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return c.JSON(http.StatusCreated, newUserResponse(user))
+}
+
+func (ex *Exchange) handleGetCurrentUser(c echo.Context) error {
+	ex.mu.RLock()
+	user, ok := ex.Users[authUserID(c)]
+	ex.mu.RUnlock()
+	if !ok {
+		return newError(http.StatusNotFound, ErrUserNotFound)
+	}
+
+	return c.JSON(http.StatusOK, newUserResponse(user))
 }
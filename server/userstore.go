@@ -0,0 +1,322 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/anakinrm/crypto-exchange/server/db"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+// UserStore keeps the registered users with their wallets, and the fees
+// set for them.
+type UserStore interface {
+	// InsertUser stores a new user. It returns ErrUserExists when the user
+	// name or the email is taken, regardless of their case.
+	InsertUser(user *User) error
+	// LastUserID returns the highest ID of the stored users, 0 when there
+	// are none
+	LastUserID() (int64, error)
+	// GetUsers returns all the stored users with their wallets
+	GetUsers() ([]*User, error)
+	SetFrozen(userID int64, frozen bool) error
+	// SetFeeOverride stores the rates the user pays whatever their volume
+	// is, nil removes the override
+	SetFeeOverride(userID int64, rates *FeeRates) error
+	GetFeeOverrides() (map[int64]FeeRates, error)
+	SetFeeSchedule(schedule FeeSchedule) error
+	// GetFeeSchedule returns the schedule last set, nil when none was
+	GetFeeSchedule() (*FeeSchedule, error)
+}
+
+// MemoryUserStore is a UserStore that lives as long as the process.
+type MemoryUserStore struct {
+	mu        sync.RWMutex
+	users     map[int64]User
+	overrides map[int64]FeeRates
+	schedule  *FeeSchedule
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:     make(map[int64]User),
+		overrides: make(map[int64]FeeRates),
+	}
+}
+
+func (s *MemoryUserStore) InsertUser(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if err := checkUserTaken(&u, user.UserName, user.Email); err != nil {
+			return err
+		}
+	}
+	s.users[user.ID] = *user
+
+	return nil
+}
+
+func (s *MemoryUserStore) LastUserID() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var last int64
+	for id := range s.users {
+		last = max(last, id)
+	}
+	return last, nil
+}
+
+func (s *MemoryUserStore) GetUsers() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		user := u
+		users = append(users, &user)
+	}
+	return users, nil
+}
+
+func (s *MemoryUserStore) SetFrozen(userID int64, frozen bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[userID]; ok {
+		user.Frozen = frozen
+		s.users[userID] = user
+	}
+	return nil
+}
+
+func (s *MemoryUserStore) SetFeeOverride(userID int64, rates *FeeRates) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rates == nil {
+		delete(s.overrides, userID)
+	} else {
+		s.overrides[userID] = *rates
+	}
+	return nil
+}
+
+func (s *MemoryUserStore) GetFeeOverrides() (map[int64]FeeRates, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	overrides := make(map[int64]FeeRates, len(s.overrides))
+	for userID, rates := range s.overrides {
+		overrides[userID] = rates
+	}
+	return overrides, nil
+}
+
+func (s *MemoryUserStore) SetFeeSchedule(schedule FeeSchedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := schedule.clone()
+	s.schedule = &stored
+	return nil
+}
+
+func (s *MemoryUserStore) GetFeeSchedule() (*FeeSchedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.schedule == nil {
+		return nil, nil
+	}
+	schedule := s.schedule.clone()
+	return &schedule, nil
+}
+
+// checkUserTaken returns ErrUserExists when the user has the user name or the
+// email, regardless of their case.
+func checkUserTaken(user *User, userName, email string) error {
+	if strings.EqualFold(user.UserName, userName) {
+		return fmt.Errorf("%w: user name %s is taken", ErrUserExists, userName)
+	}
+	if user.Email != "" && strings.EqualFold(user.Email, email) {
+		return fmt.Errorf("%w: email %s is taken", ErrUserExists, email)
+	}
+	return nil
+}
+
+// MongoUserStore is a UserStore backed by the users, wallets, feeoverrides
+// and feeschedule collections. The private keys of the wallets are encrypted
+// under the key, the db has to be initialized with db.InitializeMongo first.
+type MongoUserStore struct {
+	key []byte
+}
+
+func NewMongoUserStore(key []byte) (*MongoUserStore, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("wallet encryption key must be 32 bytes, got %d", len(key))
+	}
+	return &MongoUserStore{key: key}, nil
+}
+
+func (s *MongoUserStore) InsertUser(user *User) error {
+	taken, err := db.GetUserByNameOrEmail(user.UserName, user.Email)
+	if err == nil {
+		return checkUserTaken(&User{UserName: taken.UserName, Email: taken.Email}, user.UserName, user.Email)
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+
+	// a user registering the same name or email at the same time is only
+	// caught by the unique indexes
+	err = user.StoreUserInDataBase(s.key)
+	if db.IsDuplicate(err) {
+		return fmt.Errorf("%w: user name %s or email %s is taken", ErrUserExists, user.UserName, user.Email)
+	}
+	return err
+}
+
+func (s *MongoUserStore) LastUserID() (int64, error) {
+	return db.GetLastUserID()
+}
+
+func (s *MongoUserStore) GetUsers() ([]*User, error) {
+	usersDB, err := db.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*User, len(usersDB))
+	for i, userDB := range usersDB {
+		users[i] = &User{}
+		if err := users[i].setFromDataBase(userDB, s.key); err != nil {
+			return nil, fmt.Errorf("user %d: %w", userDB.ID, err)
+		}
+	}
+	return users, nil
+}
+
+func (s *MongoUserStore) SetFrozen(userID int64, frozen bool) error {
+	return db.SetUserFrozen(userID, frozen)
+}
+
+func (s *MongoUserStore) SetFeeOverride(userID int64, rates *FeeRates) error {
+	if rates == nil {
+		return db.DeleteFeeOverride(userID)
+	}
+
+	override := db.FeeOverride{
+		UserID:    userID,
+		MakerRate: rates.MakerRate,
+		TakerRate: rates.TakerRate,
+	}
+	return override.UpsertFeeOverride()
+}
+
+func (s *MongoUserStore) GetFeeOverrides() (map[int64]FeeRates, error) {
+	overridesDB, err := db.GetFeeOverrides()
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[int64]FeeRates, len(overridesDB))
+	for _, o := range overridesDB {
+		overrides[o.UserID] = FeeRates{MakerRate: o.MakerRate, TakerRate: o.TakerRate}
+	}
+	return overrides, nil
+}
+
+func (s *MongoUserStore) SetFeeSchedule(schedule FeeSchedule) error {
+	scheduleDB := db.FeeSchedule{
+		Tiers:      feeTiersToDB(schedule.Tiers),
+		QuoteTiers: make(map[string][]db.FeeTier, len(schedule.QuoteTiers)),
+	}
+	for asset, tiers := range schedule.QuoteTiers {
+		scheduleDB.QuoteTiers[string(asset)] = feeTiersToDB(tiers)
+	}
+	return scheduleDB.UpsertFeeSchedule()
+}
+
+func (s *MongoUserStore) GetFeeSchedule() (*FeeSchedule, error) {
+	scheduleDB, err := db.GetFeeSchedule()
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := &FeeSchedule{Tiers: feeTiersFromDB(scheduleDB.Tiers)}
+	if len(scheduleDB.QuoteTiers) > 0 {
+		schedule.QuoteTiers = make(map[token.Asset][]FeeTier, len(scheduleDB.QuoteTiers))
+		for asset, tiers := range scheduleDB.QuoteTiers {
+			schedule.QuoteTiers[token.Asset(asset)] = feeTiersFromDB(tiers)
+		}
+	}
+	return schedule, nil
+}
+
+func feeTiersToDB(tiers []FeeTier) []db.FeeTier {
+	tiersDB := make([]db.FeeTier, len(tiers))
+	for i, t := range tiers {
+		tiersDB[i] = db.FeeTier{MinVolume: t.MinVolume, MakerRate: t.MakerRate, TakerRate: t.TakerRate}
+	}
+	return tiersDB
+}
+
+func feeTiersFromDB(tiersDB []db.FeeTier) []FeeTier {
+	tiers := make([]FeeTier, len(tiersDB))
+	for i, t := range tiersDB {
+		tiers[i] = FeeTier{MinVolume: t.MinVolume, MakerRate: t.MakerRate, TakerRate: t.TakerRate}
+	}
+	return tiers
+}
+
+// SetUserStore replaces the store keeping the registered users, it has to be
+// called before any user registers.
+func (ex *Exchange) SetUserStore(store UserStore) {
+	ex.userStore = store
+}
+
+// restoreUsers puts the stored users back into memory with their frozen state
+// and fee overrides, along with the fee schedule an admin set. It has to be
+// called before the orders are restored, so every order finds its user.
+func (ex *Exchange) restoreUsers() (int, error) {
+	users, err := ex.userStore.GetUsers()
+	if err != nil {
+		return 0, err
+	}
+	overrides, err := ex.userStore.GetFeeOverrides()
+	if err != nil {
+		return 0, err
+	}
+
+	ex.mu.Lock()
+	for _, user := range users {
+		ex.Users[user.ID] = user
+	}
+	ex.mu.Unlock()
+
+	for userID, rates := range overrides {
+		if err := ex.Fees.SetOverride(userID, rates); err != nil {
+			return 0, fmt.Errorf("fee override of user %d: %w", userID, err)
+		}
+	}
+
+	schedule, err := ex.userStore.GetFeeSchedule()
+	if err != nil {
+		return 0, err
+	}
+	if schedule != nil {
+		if err := ex.Fees.SetSchedule(*schedule); err != nil {
+			return 0, fmt.Errorf("fee schedule: %w", err)
+		}
+	}
+
+	return len(users), nil
+}
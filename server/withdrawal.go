@@ -0,0 +1,781 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/config"
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/cryptoClient"
+	"github.com/anakinrm/crypto-exchange/server/ledger"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// WithdrawalState is where a withdrawal is at. Withdrawals above the
+// approval threshold start out REQUESTED, the others are APPROVED right
+// away. Approved withdrawals are BROADCAST to the chain and CONFIRMED once
+// they have enough confirmations. The funds stay on hold until then and are
+// released when the withdrawal is CANCELLED or FAILED.
+type WithdrawalState string
+
+const (
+	WithdrawalRequested WithdrawalState = "REQUESTED"
+	WithdrawalApproved  WithdrawalState = "APPROVED"
+	WithdrawalBroadcast WithdrawalState = "BROADCAST"
+	WithdrawalConfirmed WithdrawalState = "CONFIRMED"
+	WithdrawalFailed    WithdrawalState = "FAILED"
+	WithdrawalCancelled WithdrawalState = "CANCELLED"
+)
+
+var withdrawalStates = []WithdrawalState{
+	WithdrawalRequested,
+	WithdrawalApproved,
+	WithdrawalBroadcast,
+	WithdrawalConfirmed,
+	WithdrawalFailed,
+	WithdrawalCancelled,
+}
+
+// withdrawalTransitions lists the states a withdrawal can move to from each
+// state, the final states have none.
+var withdrawalTransitions = map[WithdrawalState][]WithdrawalState{
+	WithdrawalRequested: {WithdrawalApproved, WithdrawalCancelled},
+	WithdrawalApproved:  {WithdrawalBroadcast, WithdrawalFailed, WithdrawalCancelled},
+	WithdrawalBroadcast: {WithdrawalConfirmed, WithdrawalFailed},
+}
+
+func (s WithdrawalState) canMoveTo(next WithdrawalState) bool {
+	return slices.Contains(withdrawalTransitions[s], next)
+}
+
+// withdrawalDay is the window the daily limits count the withdrawals of.
+const withdrawalDay = 24 * time.Hour
+
+var (
+	ErrWithdrawalNotFound    = errors.New("withdrawal not found")
+	ErrWithdrawalState       = errors.New("invalid withdrawal state")
+	ErrWithdrawalLimit       = errors.New("daily withdrawal limit exceeded")
+	ErrInvalidAddress        = errors.New("invalid withdrawal address")
+	ErrAddressNotWhitelisted = errors.New("withdrawal address not whitelisted")
+	ErrAddressCoolingDown    = errors.New("withdrawal address is cooling down")
+	ErrAddressWhitelisted    = errors.New("withdrawal address already whitelisted")
+)
+
+type Withdrawal struct {
+	ID      int64
+	UserID  int64
+	Asset   token.Asset
+	Amount  float64
+	Address string
+	State   WithdrawalState
+	// TxHash is the transaction of the withdrawal once it is broadcast,
+	// Nonce the nonce of the exchange wallet it was signed with
+	TxHash string `json:",omitempty"`
+	Nonce  uint64 `json:",omitempty"`
+	// Reason tells why a withdrawal was cancelled or failed
+	Reason    string `json:",omitempty"`
+	CreatedAt int64
+	UpdatedAt int64
+}
+
+// WithdrawalAddress is an address a user whitelisted. Funds can only be
+// withdrawn to it from UsableAt on, so a stolen session can not drain the
+// account to a new address right away.
+type WithdrawalAddress struct {
+	Asset    token.Asset
+	Address  string
+	Label    string `json:",omitempty"`
+	AddedAt  int64
+	UsableAt int64
+}
+
+type WithdrawRequest struct {
+	Asset   token.Asset
+	Amount  float64
+	Address string
+	// TOTPCode is required from users with two-factor authentication
+	TOTPCode string
+}
+
+type AddWithdrawalAddressRequest struct {
+	Asset   token.Asset
+	Address string
+	Label   string
+	// TOTPCode is required from users with two-factor authentication
+	TOTPCode string
+}
+
+type RejectWithdrawalRequest struct {
+	Reason string
+}
+
+// WithdrawalLimit caps the withdrawals of an asset.
+type WithdrawalLimit struct {
+	// Daily caps what a user withdraws in 24 hours, 0 does not cap it
+	Daily float64
+	// ApprovalThreshold is the amount above which an admin has to approve a
+	// withdrawal, 0 approves all of them automatically
+	ApprovalThreshold float64
+}
+
+// WithdrawalPolicy holds the risk checks every withdrawal goes through.
+type WithdrawalPolicy struct {
+	// AddressCooldown is how long an address has to be whitelisted before
+	// funds can be withdrawn to it
+	AddressCooldown time.Duration
+	// Confirmations is the number of blocks a withdrawal needs to be
+	// confirmed, counting its own
+	Confirmations uint64
+	// Limits of every asset, assets without limits are not capped
+	Limits map[token.Asset]WithdrawalLimit
+}
+
+var DefaultWithdrawalPolicy = WithdrawalPolicy{
+	AddressCooldown: 24 * time.Hour,
+	Confirmations:   12,
+	Limits: map[token.Asset]WithdrawalLimit{
+		token.AssetETH: {Daily: 100, ApprovalThreshold: 10},
+	},
+}
+
+// withdrawalPolicy is the policy of the withdrawals section of the config.
+func withdrawalPolicy(cfg config.Withdrawals) WithdrawalPolicy {
+	policy := WithdrawalPolicy{
+		AddressCooldown: cfg.AddressCooldown,
+		Confirmations:   uint64(cfg.Confirmations),
+		Limits:          make(map[token.Asset]WithdrawalLimit),
+	}
+	for _, l := range cfg.Limits {
+		policy.Limits[token.Asset(l.Asset)] = WithdrawalLimit{
+			Daily:             l.Daily,
+			ApprovalThreshold: l.ApprovalThreshold,
+		}
+	}
+	return policy
+}
+
+// SetWithdrawalStore replaces the store keeping the withdrawals, it has to be
+// called before any withdrawal is requested.
+func (ex *Exchange) SetWithdrawalStore(store WithdrawalStore) {
+	ex.withdrawals = store
+}
+
+// SetWithdrawalPolicy sets the risk checks of the withdrawals requested from
+// now on.
+func (ex *Exchange) SetWithdrawalPolicy(policy WithdrawalPolicy) {
+	ex.withdrawMu.Lock()
+	defer ex.withdrawMu.Unlock()
+
+	ex.withdrawalPolicy = policy
+}
+
+// normalizeAddress checks that the address can receive the asset and returns
+// it in its canonical form. Only the assets living on chain can be
+// withdrawn.
+func normalizeAddress(asset token.Asset, address string) (string, error) {
+	switch asset {
+	case token.AssetETH:
+		if !common.IsHexAddress(address) {
+			return "", fmt.Errorf("%w: %s", ErrInvalidAddress, address)
+		}
+		return common.HexToAddress(address).Hex(), nil
+	}
+	if !token.IsKnownAsset(asset) {
+		return "", fmt.Errorf("unknown asset: %s", asset)
+	}
+	return "", fmt.Errorf("%s has no chain implementation and can not be withdrawn", asset)
+}
+
+// requestWithdrawal runs the risk checks and puts the amount on hold. The
+// withdrawal is approved right away unless it is above the approval
+// threshold of its asset.
+func (ex *Exchange) requestWithdrawal(userID int64, req WithdrawRequest) (Withdrawal, error) {
+	ex.withdrawMu.Lock()
+	defer ex.withdrawMu.Unlock()
+
+	now := time.Now()
+	if err := ex.checkWithdrawalAddress(userID, req.Asset, req.Address, now); err != nil {
+		return Withdrawal{}, err
+	}
+
+	limit := ex.withdrawalPolicy.Limits[req.Asset]
+	if limit.Daily > 0 {
+		withdrawn, err := ex.withdrawnSince(userID, req.Asset, now.Add(-withdrawalDay))
+		if err != nil {
+			return Withdrawal{}, err
+		}
+		if withdrawn+req.Amount > limit.Daily {
+			return Withdrawal{}, fmt.Errorf("%w: %f %s left of %f", ErrWithdrawalLimit, max(limit.Daily-withdrawn, 0), req.Asset, limit.Daily)
+		}
+	}
+
+	last, err := ex.withdrawals.LastWithdrawalID()
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	w := Withdrawal{
+		ID:        last + 1,
+		UserID:    userID,
+		Asset:     req.Asset,
+		Amount:    req.Amount,
+		Address:   req.Address,
+		State:     WithdrawalApproved,
+		CreatedAt: now.UnixNano(),
+		UpdatedAt: now.UnixNano(),
+	}
+	if limit.ApprovalThreshold > 0 && req.Amount > limit.ApprovalThreshold {
+		w.State = WithdrawalRequested
+	}
+
+	if _, err := ex.Ledger.Hold(userID, w.Asset, w.Amount, withdrawalRef(w.ID)); err != nil {
+		return Withdrawal{}, err
+	}
+	if err := ex.withdrawals.SaveWithdrawal(w); err != nil {
+		ex.releaseHold(userID, w.Asset, w.Amount, withdrawalRef(w.ID))
+		return Withdrawal{}, err
+	}
+
+	return w, nil
+}
+
+// checkWithdrawalAddress checks that the user whitelisted the address for
+// the asset and that it is out of its cool-down.
+func (ex *Exchange) checkWithdrawalAddress(userID int64, asset token.Asset, address string, now time.Time) error {
+	addresses, err := ex.withdrawals.GetAddresses(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range addresses {
+		if a.Address != address || a.Asset != asset {
+			continue
+		}
+		if now.UnixNano() < a.UsableAt {
+			return fmt.Errorf("%w until %s", ErrAddressCoolingDown, time.Unix(0, a.UsableAt).UTC().Format(time.RFC3339))
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrAddressNotWhitelisted, address)
+}
+
+// withdrawnSince sums the withdrawals of the asset the user requested since
+// the time, cancelled and failed ones left the funds with the user.
+func (ex *Exchange) withdrawnSince(userID int64, asset token.Asset, since time.Time) (float64, error) {
+	withdrawals, err := ex.withdrawals.GetUserWithdrawals(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var sum float64
+	for _, w := range withdrawals {
+		if w.Asset == asset && w.CreatedAt >= since.UnixNano() &&
+			w.State != WithdrawalCancelled && w.State != WithdrawalFailed {
+			sum += w.Amount
+		}
+	}
+	return sum, nil
+}
+
+// moveWithdrawal moves the withdrawal to the state and stores it. Leaving
+// the hold behind, a confirmed withdrawal debits the funds and a cancelled
+// or failed one releases them. The ledger is looked up first, a withdrawal
+// that could not be stored after leaving its hold must not leave it twice.
+// The caller has to hold withdrawMu.
+func (ex *Exchange) moveWithdrawal(w *Withdrawal, state WithdrawalState, reason string) error {
+	if !w.State.canMoveTo(state) {
+		return fmt.Errorf("%w: withdrawal %d is %s", ErrWithdrawalState, w.ID, w.State)
+	}
+
+	switch {
+	case ex.withdrawalSettled(w):
+	case state == WithdrawalConfirmed:
+		if _, err := ex.Ledger.WithdrawHeld(w.UserID, w.Asset, w.Amount, withdrawalRef(w.ID)); err != nil {
+			return err
+		}
+	case state == WithdrawalCancelled, state == WithdrawalFailed:
+		ex.releaseHold(w.UserID, w.Asset, w.Amount, withdrawalRef(w.ID))
+	}
+
+	w.State = state
+	w.Reason = reason
+	w.UpdatedAt = time.Now().UnixNano()
+
+	return ex.withdrawals.SaveWithdrawal(*w)
+}
+
+// updateWithdrawal moves the stored withdrawal to the state. owner limits it
+// to the withdrawals of a user, 0 allows any.
+func (ex *Exchange) updateWithdrawal(id, owner int64, state WithdrawalState, reason string) (Withdrawal, error) {
+	ex.withdrawMu.Lock()
+	defer ex.withdrawMu.Unlock()
+
+	w, err := ex.withdrawals.GetWithdrawal(id)
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	if owner != 0 && w.UserID != owner {
+		return Withdrawal{}, ErrWithdrawalNotFound
+	}
+
+	if err := ex.moveWithdrawal(&w, state, reason); err != nil {
+		return Withdrawal{}, err
+	}
+	return w, nil
+}
+
+// withdrawalSettled reports whether the hold of the withdrawal was already
+// debited or released. A request that could not be stored gave its ID back
+// along with its hold, so every hold of the ID has to be settled.
+func (ex *Exchange) withdrawalSettled(w *Withdrawal) bool {
+	ref := withdrawalRef(w.ID)
+
+	var held, settled int
+	for _, entry := range ex.Ledger.History(w.UserID) {
+		if entry.Ref != ref {
+			continue
+		}
+		switch entry.Type {
+		case ledger.EntryHold:
+			held++
+		case ledger.EntryWithdrawal, ledger.EntryRelease:
+			settled++
+		}
+	}
+	return held > 0 && settled >= held
+}
+
+func withdrawalRef(id int64) string {
+	return "withdrawal:" + strconv.FormatInt(id, 10)
+}
+
+// runWithdrawals processes the withdrawals every interval until ctx is done.
+func (ex *Exchange) runWithdrawals(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, ex.processWithdrawals)
+}
+
+// processWithdrawals broadcasts the approved withdrawals and follows the
+// broadcast ones until they are confirmed or failed.
+func (ex *Exchange) processWithdrawals() {
+	if ex.chain == nil {
+		return
+	}
+
+	withdrawals, err := ex.withdrawals.GetWithdrawalsInState(WithdrawalApproved, WithdrawalBroadcast)
+	if err != nil {
+		logrus.WithError(err).Error("failed to load withdrawals")
+		return
+	}
+
+	for _, w := range withdrawals {
+		var err error
+		if w.State == WithdrawalApproved {
+			err = ex.broadcastWithdrawal(w.ID)
+		} else {
+			err = ex.trackWithdrawal(w.ID)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("withdrawalID", w.ID).Error("failed to process withdrawal")
+		}
+	}
+}
+
+// broadcastWithdrawal sends the withdrawal from the exchange wallet. The
+// transaction is stored before it is sent, so a crash in between can not
+// send it twice. A transaction the node refuses fails the withdrawal.
+func (ex *Exchange) broadcastWithdrawal(id int64) error {
+	ex.withdrawMu.Lock()
+	defer ex.withdrawMu.Unlock()
+
+	// the user may have cancelled it since it was loaded
+	w, err := ex.withdrawals.GetWithdrawal(id)
+	if err != nil || w.State != WithdrawalApproved {
+		return err
+	}
+
+	ex.hotMu.Lock()
+	defer ex.hotMu.Unlock()
+
+	eth := ex.chain.Eth
+	tx, err := eth.SignTransfer(ex.PrivateKey, common.HexToAddress(w.Address), eth.FloatToBigInt(w.Amount))
+	if err != nil {
+		return err
+	}
+	w.TxHash = tx.Hash().Hex()
+	w.Nonce = tx.Nonce()
+	if err := ex.moveWithdrawal(&w, WithdrawalBroadcast, ""); err != nil {
+		return err
+	}
+
+	err = eth.SendTransaction(tx)
+	cryptoClient.RecordWithdrawal(string(w.Asset), err)
+	if cryptoClient.IsRejected(err) {
+		if err := ex.moveWithdrawal(&w, WithdrawalFailed, err.Error()); err != nil {
+			return err
+		}
+		ex.auditWithdrawal(w, audit.WithdrawalFailed)
+		return nil
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"withdrawalID": w.ID,
+		"txHash":       w.TxHash,
+		"nonce":        w.Nonce,
+	})
+	if err != nil {
+		// the transaction may still have reached the network, trackWithdrawal
+		// settles it once it is mined or its nonce is taken
+		log.WithError(err).Warn("withdrawal broadcast without an answer")
+	} else {
+		log.Info("withdrawal broadcast")
+	}
+	ex.auditWithdrawal(w, audit.WithdrawalBroadcast)
+
+	return nil
+}
+
+// trackWithdrawal confirms the withdrawal once its transaction has enough
+// confirmations, or fails it when the transaction reverted or was dropped.
+func (ex *Exchange) trackWithdrawal(id int64) error {
+	ex.withdrawMu.Lock()
+	defer ex.withdrawMu.Unlock()
+
+	w, err := ex.withdrawals.GetWithdrawal(id)
+	if err != nil || w.State != WithdrawalBroadcast {
+		return err
+	}
+
+	hash := common.HexToHash(w.TxHash)
+	status, err := ex.chain.Eth.TxStatus(hash)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !status.Mined:
+		hot := crypto.PubkeyToAddress(ex.PrivateKey.PublicKey)
+		dropped, err := ex.txDropped(hash, hot, w.Nonce)
+		if err != nil || !dropped {
+			return err
+		}
+		if err := ex.moveWithdrawal(&w, WithdrawalFailed, "transaction dropped"); err != nil {
+			return err
+		}
+		ex.auditWithdrawal(w, audit.WithdrawalFailed)
+	case status.Failed:
+		if err := ex.moveWithdrawal(&w, WithdrawalFailed, "transaction reverted"); err != nil {
+			return err
+		}
+		ex.auditWithdrawal(w, audit.WithdrawalFailed)
+	case status.Confirmations >= ex.withdrawalPolicy.Confirmations:
+		if err := ex.moveWithdrawal(&w, WithdrawalConfirmed, ""); err != nil {
+			return err
+		}
+		ex.auditWithdrawal(w, audit.WithdrawalConfirmed)
+		logrus.WithFields(logrus.Fields{
+			"withdrawalID": w.ID,
+			"txHash":       w.TxHash,
+		}).Info("withdrawal confirmed")
+	}
+
+	return nil
+}
+
+// txDropped reports whether the transaction of the sender will never be
+// mined, because another transaction took its nonce. The status is read once
+// more after the nonce, the transaction may have been mined in between.
+func (ex *Exchange) txDropped(hash common.Hash, from common.Address, nonce uint64) (bool, error) {
+	eth := ex.chain.Eth
+	mined, err := eth.NonceAt(from)
+	if err != nil || mined <= nonce {
+		return false, err
+	}
+
+	status, err := eth.TxStatus(hash)
+	if err != nil {
+		return false, err
+	}
+	return !status.Mined, nil
+}
+
+// auditWithdrawal records what the exchange did with a withdrawal on its own.
+func (ex *Exchange) auditWithdrawal(w Withdrawal, action audit.Action) {
+	details := map[string]any{
+		"withdrawal": w.ID,
+		"txHash":     w.TxHash,
+	}
+	if w.Reason != "" {
+		details["reason"] = w.Reason
+	}
+	ex.writeAudit(audit.Entry{
+		Actor:  audit.ActorSystem,
+		Action: action,
+		UserID: w.UserID,
+	}, details)
+}
+
+func (ex *Exchange) handleRequestWithdrawal(c echo.Context) error {
+	userID := authUserID(c)
+
+	var req WithdrawRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	if ex.userFrozen(userID) {
+		return newError(http.StatusForbidden, ErrAccountFrozen)
+	}
+	if err := ex.verifySecondFactor(userID, req.TOTPCode); err != nil {
+		return newError(http.StatusUnauthorized, err)
+	}
+
+	if !(req.Amount > 0) {
+		return newErrorf(http.StatusBadRequest, "amount must be positive")
+	}
+	address, err := normalizeAddress(req.Asset, req.Address)
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	req.Address = address
+
+	w, err := ex.requestWithdrawal(userID, req)
+	switch {
+	case errors.Is(err, ErrAddressNotWhitelisted), errors.Is(err, ErrAddressCoolingDown):
+		return newError(http.StatusForbidden, err)
+	case err != nil:
+		return newError(http.StatusBadRequest, err)
+	}
+
+	ex.recordAudit(c, audit.WithdrawalRequested, userID, map[string]any{
+		"withdrawal": w.ID,
+		"asset":      w.Asset,
+		"amount":     w.Amount,
+		"address":    w.Address,
+		"state":      w.State,
+	})
+
+	logrus.WithFields(logrus.Fields{
+		"withdrawalID": w.ID,
+		"userID":       userID,
+		"asset":        w.Asset,
+		"amount":       w.Amount,
+		"state":        w.State,
+	}).Info("withdrawal requested")
+
+	return c.JSON(http.StatusCreated, w)
+}
+
+func (ex *Exchange) handleGetWithdrawals(c echo.Context) error {
+	withdrawals, err := ex.withdrawals.GetUserWithdrawals(authUserID(c))
+	if err != nil {
+		return err
+	}
+	if withdrawals == nil {
+		withdrawals = []Withdrawal{}
+	}
+
+	return c.JSON(http.StatusOK, withdrawals)
+}
+
+func (ex *Exchange) handleGetWithdrawal(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	w, err := ex.withdrawals.GetWithdrawal(id)
+	if errors.Is(err, ErrWithdrawalNotFound) || (err == nil && w.UserID != authUserID(c)) {
+		return newErrorf(http.StatusNotFound, "%w: %d", ErrWithdrawalNotFound, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, w)
+}
+
+// handleCancelWithdrawal cancels a withdrawal of the user that was not
+// broadcast yet.
+func (ex *Exchange) handleCancelWithdrawal(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	w, err := ex.updateWithdrawal(id, authUserID(c), WithdrawalCancelled, "cancelled by the user")
+	if err != nil {
+		return withdrawalError(id, err)
+	}
+	ex.recordAudit(c, audit.WithdrawalCancelled, w.UserID, map[string]any{"withdrawal": w.ID})
+
+	return c.JSON(http.StatusOK, w)
+}
+
+// withdrawalError fails a request changing the state of a withdrawal.
+func withdrawalError(id int64, err error) error {
+	switch {
+	case errors.Is(err, ErrWithdrawalNotFound):
+		return newErrorf(http.StatusNotFound, "%w: %d", ErrWithdrawalNotFound, id)
+	case errors.Is(err, ErrWithdrawalState):
+		return newError(http.StatusConflict, err)
+	}
+	return err
+}
+
+func (ex *Exchange) handleGetWithdrawalAddresses(c echo.Context) error {
+	addresses, err := ex.withdrawals.GetAddresses(authUserID(c))
+	if err != nil {
+		return err
+	}
+	if addresses == nil {
+		addresses = []WithdrawalAddress{}
+	}
+
+	return c.JSON(http.StatusOK, addresses)
+}
+
+// handleAddWithdrawalAddress whitelists an address, which can be withdrawn
+// to once the cool-down passed.
+func (ex *Exchange) handleAddWithdrawalAddress(c echo.Context) error {
+	userID := authUserID(c)
+
+	var req AddWithdrawalAddressRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	if err := ex.verifySecondFactor(userID, req.TOTPCode); err != nil {
+		return newError(http.StatusUnauthorized, err)
+	}
+
+	address, err := normalizeAddress(req.Asset, req.Address)
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	ex.withdrawMu.Lock()
+	cooldown := ex.withdrawalPolicy.AddressCooldown
+	ex.withdrawMu.Unlock()
+
+	now := time.Now()
+	a := WithdrawalAddress{
+		Asset:    req.Asset,
+		Address:  address,
+		Label:    strings.TrimSpace(req.Label),
+		AddedAt:  now.UnixNano(),
+		UsableAt: now.Add(cooldown).UnixNano(),
+	}
+	if err := ex.withdrawals.AddAddress(userID, a); err != nil {
+		if errors.Is(err, ErrAddressWhitelisted) {
+			return newErrorf(http.StatusConflict, "%w: %s", err, address)
+		}
+		return err
+	}
+
+	ex.recordAudit(c, audit.WithdrawalAddressAdded, userID, map[string]any{
+		"asset":   a.Asset,
+		"address": a.Address,
+	})
+
+	return c.JSON(http.StatusCreated, a)
+}
+
+func (ex *Exchange) handleRemoveWithdrawalAddress(c echo.Context) error {
+	userID := authUserID(c)
+	address := c.Param("address")
+	if common.IsHexAddress(address) {
+		address = common.HexToAddress(address).Hex()
+	}
+
+	if err := ex.withdrawals.RemoveAddress(userID, address); err != nil {
+		if errors.Is(err, ErrAddressNotWhitelisted) {
+			return newErrorf(http.StatusNotFound, "%w: %s", err, address)
+		}
+		return err
+	}
+
+	ex.recordAudit(c, audit.WithdrawalAddressRemoved, userID, map[string]any{"address": address})
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "withdrawal address removed"})
+}
+
+// handleAdminGetWithdrawals lists the withdrawals in the states of the state
+// query parameter, a comma separated list that defaults to REQUESTED, the
+// withdrawals waiting for approval.
+func (ex *Exchange) handleAdminGetWithdrawals(c echo.Context) error {
+	states := []WithdrawalState{WithdrawalRequested}
+	if s := c.QueryParam("state"); s != "" {
+		states = nil
+		for _, state := range strings.Split(s, ",") {
+			state := WithdrawalState(strings.ToUpper(strings.TrimSpace(state)))
+			if !slices.Contains(withdrawalStates, state) {
+				return newErrorf(http.StatusBadRequest, "unknown withdrawal state: %s", state)
+			}
+			states = append(states, state)
+		}
+	}
+
+	withdrawals, err := ex.withdrawals.GetWithdrawalsInState(states...)
+	if err != nil {
+		return err
+	}
+	if withdrawals == nil {
+		withdrawals = []Withdrawal{}
+	}
+
+	return c.JSON(http.StatusOK, withdrawals)
+}
+
+func (ex *Exchange) handleApproveWithdrawal(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	w, err := ex.updateWithdrawal(id, 0, WithdrawalApproved, "")
+	if err != nil {
+		return withdrawalError(id, err)
+	}
+	ex.recordAudit(c, audit.WithdrawalApproved, w.UserID, map[string]any{"withdrawal": w.ID})
+
+	logrus.WithField("withdrawalID", w.ID).Info("withdrawal approved")
+
+	return c.JSON(http.StatusOK, w)
+}
+
+// handleRejectWithdrawal cancels a withdrawal that was not broadcast yet and
+// gives the funds back to the user.
+func (ex *Exchange) handleRejectWithdrawal(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+
+	var req RejectWithdrawalRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newError(http.StatusBadRequest, err)
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		return newErrorf(http.StatusBadRequest, "a rejection needs a reason")
+	}
+
+	w, err := ex.updateWithdrawal(id, 0, WithdrawalCancelled, req.Reason)
+	if err != nil {
+		return withdrawalError(id, err)
+	}
+
+	ex.recordAudit(c, audit.WithdrawalRejected, w.UserID, map[string]any{
+		"withdrawal": w.ID,
+		"reason":     req.Reason,
+	})
+
+	return c.JSON(http.StatusOK, w)
+}
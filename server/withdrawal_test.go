@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/anakinrm/crypto-exchange/server/audit"
+	"github.com/anakinrm/crypto-exchange/server/cryptoClient"
+	"github.com/anakinrm/crypto-exchange/server/token"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+const testWithdrawalAddress = "0x00000000000000000000000000000000000000AA"
+
+// newTestChain backs the exchange with a simulated chain on which the
+// exchange wallet holds the ether given.
+func newTestChain(t *testing.T, ex *Exchange, ether int64) *simulated.Backend {
+	alloc := types.GenesisAlloc{}
+	if ether > 0 {
+		alloc[crypto.PubkeyToAddress(ex.PrivateKey.PublicKey)] = types.Account{
+			Balance: new(big.Int).Mul(big.NewInt(ether), big.NewInt(params.Ether)),
+		}
+	}
+	sim := simulated.NewBackend(alloc)
+	t.Cleanup(func() { sim.Close() })
+
+	ex.SetChainClient(&cryptoClient.Client{Eth: cryptoClient.NewEthClientWithBackend(sim.Client(), 1337)})
+	return sim
+}
+
+// newWithdrawalExchange funds user 1 with 20 ETH and whitelists the test
+// address for it without a cool-down.
+func newWithdrawalExchange(t *testing.T) *Exchange {
+	ex := newFundedExchange(t, 20, 0, 1, 2)
+	ex.SetAdminToken(testAdminToken)
+	ex.SetWithdrawalPolicy(WithdrawalPolicy{
+		Confirmations: 2,
+		Limits: map[token.Asset]WithdrawalLimit{
+			token.AssetETH: {Daily: 15, ApprovalThreshold: 5},
+		},
+	})
+
+	rec := doUserRequest(newRouter(ex), 1, http.MethodPost, "/v1/users/me/withdrawal-addresses", AddWithdrawalAddressRequest{
+		Asset:   token.AssetETH,
+		Address: testWithdrawalAddress,
+	})
+	assert(t, rec.Code, http.StatusCreated)
+
+	return ex
+}
+
+func requestTestWithdrawal(t *testing.T, ex *Exchange, amount float64) Withdrawal {
+	rec := doUserRequest(newRouter(ex), 1, http.MethodPost, "/v1/withdrawals", WithdrawRequest{
+		Asset:   token.AssetETH,
+		Amount:  amount,
+		Address: testWithdrawalAddress,
+	})
+	assert(t, rec.Code, http.StatusCreated)
+	return decodeTestResponse[Withdrawal](t, rec)
+}
+
+func TestWithdrawal(t *testing.T) {
+	ex := newWithdrawalExchange(t)
+	sim := newTestChain(t, ex, 100)
+	e := newRouter(ex)
+
+	w := requestTestWithdrawal(t, ex, 3)
+	assert(t, w.State, WithdrawalApproved)
+	assert(t, w.Address, testWithdrawalAddress)
+	assert(t, getTestBalances(t, ex, 1)[token.AssetETH], Balance{Available: 17, Held: 3, Total: 20})
+
+	ex.processWithdrawals()
+	w, _ = ex.withdrawals.GetWithdrawal(w.ID)
+	assert(t, w.State, WithdrawalBroadcast)
+	assert(t, w.TxHash != "", true)
+
+	// the first block holds the transaction, the second confirms it again
+	sim.Commit()
+	ex.processWithdrawals()
+	w, _ = ex.withdrawals.GetWithdrawal(w.ID)
+	assert(t, w.State, WithdrawalBroadcast)
+	sim.Commit()
+	ex.processWithdrawals()
+
+	rec := doUserRequest(e, 1, http.MethodGet, "/v1/withdrawals/1", nil)
+	assert(t, rec.Code, http.StatusOK)
+	w = decodeTestResponse[Withdrawal](t, rec)
+	assert(t, w.State, WithdrawalConfirmed)
+	assert(t, getTestBalances(t, ex, 1)[token.AssetETH], Balance{Available: 17, Total: 17})
+	assert(t, ex.Ledger.Check(), nil)
+
+	received, err := ex.chain.Eth.GetBalance(testWithdrawalAddress)
+	assert(t, err, nil)
+	assert(t, received, 3.0)
+
+	rec = doUserRequest(e, 1, http.MethodGet, "/v1/withdrawals", nil)
+	assert(t, len(decodeTestResponse[[]Withdrawal](t, rec)), 1)
+	rec = doUserRequest(e, 2, http.MethodGet, "/v1/withdrawals/1", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	assert(t, decodeAPIError(t, rec).Code, CodeWithdrawalNotFound)
+
+	actions := []audit.Action{}
+	for _, entry := range ex.Audit.Search(audit.Filter{UserID: 1}) {
+		actions = append(actions, entry.Action)
+	}
+	assert(t, actions, []audit.Action{
+		audit.WithdrawalAddressAdded,
+		audit.WithdrawalRequested,
+		audit.WithdrawalBroadcast,
+		audit.WithdrawalConfirmed,
+	})
+}
+
+func TestWithdrawalSettledOnce(t *testing.T) {
+	ex := newWithdrawalExchange(t)
+	sim := newTestChain(t, ex, 100)
+	journal := &testJournal{}
+	ex.SetWithdrawalStore(journaledWithdrawalStore{ex.withdrawals, journal})
+	// the hold of an open order, pooled with the one of the withdrawal
+	_, err := ex.Ledger.Hold(1, token.AssetETH, 4, "ETH-USD:1")
+	assert(t, err, nil)
+
+	w := requestTestWithdrawal(t, ex, 3)
+	ex.processWithdrawals()
+	sim.Commit()
+	sim.Commit()
+	journal.fail = true
+	ex.processWithdrawals()
+	w, _ = ex.withdrawals.GetWithdrawal(w.ID)
+	assert(t, w.State, WithdrawalBroadcast)
+
+	journal.fail = false
+	ex.processWithdrawals()
+	w, _ = ex.withdrawals.GetWithdrawal(w.ID)
+	assert(t, w.State, WithdrawalConfirmed)
+	assert(t, getTestBalances(t, ex, 1)[token.AssetETH], Balance{Available: 13, Held: 4, Total: 17})
+	assert(t, ex.Ledger.Check(), nil)
+}
+
+func TestWithdrawalApproval(t *testing.T) {
+	ex := newWithdrawalExchange(t)
+	newTestChain(t, ex, 100)
+	e := newRouter(ex)
+
+	large := requestTestWithdrawal(t, ex, 8)
+	assert(t, large.State, WithdrawalRequested)
+	other := requestTestWithdrawal(t, ex, 6)
+
+	// what waits for approval counts towards the daily limit
+	rec := doUserRequest(e, 1, http.MethodPost, "/v1/withdrawals", WithdrawRequest{Asset: token.AssetETH, Amount: 2, Address: testWithdrawalAddress})
+	assert(t, rec.Code, http.StatusBadRequest)
+	assert(t, decodeAPIError(t, rec).Code, CodeWithdrawalLimit)
+
+	ex.processWithdrawals()
+	rec = doAdminRequest(e, http.MethodGet, "/v1/admin/withdrawals", nil)
+	assert(t, len(decodeTestResponse[[]Withdrawal](t, rec)), 2)
+
+	rec = doAdminRequest(e, http.MethodPost, "/v1/admin/withdrawals/1/approve", nil)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, decodeTestResponse[Withdrawal](t, rec).State, WithdrawalApproved)
+
+	rec = doAdminRequest(e, http.MethodPost, "/v1/admin/withdrawals/2/reject", RejectWithdrawalRequest{})
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = doAdminRequest(e, http.MethodPost, "/v1/admin/withdrawals/2/reject", RejectWithdrawalRequest{Reason: "unusual activity"})
+	assert(t, rec.Code, http.StatusOK)
+	other = decodeTestResponse[Withdrawal](t, rec)
+	assert(t, other.State, WithdrawalCancelled)
+	assert(t, other.Reason, "unusual activity")
+
+	// users can cancel until the withdrawal is broadcast
+	rec = doUserRequest(e, 2, http.MethodDelete, "/v1/withdrawals/1", nil)
+	assert(t, rec.Code, http.StatusNotFound)
+	rec = doUserRequest(e, 1, http.MethodDelete, "/v1/withdrawals/1", nil)
+	assert(t, rec.Code, http.StatusOK)
+	rec = doUserRequest(e, 1, http.MethodDelete, "/v1/withdrawals/1", nil)
+	assert(t, rec.Code, http.StatusConflict)
+	assert(t, decodeAPIError(t, rec).Code, CodeInvalidWithdrawal)
+	assert(t, getTestBalances(t, ex, 1)[token.AssetETH], Balance{Available: 20, Total: 20})
+
+	rec = doAdminRequest(e, http.MethodGet, "/v1/admin/withdrawals?state=cancelled", nil)
+	assert(t, len(decodeTestResponse[[]Withdrawal](t, rec)), 2)
+	rec = doAdminRequest(e, http.MethodGet, "/v1/admin/withdrawals?state=LOST", nil)
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	entries := ex.Audit.Search(audit.Filter{Actor: audit.ActorAdmin})
+	assert(t, len(entries), 2)
+	assert(t, entries[1].Action, audit.WithdrawalRejected)
+}
+
+func TestWithdrawalBroadcastFails(t *testing.T) {
+	ex := newWithdrawalExchange(t)
+	// the exchange wallet can not pay for the withdrawal
+	newTestChain(t, ex, 0)
+
+	w := requestTestWithdrawal(t, ex, 3)
+	ex.processWithdrawals()
+
+	w, _ = ex.withdrawals.GetWithdrawal(w.ID)
+	assert(t, w.State, WithdrawalFailed)
+	assert(t, w.Reason != "", true)
+	assert(t, getTestBalances(t, ex, 1)[token.AssetETH], Balance{Available: 20, Total: 20})
+
+	// failed withdrawals do not count towards the daily limit
+	requestTestWithdrawal(t, ex, 5)
+}
+
+// unansweredBackend loses the answer of the node to the transactions sent,
+// with deliver they still reach the chain.
+type unansweredBackend struct {
+	simulated.Client
+	deliver bool
+}
+
+func (b *unansweredBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if b.deliver {
+		if err := b.Client.SendTransaction(ctx, tx); err != nil {
+			return err
+		}
+	}
+	return context.DeadlineExceeded
+}
+
+func TestWithdrawalBroadcastWithoutAnswer(t *testing.T) {
+	ex := newWithdrawalExchange(t)
+	sim := newTestChain(t, ex, 100)
+	backend := &unansweredBackend{Client: sim.Client(), deliver: true}
+	ex.SetChainClient(&cryptoClient.Client{Eth: cryptoClient.NewEthClientWithBackend(backend, 1337)})
+
+	// the transaction reached the chain, it confirms like any other
+	w := requestTestWithdrawal(t, ex, 3)
+	ex.processWithdrawals()
+	w, _ = ex.withdrawals.GetWithdrawal(w.ID)
+	assert(t, w.State, WithdrawalBroadcast)
+	assert(t, w.Nonce, uint64(0))
+	sim.Commit()
+	sim.Commit()
+	ex.processWithdrawals()
+	w, _ = ex.withdrawals.GetWithdrawal(w.ID)
+	assert(t, w.State, WithdrawalConfirmed)
+
+	// the transaction got lost, it stays broadcast until its nonce is taken
+	backend.deliver = false
+	lost := requestTestWithdrawal(t, ex, 2)
+	ex.processWithdrawals()
+	sim.Commit()
+	ex.processWithdrawals()
+	lost, _ = ex.withdrawals.GetWithdrawal(lost.ID)
+	assert(t, lost.State, WithdrawalBroadcast)
+	assert(t, lost.Nonce, uint64(1))
+
+	backend.deliver = true
+	next := requestTestWithdrawal(t, ex, 1)
+	ex.processWithdrawals()
+	sim.Commit()
+	ex.processWithdrawals()
+	next, _ = ex.withdrawals.GetWithdrawal(next.ID)
+	assert(t, next.Nonce, uint64(1))
+	lost, _ = ex.withdrawals.GetWithdrawal(lost.ID)
+	assert(t, lost.State, WithdrawalFailed)
+	assert(t, lost.Reason, "transaction dropped")
+	assert(t, getTestBalances(t, ex, 1)[token.AssetETH], Balance{Available: 16, Held: 1, Total: 17})
+	assert(t, ex.Ledger.Check(), nil)
+}
+
+func TestWithdrawalAddresses(t *testing.T) {
+	ex := newFundedExchange(t, 20, 20, 1)
+	e := newRouter(ex)
+
+	for _, tc := range []struct {
+		req    AddWithdrawalAddressRequest
+		status int
+		code   ErrorCode
+	}{
+		{AddWithdrawalAddressRequest{Asset: token.AssetETH, Address: "0x1234"}, http.StatusBadRequest, CodeInvalidAddress},
+		{AddWithdrawalAddressRequest{Asset: token.AssetUSDT, Address: testWithdrawalAddress}, http.StatusBadRequest, CodeBadRequest},
+		{AddWithdrawalAddressRequest{Asset: token.AssetETH, Address: testWithdrawalAddress, Label: "cold storage"}, http.StatusCreated, ""},
+		{AddWithdrawalAddressRequest{Asset: token.AssetETH, Address: "0x00000000000000000000000000000000000000aa"}, http.StatusConflict, CodeAddressWhitelisted},
+	} {
+		rec := doUserRequest(e, 1, http.MethodPost, "/v1/users/me/withdrawal-addresses", tc.req)
+		assert(t, rec.Code, tc.status)
+		if tc.code != "" {
+			assert(t, decodeAPIError(t, rec).Code, tc.code)
+		}
+	}
+
+	rec := doUserRequest(e, 1, http.MethodGet, "/v1/users/me/withdrawal-addresses", nil)
+	addresses := decodeTestResponse[[]WithdrawalAddress](t, rec)
+	assert(t, len(addresses), 1)
+	assert(t, addresses[0].Label, "cold storage")
+	assert(t, time.Duration(addresses[0].UsableAt-addresses[0].AddedAt), DefaultWithdrawalPolicy.AddressCooldown)
+
+	// new addresses can not be withdrawn to right away
+	req := WithdrawRequest{Asset: token.AssetETH, Amount: 1, Address: testWithdrawalAddress}
+	rec = doUserRequest(e, 1, http.MethodPost, "/v1/withdrawals", req)
+	assert(t, rec.Code, http.StatusForbidden)
+	assert(t, decodeAPIError(t, rec).Code, CodeAddressCoolingDown)
+
+	ex.Users[1].Frozen = true
+	rec = doUserRequest(e, 1, http.MethodPost, "/v1/withdrawals", req)
+	assert(t, decodeAPIError(t, rec).Code, CodeAccountFrozen)
+	ex.Users[1].Frozen = false
+
+	rec = doUserRequest(e, 1, http.MethodDelete, "/v1/users/me/withdrawal-addresses/"+testWithdrawalAddress, nil)
+	assert(t, rec.Code, http.StatusOK)
+	rec = doUserRequest(e, 1, http.MethodDelete, "/v1/users/me/withdrawal-addresses/"+testWithdrawalAddress, nil)
+	assert(t, rec.Code, http.StatusNotFound)
+
+	rec = doUserRequest(e, 1, http.MethodPost, "/v1/withdrawals", req)
+	assert(t, decodeAPIError(t, rec).Code, CodeAddressNotWhitelisted)
+}
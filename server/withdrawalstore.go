@@ -0,0 +1,291 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/anakinrm/crypto-exchange/server/db"
+	"github.com/anakinrm/crypto-exchange/server/token"
+)
+
+// WithdrawalStore keeps the withdrawals of the users and the addresses they
+// whitelisted to withdraw to.
+type WithdrawalStore interface {
+	SaveWithdrawal(w Withdrawal) error
+	// GetWithdrawal returns ErrWithdrawalNotFound for unknown IDs
+	GetWithdrawal(id int64) (Withdrawal, error)
+	// GetUserWithdrawals returns all the withdrawals of the user, oldest
+	// first
+	GetUserWithdrawals(userID int64) ([]Withdrawal, error)
+	// GetWithdrawalsInState returns the withdrawals of all users in any of
+	// the states, oldest first
+	GetWithdrawalsInState(states ...WithdrawalState) ([]Withdrawal, error)
+	// LastWithdrawalID returns the highest ID handed out, 0 before the
+	// first withdrawal
+	LastWithdrawalID() (int64, error)
+
+	// AddAddress returns ErrAddressWhitelisted when the user already
+	// whitelisted the address
+	AddAddress(userID int64, a WithdrawalAddress) error
+	// GetAddresses returns the whitelist of the user, oldest first
+	GetAddresses(userID int64) ([]WithdrawalAddress, error)
+	// RemoveAddress returns ErrAddressNotWhitelisted when the address is
+	// not on the whitelist of the user
+	RemoveAddress(userID int64, address string) error
+}
+
+// MemoryWithdrawalStore is a WithdrawalStore that lives as long as the
+// process.
+type MemoryWithdrawalStore struct {
+	mu          sync.RWMutex
+	withdrawals map[int64]Withdrawal
+	addresses   map[int64][]WithdrawalAddress
+}
+
+func NewMemoryWithdrawalStore() *MemoryWithdrawalStore {
+	return &MemoryWithdrawalStore{
+		withdrawals: make(map[int64]Withdrawal),
+		addresses:   make(map[int64][]WithdrawalAddress),
+	}
+}
+
+func (s *MemoryWithdrawalStore) SaveWithdrawal(w Withdrawal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.withdrawals[w.ID] = w
+	return nil
+}
+
+func (s *MemoryWithdrawalStore) GetWithdrawal(id int64) (Withdrawal, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	w, ok := s.withdrawals[id]
+	if !ok {
+		return Withdrawal{}, ErrWithdrawalNotFound
+	}
+	return w, nil
+}
+
+func (s *MemoryWithdrawalStore) GetUserWithdrawals(userID int64) ([]Withdrawal, error) {
+	return s.find(func(w Withdrawal) bool { return w.UserID == userID }), nil
+}
+
+func (s *MemoryWithdrawalStore) GetWithdrawalsInState(states ...WithdrawalState) ([]Withdrawal, error) {
+	return s.find(func(w Withdrawal) bool {
+		for _, state := range states {
+			if w.State == state {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (s *MemoryWithdrawalStore) find(match func(Withdrawal) bool) []Withdrawal {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	withdrawals := []Withdrawal{}
+	for _, w := range s.withdrawals {
+		if match(w) {
+			withdrawals = append(withdrawals, w)
+		}
+	}
+	sort.Slice(withdrawals, func(i, j int) bool { return withdrawals[i].ID < withdrawals[j].ID })
+
+	return withdrawals
+}
+
+func (s *MemoryWithdrawalStore) LastWithdrawalID() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var last int64
+	for id := range s.withdrawals {
+		last = max(last, id)
+	}
+	return last, nil
+}
+
+func (s *MemoryWithdrawalStore) AddAddress(userID int64, a WithdrawalAddress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, added := range s.addresses[userID] {
+		if added.Address == a.Address {
+			return ErrAddressWhitelisted
+		}
+	}
+	s.addresses[userID] = append(s.addresses[userID], a)
+
+	return nil
+}
+
+func (s *MemoryWithdrawalStore) GetAddresses(userID int64) ([]WithdrawalAddress, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]WithdrawalAddress{}, s.addresses[userID]...), nil
+}
+
+func (s *MemoryWithdrawalStore) RemoveAddress(userID int64, address string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addresses := s.addresses[userID]
+	for i, a := range addresses {
+		if a.Address == address {
+			s.addresses[userID] = append(addresses[:i:i], addresses[i+1:]...)
+			return nil
+		}
+	}
+	return ErrAddressNotWhitelisted
+}
+
+// MongoWithdrawalStore is a WithdrawalStore backed by the withdrawals and
+// withdrawal_addresses collections, the db has to be initialized with
+// db.InitializeMongo first.
+type MongoWithdrawalStore struct{}
+
+func NewMongoWithdrawalStore() *MongoWithdrawalStore {
+	return &MongoWithdrawalStore{}
+}
+
+func (s *MongoWithdrawalStore) SaveWithdrawal(w Withdrawal) error {
+	withdrawalDB := db.Withdrawal{
+		ID:        w.ID,
+		UserID:    w.UserID,
+		Asset:     string(w.Asset),
+		Amount:    w.Amount,
+		Address:   w.Address,
+		State:     string(w.State),
+		TxHash:    w.TxHash,
+		Nonce:     int64(w.Nonce),
+		Reason:    w.Reason,
+		CreatedAt: w.CreatedAt,
+		UpdatedAt: w.UpdatedAt,
+	}
+
+	return withdrawalDB.UpsertWithdrawal()
+}
+
+func (s *MongoWithdrawalStore) GetWithdrawal(id int64) (Withdrawal, error) {
+	withdrawalDB := db.Withdrawal{
+		ID: id,
+	}
+	if err := withdrawalDB.GetWithdrawalByID(); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return Withdrawal{}, ErrWithdrawalNotFound
+		}
+		return Withdrawal{}, err
+	}
+
+	return newWithdrawalFromDB(withdrawalDB), nil
+}
+
+func (s *MongoWithdrawalStore) GetUserWithdrawals(userID int64) ([]Withdrawal, error) {
+	withdrawalsDB, err := db.GetWithdrawalsByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return newWithdrawalsFromDB(withdrawalsDB), nil
+}
+
+func (s *MongoWithdrawalStore) GetWithdrawalsInState(states ...WithdrawalState) ([]Withdrawal, error) {
+	names := make([]string, len(states))
+	for i, state := range states {
+		names[i] = string(state)
+	}
+
+	withdrawalsDB, err := db.GetWithdrawalsByState(names...)
+	if err != nil {
+		return nil, err
+	}
+	return newWithdrawalsFromDB(withdrawalsDB), nil
+}
+
+func (s *MongoWithdrawalStore) LastWithdrawalID() (int64, error) {
+	return db.GetLastWithdrawalID()
+}
+
+func (s *MongoWithdrawalStore) AddAddress(userID int64, a WithdrawalAddress) error {
+	addresses, err := s.GetAddresses(userID)
+	if err != nil {
+		return err
+	}
+	for _, added := range addresses {
+		if added.Address == a.Address {
+			return ErrAddressWhitelisted
+		}
+	}
+
+	addressDB := db.WithdrawalAddress{
+		UserID:   userID,
+		Asset:    string(a.Asset),
+		Address:  a.Address,
+		Label:    a.Label,
+		AddedAt:  a.AddedAt,
+		UsableAt: a.UsableAt,
+	}
+	return addressDB.InsertWithdrawalAddress()
+}
+
+func (s *MongoWithdrawalStore) GetAddresses(userID int64) ([]WithdrawalAddress, error) {
+	addressesDB, err := db.GetWithdrawalAddresses(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]WithdrawalAddress, len(addressesDB))
+	for i, a := range addressesDB {
+		addresses[i] = WithdrawalAddress{
+			Asset:    token.Asset(a.Asset),
+			Address:  a.Address,
+			Label:    a.Label,
+			AddedAt:  a.AddedAt,
+			UsableAt: a.UsableAt,
+		}
+	}
+	return addresses, nil
+}
+
+func (s *MongoWithdrawalStore) RemoveAddress(userID int64, address string) error {
+	addressDB := db.WithdrawalAddress{
+		UserID:  userID,
+		Address: address,
+	}
+	if err := addressDB.DeleteWithdrawalAddress(); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return ErrAddressNotWhitelisted
+		}
+		return err
+	}
+	return nil
+}
+
+func newWithdrawalsFromDB(withdrawalsDB []db.Withdrawal) []Withdrawal {
+	withdrawals := make([]Withdrawal, len(withdrawalsDB))
+	for i, w := range withdrawalsDB {
+		withdrawals[i] = newWithdrawalFromDB(w)
+	}
+	return withdrawals
+}
+
+func newWithdrawalFromDB(w db.Withdrawal) Withdrawal {
+	return Withdrawal{
+		ID:        w.ID,
+		UserID:    w.UserID,
+		Asset:     token.Asset(w.Asset),
+		Amount:    w.Amount,
+		Address:   w.Address,
+		State:     WithdrawalState(w.State),
+		TxHash:    w.TxHash,
+		Nonce:     uint64(w.Nonce),
+		Reason:    w.Reason,
+		CreatedAt: w.CreatedAt,
+		UpdatedAt: w.UpdatedAt,
+	}
+}